@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -35,7 +36,7 @@ func ampClientOffers(i *IPC, w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		arg := messages.Arg{
 			Body:       encPollReq,
-			RemoteAddr: "",
+			RemoteAddr: clientRemoteAddr(i, r),
 		}
 		err = i.ClientOffers(arg, &response)
 	} else {
@@ -55,6 +56,44 @@ func ampClientOffers(i *IPC, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeAMPArmored(w, response, "ampClientOffers")
+}
+
+// ampClientFeedback is the AMP-speaking endpoint for client match feedback
+// messages, which are encoded in the URL path as in ampClientOffers.
+func ampClientFeedback(i *IPC, w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/amp/feedback/")
+	if path == r.URL.Path {
+		log.Println("ampClientFeedback: unexpected prefix in path")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response []byte
+	encFeedback, err := amp.DecodePath(path)
+	if err == nil {
+		arg := messages.Arg{
+			Body:       encFeedback,
+			RemoteAddr: "",
+		}
+		err = i.ClientFeedback(arg, &response)
+	}
+	if err != nil && !errors.Is(err, messages.ErrInternal) {
+		response, err = (&messages.ClientMatchFeedbackResponse{
+			Error: "cannot decode match feedback",
+		}).EncodeClientMatchFeedbackResponse()
+	}
+	if err != nil {
+		log.Printf("ampClientFeedback: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeAMPArmored(w, response, "ampClientFeedback")
+}
+
+// writeAMPArmored sends response as an AMP-armored HTML document.
+func writeAMPArmored(w http.ResponseWriter, response []byte, name string) {
 	w.Header().Set("Content-Type", "text/html")
 	// Attempt to hint to an AMP cache not to waste resources caching this
 	// document. "The Google AMP Cache considers any document fresh for at
@@ -71,6 +110,6 @@ func ampClientOffers(i *IPC, w http.ResponseWriter, r *http.Request) {
 	defer enc.Close()
 
 	if _, err := enc.Write(response); err != nil {
-		log.Printf("ampClientOffers: unable to write answer: %v", err)
+		log.Printf("%s: unable to write response: %v", name, err)
 	}
 }
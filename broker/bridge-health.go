@@ -0,0 +1,216 @@
+/*
+Checking that the bridges in the bridge list are reachable, so that clients
+are not matched with proxies only to find out that their bridge is down.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// How long to wait for a bridge to accept the WebSocket connection.
+	bridgeProbeTimeout = 10 * time.Second
+	// How long the bridge must keep the connection open after the
+	// turbotunnel handshake to be considered healthy. A bridge that does
+	// not understand the handshake closes the connection right away.
+	bridgeProbeHoldTime = 1 * time.Second
+	// The number of consecutive failed probes after which a bridge is
+	// considered unhealthy.
+	bridgeUnhealthyThreshold = 3
+)
+
+// BridgeHealth is the result of the latest probes of a bridge.
+type BridgeHealth struct {
+	Healthy   bool
+	LastCheck time.Time
+	LastError string
+	// The number of consecutive failed probes
+	Failures int
+}
+
+// BridgeHealthChecker periodically probes the WebSocket endpoint of every
+// bridge in the bridge list. Bridges that have not been probed yet are
+// presumed healthy. When every bridge fails its probes, the broker itself is
+// more likely to be cut off than all bridges to be down, so then all of them
+// are presumed healthy rather than refusing every client.
+type BridgeHealthChecker struct {
+	bridgeList BridgeListHolderFileBased
+	metrics    *Metrics
+	// probe connects to a bridge and returns an error if it is unreachable.
+	probe func(bridge BridgeInfo) error
+
+	health map[bridgefingerprint.Fingerprint]BridgeHealth
+	// Whether every probed bridge is unhealthy
+	allUnhealthy bool
+	lock         sync.RWMutex
+}
+
+func NewBridgeHealthChecker(bridgeList BridgeListHolderFileBased, metrics *Metrics) *BridgeHealthChecker {
+	return &BridgeHealthChecker{
+		bridgeList: bridgeList,
+		metrics:    metrics,
+		probe:      probeBridge,
+		health:     make(map[bridgefingerprint.Fingerprint]BridgeHealth),
+	}
+}
+
+// probeBridge opens a WebSocket connection to the bridge and performs the
+// turbotunnel handshake that server/lib/http.go expects: the turbotunnel
+// token followed by a ClientID. A fresh ClientID is used for every probe,
+// so the server has no queued packets to send back, and a healthy bridge
+// keeps the connection open waiting for encapsulated packets.
+func probeBridge(bridge BridgeInfo) error {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: bridgeProbeTimeout,
+	}
+	ws, _, err := dialer.Dial(bridge.WebSocketAddress, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var clientID turbotunnel.ClientID
+	if _, err := rand.Read(clientID[:]); err != nil {
+		return err
+	}
+	handshake := append(turbotunnel.Token[:], clientID[:]...)
+	ws.SetWriteDeadline(time.Now().Add(bridgeProbeTimeout))
+	if err := ws.WriteMessage(websocket.BinaryMessage, handshake); err != nil {
+		return err
+	}
+
+	ws.SetReadDeadline(time.Now().Add(bridgeProbeHoldTime))
+	_, _, err = ws.NextReader()
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("connection closed after handshake: %v", err)
+	}
+	return fmt.Errorf("unexpected data after handshake")
+}
+
+// CheckAll probes every bridge in the bridge list concurrently and updates
+// their health. Bridges that are no longer in the list are forgotten.
+func (c *BridgeHealthChecker) CheckAll() {
+	bridges := c.bridgeList.ListBridges()
+
+	type result struct {
+		fingerprint bridgefingerprint.Fingerprint
+		bridge      BridgeInfo
+		err         error
+	}
+	results := make(chan result, len(bridges))
+	var wg sync.WaitGroup
+	for _, bridge := range bridges {
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString(bridge.Fingerprint)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(fingerprint bridgefingerprint.Fingerprint, bridge BridgeInfo) {
+			defer wg.Done()
+			results <- result{fingerprint, bridge, c.probe(bridge)}
+		}(fingerprint, bridge)
+	}
+	wg.Wait()
+	close(results)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	health := make(map[bridgefingerprint.Fingerprint]BridgeHealth)
+	for r := range results {
+		h, ok := c.health[r.fingerprint]
+		if !ok {
+			h.Healthy = true
+		}
+		h.LastCheck = time.Now()
+		status := "success"
+		if r.err == nil {
+			if !h.Healthy {
+				log.Printf("Bridge %s is healthy again", r.bridge.DisplayName)
+			}
+			h.Healthy = true
+			h.LastError = ""
+			h.Failures = 0
+		} else {
+			status = "failure"
+			h.LastError = r.err.Error()
+			h.Failures++
+			if h.Healthy && h.Failures >= bridgeUnhealthyThreshold {
+				log.Printf("Bridge %s is unhealthy: %v", r.bridge.DisplayName, r.err)
+				h.Healthy = false
+			}
+		}
+		health[r.fingerprint] = h
+
+		hexFingerprint := hex.EncodeToString(r.fingerprint.ToBytes())
+		labels := prometheus.Labels{"fingerprint": hexFingerprint}
+		c.metrics.promMetrics.BridgeHealthCheckTotal.With(prometheus.Labels{
+			"fingerprint": hexFingerprint,
+			"status":      status,
+		}).Inc()
+		if h.Healthy {
+			c.metrics.promMetrics.BridgeHealthy.With(labels).Set(1)
+		} else {
+			c.metrics.promMetrics.BridgeHealthy.With(labels).Set(0)
+		}
+	}
+	for fingerprint := range c.health {
+		if _, ok := health[fingerprint]; !ok {
+			c.metrics.promMetrics.BridgeHealthy.Delete(prometheus.Labels{"fingerprint": hex.EncodeToString(fingerprint.ToBytes())})
+		}
+	}
+	c.health = health
+
+	allUnhealthy := len(health) > 0
+	for _, h := range health {
+		if h.Healthy {
+			allUnhealthy = false
+			break
+		}
+	}
+	if allUnhealthy && !c.allUnhealthy {
+		log.Printf("Every bridge is unhealthy; not refusing clients, in case the broker cannot reach them")
+	}
+	c.allUnhealthy = allUnhealthy
+}
+
+// IsHealthy returns false if the bridge has failed its recent probes, unless
+// every bridge has. A nil checker considers every bridge healthy.
+func (c *BridgeHealthChecker) IsHealthy(fingerprint bridgefingerprint.Fingerprint) bool {
+	if c == nil {
+		return true
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	h, ok := c.health[fingerprint]
+	return !ok || h.Healthy || c.allUnhealthy
+}
+
+// Health returns the health of every bridge that has been probed.
+func (c *BridgeHealthChecker) Health() map[bridgefingerprint.Fingerprint]BridgeHealth {
+	health := make(map[bridgefingerprint.Fingerprint]BridgeHealth)
+	if c == nil {
+		return health
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for fingerprint, h := range c.health {
+		health[fingerprint] = h
+	}
+	return health
+}
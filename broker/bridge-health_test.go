@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/websocketconn"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeBridge reads the turbotunnel handshake like server/lib/http.go, and
+// then either waits for the client to close the connection or, if it does
+// not support turbotunnel, closes it right away.
+func fakeBridge(turbotunnelSupported bool) http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := websocketconn.New(ws)
+		defer conn.Close()
+
+		var token [len(turbotunnel.Token)]byte
+		if _, err := io.ReadFull(conn, token[:]); err != nil {
+			return
+		}
+		if !turbotunnelSupported {
+			return
+		}
+		var clientID turbotunnel.ClientID
+		if _, err := io.ReadFull(conn, clientID[:]); err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	})
+}
+
+func TestBridgeHealth(t *testing.T) {
+	Convey("Probing a bridge", t, func() {
+		Convey("succeeds if the bridge completes the handshake", func() {
+			server := httptest.NewServer(fakeBridge(true))
+			defer server.Close()
+			bridge := BridgeInfo{WebSocketAddress: "ws" + strings.TrimPrefix(server.URL, "http")}
+			So(probeBridge(bridge), ShouldBeNil)
+		})
+
+		Convey("fails if the bridge closes the connection", func() {
+			server := httptest.NewServer(fakeBridge(false))
+			defer server.Close()
+			bridge := BridgeInfo{WebSocketAddress: "ws" + strings.TrimPrefix(server.URL, "http")}
+			So(probeBridge(bridge), ShouldNotBeNil)
+		})
+
+		Convey("fails if the bridge is not a WebSocket server", func() {
+			server := httptest.NewServer(http.NotFoundHandler())
+			defer server.Close()
+			bridge := BridgeInfo{WebSocketAddress: "ws" + strings.TrimPrefix(server.URL, "http")}
+			So(probeBridge(bridge), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Bridge health checks", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		So(ctx.InstallBridgeListProfile(strings.NewReader(ImaginaryBridges), "", ""), ShouldBeNil)
+		ctx.bridgeHealth = NewBridgeHealthChecker(ctx.bridgeList, ctx.metrics)
+		// Only the default bridge fails, unless failAll is set.
+		var probeErr error
+		var failAll bool
+		ctx.bridgeHealth.probe = func(bridge BridgeInfo) error {
+			if bridge.DisplayName == "default" || failAll {
+				return probeErr
+			}
+			return nil
+		}
+		i := &IPC{ctx}
+
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString("2B280B23E1107BB62ABFC40DDCC8824814F80A72")
+		So(err, ShouldBeNil)
+		healthy := ctx.metrics.promMetrics.BridgeHealthy.WithLabelValues("2b280b23e1107bb62abfc40ddcc8824814f80a72")
+
+		clientOffer := func() string {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/client",
+				bytes.NewReader([]byte("1.0\n{\"offer\": \"fake\", \"nat\": \"unknown\"}")))
+			So(err, ShouldBeNil)
+			clientOffers(i, w, r)
+			return w.Body.String()
+		}
+
+		So(ctx.bridgeHealth.IsHealthy(fingerprint), ShouldBeTrue)
+
+		Convey("mark a bridge unhealthy after repeated failures", func() {
+			probeErr = errors.New("connection refused")
+			for n := 0; n < bridgeUnhealthyThreshold-1; n++ {
+				ctx.bridgeHealth.CheckAll()
+			}
+			So(ctx.bridgeHealth.IsHealthy(fingerprint), ShouldBeTrue)
+			ctx.bridgeHealth.CheckAll()
+			So(ctx.bridgeHealth.IsHealthy(fingerprint), ShouldBeFalse)
+			So(testutil.ToFloat64(healthy), ShouldEqual, 0)
+
+			So(clientOffer(), ShouldEqual, `{"error":"requested bridge is currently unavailable"}`)
+
+			var debug string
+			So(i.Debug(nil, &debug), ShouldBeNil)
+			So(debug, ShouldContainSubstring, "default 2B280B23E1107BB62ABFC40DDCC8824814F80A72: unhealthy (connection refused)")
+
+			Convey("and healthy again once it recovers", func() {
+				probeErr = nil
+				ctx.bridgeHealth.CheckAll()
+				So(ctx.bridgeHealth.IsHealthy(fingerprint), ShouldBeTrue)
+				So(testutil.ToFloat64(healthy), ShouldEqual, 1)
+				So(clientOffer(), ShouldEqual, `{"error":"no snowflake proxies currently available"}`)
+			})
+
+			Convey("but not if every bridge is unhealthy", func() {
+				failAll = true
+				for n := 0; n < bridgeUnhealthyThreshold; n++ {
+					ctx.bridgeHealth.CheckAll()
+				}
+				So(ctx.bridgeHealth.IsHealthy(fingerprint), ShouldBeTrue)
+				So(testutil.ToFloat64(healthy), ShouldEqual, 0)
+				So(clientOffer(), ShouldEqual, `{"error":"no snowflake proxies currently available"}`)
+			})
+		})
+	})
+}
@@ -50,6 +50,7 @@ type BridgeListHolder interface {
 type BridgeListHolderFileBased interface {
 	BridgeListHolder
 	LoadBridgeInfo(reader io.Reader) error
+	ListBridges() []BridgeInfo
 }
 
 type BridgeInfo struct {
@@ -67,6 +68,16 @@ func (h *bridgeListHolder) GetBridgeInfo(fingerprint bridgefingerprint.Fingerpri
 	return BridgeInfo{}, ErrBridgeNotFound
 }
 
+func (h *bridgeListHolder) ListBridges() []BridgeInfo {
+	h.accessBridgeInfo.RLock()
+	defer h.accessBridgeInfo.RUnlock()
+	bridges := make([]BridgeInfo, 0, len(h.bridgeInfo))
+	for _, bridgeInfo := range h.bridgeInfo {
+		bridges = append(bridges, bridgeInfo)
+	}
+	return bridges
+}
+
 func (h *bridgeListHolder) LoadBridgeInfo(reader io.Reader) error {
 	bridgeInfoMap := map[bridgefingerprint.Fingerprint]BridgeInfo{}
 	inputScanner := bufio.NewScanner(reader)
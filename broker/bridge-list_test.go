@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/hex"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -62,3 +66,47 @@ func TestBridgeLoad(t *testing.T) {
 		}
 	})
 }
+
+func TestBridgeListReload(t *testing.T) {
+	Convey("Reloading the bridge list", t, func() {
+		f, err := ioutil.TempFile("", "snowflake-bridge-list")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(DefaultBridges)
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		ctx := NewBrokerContext(NullLogger())
+		So(ctx.ReloadBridgeListProfile(f.Name(), "snowflake.torproject.org", ""), ShouldBeNil)
+		lastSeen := ctx.bridgeListDigest
+
+		imaginary8, err := bridgefingerprint.FingerprintFromHexString("2B280B23E1107BB62ABFC40DDCC8824814F80B07")
+		So(err, ShouldBeNil)
+		_, err = ctx.GetBridgeInfo(imaginary8)
+		So(err, ShouldEqual, ErrBridgeNotFound)
+
+		Convey("picks up changes to the file", func() {
+			So(ioutil.WriteFile(f.Name(), []byte(ImaginaryBridges), 0644), ShouldBeNil)
+			ctx.reloadBridgeListIfChanged(f.Name(), "$torproject.org", "", &lastSeen)
+			bridgeInfo, err := ctx.GetBridgeInfo(imaginary8)
+			So(err, ShouldBeNil)
+			So(bridgeInfo.DisplayName, ShouldEqual, "imaginary-8")
+			So(ctx.allowedRelayPattern, ShouldEqual, "$torproject.org")
+			So(testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListLastReloadSuccessful), ShouldEqual, 1)
+		})
+
+		Convey("keeps the previous list if the file is malformed", func() {
+			So(ioutil.WriteFile(f.Name(), []byte(ImaginaryBridges+`{"displayName":"broken"`), 0644), ShouldBeNil)
+			ctx.reloadBridgeListIfChanged(f.Name(), "$torproject.org", "", &lastSeen)
+			_, err = ctx.GetBridgeInfo(imaginary8)
+			So(err, ShouldEqual, ErrBridgeNotFound)
+			So(ctx.allowedRelayPattern, ShouldEqual, "snowflake.torproject.org")
+			So(testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListReloadTotal.With(prometheus.Labels{"status": "failure"})), ShouldEqual, 1)
+			So(testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListLastReloadSuccessful), ShouldEqual, 0)
+
+			// The same broken file is not loaded again.
+			ctx.reloadBridgeListIfChanged(f.Name(), "$torproject.org", "", &lastSeen)
+			So(testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListReloadTotal.With(prometheus.Labels{"status": "failure"})), ShouldEqual, 1)
+		})
+	})
+}
@@ -7,13 +7,16 @@ package main
 
 import (
 	"bytes"
-	"container/heap"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/ipsetsink"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/ipsetsink/sinkcluster"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -24,27 +27,67 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/namematcher"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/safelog"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/task"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// How long a shutdown waits for the pending polls, the longest of which wait
+// for a proxy's answer, before it closes their connections.
+const shutdownTimeout = 2 * time.Second * ClientTimeout
+
 type BrokerContext struct {
-	snowflakes           *SnowflakeHeap
-	restrictedSnowflakes *SnowflakeHeap
+	// The number of clients waiting for a proxy's answer, accessed
+	// atomically. Kept first in the struct for 64-bit alignment.
+	pendingClientOffers int64
+
+	// Available snowflakes, which are matched with the clients whose NAT
+	// they are compatible with, as in nat-matching.go
+	snowflakes *SnowflakeHeaps
 	// Maps keeping track of snowflakeIDs required to match SDP answers from
-	// the second http POST. Restricted snowflakes can only be matched up with
-	// clients behind an unrestricted NAT.
+	// the second http POST.
 	idToSnowflake map[string]*Snowflake
 	// Synchronization for the snowflake map and heap
 	snowflakeLock sync.Mutex
 	proxyPolls    chan *ProxyPoll
 	metrics       *Metrics
 
+	// The pool through which proxies are matched with clients. By default,
+	// this is the broker context itself, which matches proxies in process
+	// using the heap above.
+	pool SnowflakePool
+	// Rules for choosing among the proxies that could serve a client
+	matchingPolicy MatchingPolicyHolder
+
 	bridgeList                     BridgeListHolderFileBased
 	allowedRelayPattern            string
 	presumedPatternForLegacyClient string
+	// Digest of the last installed bridge list, and synchronization so that
+	// the bridge list and relay patterns are replaced together
+	bridgeListDigest [sha256.Size]byte
+	bridgeListLock   sync.RWMutex
+	// Optional periodic probing of the bridges in the bridge list
+	bridgeHealth *BridgeHealthChecker
+	// Optional per-address limits on the rate of requests
+	rateLimiter *RateLimiter
+	// The ranges of the CDNs and caches that forward the requests of
+	// clients, through which the broker finds the addresses of clients
+	trustedRanges trustedRanges
+	// Reputation of the proxies that identify themselves
+	reputation *ReputationTracker
+	// Matches awaiting feedback from clients, and whether failures that
+	// clients report count against the reputation of proxies
+	matches            *MatchTracker
+	feedbackReputation bool
+	// Candidates exchanged by clients and proxies that use trickle ICE,
+	// nil if trickle ICE is not supported
+	trickle *TrickleTracker
+
+	// Optional store used to checkpoint state across restarts
+	stateStore StateStore
 }
 
 func (ctx *BrokerContext) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (BridgeInfo, error) {
@@ -52,10 +95,7 @@ func (ctx *BrokerContext) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprin
 }
 
 func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
-	snowflakes := new(SnowflakeHeap)
-	heap.Init(snowflakes)
-	rSnowflakes := new(SnowflakeHeap)
-	heap.Init(rSnowflakes)
+	snowflakes := NewSnowflakeHeaps()
 	metrics, err := NewMetrics(metricsLogger)
 
 	if err != nil {
@@ -72,14 +112,27 @@ func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
 `
 	bridgeListHolder.LoadBridgeInfo(bytes.NewReader([]byte(DefaultBridges)))
 
-	return &BrokerContext{
-		snowflakes:           snowflakes,
-		restrictedSnowflakes: rSnowflakes,
-		idToSnowflake:        make(map[string]*Snowflake),
-		proxyPolls:           make(chan *ProxyPoll),
-		metrics:              metrics,
-		bridgeList:           bridgeListHolder,
+	ctx := &BrokerContext{
+		snowflakes:    snowflakes,
+		idToSnowflake: make(map[string]*Snowflake),
+		proxyPolls:    make(chan *ProxyPoll),
+		metrics:       metrics,
+		bridgeList:    bridgeListHolder,
+		reputation:    NewReputationTracker(),
+		matches:       NewMatchTracker(metrics),
+		trickle:       NewTrickleTracker(),
 	}
+	ctx.pool = ctx
+	return ctx
+}
+
+// Replaces the in-process matching of proxies and clients with the given
+// pool, for example one shared by several broker instances. Trickle ICE is
+// not supported with such a pool, because the client and the proxy of a
+// match may be polling different brokers.
+func (ctx *BrokerContext) SetSnowflakePool(pool SnowflakePool) {
+	ctx.pool = pool
+	ctx.trickle = nil
 }
 
 // Proxies may poll for client offers concurrently.
@@ -87,18 +140,30 @@ type ProxyPoll struct {
 	id           string
 	proxyType    string
 	natType      string
+	natBehavior  *nat.Behavior
+	country      string
 	clients      int
+	identity     string
+	reputation   float64
+	trickle      bool
+	turn         bool
 	offerChannel chan *ClientOffer
 }
 
 // Registers a Snowflake and waits for some Client to send an offer,
 // as part of the polling logic of the proxy handler.
-func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType string, clients int) *ClientOffer {
+func (ctx *BrokerContext) RequestOffer(proxy ProxyEntry) *ClientOffer {
 	request := new(ProxyPoll)
-	request.id = id
-	request.proxyType = proxyType
-	request.natType = natType
-	request.clients = clients
+	request.id = proxy.ID
+	request.proxyType = proxy.Type
+	request.natType = proxy.NAT
+	request.natBehavior = proxy.NATBehavior
+	request.country = proxy.Country
+	request.clients = proxy.Clients
+	request.identity = proxy.Identity
+	request.reputation = proxy.Reputation
+	request.trickle = proxy.Trickle
+	request.turn = proxy.TURN
 	request.offerChannel = make(chan *ClientOffer)
 	ctx.proxyPolls <- request
 	// Block until an offer is available, or timeout which sends a nil offer.
@@ -111,7 +176,18 @@ func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType stri
 // client offer or nil on timeout / none are available.
 func (ctx *BrokerContext) Broker() {
 	for request := range ctx.proxyPolls {
-		snowflake := ctx.AddSnowflake(request.id, request.proxyType, request.natType, request.clients)
+		snowflake := ctx.addSnowflake(ProxyEntry{
+			ID:          request.id,
+			Type:        request.proxyType,
+			NAT:         request.natType,
+			NATBehavior: request.natBehavior,
+			Country:     request.country,
+			Clients:     request.clients,
+			Identity:    request.identity,
+			Reputation:  request.reputation,
+			Trickle:     request.trickle,
+			TURN:        request.turn,
+		})
 		// Wait for a client to avail an offer to the snowflake.
 		go func(request *ProxyPoll) {
 			select {
@@ -122,11 +198,7 @@ func (ctx *BrokerContext) Broker() {
 				ctx.snowflakeLock.Lock()
 				defer ctx.snowflakeLock.Unlock()
 				if snowflake.index != -1 {
-					if request.natType == NATUnrestricted {
-						heap.Remove(ctx.snowflakes, snowflake.index)
-					} else {
-						heap.Remove(ctx.restrictedSnowflakes, snowflake.index)
-					}
+					ctx.snowflakes.Remove(snowflake)
 					ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": request.natType, "type": request.proxyType}).Dec()
 					delete(ctx.idToSnowflake, snowflake.id)
 					close(request.offerChannel)
@@ -140,48 +212,245 @@ func (ctx *BrokerContext) Broker() {
 // Required to keep track of proxies between providing them
 // with an offer and awaiting their second POST with an answer.
 func (ctx *BrokerContext) AddSnowflake(id string, proxyType string, natType string, clients int) *Snowflake {
-	snowflake := new(Snowflake)
-	snowflake.id = id
-	snowflake.clients = clients
-	snowflake.proxyType = proxyType
-	snowflake.natType = natType
+	return ctx.addSnowflake(ProxyEntry{ID: id, Type: proxyType, NAT: natType, Clients: clients})
+}
+
+func (ctx *BrokerContext) addSnowflake(proxy ProxyEntry) *Snowflake {
+	snowflake := snowflakeOf(proxy)
 	snowflake.offerChannel = make(chan *ClientOffer)
 	snowflake.answerChannel = make(chan string)
 	ctx.snowflakeLock.Lock()
-	if natType == NATUnrestricted {
-		heap.Push(ctx.snowflakes, snowflake)
-	} else {
-		heap.Push(ctx.restrictedSnowflakes, snowflake)
-	}
-	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": natType, "type": proxyType}).Inc()
-	ctx.idToSnowflake[id] = snowflake
+	ctx.snowflakes.Push(snowflake)
+	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": proxy.NAT, "type": proxy.Type}).Inc()
+	ctx.idToSnowflake[proxy.ID] = snowflake
 	ctx.snowflakeLock.Unlock()
 	return snowflake
 }
 
+// Implements SnowflakePool
+func (ctx *BrokerContext) MatchSnowflake(offer *ClientOffer) *Snowflake {
+	policy := ctx.matchingPolicy.Get()
+
+	ctx.snowflakeLock.Lock()
+	snowflake := ctx.snowflakes.Select(offer.clientEntry(), policy)
+	ctx.snowflakeLock.Unlock()
+	if snowflake == nil {
+		return nil
+	}
+
+	snowflake.offerChannel <- offer
+	return snowflake
+}
+
+// Loads the matching policy from the given file, keeping the current
+// policy if the file is invalid.
+func (ctx *BrokerContext) LoadMatchingPolicy(path string) error {
+	return ctx.matchingPolicy.LoadFile(path)
+}
+
+// Implements SnowflakePool
+func (ctx *BrokerContext) ReleaseSnowflake(snowflake *Snowflake) {
+	ctx.snowflakeLock.Lock()
+	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
+	delete(ctx.idToSnowflake, snowflake.id)
+	ctx.snowflakeLock.Unlock()
+}
+
+// Implements SnowflakePool
+func (ctx *BrokerContext) SendAnswer(id string, answer string) bool {
+	ctx.snowflakeLock.Lock()
+	snowflake, ok := ctx.idToSnowflake[id]
+	ctx.snowflakeLock.Unlock()
+	if !ok || snowflake == nil {
+		// The snowflake took too long to respond with an answer, so its client
+		// disappeared / the snowflake is no longer recognized by the Broker.
+		return false
+	}
+	snowflake.answerChannel <- answer
+	return true
+}
+
+// Implements SnowflakePool
+func (ctx *BrokerContext) Snowflakes() []*Snowflake {
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+	snowflakes := make([]*Snowflake, 0, len(ctx.idToSnowflake))
+	for _, snowflake := range ctx.idToSnowflake {
+		snowflakes = append(snowflakes, snowflake)
+	}
+	return snowflakes
+}
+
 func (ctx *BrokerContext) InstallBridgeListProfile(reader io.Reader, relayPattern, presumedPatternForLegacyClient string) error {
-	if err := ctx.bridgeList.LoadBridgeInfo(reader); err != nil {
+	bridgeList, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	ctx.bridgeListLock.Lock()
+	if err := ctx.bridgeList.LoadBridgeInfo(bytes.NewReader(bridgeList)); err != nil {
+		ctx.bridgeListLock.Unlock()
 		return err
 	}
 	ctx.allowedRelayPattern = relayPattern
 	ctx.presumedPatternForLegacyClient = presumedPatternForLegacyClient
+	ctx.bridgeListDigest = sha256.Sum256(bridgeList)
+	ctx.bridgeListLock.Unlock()
+	if ctx.stateStore != nil {
+		if err := ctx.stateStore.Put(stateKeyBridgeList, bridgeList); err != nil {
+			log.Printf("Error saving bridge list: %v", err)
+		}
+	}
 	return nil
 }
 
+// Sets the store used to checkpoint broker state and restores the metrics
+// window saved in it, if any.
+func (ctx *BrokerContext) RestoreState(store StateStore) error {
+	ctx.stateStore = store
+	return ctx.metrics.RestoreState(store)
+}
+
+// Installs the bridge list last saved in the state store. The default bridge
+// list is kept if none was saved.
+func (ctx *BrokerContext) RestoreBridgeListProfile(relayPattern, presumedPatternForLegacyClient string) error {
+	bridgeList, err := ctx.stateStore.Get(stateKeyBridgeList)
+	if err == ErrStateNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ctx.InstallBridgeListProfile(bytes.NewReader(bridgeList), relayPattern, presumedPatternForLegacyClient)
+}
+
+// Saves the current metrics window to the state store.
+func (ctx *BrokerContext) CheckpointState() error {
+	if ctx.stateStore == nil {
+		return nil
+	}
+	return ctx.metrics.SaveState(ctx.stateStore)
+}
+
+// Shutdown stops server gracefully: it closes the listeners, and waits until
+// timeout for the pending polls to finish. It then saves the state of the
+// broker, if it has a state store, so that a restart picks up where it left
+// off.
+func (ctx *BrokerContext) Shutdown(server *http.Server, timeout time.Duration) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if stateErr := ctx.CheckpointState(); err == nil {
+		err = stateErr
+	}
+	return err
+}
+
+// Reloads the bridge list from the given file. If the file cannot be read or
+// is invalid, the current bridge list and relay patterns are kept.
+func (ctx *BrokerContext) ReloadBridgeListProfile(path, relayPattern, presumedPatternForLegacyClient string) error {
+	bridgeListFile, err := os.Open(path)
+	if err == nil {
+		err = ctx.InstallBridgeListProfile(bridgeListFile, relayPattern, presumedPatternForLegacyClient)
+		bridgeListFile.Close()
+	}
+
+	if err != nil {
+		log.Printf("Reload of bridge list %s failed, keeping the previous bridge list: %v", path, err)
+		ctx.metrics.promMetrics.BridgeListReloadTotal.With(prometheus.Labels{"status": "failure"}).Inc()
+		ctx.metrics.promMetrics.BridgeListLastReloadSuccessful.Set(0)
+		return err
+	}
+	log.Printf("Reloaded bridge list %s", path)
+	ctx.metrics.promMetrics.BridgeListReloadTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	ctx.metrics.promMetrics.BridgeListLastReloadSuccessful.Set(1)
+	return nil
+}
+
+// Checks the bridge list file every interval, and reloads it when its
+// contents differ from the installed bridge list. A file that failed to load
+// is not retried until its contents change again.
+func (ctx *BrokerContext) WatchBridgeListFile(path, relayPattern, presumedPatternForLegacyClient string, interval time.Duration) {
+	ctx.bridgeListLock.RLock()
+	lastSeen := ctx.bridgeListDigest
+	ctx.bridgeListLock.RUnlock()
+
+	for range time.Tick(interval) {
+		ctx.reloadBridgeListIfChanged(path, relayPattern, presumedPatternForLegacyClient, &lastSeen)
+	}
+}
+
+func (ctx *BrokerContext) reloadBridgeListIfChanged(path, relayPattern, presumedPatternForLegacyClient string, lastSeen *[sha256.Size]byte) {
+	bridgeList, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Error checking bridge list %s for changes: %v", path, err)
+		return
+	}
+	digest := sha256.Sum256(bridgeList)
+	if digest == *lastSeen {
+		return
+	}
+	*lastSeen = digest
+	ctx.ReloadBridgeListProfile(path, relayPattern, presumedPatternForLegacyClient)
+}
+
 func (ctx *BrokerContext) CheckProxyRelayPattern(pattern string, nonSupported bool) bool {
+	ctx.bridgeListLock.RLock()
 	if nonSupported {
 		pattern = ctx.presumedPatternForLegacyClient
 	}
+	allowedRelayPattern := ctx.allowedRelayPattern
+	ctx.bridgeListLock.RUnlock()
+
 	proxyPattern := namematcher.NewNameMatcher(pattern)
-	brokerPattern := namematcher.NewNameMatcher(ctx.allowedRelayPattern)
+	brokerPattern := namematcher.NewNameMatcher(allowedRelayPattern)
 	return proxyPattern.IsSupersetOf(brokerPattern)
 }
 
-// Client offer contains an SDP, bridge fingerprint and the NAT type of the client
+// Client offer contains an SDP, bridge fingerprint, the NAT type of the client,
+// and the client's country if known. Offers of clients that use trickle ICE
+// carry the id under which the candidates of the match are exchanged.
 type ClientOffer struct {
 	natType     string
+	natBehavior *nat.Behavior
+	country     string
 	sdp         []byte
 	fingerprint []byte
+	trickle     bool
+	trickleID   string
+}
+
+func (o *ClientOffer) clientEntry() ClientEntry {
+	return ClientEntry{
+		NAT:         o.natType,
+		NATBehavior: o.natBehavior,
+		Country:     o.country,
+		Fingerprint: strings.ToUpper(hex.EncodeToString(o.fingerprint)),
+		Trickle:     o.trickle,
+	}
+}
+
+// newBrokerMux returns the HTTP handler of the broker, serving the endpoints
+// used by proxies and clients along with the debug and metrics pages.
+func newBrokerMux(ctx *BrokerContext, metricsFilename string) *http.ServeMux {
+	i := &IPC{ctx}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/robots.txt", robotsTxtHandler)
+
+	limiter := ctx.rateLimiter
+	mux.Handle("/proxy", limiter.Wrap(rateLimitProxy, SnowflakeHandler{i, proxyPolls}))
+	mux.Handle("/client", limiter.Wrap(rateLimitClient, SnowflakeHandler{i, clientOffers}))
+	mux.Handle("/answer", limiter.Wrap(rateLimitAnswer, SnowflakeHandler{i, proxyAnswers}))
+	mux.Handle("/feedback", limiter.Wrap(rateLimitFeedback, SnowflakeHandler{i, clientFeedback}))
+	mux.Handle("/trickle", limiter.Wrap(rateLimitTrickle, SnowflakeHandler{i, trickleCandidates}))
+	mux.Handle("/debug", SnowflakeHandler{i, debugHandler})
+	mux.Handle("/debug.json", SnowflakeHandler{i, debugJSONHandler})
+	mux.Handle("/metrics", MetricsHandler{metricsFilename, metricsHandler})
+	mux.Handle("/prometheus", promhttp.HandlerFor(ctx.metrics.promMetrics.registry, promhttp.HandlerOpts{}))
+
+	mux.Handle("/amp/client/", limiter.Wrap(rateLimitAMPClient, SnowflakeHandler{i, ampClientOffers}))
+	mux.Handle("/amp/feedback/", limiter.Wrap(rateLimitAMPFeedback, SnowflakeHandler{i, ampClientFeedback}))
+
+	return mux
 }
 
 func main() {
@@ -199,6 +468,18 @@ func main() {
 	var ipCountFilename, ipCountMaskingKey string
 	var ipCountInterval time.Duration
 	var unsafeLogging bool
+	var stateDir string
+	var stateCheckpointInterval time.Duration
+	var matchingBackendURL, matchingBackendAddr string
+	var matchingBackendSecretFilename string
+	var matchingPolicyFilename string
+	var bridgeListReloadInterval time.Duration
+	var bridgeHealthCheckInterval time.Duration
+	var clientRateLimit, ampClientRateLimit, proxyRateLimit, answerRateLimit string
+	var feedbackRateLimit, ampFeedbackRateLimit, trickleRateLimit string
+	var rateLimitIPv4Prefix, rateLimitIPv6Prefix int
+	var rateLimitTrustedRanges string
+	var feedbackReputation bool
 
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
 	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for TLS certificate")
@@ -211,6 +492,7 @@ func main() {
 	flag.StringVar(&bridgeListFilePath, "bridge-list-path", "", "file path for bridgeListFile")
 	flag.StringVar(&allowedRelayPattern, "allowed-relay-pattern", "", "allowed pattern for relay host name")
 	flag.StringVar(&presumedPatternForLegacyClient, "default-relay-pattern", "", "presumed pattern for legacy client")
+	flag.DurationVar(&bridgeListReloadInterval, "bridge-list-reload-interval", time.Minute, "time interval between checks of bridgeListFile for changes, 0 to disable")
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
 	flag.BoolVar(&disableGeoip, "disable-geoip", false, "don't use geoip for stats collection")
 	flag.StringVar(&metricsFilename, "metrics-log", "", "path to metrics logging output")
@@ -218,6 +500,24 @@ func main() {
 	flag.StringVar(&ipCountMaskingKey, "ip-count-mask", "", "masking key for ip count logging")
 	flag.DurationVar(&ipCountInterval, "ip-count-interval", time.Hour, "time interval between each chunk")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.StringVar(&stateDir, "state-dir", "", "directory in which to persist metrics and the bridge list across restarts")
+	flag.DurationVar(&stateCheckpointInterval, "state-checkpoint-interval", 5*time.Minute, "time interval between each state checkpoint")
+	flag.StringVar(&matchingBackendURL, "matching-backend-url", "", "URL of a matching backend shared with other broker instances")
+	flag.StringVar(&matchingBackendAddr, "matching-backend-addr", "", "address on which to serve a matching backend to other broker instances")
+	flag.StringVar(&matchingBackendSecretFilename, "matching-backend-secret-file", "", "path to a file with a secret shared by the matching backend and the broker instances that use it, required unless the matching backend is on a loopback address")
+	flag.StringVar(&matchingPolicyFilename, "matching-policy", "", "path to a file with rules for matching proxies with clients")
+	flag.DurationVar(&bridgeHealthCheckInterval, "bridge-health-check-interval", 0, "time interval between health checks of the bridges in the bridge list, 0 to disable")
+	flag.StringVar(&clientRateLimit, "client-rate-limit", "", "maximum rate of /client requests per address, as requests/period such as 10/1m; empty for no limit")
+	flag.StringVar(&ampClientRateLimit, "amp-client-rate-limit", "", "maximum rate of /amp/client/ requests per address, as requests/period; empty for no limit")
+	flag.StringVar(&proxyRateLimit, "proxy-rate-limit", "", "maximum rate of /proxy requests per address, as requests/period; empty for no limit")
+	flag.StringVar(&answerRateLimit, "answer-rate-limit", "", "maximum rate of /answer requests per address, as requests/period; empty for no limit")
+	flag.StringVar(&feedbackRateLimit, "feedback-rate-limit", "", "maximum rate of /feedback requests per address, as requests/period; empty for no limit")
+	flag.StringVar(&ampFeedbackRateLimit, "amp-feedback-rate-limit", "", "maximum rate of /amp/feedback/ requests per address, as requests/period; empty for no limit")
+	flag.StringVar(&trickleRateLimit, "trickle-rate-limit", "", "maximum rate of /trickle requests per address, as requests/period; empty for no limit")
+	flag.IntVar(&rateLimitIPv4Prefix, "rate-limit-ipv4-prefix", defaultRateLimitIPv4Prefix, "length of the IPv4 prefix that shares a rate limit")
+	flag.IntVar(&rateLimitIPv6Prefix, "rate-limit-ipv6-prefix", defaultRateLimitIPv6Prefix, "length of the IPv6 prefix that shares a rate limit")
+	flag.StringVar(&rateLimitTrustedRanges, "rate-limit-trusted-ranges", "", "comma-separated CIDR ranges of CDNs and caches whose X-Forwarded-For is trusted to name the client, and that are exempt from rate limits")
+	flag.BoolVar(&feedbackReputation, "feedback-reputation", false, "count failed matches reported by clients against the reputation of proxies")
 	flag.Parse()
 
 	var err error
@@ -246,6 +546,16 @@ func main() {
 
 	ctx := NewBrokerContext(metricsLogger)
 
+	if stateDir != "" {
+		stateStore, err := NewFileStateStore(stateDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err = ctx.RestoreState(stateStore); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
 	if bridgeListFilePath != "" {
 		bridgeListFile, err := os.Open(bridgeListFilePath)
 		if err != nil {
@@ -255,6 +565,15 @@ func main() {
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		bridgeListFile.Close()
+		if bridgeListReloadInterval > 0 {
+			go ctx.WatchBridgeListFile(bridgeListFilePath, allowedRelayPattern, presumedPatternForLegacyClient, bridgeListReloadInterval)
+		}
+	} else if stateDir != "" {
+		err = ctx.RestoreBridgeListProfile(allowedRelayPattern, presumedPatternForLegacyClient)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
 	}
 
 	if !disableGeoip {
@@ -264,6 +583,60 @@ func main() {
 		}
 	}
 
+	if matchingPolicyFilename != "" {
+		if err = ctx.LoadMatchingPolicy(matchingPolicyFilename); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if bridgeHealthCheckInterval > 0 {
+		ctx.bridgeHealth = NewBridgeHealthChecker(ctx.bridgeList, ctx.metrics)
+		healthCheck := &task.Periodic{
+			Interval: bridgeHealthCheckInterval,
+			Execute: func() error {
+				ctx.bridgeHealth.CheckAll()
+				return nil
+			},
+		}
+		go healthCheck.Start()
+	}
+
+	ctx.feedbackReputation = feedbackReputation
+
+	ctx.trustedRanges, err = parseTrustedRanges(rateLimitTrustedRanges)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	rateLimits := map[string]string{
+		rateLimitClient:      clientRateLimit,
+		rateLimitAMPClient:   ampClientRateLimit,
+		rateLimitProxy:       proxyRateLimit,
+		rateLimitAnswer:      answerRateLimit,
+		rateLimitFeedback:    feedbackRateLimit,
+		rateLimitAMPFeedback: ampFeedbackRateLimit,
+		rateLimitTrickle:     trickleRateLimit,
+	}
+	for endpoint, s := range rateLimits {
+		if s == "" {
+			continue
+		}
+		limit, err := ParseRateLimit(s)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if ctx.rateLimiter == nil {
+			ctx.rateLimiter = NewRateLimiter(ctx.metrics)
+			if err := ctx.rateLimiter.SetPrefixLengths(rateLimitIPv4Prefix, rateLimitIPv6Prefix); err != nil {
+				log.Fatal(err.Error())
+			}
+			if err := ctx.rateLimiter.SetTrustedRanges(rateLimitTrustedRanges); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		ctx.rateLimiter.SetLimit(endpoint, limit)
+	}
+
 	if ipCountFilename != "" {
 		ipCountFile, err := os.OpenFile(ipCountFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 
@@ -274,31 +647,72 @@ func main() {
 		ctx.metrics.distinctIPWriter = sinkcluster.NewClusterWriter(ipCountFile, ipCountInterval, ipSetSink)
 	}
 
-	go ctx.Broker()
-
-	i := &IPC{ctx}
-
-	http.HandleFunc("/robots.txt", robotsTxtHandler)
+	if matchingBackendURL != "" && matchingBackendAddr != "" {
+		log.Fatal("the --matching-backend-url and --matching-backend-addr options are not allowed together")
+	}
+	var matchingBackendSecret string
+	if matchingBackendSecretFilename != "" {
+		matchingBackendSecret, err = readMatchingBackendSecret(matchingBackendSecretFilename)
+		if err != nil {
+			log.Fatalf("could not read matching backend secret: %v", err)
+		}
+	}
+	if matchingBackendURL != "" {
+		backend := NewHTTPMatchingBackend(matchingBackendURL, matchingBackendSecret, nil)
+		ctx.SetSnowflakePool(NewSharedSnowflakePool(backend, ctx.metrics))
+	} else if matchingBackendAddr != "" {
+		if matchingBackendSecret == "" && !isLoopbackAddr(matchingBackendAddr) {
+			log.Fatal("the --matching-backend-addr option needs a --matching-backend-secret-file unless it is a loopback address")
+		}
+		backend := NewMemoryMatchingBackend(&ctx.matchingPolicy)
+		ctx.SetSnowflakePool(NewSharedSnowflakePool(backend, ctx.metrics))
+		go func() {
+			log.Printf("Serving matching backend on %s", matchingBackendAddr)
+			log.Fatal(http.ListenAndServe(matchingBackendAddr, MatchingBackendHandler{Backend: backend, Secret: matchingBackendSecret}))
+		}()
+	}
 
-	http.Handle("/proxy", SnowflakeHandler{i, proxyPolls})
-	http.Handle("/client", SnowflakeHandler{i, clientOffers})
-	http.Handle("/answer", SnowflakeHandler{i, proxyAnswers})
-	http.Handle("/debug", SnowflakeHandler{i, debugHandler})
-	http.Handle("/metrics", MetricsHandler{metricsFilename, metricsHandler})
-	http.Handle("/prometheus", promhttp.HandlerFor(ctx.metrics.promMetrics.registry, promhttp.HandlerOpts{}))
+	if stateDir != "" {
+		checkpoint := &task.Periodic{
+			Interval: stateCheckpointInterval,
+			Execute: func() error {
+				if err := ctx.CheckpointState(); err != nil {
+					log.Printf("Error checkpointing broker state: %v", err)
+				}
+				return nil
+			},
+		}
+		checkpoint.WaitThenStart()
+		defer checkpoint.Close()
+	}
 
-	http.Handle("/amp/client/", SnowflakeHandler{i, ampClientOffers})
+	go ctx.Broker()
 
 	server := http.Server{
-		Addr: addr,
+		Addr:    addr,
+		Handler: newBrokerMux(ctx, metricsFilename),
 	}
 
+	// Shut down gracefully on SIGINT or SIGTERM, which makes the server
+	// below return http.ErrServerClosed.
+	shutdownDone := make(chan struct{})
+	exitChan := make(chan os.Signal, 1)
+	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(shutdownDone)
+		signal := <-exitChan
+		log.Printf("Received signal: %s. Shutting down.", signal)
+		if err := ctx.Shutdown(&server, shutdownTimeout); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 
 	// go routine to handle a SIGHUP signal to allow the broker operator to send
-	// a SIGHUP signal when the geoip database files are updated, without requiring
-	// a restart of the broker
+	// a SIGHUP signal when the geoip database files, the bridge list or the
+	// matching policy are updated, without requiring a restart of the broker
 	go func() {
 		for {
 			signal := <-sigChan
@@ -306,6 +720,16 @@ func main() {
 			if err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
 				log.Fatalf("reload of Geo IP databases on signal %s returned error: %v", signal, err)
 			}
+			if bridgeListFilePath != "" {
+				log.Printf("Received signal: %s. Reloading bridge list.", signal)
+				ctx.ReloadBridgeListProfile(bridgeListFilePath, allowedRelayPattern, presumedPatternForLegacyClient)
+			}
+			if matchingPolicyFilename != "" {
+				log.Printf("Received signal: %s. Reloading matching policy.", signal)
+				if err := ctx.LoadMatchingPolicy(matchingPolicyFilename); err != nil {
+					log.Printf("reload of matching policy on signal %s returned error, keeping the previous policy: %v", signal, err)
+				}
+			}
 		}
 	}()
 
@@ -351,7 +775,8 @@ func main() {
 		log.Fatal("the --acme-hostnames, --cert and --key, or --disable-tls option is required")
 	}
 
-	if err != nil {
+	if err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-shutdownDone
 }
@@ -0,0 +1,149 @@
+/*
+The state of the broker shown on /debug, either as text or as JSON.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+)
+
+// DebugInfo is the JSON form of the /debug page.
+type DebugInfo struct {
+	// The number of proxies currently waiting for a client
+	Snowflakes int `json:"snowflakes"`
+	// The number of available proxies by type, with proxies of unknown
+	// types counted as messages.ProxyUnknown
+	ProxyTypes map[string]int `json:"proxyTypes"`
+	// The number of available proxies by NAT type
+	NATTypes map[string]int `json:"natTypes"`
+	// The number of clients that are waiting for a proxy's answer
+	PendingClientOffers int64 `json:"pendingClientOffers"`
+	// The proxies waiting in the in-process pool, by NAT class
+	NATClasses []DebugNATClass `json:"natClasses"`
+	// The bridges in the bridge list
+	Bridges []DebugBridge `json:"bridges"`
+	// The time it took to answer the last matched client, in milliseconds
+	ClientRoundtripEstimate int64 `json:"clientRoundtripEstimate"`
+}
+
+// DebugNATClass is a class of proxies that can serve the same clients: those
+// with the same NAT behaviour, TURN server or not, and trickle ICE or not.
+type DebugNATClass struct {
+	Mapping   string `json:"mapping"`
+	Filtering string `json:"filtering"`
+	TURN      bool   `json:"turn"`
+	Trickle   bool   `json:"trickle"`
+	// Whether the proxies of the class can serve clients behind restricted
+	// NATs
+	ServesRestrictedClients bool `json:"servesRestrictedClients"`
+	// The number of proxies of the class
+	Snowflakes int `json:"snowflakes"`
+}
+
+type DebugBridge struct {
+	DisplayName      string `json:"displayName"`
+	Fingerprint      string `json:"fingerprint"`
+	WebSocketAddress string `json:"webSocketAddress"`
+	// Available is false if the bridge failed its recent health checks.
+	Available bool `json:"available"`
+	// Checked is false if the bridge has not been health checked.
+	Checked   bool       `json:"checked"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+func (i *IPC) debugInfo() *DebugInfo {
+	info := &DebugInfo{
+		ProxyTypes: make(map[string]int),
+		NATTypes: map[string]int{
+			NATRestricted:   0,
+			NATUnrestricted: 0,
+			NATUnknown:      0,
+		},
+		NATClasses: []DebugNATClass{},
+		Bridges:    []DebugBridge{},
+	}
+	info.ProxyTypes[messages.ProxyUnknown] = 0
+
+	snowflakes := i.ctx.pool.Snowflakes()
+	info.Snowflakes = len(snowflakes)
+	for _, snowflake := range snowflakes {
+		if messages.KnownProxyTypes[snowflake.proxyType] {
+			info.ProxyTypes[snowflake.proxyType]++
+		} else {
+			info.ProxyTypes[messages.ProxyUnknown]++
+		}
+
+		switch snowflake.natType {
+		case NATRestricted, NATUnrestricted:
+			info.NATTypes[snowflake.natType]++
+		default:
+			info.NATTypes[NATUnknown]++
+		}
+	}
+
+	info.PendingClientOffers = atomic.LoadInt64(&i.ctx.pendingClientOffers)
+
+	i.ctx.snowflakeLock.Lock()
+	for _, class := range i.ctx.snowflakes.classes {
+		n := i.ctx.snowflakes.heaps[class].Len()
+		if n == 0 {
+			continue
+		}
+		info.NATClasses = append(info.NATClasses, DebugNATClass{
+			Mapping:                 class.mapping,
+			Filtering:               class.filtering,
+			TURN:                    class.turn,
+			Trickle:                 class.trickle,
+			ServesRestrictedClients: class.proxyEntry().servesRestrictedClients(),
+			Snowflakes:              n,
+		})
+	}
+	i.ctx.snowflakeLock.Unlock()
+
+	health := i.ctx.bridgeHealth.Health()
+	bridges := i.ctx.bridgeList.ListBridges()
+	sort.Slice(bridges, func(a, b int) bool { return bridges[a].Fingerprint < bridges[b].Fingerprint })
+	for _, bridge := range bridges {
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString(bridge.Fingerprint)
+		if err != nil {
+			continue
+		}
+		debugBridge := DebugBridge{
+			DisplayName:      bridge.DisplayName,
+			Fingerprint:      bridge.Fingerprint,
+			WebSocketAddress: bridge.WebSocketAddress,
+			Available:        true,
+		}
+		if h, ok := health[fingerprint]; ok {
+			lastCheck := h.LastCheck
+			debugBridge.Available = h.Healthy
+			debugBridge.Checked = true
+			debugBridge.LastCheck = &lastCheck
+			debugBridge.LastError = h.LastError
+		}
+		info.Bridges = append(info.Bridges, debugBridge)
+	}
+
+	i.ctx.metrics.lock.Lock()
+	info.ClientRoundtripEstimate = int64(i.ctx.metrics.clientRoundtripEstimate)
+	i.ctx.metrics.lock.Unlock()
+
+	return info
+}
+
+func (i *IPC) DebugJSON(_ interface{}, response *[]byte) error {
+	b, err := json.Marshal(i.debugInfo())
+	if err != nil {
+		return messages.ErrInternal
+	}
+	*response = b
+	return nil
+}
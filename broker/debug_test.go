@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDebug(t *testing.T) {
+	Convey("Debug page", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		i := &IPC{ctx}
+		ctx.AddSnowflake("standalone", "standalone", NATUnrestricted, 0)
+		ctx.AddSnowflake("webext", "webext", NATRestricted, 0)
+		ctx.AddSnowflake("other", "other", NATUnknown, 0)
+
+		Convey("as text", func() {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("GET", "snowflake.broker/debug", nil)
+			So(err, ShouldBeNil)
+			debugHandler(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldStartWith, "current snowflakes available: 3\n")
+			So(w.Body.String(), ShouldContainSubstring, "\twebext proxies: 1\n")
+			So(w.Body.String(), ShouldContainSubstring, "\tunknown proxies: 1\nNAT Types available:"+
+				"\n\trestricted: 1\n\tunrestricted: 1\n\tunknown: 1")
+		})
+
+		for _, url := range []string{"snowflake.broker/debug?format=json", "snowflake.broker/debug.json"} {
+			Convey("as JSON from "+url, func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", url, nil)
+				So(err, ShouldBeNil)
+				if r.URL.Path == "snowflake.broker/debug.json" {
+					debugJSONHandler(i, w, r)
+				} else {
+					debugHandler(i, w, r)
+				}
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+				var info DebugInfo
+				So(json.Unmarshal(w.Body.Bytes(), &info), ShouldBeNil)
+				So(info.Snowflakes, ShouldEqual, 3)
+				So(info.ProxyTypes, ShouldResemble, map[string]int{"standalone": 1, "webext": 1, "unknown": 1})
+				So(info.NATTypes, ShouldResemble, map[string]int{"restricted": 1, "unrestricted": 1, "unknown": 1})
+				// Proxies of unknown NAT type are in the same class as
+				// restricted ones.
+				So(info.NATClasses, ShouldResemble, []DebugNATClass{
+					{Mapping: nat.EndpointIndependent, Filtering: nat.EndpointIndependent, ServesRestrictedClients: true, Snowflakes: 1},
+					{Mapping: nat.AddressAndPortDependent, Filtering: nat.AddressAndPortDependent, Snowflakes: 2},
+				})
+				So(info.PendingClientOffers, ShouldEqual, 0)
+				So(info.Bridges, ShouldHaveLength, 1)
+				So(info.Bridges[0].Fingerprint, ShouldEqual, "2B280B23E1107BB62ABFC40DDCC8824814F80A72")
+				So(info.Bridges[0].Available, ShouldBeTrue)
+				So(info.Bridges[0].Checked, ShouldBeFalse)
+			})
+		}
+	})
+}
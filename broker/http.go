@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 
@@ -74,6 +75,11 @@ func metricsHandler(metricsFilename string, w http.ResponseWriter, r *http.Reque
 }
 
 func debugHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "json" {
+		debugJSONHandler(i, w, r)
+		return
+	}
+
 	var response string
 
 	err := i.Debug(new(interface{}), &response)
@@ -88,6 +94,22 @@ func debugHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func debugJSONHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	var response []byte
+
+	err := i.DebugJSON(new(interface{}), &response)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		log.Printf("writing proxy information returned error: %v ", err)
+	}
+}
+
 /*
 For snowflake proxies to request a client from the Broker.
 */
@@ -124,6 +146,17 @@ func proxyPolls(i *IPC, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// clientRemoteAddr returns the address of the client that sent r, for looking
+// up its country. It is empty, leaving the country unknown, if r came through
+// a trusted CDN or cache that did not say whom it was forwarded for.
+func clientRemoteAddr(i *IPC, r *http.Request) string {
+	ip := i.ctx.trustedRanges.clientIP(r)
+	if ip == nil {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), "0")
+}
+
 /*
 Expects a WebRTC SDP offer in the Request to give to an assigned
 snowflake proxy, which responds with the SDP answer to be sent in
@@ -159,7 +192,7 @@ func clientOffers(i *IPC, w http.ResponseWriter, r *http.Request) {
 
 	arg := messages.Arg{
 		Body:       body,
-		RemoteAddr: "",
+		RemoteAddr: clientRemoteAddr(i, r),
 	}
 
 	var response []byte
@@ -180,7 +213,7 @@ func clientOffers(i *IPC, w http.ResponseWriter, r *http.Request) {
 		switch resp.Error {
 		case "":
 			response = []byte(resp.Answer)
-		case messages.StrNoProxies:
+		case messages.StrNoProxies, messages.StrBridgeUnavailable:
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		case messages.StrTimedOut:
@@ -233,3 +266,73 @@ func proxyAnswers(i *IPC, w http.ResponseWriter, r *http.Request) {
 		log.Printf("proxyAnswers unable to write answer response with error: %v", err)
 	}
 }
+
+/*
+Expects clients that were matched with a proxy to report whether they could
+connect to it.
+*/
+func clientFeedback(i *IPC, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		log.Println("Invalid data.", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	arg := messages.Arg{
+		Body:       body,
+		RemoteAddr: "",
+	}
+
+	var response []byte
+	err = i.ClientFeedback(arg, &response)
+	switch {
+	case err == nil:
+	case errors.Is(err, messages.ErrBadRequest):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(response); err != nil {
+		log.Printf("clientFeedback unable to write response with error: %v", err)
+	}
+}
+
+/*
+Expects clients and proxies that use trickle ICE to send their new ICE
+candidates, and returns those of their peer.
+*/
+func trickleCandidates(i *IPC, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		log.Println("Invalid data.", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	arg := messages.Arg{
+		Body:       body,
+		RemoteAddr: "",
+	}
+
+	var response []byte
+	err = i.Trickle(arg, &response)
+	switch {
+	case err == nil:
+	case errors.Is(err, messages.ErrBadRequest):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(response); err != nil {
+		log.Printf("trickleCandidates unable to write response with error: %v", err)
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"container/heap"
 	"encoding/hex"
 	"fmt"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
@@ -27,50 +27,50 @@ type IPC struct {
 }
 
 func (i *IPC) Debug(_ interface{}, response *string) error {
-	var unknowns int
-	var natRestricted, natUnrestricted, natUnknown int
-	proxyTypes := make(map[string]int)
-
-	i.ctx.snowflakeLock.Lock()
-	s := fmt.Sprintf("current snowflakes available: %d\n", len(i.ctx.idToSnowflake))
-	for _, snowflake := range i.ctx.idToSnowflake {
-		if messages.KnownProxyTypes[snowflake.proxyType] {
-			proxyTypes[snowflake.proxyType]++
-		} else {
-			unknowns++
-		}
+	info := i.debugInfo()
 
-		switch snowflake.natType {
-		case NATRestricted:
-			natRestricted++
-		case NATUnrestricted:
-			natUnrestricted++
-		default:
-			natUnknown++
+	s := fmt.Sprintf("current snowflakes available: %d\n", info.Snowflakes)
+	for pType, num := range info.ProxyTypes {
+		if pType != messages.ProxyUnknown && num > 0 {
+			s += fmt.Sprintf("\t%s proxies: %d\n", pType, num)
 		}
-
-	}
-	i.ctx.snowflakeLock.Unlock()
-
-	for pType, num := range proxyTypes {
-		s += fmt.Sprintf("\t%s proxies: %d\n", pType, num)
 	}
-	s += fmt.Sprintf("\tunknown proxies: %d", unknowns)
+	s += fmt.Sprintf("\tunknown proxies: %d", info.ProxyTypes[messages.ProxyUnknown])
 
 	s += fmt.Sprintf("\nNAT Types available:")
-	s += fmt.Sprintf("\n\trestricted: %d", natRestricted)
-	s += fmt.Sprintf("\n\tunrestricted: %d", natUnrestricted)
-	s += fmt.Sprintf("\n\tunknown: %d", natUnknown)
+	s += fmt.Sprintf("\n\trestricted: %d", info.NATTypes[NATRestricted])
+	s += fmt.Sprintf("\n\tunrestricted: %d", info.NATTypes[NATUnrestricted])
+	s += fmt.Sprintf("\n\tunknown: %d", info.NATTypes[NATUnknown])
+
+	if i.ctx.bridgeHealth != nil {
+		s += fmt.Sprintf("\nBridges:")
+		for _, bridge := range info.Bridges {
+			switch {
+			case !bridge.Checked:
+				s += fmt.Sprintf("\n\t%s %s: not checked yet", bridge.DisplayName, bridge.Fingerprint)
+			case bridge.Available:
+				s += fmt.Sprintf("\n\t%s %s: healthy", bridge.DisplayName, bridge.Fingerprint)
+			default:
+				s += fmt.Sprintf("\n\t%s %s: unhealthy (%s)", bridge.DisplayName, bridge.Fingerprint, bridge.LastError)
+			}
+		}
+	}
 
 	*response = s
 	return nil
 }
 
 func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
-	sid, proxyType, natType, clients, relayPattern, relayPatternSupported, err := messages.DecodeProxyPollRequestWithRelayPrefix(arg.Body)
+	poll, err := messages.DecodeProxyPollRequestMessage(arg.Body)
 	if err != nil {
 		return messages.ErrBadRequest
 	}
+	sid, proxyType, natType := poll.Sid, poll.Type, poll.NAT
+	relayPatternSupported := poll.AcceptedRelayPattern != nil
+	var relayPattern string
+	if relayPatternSupported {
+		relayPattern = *poll.AcceptedRelayPattern
+	}
 
 	if !relayPatternSupported {
 		i.ctx.metrics.lock.Lock()
@@ -100,6 +100,7 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 	}
 
 	// Log geoip stats
+	var country string
 	remoteIP, _, err := net.SplitHostPort(arg.RemoteAddr)
 	if err != nil {
 		log.Println("Error processing proxy IP: ", err.Error())
@@ -108,12 +109,29 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 		i.ctx.metrics.UpdateCountryStats(remoteIP, proxyType, natType)
 		i.ctx.metrics.RecordIPAddress(remoteIP)
 		i.ctx.metrics.lock.Unlock()
+		country = i.ctx.metrics.GetCountryByAddr(remoteIP)
 	}
 
+	identity := i.authenticateProxy(poll)
+	// Proxies that support trickle ICE are only matched with clients that
+	// use it if the broker can relay their candidates.
+	trickle := poll.Trickle && i.ctx.trickle != nil
+
 	var b []byte
 
 	// Wait for a client to avail an offer to the snowflake, or timeout if nil.
-	offer := i.ctx.RequestOffer(sid, proxyType, natType, clients)
+	offer := i.ctx.pool.RequestOffer(ProxyEntry{
+		ID:          sid,
+		Type:        proxyType,
+		NAT:         natType,
+		NATBehavior: poll.NATBehavior,
+		Country:     country,
+		Clients:     poll.Clients,
+		Identity:    identity,
+		Reputation:  i.ctx.reputation.Reputation(identity),
+		Trickle:     trickle,
+		TURN:        poll.TURN,
+	})
 
 	if offer == nil {
 		i.ctx.metrics.lock.Lock()
@@ -141,7 +159,11 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 	} else {
 		relayURL = info.WebSocketAddress
 	}
-	b, err = messages.EncodePollResponseWithRelayURL(string(offer.sdp), true, offer.natType, relayURL, "")
+	if offer.trickleID != "" {
+		b, err = messages.EncodePollResponseWithTrickleID(string(offer.sdp), offer.natType, relayURL, offer.trickleID)
+	} else {
+		b, err = messages.EncodePollResponseWithRelayURL(string(offer.sdp), true, offer.natType, relayURL, "")
+	}
 	if err != nil {
 		return messages.ErrInternal
 	}
@@ -150,6 +172,28 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 	return nil
 }
 
+// Returns the identity of the proxy that sent a poll, or an empty identity
+// if the proxy is anonymous or its identity cannot be trusted, in which case
+// it is treated like an anonymous proxy.
+func (i *IPC) authenticateProxy(poll *messages.ProxyPollRequest) string {
+	identity, timestamp, err := poll.Identity()
+	status := "anonymous"
+	if err != nil {
+		log.Printf("Error verifying proxy identity: %v", err)
+		identity = ""
+		status = "rejected"
+	} else if identity != "" {
+		if i.ctx.reputation.Authenticate(identity, poll.Sid, timestamp) {
+			status = "verified"
+		} else {
+			identity = ""
+			status = "rejected"
+		}
+	}
+	i.ctx.metrics.promMetrics.ProxyPollIdentityTotal.With(prometheus.Labels{"status": status}).Inc()
+	return identity
+}
+
 func sendClientResponse(resp *messages.ClientPollResponse, response *[]byte) error {
 	data, err := resp.EncodePollResponse()
 	if err != nil {
@@ -170,8 +214,15 @@ func (i *IPC) ClientOffers(arg messages.Arg, response *[]byte) error {
 	}
 
 	offer := &ClientOffer{
-		natType: req.NAT,
-		sdp:     []byte(req.Offer),
+		natType:     req.NAT,
+		natBehavior: req.NATBehavior,
+		sdp:         []byte(req.Offer),
+	}
+
+	// The client's address is only used to look up its country for the
+	// matching policy, and is not recorded.
+	if remoteIP, _, err := net.SplitHostPort(arg.RemoteAddr); err == nil {
+		offer.country = i.ctx.metrics.GetCountryByAddr(remoteIP)
 	}
 
 	fingerprint, err := hex.DecodeString(req.Fingerprint)
@@ -188,12 +239,38 @@ func (i *IPC) ClientOffers(arg messages.Arg, response *[]byte) error {
 		return err
 	}
 
+	if !i.ctx.bridgeHealth.IsHealthy(BridgeFingerprint) {
+		i.ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "unavailable"}).Inc()
+		resp := &messages.ClientPollResponse{Error: messages.StrBridgeUnavailable}
+		return sendClientResponse(resp, response)
+	}
+
 	offer.fingerprint = BridgeFingerprint.ToBytes()
 
-	snowflake := i.matchSnowflake(offer.natType)
-	if snowflake != nil {
-		snowflake.offerChannel <- offer
-	} else {
+	// The offer of a client that uses trickle ICE may be missing
+	// candidates, so it can only be handed to a proxy that will get the
+	// rest of them through the broker.
+	if req.Trickle {
+		offer.trickle = true
+		if i.ctx.trickle != nil {
+			offer.trickleID = i.ctx.trickle.Add()
+		}
+	}
+
+	atomic.AddInt64(&i.ctx.pendingClientOffers, 1)
+	defer atomic.AddInt64(&i.ctx.pendingClientOffers, -1)
+
+	snowflake := i.matchSnowflake(offer)
+	if snowflake == nil && offer.trickle {
+		// The client will try again with a complete offer.
+		if offer.trickleID != "" {
+			i.ctx.trickle.Remove(offer.trickleID)
+		}
+		i.ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "trickle_unavailable"}).Inc()
+		resp := &messages.ClientPollResponse{Error: messages.StrTrickleUnavailable}
+		return sendClientResponse(resp, response)
+	}
+	if snowflake == nil {
 		i.ctx.metrics.lock.Lock()
 		i.ctx.metrics.clientDeniedCount++
 		i.ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "denied"}).Inc()
@@ -210,45 +287,39 @@ func (i *IPC) ClientOffers(arg messages.Arg, response *[]byte) error {
 	// Wait for the answer to be returned on the channel or timeout.
 	select {
 	case answer := <-snowflake.answerChannel:
+		i.ctx.reputation.RecordAnswer(snowflake.identity, true)
 		i.ctx.metrics.lock.Lock()
 		i.ctx.metrics.clientProxyMatchCount++
 		i.ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "matched"}).Inc()
 		i.ctx.metrics.lock.Unlock()
-		resp := &messages.ClientPollResponse{Answer: answer}
+		resp := &messages.ClientPollResponse{Answer: answer, Trickle: offer.trickleID}
+		if req.Feedback {
+			resp.MatchID = i.ctx.matches.Add(offer.natType, snowflake.natType, snowflake.identity)
+		}
 		err = sendClientResponse(resp, response)
 		// Initial tracking of elapsed time.
+		i.ctx.metrics.lock.Lock()
 		i.ctx.metrics.clientRoundtripEstimate = time.Since(startTime) / time.Millisecond
+		i.ctx.metrics.lock.Unlock()
 	case <-time.After(time.Second * ClientTimeout):
 		log.Println("Client: Timed out.")
+		i.ctx.reputation.RecordAnswer(snowflake.identity, false)
+		if offer.trickleID != "" {
+			i.ctx.trickle.Remove(offer.trickleID)
+		}
 		resp := &messages.ClientPollResponse{Error: messages.StrTimedOut}
 		err = sendClientResponse(resp, response)
 	}
 
-	i.ctx.snowflakeLock.Lock()
-	i.ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
-	delete(i.ctx.idToSnowflake, snowflake.id)
-	i.ctx.snowflakeLock.Unlock()
+	i.ctx.pool.ReleaseSnowflake(snowflake)
 
 	return err
 }
 
-func (i *IPC) matchSnowflake(natType string) *Snowflake {
-	// Only hand out known restricted snowflakes to unrestricted clients
-	var snowflakeHeap *SnowflakeHeap
-	if natType == NATUnrestricted {
-		snowflakeHeap = i.ctx.restrictedSnowflakes
-	} else {
-		snowflakeHeap = i.ctx.snowflakes
-	}
-
-	i.ctx.snowflakeLock.Lock()
-	defer i.ctx.snowflakeLock.Unlock()
-
-	if snowflakeHeap.Len() > 0 {
-		return heap.Pop(snowflakeHeap).(*Snowflake)
-	} else {
-		return nil
-	}
+// Hands the client offer to a proxy from the pool, returning nil if no
+// suitable proxy is available.
+func (i *IPC) matchSnowflake(offer *ClientOffer) *Snowflake {
+	return i.ctx.pool.MatchSnowflake(offer)
 }
 
 func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
@@ -257,15 +328,7 @@ func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
 		return messages.ErrBadRequest
 	}
 
-	var success = true
-	i.ctx.snowflakeLock.Lock()
-	snowflake, ok := i.ctx.idToSnowflake[id]
-	i.ctx.snowflakeLock.Unlock()
-	if !ok || snowflake == nil {
-		// The snowflake took too long to respond with an answer, so its client
-		// disappeared / the snowflake is no longer recognized by the Broker.
-		success = false
-	}
+	success := i.ctx.pool.SendAnswer(id, answer)
 
 	b, err := messages.EncodeAnswerResponse(success)
 	if err != nil {
@@ -274,9 +337,46 @@ func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
 	}
 	*response = b
 
-	if success {
-		snowflake.answerChannel <- answer
+	return nil
+}
+
+func (i *IPC) ClientFeedback(arg messages.Arg, response *[]byte) error {
+	feedback, err := messages.DecodeClientMatchFeedback(arg.Body)
+	if err != nil {
+		return messages.ErrBadRequest
 	}
 
+	// Feedback for unknown matches is ignored, without telling the client.
+	identity, ok := i.ctx.matches.Report(feedback.MatchID, feedback.Outcome)
+	if ok && feedback.Outcome == messages.MatchOutcomeFailed && i.ctx.feedbackReputation {
+		i.ctx.reputation.RecordClientFailure(identity)
+	}
+
+	b, err := (&messages.ClientMatchFeedbackResponse{}).EncodeClientMatchFeedbackResponse()
+	if err != nil {
+		return messages.ErrInternal
+	}
+	*response = b
+	return nil
+}
+
+func (i *IPC) Trickle(arg messages.Arg, response *[]byte) error {
+	req, err := messages.DecodeTrickleRequest(arg.Body)
+	if err != nil {
+		return messages.ErrBadRequest
+	}
+
+	resp := &messages.TrickleResponse{Error: messages.StrUnknownTrickleID}
+	if i.ctx.trickle != nil {
+		if candidates, done, ok := i.ctx.trickle.Exchange(req); ok {
+			resp = &messages.TrickleResponse{Candidates: candidates, Done: done}
+		}
+	}
+
+	b, err := resp.EncodeTrickleResponse()
+	if err != nil {
+		return messages.ErrInternal
+	}
+	*response = b
 	return nil
 }
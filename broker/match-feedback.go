@@ -0,0 +1,101 @@
+/*
+Keeping track of the matches made by the broker until clients report whether
+they could connect to their proxy.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// How long the broker waits for a client to report the outcome of a
+	// match. Clients give up on a proxy after DataChannelTimeout, 10
+	// seconds, which this leaves ample room for.
+	matchFeedbackTimeout = time.Minute
+	// The outcome recorded for matches that the client did not report.
+	matchOutcomeUnreported = "unreported"
+)
+
+// match is a client matched with a proxy, awaiting feedback.
+type match struct {
+	clientNAT string
+	proxyNAT  string
+	// The identity of the proxy, empty if it is anonymous
+	identity string
+	expires  time.Time
+}
+
+// MatchTracker hands out opaque ids for matches and records the outcomes
+// that clients report for them, by the NAT types of the client and the
+// proxy. Each outcome may be reported once.
+type MatchTracker struct {
+	metrics *Metrics
+
+	lock    sync.Mutex
+	matches map[string]*match
+	now     func() time.Time
+}
+
+func NewMatchTracker(metrics *Metrics) *MatchTracker {
+	return &MatchTracker{
+		metrics: metrics,
+		matches: make(map[string]*match),
+		now:     time.Now,
+	}
+}
+
+// Add records a match and returns its id.
+func (t *MatchTracker) Add(clientNAT, proxyNAT, identity string) string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(buf[:])
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	for oldID, m := range t.matches {
+		if now.After(m.expires) {
+			t.record(m, matchOutcomeUnreported)
+			delete(t.matches, oldID)
+		}
+	}
+	t.matches[id] = &match{
+		clientNAT: clientNAT,
+		proxyNAT:  proxyNAT,
+		identity:  identity,
+		expires:   now.Add(matchFeedbackTimeout),
+	}
+	return id
+}
+
+// Report records the outcome of the match with the given id, and returns
+// the identity of its proxy. It returns false if the id is unknown, has
+// expired or has already been reported.
+func (t *MatchTracker) Report(id, outcome string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m, ok := t.matches[id]
+	if !ok || t.now().After(m.expires) {
+		return "", false
+	}
+	delete(t.matches, id)
+	t.record(m, outcome)
+	return m.identity, true
+}
+
+func (t *MatchTracker) record(m *match, outcome string) {
+	t.metrics.promMetrics.ClientMatchOutcomeTotal.With(prometheus.Labels{
+		"client_nat": m.clientNAT,
+		"proxy_nat":  m.proxyNAT,
+		"outcome":    outcome,
+	}).Inc()
+}
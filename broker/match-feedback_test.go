@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/amp"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMatchFeedback(t *testing.T) {
+	Convey("Match feedback", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		i := &IPC{ctx}
+		now := time.Unix(1000000, 0)
+		ctx.matches.now = func() time.Time { return now }
+		ctx.reputation.now = func() time.Time { return now }
+		outcomes := func(clientNAT, proxyNAT, outcome string) float64 {
+			var m dto.Metric
+			So(ctx.metrics.promMetrics.ClientMatchOutcomeTotal.With(prometheus.Labels{
+				"client_nat": clientNAT,
+				"proxy_nat":  proxyNAT,
+				"outcome":    outcome,
+			}).Write(&m), ShouldBeNil)
+			return m.GetCounter().GetValue()
+		}
+		send := func(matchID, outcome string) *httptest.ResponseRecorder {
+			body, err := (&messages.ClientMatchFeedback{MatchID: matchID, Outcome: outcome}).EncodeClientMatchFeedback()
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "snowflake.broker/feedback", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			clientFeedback(i, w, r)
+			return w
+		}
+
+		Convey("is counted by NAT types and outcome", func() {
+			failed := ctx.matches.Add(NATRestricted, NATUnrestricted, "")
+			connected := ctx.matches.Add(NATUnrestricted, NATRestricted, "")
+			So(failed, ShouldNotEqual, connected)
+
+			w := send(failed, messages.MatchOutcomeFailed)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, `{}`)
+			So(send(connected, messages.MatchOutcomeConnected).Code, ShouldEqual, http.StatusOK)
+			// Rounded up to a multiple of 8
+			So(outcomes(NATRestricted, NATUnrestricted, messages.MatchOutcomeFailed), ShouldEqual, 8)
+			So(outcomes(NATUnrestricted, NATRestricted, messages.MatchOutcomeConnected), ShouldEqual, 8)
+		})
+
+		Convey("is accepted once per match", func() {
+			id := ctx.matches.Add(NATRestricted, NATUnrestricted, "")
+			_, ok := ctx.matches.Report(id, messages.MatchOutcomeFailed)
+			So(ok, ShouldBeTrue)
+			_, ok = ctx.matches.Report(id, messages.MatchOutcomeConnected)
+			So(ok, ShouldBeFalse)
+			_, ok = ctx.matches.Report("unknown", messages.MatchOutcomeConnected)
+			So(ok, ShouldBeFalse)
+			// Unknown matches are ignored without telling the client.
+			So(send("unknown", messages.MatchOutcomeConnected).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("that does not come in time is counted as unreported", func() {
+			id := ctx.matches.Add(NATRestricted, NATUnrestricted, "")
+			now = now.Add(matchFeedbackTimeout + time.Second)
+			_, ok := ctx.matches.Report(id, messages.MatchOutcomeFailed)
+			So(ok, ShouldBeFalse)
+			ctx.matches.Add(NATRestricted, NATUnrestricted, "")
+			So(len(ctx.matches.matches), ShouldEqual, 1)
+			So(outcomes(NATRestricted, NATUnrestricted, matchOutcomeUnreported), ShouldEqual, 8)
+		})
+
+		Convey("counts against the reputation of proxies only if enabled", func() {
+			So(ctx.reputation.Authenticate("proxy", "sid", now), ShouldBeTrue)
+			ctx.reputation.RecordAnswer("proxy", true)
+			reputation := ctx.reputation.Reputation("proxy")
+
+			send(ctx.matches.Add(NATRestricted, NATUnrestricted, "proxy"), messages.MatchOutcomeFailed)
+			So(ctx.reputation.Reputation("proxy"), ShouldEqual, reputation)
+
+			ctx.feedbackReputation = true
+			send(ctx.matches.Add(NATRestricted, NATUnrestricted, "proxy"), messages.MatchOutcomeConnected)
+			So(ctx.reputation.Reputation("proxy"), ShouldEqual, reputation)
+			send(ctx.matches.Add(NATRestricted, NATUnrestricted, "proxy"), messages.MatchOutcomeFailed)
+			So(ctx.reputation.Reputation("proxy"), ShouldBeLessThan, reputation)
+		})
+
+		Convey("is requested by clients that want to give it", func() {
+			offer := func(body string) *messages.ClientPollResponse {
+				r, err := http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(body)))
+				So(err, ShouldBeNil)
+				w := httptest.NewRecorder()
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted, 0)
+				go func() {
+					clientOffers(i, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- "fake answer"
+				<-done
+				So(w.Code, ShouldEqual, http.StatusOK)
+				resp, err := messages.DecodeClientPollResponse(w.Body.Bytes())
+				So(err, ShouldBeNil)
+				return resp
+			}
+
+			resp := offer("1.0\n{\"offer\": \"fake\", \"nat\": \"restricted\", \"feedback\": true}")
+			So(resp.Answer, ShouldEqual, "fake answer")
+			So(resp.MatchID, ShouldNotEqual, "")
+			So(send(resp.MatchID, messages.MatchOutcomeConnected).Code, ShouldEqual, http.StatusOK)
+			So(outcomes(NATRestricted, NATUnrestricted, messages.MatchOutcomeConnected), ShouldEqual, 8)
+
+			resp = offer("1.0\n{\"offer\": \"fake\", \"nat\": \"restricted\"}")
+			So(resp.Answer, ShouldEqual, "fake answer")
+			So(resp.MatchID, ShouldEqual, "")
+		})
+
+		Convey("rejects malformed messages", func() {
+			r, err := http.NewRequest("POST", "snowflake.broker/feedback", bytes.NewReader([]byte("1.0\n{}")))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			clientFeedback(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("is accepted through the AMP cache", func() {
+			id := ctx.matches.Add(NATRestricted, NATUnrestricted, "")
+			body, err := (&messages.ClientMatchFeedback{MatchID: id, Outcome: messages.MatchOutcomeFailed}).EncodeClientMatchFeedback()
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("GET", "/amp/feedback/"+amp.EncodePath(body), nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			ampClientFeedback(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			response, err := decodeAMPArmorToString(w.Body)
+			So(err, ShouldBeNil)
+			So(response, ShouldEqual, `{}`)
+			_, ok := ctx.matches.Report(id, messages.MatchOutcomeFailed)
+			So(ok, ShouldBeFalse)
+
+			r, err = http.NewRequest("GET", "/amp/feedback/bogus", nil)
+			So(err, ShouldBeNil)
+			w = httptest.NewRecorder()
+			ampClientFeedback(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			response, err = decodeAMPArmorToString(w.Body)
+			So(err, ShouldBeNil)
+			So(response, ShouldEqual, `{"error":"cannot decode match feedback"}`)
+		})
+	})
+}
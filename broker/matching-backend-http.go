@@ -0,0 +1,276 @@
+/*
+Sharing a MatchingBackend between broker instances over HTTP.
+
+One process serves a memory backend with MatchingBackendHandler, and every
+broker instance connects to it with NewHTTPMatchingBackend. The requests carry
+client offers, which contain client addresses, and proxy answers, so when the
+handler has a secret, it only serves requests that carry the same secret as a
+bearer token in the Authorization header. The secret is in the clear unless
+the backend is behind HTTPS, so without TLS it should only cross networks that
+the operator trusts.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// The longest time a single request to the matching backend may block.
+	maxMatchingBackendTimeout = 2 * time.Second * ClientTimeout
+	// Extra time allowed for a blocking request to make its way to the
+	// matching backend and back.
+	matchingBackendRequestSlack = 10 * time.Second
+	// The prefix of the Authorization header that carries the secret.
+	matchingBackendAuthScheme = "Bearer "
+)
+
+type waitForOfferRequest struct {
+	Proxy   ProxyEntry
+	Timeout time.Duration
+}
+
+type waitForOfferResponse struct {
+	Offer []byte
+}
+
+type assignOfferRequest struct {
+	Client ClientEntry
+	Offer  []byte
+}
+
+type assignOfferResponse struct {
+	Proxy *ProxyEntry
+}
+
+type waitForAnswerRequest struct {
+	ID      string
+	Timeout time.Duration
+}
+
+type waitForAnswerResponse struct {
+	Answer []byte
+}
+
+type sendAnswerRequest struct {
+	ID     string
+	Answer []byte
+}
+
+type sendAnswerResponse struct {
+	OK bool
+}
+
+// Implements the http.Handler interface, serving a MatchingBackend to
+// httpMatchingBackend clients. If Secret is not empty, requests without it
+// are refused.
+type MatchingBackendHandler struct {
+	Backend MatchingBackend
+	Secret  string
+}
+
+func (h MatchingBackendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var response interface{}
+	var err error
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "wait-for-offer":
+		var req waitForOfferRequest
+		if err = decodeMatchingRequest(w, r, &req); err != nil {
+			break
+		}
+		var offer []byte
+		offer, err = h.Backend.WaitForOffer(req.Proxy, clampMatchingTimeout(req.Timeout))
+		response = waitForOfferResponse{Offer: offer}
+	case "assign-offer":
+		var req assignOfferRequest
+		if err = decodeMatchingRequest(w, r, &req); err != nil {
+			break
+		}
+		var proxy *ProxyEntry
+		proxy, err = h.Backend.AssignOffer(req.Client, req.Offer)
+		response = assignOfferResponse{Proxy: proxy}
+	case "wait-for-answer":
+		var req waitForAnswerRequest
+		if err = decodeMatchingRequest(w, r, &req); err != nil {
+			break
+		}
+		var answer []byte
+		answer, err = h.Backend.WaitForAnswer(req.ID, clampMatchingTimeout(req.Timeout))
+		response = waitForAnswerResponse{Answer: answer}
+	case "send-answer":
+		var req sendAnswerRequest
+		if err = decodeMatchingRequest(w, r, &req); err != nil {
+			break
+		}
+		var ok bool
+		ok, err = h.Backend.SendAnswer(req.ID, req.Answer)
+		response = sendAnswerResponse{OK: ok}
+	case "proxies":
+		response, err = h.Backend.ListProxies()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("MatchingBackendHandler unable to write response with error: %v", err)
+	}
+}
+
+// authorized reports whether r carries the secret of the handler, if it has
+// one.
+func (h MatchingBackendHandler) authorized(r *http.Request) bool {
+	if h.Secret == "" {
+		return true
+	}
+	expected := []byte(matchingBackendAuthScheme + h.Secret)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// readMatchingBackendSecret returns the secret in the file at path, without
+// surrounding whitespace.
+func readMatchingBackendSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s contains no secret", path)
+	}
+	return secret, nil
+}
+
+// isLoopbackAddr reports whether the host:port address addr can only be
+// reached from the local host, which is the only place where the matching
+// backend may be served without a secret.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func decodeMatchingRequest(w http.ResponseWriter, r *http.Request, req interface{}) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, req)
+}
+
+func clampMatchingTimeout(timeout time.Duration) time.Duration {
+	if timeout < 0 {
+		return 0
+	}
+	if timeout > maxMatchingBackendTimeout {
+		return maxMatchingBackendTimeout
+	}
+	return timeout
+}
+
+// httpMatchingBackend implements MatchingBackend by forwarding each call to
+// a MatchingBackendHandler.
+type httpMatchingBackend struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Returns a MatchingBackend that uses the MatchingBackendHandler served at
+// url, authenticating with secret if it is not empty. If client is nil,
+// http.DefaultClient is used.
+func NewHTTPMatchingBackend(url string, secret string, client *http.Client) MatchingBackend {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpMatchingBackend{url: strings.TrimSuffix(url, "/"), secret: secret, client: client}
+}
+
+func (b *httpMatchingBackend) call(method string, path string, timeout time.Duration, req interface{}, resp interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+matchingBackendRequestSlack)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, b.url+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if b.secret != "" {
+		request.Header.Set("Authorization", matchingBackendAuthScheme+b.secret)
+	}
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("matching backend returned status %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(resp)
+}
+
+func (b *httpMatchingBackend) WaitForOffer(proxy ProxyEntry, timeout time.Duration) ([]byte, error) {
+	var resp waitForOfferResponse
+	err := b.call("POST", "wait-for-offer", timeout, waitForOfferRequest{Proxy: proxy, Timeout: timeout}, &resp)
+	return resp.Offer, err
+}
+
+func (b *httpMatchingBackend) AssignOffer(client ClientEntry, offer []byte) (*ProxyEntry, error) {
+	var resp assignOfferResponse
+	err := b.call("POST", "assign-offer", 0, assignOfferRequest{Client: client, Offer: offer}, &resp)
+	return resp.Proxy, err
+}
+
+func (b *httpMatchingBackend) WaitForAnswer(id string, timeout time.Duration) ([]byte, error) {
+	var resp waitForAnswerResponse
+	err := b.call("POST", "wait-for-answer", timeout, waitForAnswerRequest{ID: id, Timeout: timeout}, &resp)
+	return resp.Answer, err
+}
+
+func (b *httpMatchingBackend) SendAnswer(id string, answer []byte) (bool, error) {
+	var resp sendAnswerResponse
+	err := b.call("POST", "send-answer", 0, sendAnswerRequest{ID: id, Answer: answer}, &resp)
+	return resp.OK, err
+}
+
+func (b *httpMatchingBackend) ListProxies() ([]ProxyEntry, error) {
+	var proxies []ProxyEntry
+	err := b.call("GET", "proxies", 0, nil, &proxies)
+	return proxies, err
+}
@@ -0,0 +1,226 @@
+/*
+The state behind a shared snowflake pool.
+
+A MatchingBackend keeps track of the proxies that are waiting for a client,
+hands client offers to them, and passes proxy answers back. Several broker
+instances using the same backend can match a client polling one of them with
+a proxy polling another.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+)
+
+// ProxyEntry describes a proxy that is polling for a client.
+type ProxyEntry struct {
+	ID      string
+	Type    string
+	NAT     string
+	Country string
+	Clients int
+	// The public key of the proxy, empty if it is anonymous, and its
+	// reputation when it polled
+	Identity   string
+	Reputation float64
+	// Whether the proxy supports trickle ICE
+	Trickle bool
+	// Whether the proxy gathers relay candidates from a TURN server
+	TURN bool
+	// The classification of the proxy's NAT, if it reported one
+	NATBehavior *nat.Behavior
+}
+
+// load orders proxies for matching, as in proxyLoad. Proxies without an
+// identity are neutral, whatever their Reputation.
+func (p ProxyEntry) load() float64 {
+	if p.Identity == "" {
+		return proxyLoad(p.Clients, NeutralReputation)
+	}
+	return proxyLoad(p.Clients, p.Reputation)
+}
+
+type MatchingBackend interface {
+	// WaitForOffer registers a proxy and blocks until a client offer is
+	// assigned to it. If the timeout expires first, the proxy is withdrawn
+	// and a nil offer is returned.
+	WaitForOffer(proxy ProxyEntry, timeout time.Duration) ([]byte, error)
+	// AssignOffer hands the client's offer to the most suitable proxy, and
+	// returns that proxy. It returns nil if no proxy is available.
+	AssignOffer(client ClientEntry, offer []byte) (*ProxyEntry, error)
+	// WaitForAnswer blocks until the proxy with the given id, which was
+	// returned by AssignOffer, sends its answer. It returns a nil answer on
+	// timeout. Once it returns, further answers from the proxy are refused.
+	WaitForAnswer(id string, timeout time.Duration) ([]byte, error)
+	// SendAnswer passes the answer of a proxy to the client waiting for it.
+	// It returns false if no client is waiting.
+	SendAnswer(id string, answer []byte) (bool, error)
+	// ListProxies returns the proxies currently waiting for a client.
+	ListProxies() ([]ProxyEntry, error)
+}
+
+// How long an assigned proxy's answer is accepted if nobody calls
+// WaitForAnswer, for example because the client's broker went away.
+const answerSlotTimeout = 2 * time.Second * ClientTimeout
+
+type waitingProxy struct {
+	entry ProxyEntry
+	// The proxy in the heaps of memoryMatchingBackend
+	snowflake *Snowflake
+	offer     chan []byte
+}
+
+type answerSlot struct {
+	answer  chan []byte
+	expires time.Time
+}
+
+// memoryMatchingBackend implements MatchingBackend in memory. It is served
+// to other brokers by MatchingBackendHandler, and can stand in for a shared
+// backend in tests.
+type memoryMatchingBackend struct {
+	lock       sync.Mutex
+	proxies    map[string]*waitingProxy
+	snowflakes *SnowflakeHeaps
+	answers    map[string]*answerSlot
+	policy     *MatchingPolicyHolder
+}
+
+// Returns a MatchingBackend that matches proxies according to the policy
+// in policyHolder, which may be nil.
+func NewMemoryMatchingBackend(policyHolder *MatchingPolicyHolder) MatchingBackend {
+	return &memoryMatchingBackend{
+		proxies:    make(map[string]*waitingProxy),
+		snowflakes: NewSnowflakeHeaps(),
+		answers:    make(map[string]*answerSlot),
+		policy:     policyHolder,
+	}
+}
+
+func (b *memoryMatchingBackend) WaitForOffer(proxy ProxyEntry, timeout time.Duration) ([]byte, error) {
+	// A proxy that polls again with the same id replaces its earlier
+	// registration.
+	p := &waitingProxy{entry: proxy, snowflake: snowflakeOf(proxy), offer: make(chan []byte, 1)}
+	b.lock.Lock()
+	if old := b.proxies[proxy.ID]; old != nil {
+		b.snowflakes.Remove(old.snowflake)
+	}
+	b.proxies[proxy.ID] = p
+	b.snowflakes.Push(p.snowflake)
+	b.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case offer := <-p.offer:
+		return offer, nil
+	case <-timer.C:
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.proxies[proxy.ID] == p {
+		delete(b.proxies, proxy.ID)
+		b.snowflakes.Remove(p.snowflake)
+		return nil, nil
+	}
+	// An offer may have been assigned just as the timer expired.
+	select {
+	case offer := <-p.offer:
+		return offer, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (b *memoryMatchingBackend) AssignOffer(client ClientEntry, offer []byte) (*ProxyEntry, error) {
+	policy := b.policy.Get()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	snowflake := b.snowflakes.Select(client, policy)
+	if snowflake == nil {
+		return nil, nil
+	}
+	match := b.proxies[snowflake.id]
+	delete(b.proxies, match.entry.ID)
+	match.offer <- offer
+
+	now := time.Now()
+	for id, slot := range b.answers {
+		if now.After(slot.expires) {
+			delete(b.answers, id)
+		}
+	}
+	b.answers[match.entry.ID] = &answerSlot{
+		answer:  make(chan []byte, 1),
+		expires: now.Add(answerSlotTimeout),
+	}
+
+	entry := match.entry
+	return &entry, nil
+}
+
+func (b *memoryMatchingBackend) WaitForAnswer(id string, timeout time.Duration) ([]byte, error) {
+	b.lock.Lock()
+	slot := b.answers[id]
+	b.lock.Unlock()
+	if slot == nil {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var answer []byte
+	select {
+	case answer = <-slot.answer:
+	case <-timer.C:
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.answers[id] == slot {
+		delete(b.answers, id)
+	}
+	if answer == nil {
+		// An answer may have been sent just as the timer expired.
+		select {
+		case answer = <-slot.answer:
+		default:
+		}
+	}
+	return answer, nil
+}
+
+func (b *memoryMatchingBackend) SendAnswer(id string, answer []byte) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	slot := b.answers[id]
+	if slot == nil || time.Now().After(slot.expires) {
+		return false, nil
+	}
+	// The slot is kept until WaitForAnswer picks up the answer, which may
+	// not have started waiting yet.
+	select {
+	case slot.answer <- answer:
+		return true, nil
+	default:
+		// The proxy already answered.
+		return false, nil
+	}
+}
+
+func (b *memoryMatchingBackend) ListProxies() ([]ProxyEntry, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	proxies := make([]ProxyEntry, 0, len(b.proxies))
+	for _, p := range b.proxies {
+		proxies = append(proxies, p.entry)
+	}
+	return proxies, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryMatchingBackend(t *testing.T) {
+	Convey("Memory matching backend", t, func() {
+		backend := NewMemoryMatchingBackend(nil)
+
+		Convey("times out when no client offer arrives", func() {
+			offer, err := backend.WaitForOffer(ProxyEntry{ID: "proxy", NAT: NATUnrestricted}, 10*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(offer, ShouldBeNil)
+			proxies, err := backend.ListProxies()
+			So(err, ShouldBeNil)
+			So(proxies, ShouldBeEmpty)
+		})
+
+		Convey("only hands restricted proxies to unrestricted clients", func() {
+			offers := make(chan []byte)
+			go func() {
+				offer, _ := backend.WaitForOffer(ProxyEntry{ID: "restricted", NAT: NATRestricted}, time.Second)
+				offers <- offer
+			}()
+			for {
+				proxies, _ := backend.ListProxies()
+				if len(proxies) == 1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			proxy, err := backend.AssignOffer(ClientEntry{NAT: NATRestricted}, []byte("offer"))
+			So(err, ShouldBeNil)
+			So(proxy, ShouldBeNil)
+
+			proxy, err = backend.AssignOffer(ClientEntry{NAT: NATUnrestricted}, []byte("offer"))
+			So(err, ShouldBeNil)
+			So(proxy, ShouldNotBeNil)
+			So(proxy.ID, ShouldEqual, "restricted")
+			So(<-offers, ShouldResemble, []byte("offer"))
+		})
+
+		Convey("hands restricted proxies with a TURN server to restricted clients", func() {
+			offers := make(chan []byte)
+			go func() {
+				offer, _ := backend.WaitForOffer(ProxyEntry{ID: "turn", NAT: NATRestricted, TURN: true}, time.Second)
+				offers <- offer
+			}()
+			for {
+				proxies, _ := backend.ListProxies()
+				if len(proxies) == 1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			proxy, err := backend.AssignOffer(ClientEntry{NAT: NATUnrestricted}, []byte("offer"))
+			So(err, ShouldBeNil)
+			So(proxy, ShouldBeNil)
+
+			proxy, err = backend.AssignOffer(ClientEntry{NAT: NATRestricted}, []byte("offer"))
+			So(err, ShouldBeNil)
+			So(proxy, ShouldNotBeNil)
+			So(proxy.ID, ShouldEqual, "turn")
+			So(proxy.TURN, ShouldBeTrue)
+			So(<-offers, ShouldResemble, []byte("offer"))
+		})
+
+		Convey("refuses answers once the client stopped waiting", func() {
+			ok, err := backend.SendAnswer("proxy", []byte("answer"))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestSharedSnowflakePool(t *testing.T) {
+	Convey("Brokers sharing a matching backend", t, func() {
+		server := httptest.NewServer(MatchingBackendHandler{Backend: NewMemoryMatchingBackend(nil), Secret: "secret"})
+		defer server.Close()
+
+		ctxA := NewBrokerContext(NullLogger())
+		ctxA.SetSnowflakePool(NewSharedSnowflakePool(NewHTTPMatchingBackend(server.URL, "secret", nil), ctxA.metrics))
+		ctxB := NewBrokerContext(NullLogger())
+		ctxB.SetSnowflakePool(NewSharedSnowflakePool(NewHTTPMatchingBackend(server.URL, "secret", nil), ctxB.metrics))
+		brokerA := &IPC{ctxA}
+		brokerB := &IPC{ctxB}
+
+		Convey("match a client on one broker with a proxy on another", func() {
+			// The proxy polls broker B...
+			proxyDone := make(chan bool)
+			wP := httptest.NewRecorder()
+			rP, err := http.NewRequest("POST", "snowflake.broker/proxy",
+				bytes.NewReader([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","NAT":"unrestricted","NATBehavior":{"mapping":"endpoint-independent","filtering":"endpoint-independent"}}`)))
+			So(err, ShouldBeNil)
+			go func() {
+				proxyPolls(brokerB, wP, rP)
+				proxyDone <- true
+			}()
+			var snowflakes []*Snowflake
+			for len(snowflakes) == 0 {
+				time.Sleep(time.Millisecond)
+				snowflakes = ctxA.pool.Snowflakes()
+			}
+			So(snowflakes[0].natBehavior, ShouldResemble, &nat.Behavior{Mapping: nat.EndpointIndependent, Filtering: nat.EndpointIndependent})
+
+			// ...while the client polls broker A.
+			clientDone := make(chan bool)
+			wC := httptest.NewRecorder()
+			rC, err := http.NewRequest("POST", "snowflake.broker/client",
+				bytes.NewReader([]byte("1.0\n{\"offer\": \"fake\", \"nat\": \"unknown\"}")))
+			So(err, ShouldBeNil)
+			go func() {
+				clientOffers(brokerA, wC, rC)
+				clientDone <- true
+			}()
+
+			<-proxyDone
+			So(wP.Code, ShouldEqual, http.StatusOK)
+			So(wP.Body.String(), ShouldEqual, `{"Status":"client match","Offer":"fake","NAT":"unknown","RelayURL":"wss://snowflake.torproject.net/"}`)
+
+			// The answer may reach either broker.
+			wA := httptest.NewRecorder()
+			rA, err := http.NewRequest("POST", "snowflake.broker/answer",
+				bytes.NewReader([]byte(`{"Version":"1.0","Sid":"ymbcCMto7KHNGYlp","Answer":"test"}`)))
+			So(err, ShouldBeNil)
+			proxyAnswers(brokerB, wA, rA)
+			So(wA.Code, ShouldEqual, http.StatusOK)
+			So(wA.Body.String(), ShouldEqual, `{"Status":"success"}`)
+
+			<-clientDone
+			So(wC.Code, ShouldEqual, http.StatusOK)
+			So(wC.Body.String(), ShouldEqual, `{"answer":"test"}`)
+		})
+
+		Convey("deny clients when no proxy polls any broker", func() {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/client",
+				bytes.NewReader([]byte("1.0\n{\"offer\": \"fake\", \"nat\": \"unknown\"}")))
+			So(err, ShouldBeNil)
+			clientOffers(brokerA, w, r)
+			So(w.Body.String(), ShouldEqual, `{"error":"no snowflake proxies currently available"}`)
+		})
+
+		Convey("refuse requests without the secret", func() {
+			for _, secret := range []string{"", "wrong"} {
+				_, err := NewHTTPMatchingBackend(server.URL, secret, nil).ListProxies()
+				So(err, ShouldNotBeNil)
+			}
+			resp, err := http.Get(server.URL + "/proxies")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+
+	Convey("Matching backend addresses without a secret", t, func() {
+		for _, addr := range []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080"} {
+			So(isLoopbackAddr(addr), ShouldBeTrue)
+		}
+		for _, addr := range []string{":8080", "0.0.0.0:8080", "192.0.2.1:8080", "example.com:8080", "127.0.0.1"} {
+			So(isLoopbackAddr(addr), ShouldBeFalse)
+		}
+	})
+}
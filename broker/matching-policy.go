@@ -0,0 +1,214 @@
+/* (*MatchingPolicyHolder).LoadFile loads a proxy matching policy file,
+   its format is as follows:
+
+   The file contains a single JSON object with a list of rules:
+   {"rules": [
+     {"name":"prefer-foreign-proxies", "sameCountry":true, "penalty":10},
+     {"name":"reserve-webext", "proxyTypes":["webext"], "exceptClientCountries":["CN","IR","RU","TM"], "deny":true}
+   ]}
+
+   Each rule applies to a pair of a client and a candidate proxy if all of
+   its conditions hold. Conditions that are absent always hold.
+
+   clientCountries:[]string holds if the client's country is in the list.
+   exceptClientCountries:[]string holds if the client's country is not in the list.
+   fingerprints:[]string holds if the client asked for one of these bridges.
+   proxyTypes:[]string holds if the proxy is of one of these types.
+   proxyCountries:[]string holds if the proxy's country is in the list.
+   sameCountry:bool holds if the client and proxy are (or are not) known to
+   be in the same country.
+
+   Countries are two-letter codes from the broker's GeoIP database. Clients
+   and proxies whose country is unknown have the country code "??".
+
+   deny:bool prevents the proxy from being matched with the client.
+   penalty:int makes the proxy less preferred for the client. The penalties
+   of all applying rules are added up, and among the proxies that are not
+   denied, the one with the lowest total penalty is matched, and then the
+   one serving the fewest clients.
+
+   The existence of ANY other fields is NOT permitted.
+
+   If the file is invalid, an error is returned and the previous policy is
+   kept.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+)
+
+// The country code of clients and proxies whose country is not known
+const unknownCountry = "??"
+
+// ClientEntry describes a client that is looking for a proxy.
+type ClientEntry struct {
+	NAT         string
+	NATBehavior *nat.Behavior
+	Country     string
+	Fingerprint string
+	// Whether the client uses trickle ICE, and can only be matched with
+	// proxies that support it
+	Trickle bool
+}
+
+type MatchingRule struct {
+	Name                  string   `json:"name"`
+	ClientCountries       []string `json:"clientCountries"`
+	ExceptClientCountries []string `json:"exceptClientCountries"`
+	Fingerprints          []string `json:"fingerprints"`
+	ProxyTypes            []string `json:"proxyTypes"`
+	ProxyCountries        []string `json:"proxyCountries"`
+	SameCountry           *bool    `json:"sameCountry"`
+
+	Deny    bool `json:"deny"`
+	Penalty int  `json:"penalty"`
+}
+
+type MatchingPolicy struct {
+	Rules []MatchingRule `json:"rules"`
+}
+
+func ParseMatchingPolicy(reader io.Reader) (*MatchingPolicy, error) {
+	var policy MatchingPolicy
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		for _, countries := range [][]string{rule.ClientCountries, rule.ExceptClientCountries, rule.ProxyCountries} {
+			for j, cc := range countries {
+				if len(cc) != 2 {
+					return nil, fmt.Errorf("rule %q: invalid country code %q", rule.Name, cc)
+				}
+				countries[j] = strings.ToUpper(cc)
+			}
+		}
+		for j, fingerprint := range rule.Fingerprints {
+			if _, err := bridgefingerprint.FingerprintFromHexString(fingerprint); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+			rule.Fingerprints[j] = strings.ToUpper(fingerprint)
+		}
+		if rule.Penalty < 0 {
+			return nil, fmt.Errorf("rule %q: negative penalty", rule.Name)
+		}
+	}
+	return &policy, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *MatchingRule) applies(client ClientEntry, proxy ProxyEntry) bool {
+	clientCountry := client.Country
+	if clientCountry == "" {
+		clientCountry = unknownCountry
+	}
+	proxyCountry := proxy.Country
+	if proxyCountry == "" {
+		proxyCountry = unknownCountry
+	}
+
+	if rule.ClientCountries != nil && !containsString(rule.ClientCountries, clientCountry) {
+		return false
+	}
+	if containsString(rule.ExceptClientCountries, clientCountry) {
+		return false
+	}
+	if rule.Fingerprints != nil && !containsString(rule.Fingerprints, strings.ToUpper(client.Fingerprint)) {
+		return false
+	}
+	if rule.ProxyTypes != nil && !containsString(rule.ProxyTypes, proxy.Type) {
+		return false
+	}
+	if rule.ProxyCountries != nil && !containsString(rule.ProxyCountries, proxyCountry) {
+		return false
+	}
+	if rule.SameCountry != nil {
+		same := clientCountry != unknownCountry && clientCountry == proxyCountry
+		if same != *rule.SameCountry {
+			return false
+		}
+	}
+	return true
+}
+
+// Evaluate returns whether the proxy may be matched with the client, and
+// the penalty of doing so. A nil policy allows every match.
+func (p *MatchingPolicy) Evaluate(client ClientEntry, proxy ProxyEntry) (bool, int) {
+	if p == nil {
+		return true, 0
+	}
+	penalty := 0
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.applies(client, proxy) {
+			continue
+		}
+		if rule.Deny {
+			return false, 0
+		}
+		penalty += rule.Penalty
+	}
+	return true, penalty
+}
+
+// Empty returns true if the policy has no effect on matching.
+func (p *MatchingPolicy) Empty() bool {
+	return p == nil || len(p.Rules) == 0
+}
+
+// MatchingPolicyHolder holds the current matching policy, which may be
+// replaced while proxies are being matched.
+type MatchingPolicyHolder struct {
+	policy *MatchingPolicy
+	lock   sync.RWMutex
+}
+
+func (h *MatchingPolicyHolder) Get() *MatchingPolicy {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.policy
+}
+
+func (h *MatchingPolicyHolder) Set(policy *MatchingPolicy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.policy = policy
+}
+
+func (h *MatchingPolicyHolder) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	policy, err := ParseMatchingPolicy(f)
+	if err != nil {
+		return err
+	}
+	h.Set(policy)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testMatchingPolicy = `{"rules": [
+	{"name":"prefer-foreign-proxies", "sameCountry":true, "penalty":10},
+	{"name":"reserve-webext", "proxyTypes":["webext"], "exceptClientCountries":["cn","IR"], "deny":true},
+	{"name":"avoid-bridge", "fingerprints":["2b280b23e1107bb62abfc40ddcc8824814f80b00"], "proxyCountries":["RU"], "deny":true}
+]}`
+
+func TestMatchingPolicy(t *testing.T) {
+	Convey("Matching policy", t, func() {
+		policy, err := ParseMatchingPolicy(strings.NewReader(testMatchingPolicy))
+		So(err, ShouldBeNil)
+
+		Convey("penalizes proxies in the client's country", func() {
+			client := ClientEntry{Country: "DE"}
+			allowed, penalty := policy.Evaluate(client, ProxyEntry{Type: "standalone", Country: "DE"})
+			So(allowed, ShouldBeTrue)
+			So(penalty, ShouldEqual, 10)
+			allowed, penalty = policy.Evaluate(client, ProxyEntry{Type: "standalone", Country: "FR"})
+			So(allowed, ShouldBeTrue)
+			So(penalty, ShouldEqual, 0)
+			// Unknown countries are never considered the same.
+			allowed, penalty = policy.Evaluate(ClientEntry{}, ProxyEntry{Type: "standalone"})
+			So(allowed, ShouldBeTrue)
+			So(penalty, ShouldEqual, 0)
+		})
+
+		Convey("reserves webext proxies for some countries", func() {
+			proxy := ProxyEntry{Type: "webext", Country: "US"}
+			allowed, _ := policy.Evaluate(ClientEntry{Country: "DE"}, proxy)
+			So(allowed, ShouldBeFalse)
+			allowed, _ = policy.Evaluate(ClientEntry{Country: "CN"}, proxy)
+			So(allowed, ShouldBeTrue)
+		})
+
+		Convey("applies rules by bridge fingerprint", func() {
+			proxy := ProxyEntry{Type: "standalone", Country: "RU"}
+			allowed, _ := policy.Evaluate(ClientEntry{Fingerprint: "2B280B23E1107BB62ABFC40DDCC8824814F80B00"}, proxy)
+			So(allowed, ShouldBeFalse)
+			allowed, _ = policy.Evaluate(ClientEntry{Fingerprint: "2B280B23E1107BB62ABFC40DDCC8824814F80A72"}, proxy)
+			So(allowed, ShouldBeTrue)
+		})
+
+		Convey("rejects malformed files", func() {
+			_, err := ParseMatchingPolicy(strings.NewReader(`{"rules": [{"unknown":true}]}`))
+			So(err, ShouldNotBeNil)
+			_, err = ParseMatchingPolicy(strings.NewReader(`{"rules": [{"clientCountries":["CHN"]}]}`))
+			So(err, ShouldNotBeNil)
+			_, err = ParseMatchingPolicy(strings.NewReader(`{"rules": [{"fingerprints":["abc"]}]}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("keeps the previous policy if a reload fails", func() {
+			f, err := ioutil.TempFile("", "snowflake-matching-policy")
+			So(err, ShouldBeNil)
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(testMatchingPolicy)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			var holder MatchingPolicyHolder
+			So(holder.LoadFile(f.Name()), ShouldBeNil)
+			So(holder.Get().Rules, ShouldHaveLength, 3)
+
+			So(ioutil.WriteFile(f.Name(), []byte("{"), 0644), ShouldBeNil)
+			So(holder.LoadFile(f.Name()), ShouldNotBeNil)
+			So(holder.Get().Rules, ShouldHaveLength, 3)
+		})
+	})
+
+	Convey("Broker applies the matching policy", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		policy, err := ParseMatchingPolicy(strings.NewReader(testMatchingPolicy))
+		So(err, ShouldBeNil)
+		ctx.matchingPolicy.Set(policy)
+
+		local := ctx.addSnowflake(ProxyEntry{ID: "local", Type: "standalone", NAT: NATUnrestricted, Country: "DE"})
+		webext := ctx.addSnowflake(ProxyEntry{ID: "webext", Type: "webext", NAT: NATUnrestricted, Country: "FR", Clients: 1})
+		foreign := ctx.addSnowflake(ProxyEntry{ID: "foreign", Type: "standalone", NAT: NATUnrestricted, Country: "FR", Clients: 2})
+
+		match := func(country string) *Snowflake {
+			matched := make(chan *Snowflake, 1)
+			go func() {
+				matched <- ctx.MatchSnowflake(&ClientOffer{natType: NATUnknown, country: country})
+			}()
+			select {
+			case <-local.offerChannel:
+			case <-webext.offerChannel:
+			case <-foreign.offerChannel:
+			case snowflake := <-matched:
+				return snowflake
+			}
+			return <-matched
+		}
+
+		So(match("DE"), ShouldEqual, foreign)
+		So(match("DE"), ShouldEqual, local)
+		So(match("DE"), ShouldBeNil)
+		So(ctx.snowflakes.Len(), ShouldEqual, 1)
+		So(match("IR"), ShouldEqual, webext)
+	})
+}
@@ -6,6 +6,7 @@ https://gitweb.torproject.org/pluggable-transports/snowflake.git/tree/doc/broker
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -56,6 +57,11 @@ type Metrics struct {
 	proxyPollWithoutRelayURLExtension      uint
 	proxyPollRejectedWithRelayURLExtension uint
 
+	// start of the current metrics window, and a channel used to notify
+	// logMetrics when the window is moved by RestoreState
+	windowStart   time.Time
+	windowChanged chan struct{}
+
 	// synchronization for access to snowflake metrics
 	lock sync.Mutex
 
@@ -143,6 +149,25 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 
 }
 
+// Returns the country code of the given IP address, or the empty string
+// if it cannot be determined.
+func (m *Metrics) GetCountryByAddr(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.geoipdb == nil {
+		return ""
+	}
+	country, ok := m.geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return unknownCountry
+	}
+	return country
+}
+
 func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
 
 	// Load geoip databases
@@ -169,6 +194,8 @@ func NewMetrics(metricsLogger *log.Logger) (*Metrics, error) {
 
 	m.logger = metricsLogger
 	m.promMetrics = initPrometheus()
+	m.windowStart = time.Now()
+	m.windowChanged = make(chan struct{}, 1)
 
 	// Write to log file every day with updated metrics
 	go m.logMetrics()
@@ -178,10 +205,19 @@ func NewMetrics(metricsLogger *log.Logger) (*Metrics, error) {
 
 // Logs metrics in intervals specified by metricsResolution
 func (m *Metrics) logMetrics() {
-	heartbeat := time.Tick(metricsResolution)
-	for range heartbeat {
-		m.printMetrics()
-		m.zeroMetrics()
+	for {
+		m.lock.Lock()
+		windowEnd := m.windowStart.Add(metricsResolution)
+		m.lock.Unlock()
+
+		select {
+		case <-time.After(time.Until(windowEnd)):
+			m.printMetrics()
+			m.lock.Lock()
+			m.zeroMetrics()
+			m.lock.Unlock()
+		case <-m.windowChanged:
+		}
 	}
 }
 
@@ -227,6 +263,119 @@ func (m *Metrics) zeroMetrics() {
 	m.countryStats.natRestricted = make(map[string]bool)
 	m.countryStats.natUnrestricted = make(map[string]bool)
 	m.countryStats.natUnknown = make(map[string]bool)
+	m.windowStart = time.Now()
+}
+
+// metricsState is the serialized form of the current metrics window
+type metricsState struct {
+	WindowStart time.Time
+
+	Proxies         map[string]map[string]bool
+	Unknown         map[string]bool
+	NATRestricted   map[string]bool
+	NATUnrestricted map[string]bool
+	NATUnknown      map[string]bool
+	Counts          map[string]int
+
+	ProxyIdleCount                uint
+	ClientDeniedCount             uint
+	ClientRestrictedDeniedCount   uint
+	ClientUnrestrictedDeniedCount uint
+	ClientProxyMatchCount         uint
+
+	ProxyPollWithRelayURLExtension         uint
+	ProxyPollWithoutRelayURLExtension      uint
+	ProxyPollRejectedWithRelayURLExtension uint
+}
+
+// Checkpoints the current metrics window to the state store
+func (m *Metrics) SaveState(store StateStore) error {
+	m.lock.Lock()
+	state := metricsState{
+		WindowStart:     m.windowStart,
+		Proxies:         m.countryStats.proxies,
+		Unknown:         m.countryStats.unknown,
+		NATRestricted:   m.countryStats.natRestricted,
+		NATUnrestricted: m.countryStats.natUnrestricted,
+		NATUnknown:      m.countryStats.natUnknown,
+		Counts:          m.countryStats.counts,
+
+		ProxyIdleCount:                m.proxyIdleCount,
+		ClientDeniedCount:             m.clientDeniedCount,
+		ClientRestrictedDeniedCount:   m.clientRestrictedDeniedCount,
+		ClientUnrestrictedDeniedCount: m.clientUnrestrictedDeniedCount,
+		ClientProxyMatchCount:         m.clientProxyMatchCount,
+
+		ProxyPollWithRelayURLExtension:         m.proxyPollWithRelayURLExtension,
+		ProxyPollWithoutRelayURLExtension:      m.proxyPollWithoutRelayURLExtension,
+		ProxyPollRejectedWithRelayURLExtension: m.proxyPollRejectedWithRelayURLExtension,
+	}
+	data, err := json.Marshal(state)
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return store.Put(stateKeyMetrics, data)
+}
+
+// Restores a metrics window previously saved with SaveState. A window that
+// has already ended is discarded, since it no longer covers a full period.
+func (m *Metrics) RestoreState(store StateStore) error {
+	data, err := store.Get(stateKeyMetrics)
+	if err == ErrStateNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state metricsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if time.Since(state.WindowStart) >= metricsResolution {
+		log.Printf("Discarding saved metrics window that started at %s",
+			state.WindowStart.UTC().Format("2006-01-02 15:04:05"))
+		return nil
+	}
+
+	m.lock.Lock()
+	m.windowStart = state.WindowStart
+	for pType, addresses := range state.Proxies {
+		if addresses != nil {
+			m.countryStats.proxies[pType] = addresses
+		}
+	}
+	restoreSet(&m.countryStats.unknown, state.Unknown)
+	restoreSet(&m.countryStats.natRestricted, state.NATRestricted)
+	restoreSet(&m.countryStats.natUnrestricted, state.NATUnrestricted)
+	restoreSet(&m.countryStats.natUnknown, state.NATUnknown)
+	if state.Counts != nil {
+		m.countryStats.counts = state.Counts
+	}
+
+	m.proxyIdleCount = state.ProxyIdleCount
+	m.clientDeniedCount = state.ClientDeniedCount
+	m.clientRestrictedDeniedCount = state.ClientRestrictedDeniedCount
+	m.clientUnrestrictedDeniedCount = state.ClientUnrestrictedDeniedCount
+	m.clientProxyMatchCount = state.ClientProxyMatchCount
+
+	m.proxyPollWithRelayURLExtension = state.ProxyPollWithRelayURLExtension
+	m.proxyPollWithoutRelayURLExtension = state.ProxyPollWithoutRelayURLExtension
+	m.proxyPollRejectedWithRelayURLExtension = state.ProxyPollRejectedWithRelayURLExtension
+	m.lock.Unlock()
+
+	// Wake up logMetrics so that it reschedules the end of the window.
+	select {
+	case m.windowChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func restoreSet(dst *map[string]bool, src map[string]bool) {
+	if src != nil {
+		*dst = src
+	}
 }
 
 // Rounds up a count to the nearest multiple of 8.
@@ -241,10 +390,22 @@ type PromMetrics struct {
 	ClientPollTotal  *RoundedCounterVec
 	AvailableProxies *prometheus.GaugeVec
 
+	ClientMatchOutcomeTotal *RoundedCounterVec
+
 	ProxyPollWithRelayURLExtensionTotal    *RoundedCounterVec
 	ProxyPollWithoutRelayURLExtensionTotal *RoundedCounterVec
 
 	ProxyPollRejectedForRelayURLExtensionTotal *RoundedCounterVec
+
+	ProxyPollIdentityTotal *RoundedCounterVec
+
+	BridgeListReloadTotal          *prometheus.CounterVec
+	BridgeListLastReloadSuccessful prometheus.Gauge
+
+	BridgeHealthy          *prometheus.GaugeVec
+	BridgeHealthCheckTotal *prometheus.CounterVec
+
+	RateLimitedTotal *prometheus.CounterVec
 }
 
 // Initialize metrics for prometheus exporter
@@ -307,6 +468,15 @@ func initPrometheus() *PromMetrics {
 		[]string{"nat", "type"},
 	)
 
+	promMetrics.ProxyPollIdentityTotal = NewRoundedCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rounded_proxy_poll_identity_total",
+			Help:      "The number of snowflake proxy polls by whether the proxy identified itself, rounded up to a multiple of 8",
+		},
+		[]string{"status"},
+	)
+
 	promMetrics.ClientPollTotal = NewRoundedCounterVec(
 		prometheus.CounterOpts{
 			Namespace: prometheusNamespace,
@@ -316,13 +486,73 @@ func initPrometheus() *PromMetrics {
 		[]string{"nat", "status"},
 	)
 
+	promMetrics.ClientMatchOutcomeTotal = NewRoundedCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rounded_client_match_outcome_total",
+			Help:      "The number of client-proxy matches by the outcome reported by the client, rounded up to a multiple of 8",
+		},
+		[]string{"client_nat", "proxy_nat", "outcome"},
+	)
+
+	promMetrics.BridgeListReloadTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_list_reload_total",
+			Help:      "The number of attempts to reload the bridge list",
+		},
+		[]string{"status"},
+	)
+
+	promMetrics.BridgeListLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_list_last_reload_successful",
+			Help:      "Whether the last attempt to reload the bridge list succeeded",
+		},
+	)
+	promMetrics.BridgeListLastReloadSuccessful.Set(1)
+
+	promMetrics.BridgeHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_healthy",
+			Help:      "Whether the bridge passed its recent health checks",
+		},
+		[]string{"fingerprint"},
+	)
+
+	promMetrics.BridgeHealthCheckTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_health_check_total",
+			Help:      "The number of bridge health checks",
+		},
+		[]string{"fingerprint", "status"},
+	)
+
+	promMetrics.RateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rate_limited_total",
+			Help:      "The number of requests rejected for exceeding a rate limit",
+		},
+		[]string{"endpoint"},
+	)
+
 	// We need to register our metrics so they can be exported.
 	promMetrics.registry.MustRegister(
 		promMetrics.ClientPollTotal, promMetrics.ProxyPollTotal,
+		promMetrics.ClientMatchOutcomeTotal,
 		promMetrics.ProxyTotal, promMetrics.AvailableProxies,
 		promMetrics.ProxyPollWithRelayURLExtensionTotal,
 		promMetrics.ProxyPollWithoutRelayURLExtensionTotal,
 		promMetrics.ProxyPollRejectedForRelayURLExtensionTotal,
+		promMetrics.ProxyPollIdentityTotal,
+		promMetrics.BridgeListReloadTotal,
+		promMetrics.BridgeListLastReloadSuccessful,
+		promMetrics.BridgeHealthy, promMetrics.BridgeHealthCheckTotal,
+		promMetrics.RateLimitedTotal,
 	)
 
 	return promMetrics
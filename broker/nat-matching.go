@@ -0,0 +1,103 @@
+/*
+Deciding which proxies can serve which clients, according to the NAT
+behaviour of both.
+
+Clients and proxies may report the RFC 5780 classification of their NAT, and
+otherwise only report a NAT type, from which the behaviour that the broker
+always assumed is derived. nat.Compatible tells whether a client and a proxy
+can connect directly; a proxy with a TURN server can serve any client.
+
+A peer that got no answer from its STUN server may have had its STUN traffic
+censored, or its STUN server may be down, so a behaviour with UDPBlocked set
+counts as unknown rather than as a peer that no one can reach.
+
+Proxies that can serve clients behind restricted NATs are scarce, so clients
+that a restricted proxy could serve are only matched with restricted proxies.
+*/
+
+package main
+
+import (
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+)
+
+// The behaviour of the least capable peers, behind a restricted NAT
+var restrictedBehavior = nat.BehaviorOfType(NATRestricted)
+
+// natBehavior returns the behaviour that a client or proxy reported, or else
+// the one implied by its NAT type.
+func natBehavior(natType string, behavior *nat.Behavior) nat.Behavior {
+	if behavior != nil && !behavior.UDPBlocked {
+		return *behavior
+	}
+	return nat.BehaviorOfType(natType)
+}
+
+func (c ClientEntry) natBehavior() nat.Behavior {
+	return natBehavior(c.NAT, c.NATBehavior)
+}
+
+func (p ProxyEntry) natBehavior() nat.Behavior {
+	return natBehavior(p.NAT, p.NATBehavior)
+}
+
+// needsUnrestrictedProxy reports whether no restricted proxy can serve the
+// client.
+func (c ClientEntry) needsUnrestrictedProxy() bool {
+	return !nat.Compatible(c.natBehavior(), restrictedBehavior)
+}
+
+// servesRestrictedClients reports whether the proxy can serve clients behind
+// a restricted NAT: either its own NAT allows it, or it has a TURN server,
+// whose relay candidates any client can reach.
+func (p ProxyEntry) servesRestrictedClients() bool {
+	return p.TURN || nat.Compatible(p.natBehavior(), restrictedBehavior)
+}
+
+// canServe reports whether the proxy may be matched with the client, as far
+// as their NATs are concerned.
+func (p ProxyEntry) canServe(client ClientEntry) bool {
+	if !p.TURN && !nat.Compatible(client.natBehavior(), p.natBehavior()) {
+		return false
+	}
+	return client.needsUnrestrictedProxy() || !p.servesRestrictedClients()
+}
+
+// natClass is all that decides which clients a proxy can serve, apart from
+// the matching policy: the behaviour of its NAT, and whether it has a TURN
+// server and supports trickle ICE.
+type natClass struct {
+	mapping   string
+	filtering string
+	turn      bool
+	trickle   bool
+}
+
+func (p ProxyEntry) natClass() natClass {
+	behavior := p.natBehavior()
+	return natClass{
+		mapping:   behavior.Mapping,
+		filtering: behavior.Filtering,
+		turn:      p.TURN,
+		trickle:   p.Trickle,
+	}
+}
+
+// proxyEntry returns a proxy of the class.
+func (c natClass) proxyEntry() ProxyEntry {
+	return ProxyEntry{
+		NATBehavior: &nat.Behavior{Mapping: c.mapping, Filtering: c.filtering},
+		TURN:        c.turn,
+		Trickle:     c.trickle,
+	}
+}
+
+// canServe reports whether the proxies of the class may be matched with the
+// client. Clients that use trickle ICE are only matched with proxies that
+// support it.
+func (c natClass) canServe(client ClientEntry) bool {
+	if client.Trickle && !c.trickle {
+		return false
+	}
+	return c.proxyEntry().canServe(client)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNATMatching(t *testing.T) {
+	open := &nat.Behavior{Mapping: nat.EndpointIndependent, Filtering: nat.AddressDependent}
+	portRestricted := &nat.Behavior{Mapping: nat.EndpointIndependent, Filtering: nat.AddressAndPortDependent}
+	symmetric := &nat.Behavior{Mapping: nat.AddressDependent, Filtering: nat.AddressDependent}
+	blocked := &nat.Behavior{UDPBlocked: true}
+
+	Convey("NAT matching", t, func() {
+		Convey("matches legacy NAT types as before", func() {
+			restricted := ProxyEntry{NAT: NATRestricted}
+			unrestricted := ProxyEntry{NAT: NATUnrestricted}
+			turn := ProxyEntry{NAT: NATRestricted, TURN: true}
+			for _, natType := range []string{NATRestricted, NATUnknown} {
+				client := ClientEntry{NAT: natType}
+				So(restricted.canServe(client), ShouldBeFalse)
+				So(unrestricted.canServe(client), ShouldBeTrue)
+				So(turn.canServe(client), ShouldBeTrue)
+			}
+			client := ClientEntry{NAT: NATUnrestricted}
+			So(restricted.canServe(client), ShouldBeTrue)
+			So(unrestricted.canServe(client), ShouldBeFalse)
+			So(turn.canServe(client), ShouldBeFalse)
+		})
+
+		Convey("prefers the NAT behavior to the NAT type", func() {
+			// The mapping of this client is endpoint-independent, but its
+			// filtering keeps out restricted proxies.
+			client := ClientEntry{NAT: NATUnrestricted, NATBehavior: portRestricted}
+			So(client.needsUnrestrictedProxy(), ShouldBeTrue)
+			So(ProxyEntry{NAT: NATRestricted}.canServe(client), ShouldBeFalse)
+			So(ProxyEntry{NAT: NATUnrestricted}.canServe(client), ShouldBeTrue)
+			// A proxy whose filtering also depends on the port cannot
+			// serve restricted clients, but can serve this one.
+			proxy := ProxyEntry{NAT: NATUnrestricted, NATBehavior: portRestricted}
+			So(proxy.servesRestrictedClients(), ShouldBeFalse)
+			So(proxy.canServe(client), ShouldBeTrue)
+			So(proxy.canServe(ClientEntry{NAT: NATRestricted, NATBehavior: symmetric}), ShouldBeFalse)
+
+			client = ClientEntry{NAT: NATRestricted, NATBehavior: symmetric}
+			So(ProxyEntry{NATBehavior: open}.canServe(client), ShouldBeTrue)
+			So(ProxyEntry{NATBehavior: symmetric}.canServe(client), ShouldBeFalse)
+		})
+
+		Convey("matches peers whose STUN server did not answer by their NAT type", func() {
+			client := ClientEntry{NAT: NATUnknown, NATBehavior: blocked}
+			So(ProxyEntry{NAT: NATUnrestricted, NATBehavior: open}.canServe(client), ShouldBeTrue)
+			So(ProxyEntry{NAT: NATRestricted, TURN: true}.canServe(client), ShouldBeTrue)
+			So(ProxyEntry{NAT: NATRestricted}.canServe(client), ShouldBeFalse)
+			proxy := ProxyEntry{NAT: NATUnrestricted, NATBehavior: blocked}
+			So(proxy.servesRestrictedClients(), ShouldBeTrue)
+			So(proxy.canServe(ClientEntry{NAT: NATRestricted, NATBehavior: symmetric}), ShouldBeTrue)
+		})
+
+		Convey("hands clients the proxies that suit their NAT", func() {
+			ctx := NewBrokerContext(NullLogger())
+			restricted := ctx.addSnowflake(ProxyEntry{ID: "restricted", NAT: NATRestricted, NATBehavior: symmetric})
+			unrestricted := ctx.addSnowflake(ProxyEntry{ID: "unrestricted", NAT: NATUnrestricted, NATBehavior: open, Clients: 8})
+			offers := make(chan *ClientOffer, 2)
+			for _, snowflake := range []*Snowflake{restricted, unrestricted} {
+				snowflake := snowflake
+				go func() { offers <- <-snowflake.offerChannel }()
+			}
+
+			So(ctx.MatchSnowflake(&ClientOffer{natType: NATUnrestricted, natBehavior: portRestricted}), ShouldEqual, unrestricted)
+			<-offers
+			So(ctx.MatchSnowflake(&ClientOffer{natType: NATRestricted, natBehavior: symmetric}), ShouldBeNil)
+			So(ctx.MatchSnowflake(&ClientOffer{natType: NATUnrestricted, natBehavior: open}), ShouldEqual, restricted)
+			<-offers
+			So(ctx.snowflakes.Len(), ShouldEqual, 0)
+		})
+	})
+}
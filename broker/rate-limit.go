@@ -0,0 +1,301 @@
+/*
+Limiting the rate of requests to the broker from any one address, so that a
+single client or proxy cannot exhaust the pool of proxies or flood the
+broker with polls.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The endpoints that have separate rate limits.
+const (
+	rateLimitClient      = "client"
+	rateLimitAMPClient   = "amp-client"
+	rateLimitProxy       = "proxy"
+	rateLimitAnswer      = "answer"
+	rateLimitFeedback    = "feedback"
+	rateLimitAMPFeedback = "amp-feedback"
+	rateLimitTrickle     = "trickle"
+)
+
+const (
+	// How often buckets that have filled up again are forgotten.
+	rateLimitSweepInterval = time.Minute
+	// The default prefix lengths by which addresses are grouped.
+	defaultRateLimitIPv4Prefix = 32
+	defaultRateLimitIPv6Prefix = 64
+)
+
+// RateLimit allows Requests requests in every Period, in bursts of up to
+// Requests.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseRateLimit parses a rate limit of the form "30/1m", meaning 30
+// requests per minute. The empty string means no limit, and is returned as
+// the zero RateLimit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit %q is not of the form requests/period", s)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid number of requests", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid period", s)
+	}
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+// tokenBucket holds up to capacity tokens, and gains rate tokens per
+// second. Each request takes one token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Period.Seconds()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be full at now, in which case it is
+// no different from a new bucket.
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	rate := float64(limit.Requests) / limit.Period.Seconds()
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(limit.Requests)
+}
+
+// RateLimiter keeps a token bucket for every endpoint and client subnet.
+// Requests from trusted ranges, such as those of a domain-fronting CDN or
+// the AMP cache, are exempt, unless they carry an X-Forwarded-For header
+// naming the client they were forwarded for, in which case that client is
+// limited instead. X-Forwarded-For is ignored on requests from anywhere
+// else.
+type RateLimiter struct {
+	metrics *Metrics
+	limits  map[string]RateLimit
+	trusted trustedRanges
+	// The prefix lengths by which IPv4 and IPv6 addresses are grouped
+	ipv4Prefix, ipv6Prefix int
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	lock      sync.Mutex
+	now       func() time.Time
+}
+
+func NewRateLimiter(metrics *Metrics) *RateLimiter {
+	return &RateLimiter{
+		metrics:    metrics,
+		limits:     make(map[string]RateLimit),
+		ipv4Prefix: defaultRateLimitIPv4Prefix,
+		ipv6Prefix: defaultRateLimitIPv6Prefix,
+		buckets:    make(map[string]*tokenBucket),
+		now:        time.Now,
+	}
+}
+
+// SetLimit sets the rate limit of an endpoint. The zero RateLimit removes
+// the limit.
+func (l *RateLimiter) SetLimit(endpoint string, limit RateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit.Requests <= 0 {
+		delete(l.limits, endpoint)
+	} else {
+		l.limits[endpoint] = limit
+	}
+}
+
+// SetPrefixLengths sets the lengths of the subnets that share a bucket.
+func (l *RateLimiter) SetPrefixLengths(ipv4, ipv6 int) error {
+	if ipv4 < 0 || ipv4 > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length %d", ipv4)
+	}
+	if ipv6 < 0 || ipv6 > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", ipv6)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.ipv4Prefix, l.ipv6Prefix = ipv4, ipv6
+	return nil
+}
+
+// SetTrustedRanges parses a comma-separated list of CIDR ranges whose
+// requests are exempt from rate limiting, and whose X-Forwarded-For headers
+// are honoured.
+func (l *RateLimiter) SetTrustedRanges(ranges string) error {
+	trusted, err := parseTrustedRanges(ranges)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.trusted = trusted
+	return nil
+}
+
+// trustedRanges are the CIDR ranges of the CDNs and caches, such as those
+// used for domain fronting and by AMP, that forward requests for clients and
+// whose X-Forwarded-For headers are honoured.
+type trustedRanges []*net.IPNet
+
+// parseTrustedRanges parses a comma-separated list of CIDR ranges.
+func parseTrustedRanges(ranges string) (trustedRanges, error) {
+	var trusted trustedRanges
+	for _, s := range strings.Split(ranges, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted, nil
+}
+
+func (t trustedRanges) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent a request: the
+// address it came from, or, if that is trusted, the one that X-Forwarded-For
+// names. It is nil if the request came through trusted hops that did not say
+// whom it was forwarded for, or if an address cannot be parsed.
+func (t trustedRanges) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !t.contains(ip) {
+		return ip
+	}
+	// Each trusted hop appends the address it received the request from,
+	// so the client is the rightmost address that is not trusted. Anything
+	// to its left may have been made up by the client.
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			return nil
+		}
+		if !t.contains(hop) {
+			return hop
+		}
+	}
+	return nil
+}
+
+// subnet returns the key of the subnet that ip belongs to. Must be called
+// with the lock held.
+func (l *RateLimiter) subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.ipv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.ipv6Prefix, 128)).String()
+}
+
+// Allow reports whether a request to endpoint may go ahead, and counts it
+// if so.
+func (l *RateLimiter) Allow(endpoint string, r *http.Request) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit, ok := l.limits[endpoint]
+	if !ok {
+		return true
+	}
+	ip := l.trusted.clientIP(r)
+	if ip == nil {
+		// Exempt, or we cannot tell who is asking.
+		return true
+	}
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	key := endpoint + " " + l.subnet(ip)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Requests), last: now}
+		l.buckets[key] = bucket
+	}
+	if bucket.take(limit, now) {
+		return true
+	}
+	if l.metrics != nil {
+		l.metrics.promMetrics.RateLimitedTotal.With(map[string]string{"endpoint": endpoint}).Inc()
+	}
+	return false
+}
+
+// sweep forgets buckets that have filled up again. Must be called with the
+// lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		endpoint := key[:strings.IndexByte(key, ' ')]
+		limit, ok := l.limits[endpoint]
+		if !ok || bucket.full(limit, now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Wrap returns a handler that rejects requests to next with 429 Too Many
+// Requests when they exceed the limit of endpoint. A nil RateLimiter
+// allows everything.
+func (l *RateLimiter) Wrap(endpoint string, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Let CORS preflight requests through, as SnowflakeHandler does.
+		if r.Method != "OPTIONS" && !l.Allow(endpoint, r) {
+			// Browser proxies can only see the status with this header.
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimit(t *testing.T) {
+	Convey("Parsing rate limits", t, func() {
+		limit, err := ParseRateLimit("30/1m")
+		So(err, ShouldBeNil)
+		So(limit, ShouldResemble, RateLimit{Requests: 30, Period: time.Minute})
+
+		limit, err = ParseRateLimit("")
+		So(err, ShouldBeNil)
+		So(limit, ShouldResemble, RateLimit{})
+
+		for _, s := range []string{"30", "x/1m", "0/1m", "30/x", "30/0s", "-1/1m"} {
+			_, err = ParseRateLimit(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Rate limiter", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		limiter := NewRateLimiter(ctx.metrics)
+		now := time.Unix(1000000, 0)
+		limiter.now = func() time.Time { return now }
+		limiter.SetLimit(rateLimitClient, RateLimit{Requests: 2, Period: time.Minute})
+
+		request := func(remoteAddr string, forwardedFor ...string) *http.Request {
+			r := httptest.NewRequest("POST", "/client", nil)
+			r.RemoteAddr = remoteAddr
+			for _, f := range forwardedFor {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			return r
+		}
+		rejected := func() float64 {
+			return testutil.ToFloat64(ctx.metrics.promMetrics.RateLimitedTotal.WithLabelValues(rateLimitClient))
+		}
+
+		Convey("allows bursts up to the limit and refills over the period", func() {
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1001")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1002")), ShouldBeFalse)
+			So(rejected(), ShouldEqual, 1)
+
+			now = now.Add(30 * time.Second)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1003")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1004")), ShouldBeFalse)
+			So(rejected(), ShouldEqual, 2)
+		})
+
+		Convey("keeps separate budgets for each address and endpoint", func() {
+			limiter.SetLimit(rateLimitProxy, RateLimit{Requests: 1, Period: time.Minute})
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeFalse)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.2:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitProxy, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitProxy, request("192.0.2.1:1000")), ShouldBeFalse)
+			So(limiter.Allow(rateLimitAnswer, request("192.0.2.1:1000")), ShouldBeTrue)
+		})
+
+		Convey("groups addresses by subnet", func() {
+			So(limiter.SetPrefixLengths(24, 48), ShouldBeNil)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.2:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.3:1000")), ShouldBeFalse)
+			So(limiter.Allow(rateLimitClient, request("[2001:db8:1:2::1]:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("[2001:db8:1:3::1]:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("[2001:db8:1:4::1]:1000")), ShouldBeFalse)
+
+			So(limiter.SetPrefixLengths(33, 64), ShouldNotBeNil)
+			So(limiter.SetPrefixLengths(32, 129), ShouldNotBeNil)
+		})
+
+		Convey("ignores X-Forwarded-For from untrusted addresses", func() {
+			So(limiter.SetTrustedRanges("198.51.100.0/24"), ShouldBeNil)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000", "203.0.113.1")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000", "203.0.113.2")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000", "203.0.113.3")), ShouldBeFalse)
+		})
+
+		Convey("exempts trusted ranges and honours their X-Forwarded-For", func() {
+			So(limiter.SetTrustedRanges("198.51.100.0/24, 2001:db8:ff::/48"), ShouldBeNil)
+			for i := 0; i < 5; i++ {
+				So(limiter.Allow(rateLimitClient, request("198.51.100.7:443")), ShouldBeTrue)
+				So(limiter.Allow(rateLimitClient, request("[2001:db8:ff::1]:443")), ShouldBeTrue)
+			}
+
+			// The client can put anything at the start of the header, so
+			// only the rightmost untrusted address counts.
+			So(limiter.Allow(rateLimitClient, request("198.51.100.7:443", "10.0.0.1, 203.0.113.1")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("198.51.100.7:443", "10.0.0.2, 203.0.113.1, 198.51.100.8")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("198.51.100.7:443", "10.0.0.3", "203.0.113.1")), ShouldBeFalse)
+			So(limiter.Allow(rateLimitClient, request("198.51.100.7:443", "203.0.113.2")), ShouldBeTrue)
+
+			So(limiter.SetTrustedRanges("198.51.100.0/33"), ShouldNotBeNil)
+		})
+
+		Convey("forgets buckets that have filled up again", func() {
+			So(limiter.Allow(rateLimitClient, request("192.0.2.1:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.2:1000")), ShouldBeTrue)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.2:1000")), ShouldBeTrue)
+			So(len(limiter.buckets), ShouldEqual, 2)
+
+			now = now.Add(rateLimitSweepInterval)
+			So(limiter.Allow(rateLimitClient, request("192.0.2.3:1000")), ShouldBeTrue)
+			So(len(limiter.buckets), ShouldEqual, 1)
+		})
+
+		Convey("rejects requests over the limit with 429", func() {
+			handler := limiter.Wrap(rateLimitClient, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, request("192.0.2.1:1000"))
+				So(w.Code, ShouldEqual, status)
+			}
+			w := httptest.NewRecorder()
+			r := request("192.0.2.1:1000")
+			r.Method = "OPTIONS"
+			handler.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("limits the match feedback endpoints of the broker", func() {
+			limiter.SetLimit(rateLimitFeedback, RateLimit{Requests: 1, Period: time.Minute})
+			limiter.SetLimit(rateLimitAMPFeedback, RateLimit{Requests: 1, Period: time.Minute})
+			ctx.rateLimiter = limiter
+			mux := newBrokerMux(ctx, "")
+			for _, path := range []string{"/feedback", "/amp/feedback/"} {
+				var codes []int
+				for i := 0; i < 2; i++ {
+					r := httptest.NewRequest("POST", path, nil)
+					r.RemoteAddr = "192.0.2.1:1000"
+					w := httptest.NewRecorder()
+					mux.ServeHTTP(w, r)
+					codes = append(codes, w.Code)
+				}
+				So(codes[0], ShouldNotEqual, http.StatusTooManyRequests)
+				So(codes[1], ShouldEqual, http.StatusTooManyRequests)
+			}
+		})
+
+		Convey("limits the trickle candidate endpoint of the broker", func() {
+			limiter.SetLimit(rateLimitTrickle, RateLimit{Requests: 1, Period: time.Minute})
+			ctx.rateLimiter = limiter
+			mux := newBrokerMux(ctx, "")
+			var codes []int
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest("POST", "/trickle", nil)
+				r.RemoteAddr = "192.0.2.1:1000"
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				codes = append(codes, w.Code)
+			}
+			So(codes[0], ShouldNotEqual, http.StatusTooManyRequests)
+			So(codes[1], ShouldEqual, http.StatusTooManyRequests)
+		})
+
+		Convey("a nil limiter allows everything", func() {
+			var none *RateLimiter
+			handler := http.NotFoundHandler()
+			So(none.Wrap(rateLimitClient, handler), ShouldEqual, handler)
+		})
+	})
+}
@@ -0,0 +1,188 @@
+/*
+Keeping track of how well proxies that identify themselves with a long-lived
+key serve the clients they are matched with, so that the broker can prefer
+proxies that have done well in the past.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// The reputation of anonymous proxies and of identities the broker has
+	// not seen before.
+	NeutralReputation = 0.5
+	// How much the reputation of a proxy counts against its number of
+	// clients when choosing a proxy. A proxy with a perfect reputation
+	// counts as serving half this many clients less than a neutral one,
+	// and a proxy with the worst reputation as serving that many more.
+	reputationWeight = 16.0
+	// How long it takes for past outcomes to count half as much.
+	reputationHalfLife = 24 * time.Hour
+	// How far the timestamp of a signed poll may be from the broker's
+	// clock. Signed polls are remembered for this long, so that they
+	// cannot be replayed.
+	identityTimestampWindow = 5 * time.Minute
+	// Identities that have not polled for this long are forgotten.
+	reputationExpiry = 7 * 24 * time.Hour
+	// How often expired identities and polls are forgotten.
+	reputationSweepInterval = identityTimestampWindow
+)
+
+// reputation holds the outcomes of the matches of a proxy identity, decayed
+// according to their age.
+type reputation struct {
+	// Matches in which the proxy sent an answer in time
+	answered float64
+	// Matches in which the proxy did not send an answer in time
+	unanswered float64
+	// Answered matches in which the client could not connect to the proxy
+	failed   float64
+	updated  time.Time
+	lastPoll time.Time
+}
+
+func (r *reputation) decay(now time.Time) {
+	if elapsed := now.Sub(r.updated); elapsed > 0 {
+		factor := math.Pow(0.5, elapsed.Hours()/reputationHalfLife.Hours())
+		r.answered *= factor
+		r.unanswered *= factor
+		r.failed *= factor
+	}
+	r.updated = now
+}
+
+// score is the fraction of good outcomes, with one good and one bad outcome
+// added so that new identities start out neutral.
+func (r *reputation) score() float64 {
+	good := math.Max(r.answered-r.failed, 0)
+	bad := r.unanswered + math.Min(r.failed, r.answered)
+	return (good + 1) / (good + bad + 2)
+}
+
+// ReputationTracker keeps the reputation of every proxy identity the broker
+// has seen. The empty identity stands for anonymous proxies, whose
+// reputation is always neutral.
+type ReputationTracker struct {
+	lock       sync.Mutex
+	identities map[string]*reputation
+	// Signed polls seen within identityTimestampWindow, by identity and
+	// session id
+	polls     map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewReputationTracker() *ReputationTracker {
+	return &ReputationTracker{
+		identities: make(map[string]*reputation),
+		polls:      make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Authenticate reports whether a signed poll from identity may be trusted
+// to come from it: its timestamp must be recent, and it must not have been
+// seen before.
+func (t *ReputationTracker) Authenticate(identity, sid string, timestamp time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	t.sweep(now)
+
+	if timestamp.Before(now.Add(-identityTimestampWindow)) || timestamp.After(now.Add(identityTimestampWindow)) {
+		return false
+	}
+	key := identity + " " + sid
+	if _, ok := t.polls[key]; ok {
+		return false
+	}
+	t.polls[key] = timestamp
+
+	r, ok := t.identities[identity]
+	if !ok {
+		r = &reputation{updated: now}
+		t.identities[identity] = r
+	}
+	r.lastPoll = now
+	return true
+}
+
+// Reputation returns the reputation of an identity, between 0 and 1.
+func (t *ReputationTracker) Reputation(identity string) float64 {
+	if identity == "" {
+		return NeutralReputation
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	r, ok := t.identities[identity]
+	if !ok {
+		return NeutralReputation
+	}
+	r.decay(t.now())
+	return r.score()
+}
+
+func (t *ReputationTracker) record(identity string, update func(r *reputation)) {
+	if identity == "" {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	r, ok := t.identities[identity]
+	if !ok {
+		// Only identities that have polled recently are tracked.
+		return
+	}
+	r.decay(t.now())
+	update(r)
+}
+
+// RecordAnswer records whether a proxy sent its answer in time after being
+// matched with a client.
+func (t *ReputationTracker) RecordAnswer(identity string, answered bool) {
+	t.record(identity, func(r *reputation) {
+		if answered {
+			r.answered++
+		} else {
+			r.unanswered++
+		}
+	})
+}
+
+// RecordClientFailure records that a client could not connect to a proxy
+// that had answered it.
+func (t *ReputationTracker) RecordClientFailure(identity string) {
+	t.record(identity, func(r *reputation) {
+		r.failed++
+	})
+}
+
+// sweep forgets expired polls and identities. Must be called with the lock
+// held.
+func (t *ReputationTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < reputationSweepInterval {
+		return
+	}
+	for key, timestamp := range t.polls {
+		if timestamp.Before(now.Add(-identityTimestampWindow)) {
+			delete(t.polls, key)
+		}
+	}
+	for identity, r := range t.identities {
+		if now.Sub(r.lastPoll) > reputationExpiry {
+			delete(t.identities, identity)
+		}
+	}
+	t.lastSweep = now
+}
+
+// proxyLoad orders proxies for matching: those with a lower load are
+// preferred. It counts the clients of a proxy, offset by its reputation.
+func proxyLoad(clients int, reputation float64) float64 {
+	return float64(clients) + reputationWeight*(NeutralReputation-reputation)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReputation(t *testing.T) {
+	Convey("Reputation tracker", t, func() {
+		tracker := NewReputationTracker()
+		now := time.Unix(1000000, 0)
+		tracker.now = func() time.Time { return now }
+
+		Convey("gives anonymous and unknown proxies a neutral reputation", func() {
+			So(tracker.Reputation(""), ShouldEqual, NeutralReputation)
+			So(tracker.Reputation("unknown"), ShouldEqual, NeutralReputation)
+			tracker.RecordAnswer("", false)
+			So(tracker.Reputation(""), ShouldEqual, NeutralReputation)
+		})
+
+		Convey("only tracks identities that have polled", func() {
+			tracker.RecordAnswer("unknown", false)
+			So(tracker.Reputation("unknown"), ShouldEqual, NeutralReputation)
+			So(tracker.Authenticate("alice", "sid", now), ShouldBeTrue)
+			So(tracker.Reputation("alice"), ShouldEqual, NeutralReputation)
+		})
+
+		Convey("follows the outcomes of matches", func() {
+			So(tracker.Authenticate("good", "sid", now), ShouldBeTrue)
+			So(tracker.Authenticate("slow", "sid", now), ShouldBeTrue)
+			So(tracker.Authenticate("broken", "sid", now), ShouldBeTrue)
+			for i := 0; i < 10; i++ {
+				tracker.RecordAnswer("good", true)
+				tracker.RecordAnswer("slow", false)
+				tracker.RecordAnswer("broken", true)
+				tracker.RecordClientFailure("broken")
+			}
+			good := tracker.Reputation("good")
+			So(good, ShouldBeGreaterThan, 0.9)
+			So(tracker.Reputation("slow"), ShouldBeLessThan, 0.1)
+			So(tracker.Reputation("broken"), ShouldBeLessThan, 0.1)
+
+			Convey("and forgets old outcomes", func() {
+				now = now.Add(10 * reputationHalfLife)
+				So(tracker.Reputation("good"), ShouldBeLessThan, good)
+				So(tracker.Reputation("good"), ShouldAlmostEqual, NeutralReputation, 0.01)
+				So(tracker.Reputation("slow"), ShouldAlmostEqual, NeutralReputation, 0.01)
+			})
+		})
+
+		Convey("authenticates only fresh polls that have not been seen", func() {
+			So(tracker.Authenticate("alice", "sid1", now.Add(-time.Minute)), ShouldBeTrue)
+			So(tracker.Authenticate("alice", "sid1", now.Add(-time.Minute)), ShouldBeFalse)
+			So(tracker.Authenticate("alice", "sid2", now.Add(-2*identityTimestampWindow)), ShouldBeFalse)
+			So(tracker.Authenticate("alice", "sid3", now.Add(2*identityTimestampWindow)), ShouldBeFalse)
+			So(tracker.Authenticate("bob", "sid1", now), ShouldBeTrue)
+		})
+
+		Convey("forgets old polls and identities", func() {
+			So(tracker.Authenticate("alice", "sid", now), ShouldBeTrue)
+			now = now.Add(reputationSweepInterval + identityTimestampWindow)
+			So(tracker.Authenticate("bob", "sid", now), ShouldBeTrue)
+			So(len(tracker.polls), ShouldEqual, 1)
+			So(len(tracker.identities), ShouldEqual, 2)
+
+			now = now.Add(reputationExpiry)
+			So(tracker.Authenticate("bob", "sid2", now), ShouldBeTrue)
+			So(len(tracker.identities), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Matching prefers proxies with a good reputation", t, func() {
+		h := new(SnowflakeHeap)
+		heap.Init(h)
+		anonymous := &Snowflake{id: "anonymous", natType: NATUnrestricted, clients: 0, reputation: 0.9}
+		trusted := &Snowflake{id: "trusted", natType: NATUnrestricted, clients: 4, identity: "trusted", reputation: 0.9}
+		distrusted := &Snowflake{id: "distrusted", natType: NATUnrestricted, clients: 0, identity: "distrusted", reputation: 0.1}
+		busy := &Snowflake{id: "busy", natType: NATUnrestricted, clients: 16, identity: "busy", reputation: 0.9}
+		for _, s := range []*Snowflake{busy, distrusted, anonymous, trusted} {
+			heap.Push(h, s)
+		}
+		var order []string
+		for h.Len() > 0 {
+			order = append(order, heap.Pop(h).(*Snowflake).id)
+		}
+		So(order, ShouldResemble, []string{"trusted", "anonymous", "distrusted", "busy"})
+
+		backend := NewMemoryMatchingBackend(nil)
+		for _, s := range []*Snowflake{busy, distrusted, anonymous, trusted} {
+			go backend.WaitForOffer(s.proxyEntry(), time.Second)
+		}
+		for {
+			proxies, err := backend.ListProxies()
+			So(err, ShouldBeNil)
+			if len(proxies) == 4 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		proxy, err := backend.AssignOffer(ClientEntry{NAT: NATRestricted}, []byte("offer"))
+		So(err, ShouldBeNil)
+		So(proxy.ID, ShouldEqual, "trusted")
+	})
+
+	Convey("Proxy polls", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		i := &IPC{ctx}
+		public, private, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		identity := base64.StdEncoding.EncodeToString(public)
+
+		poll := func(body []byte) *ProxyPoll {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/proxy", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			r.RemoteAddr = "192.0.2.1:1000"
+			done := make(chan struct{})
+			go func() {
+				proxyPolls(i, w, r)
+				close(done)
+			}()
+			p := <-ctx.proxyPolls
+			p.offerChannel <- nil
+			<-done
+			So(w.Code, ShouldEqual, http.StatusOK)
+			return p
+		}
+
+		Convey("carry the identity of signed proxies", func() {
+			body, err := messages.EncodeSignedProxyPollRequest("sid", "standalone", NATUnrestricted, 0, "", private)
+			So(err, ShouldBeNil)
+			p := poll(body)
+			So(p.identity, ShouldEqual, identity)
+			So(p.reputation, ShouldEqual, NeutralReputation)
+
+			Convey("but not of replayed polls", func() {
+				p := poll(body)
+				So(p.identity, ShouldEqual, "")
+			})
+
+			Convey("and their reputation", func() {
+				ctx.reputation.RecordAnswer(identity, true)
+				body, err := messages.EncodeSignedProxyPollRequest("sid2", "standalone", NATUnrestricted, 0, "", private)
+				So(err, ShouldBeNil)
+				p := poll(body)
+				So(p.identity, ShouldEqual, identity)
+				So(p.reputation, ShouldBeGreaterThan, NeutralReputation)
+			})
+		})
+
+		Convey("treat anonymous proxies as neutral", func() {
+			body, err := messages.EncodeProxyPollRequestWithRelayPrefix("sid", "standalone", NATUnrestricted, 0, "")
+			So(err, ShouldBeNil)
+			p := poll(body)
+			So(p.identity, ShouldEqual, "")
+			So(p.reputation, ShouldEqual, NeutralReputation)
+		})
+	})
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/amp"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -53,6 +54,29 @@ func TestBroker(t *testing.T) {
 			So(len(ctx.idToSnowflake), ShouldEqual, 1)
 		})
 
+		Convey("Keeps restricted proxies with a TURN server for restricted clients", func() {
+			go ctx.Broker()
+			body, err := messages.EncodeProxyPollRequestWithOptions("turn", "standalone", NATRestricted, 0, "", messages.ProxyPollOptions{TURN: true})
+			So(err, ShouldBeNil)
+			go i.ProxyPolls(messages.Arg{Body: body, RemoteAddr: ""}, new([]byte))
+			for {
+				ctx.snowflakeLock.Lock()
+				n := ctx.snowflakes.Len()
+				ctx.snowflakeLock.Unlock()
+				if n > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			ctx.snowflakeLock.Lock()
+			defer ctx.snowflakeLock.Unlock()
+			snowflake := ctx.idToSnowflake["turn"]
+			So(snowflake, ShouldNotBeNil)
+			So(snowflake.natType, ShouldEqual, NATRestricted)
+			So(snowflake.turn, ShouldBeTrue)
+			So(snowflake.proxyEntry().servesRestrictedClients(), ShouldBeTrue)
+		})
+
 		Convey("Broker goroutine matches clients with proxies", func() {
 			p := new(ProxyPoll)
 			p.id = "test"
@@ -64,7 +88,7 @@ func TestBroker(t *testing.T) {
 			}(ctx)
 			ctx.Broker()
 			So(ctx.snowflakes.Len(), ShouldEqual, 1)
-			snowflake := heap.Pop(ctx.snowflakes).(*Snowflake)
+			snowflake := ctx.snowflakes.Select(ClientEntry{NAT: NATRestricted}, nil)
 			snowflake.offerChannel <- &ClientOffer{sdp: []byte("test offer")}
 			offer := <-p.offerChannel
 			So(ctx.idToSnowflake["test"], ShouldNotBeNil)
@@ -75,7 +99,7 @@ func TestBroker(t *testing.T) {
 		Convey("Request an offer from the Snowflake Heap", func() {
 			done := make(chan *ClientOffer)
 			go func() {
-				offer := ctx.RequestOffer("test", "", NATUnrestricted, 0)
+				offer := ctx.RequestOffer(ProxyEntry{ID: "test", NAT: NATUnrestricted})
 				done <- offer
 			}()
 			request := <-ctx.proxyPolls
@@ -477,6 +501,44 @@ func TestSnowflakeHeap(t *testing.T) {
 	})
 }
 
+func TestSnowflakeHeaps(t *testing.T) {
+	Convey("SnowflakeHeaps", t, func() {
+		sh := NewSnowflakeHeaps()
+		busy := snowflakeOf(ProxyEntry{ID: "busy", Type: "standalone", NAT: NATUnrestricted, Clients: 8})
+		idle := snowflakeOf(ProxyEntry{ID: "idle", NAT: NATUnrestricted, Clients: 0})
+		restricted := snowflakeOf(ProxyEntry{ID: "restricted", NAT: NATRestricted, Clients: 0})
+		trickle := snowflakeOf(ProxyEntry{ID: "trickle", NAT: NATUnrestricted, Clients: 4, Trickle: true})
+		for _, s := range []*Snowflake{busy, idle, restricted, trickle} {
+			sh.Push(s)
+		}
+		So(sh.Len(), ShouldEqual, 4)
+		So(sh.heaps, ShouldHaveLength, 3)
+
+		Convey("selects the least loaded snowflake of the classes that can serve a client", func() {
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, nil), ShouldEqual, idle)
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, nil), ShouldEqual, trickle)
+			So(sh.Select(ClientEntry{NAT: NATRestricted, Trickle: true}, nil), ShouldBeNil)
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, nil), ShouldEqual, busy)
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, nil), ShouldBeNil)
+			So(sh.Select(ClientEntry{NAT: NATUnrestricted}, nil), ShouldEqual, restricted)
+			So(sh.Len(), ShouldEqual, 0)
+		})
+
+		Convey("looks past the top of the heaps with a policy", func() {
+			policy := &MatchingPolicy{Rules: []MatchingRule{{ProxyTypes: []string{""}, Penalty: 1}}}
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, policy), ShouldEqual, busy)
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, policy), ShouldEqual, idle)
+		})
+
+		Convey("removes snowflakes once", func() {
+			sh.Remove(idle)
+			sh.Remove(idle)
+			So(sh.Len(), ShouldEqual, 3)
+			So(sh.Select(ClientEntry{NAT: NATRestricted}, nil), ShouldEqual, trickle)
+		})
+	})
+}
+
 func TestInvalidGeoipFile(t *testing.T) {
 	Convey("Geoip", t, func() {
 		// Make sure things behave properly if geoip file fails to load
@@ -500,6 +562,38 @@ func TestMetrics(t *testing.T) {
 		err := ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6")
 		So(err, ShouldEqual, nil)
 
+		Convey("for the country of fronted clients", func() {
+			// A domain-fronting CDN in AU.
+			ctx.trustedRanges, err = parseTrustedRanges("1.0.0.0/24")
+			So(err, ShouldBeNil)
+			country := func(remoteAddr string, forwardedFor ...string) string {
+				data := bytes.NewReader([]byte("1.0\n{\"offer\": \"fake\", \"nat\": \"unknown\"}"))
+				r, err := http.NewRequest("POST", "snowflake.broker/client", data)
+				So(err, ShouldBeNil)
+				r.RemoteAddr = remoteAddr
+				for _, value := range forwardedFor {
+					r.Header.Add("X-Forwarded-For", value)
+				}
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted, 0)
+				go func() {
+					clientOffers(i, httptest.NewRecorder(), r)
+					done <- true
+				}()
+				offer := <-snowflake.offerChannel
+				snowflake.answerChannel <- "fake answer"
+				<-done
+				return offer.country
+			}
+
+			So(country("129.97.208.23:8888"), ShouldEqual, "CA")
+			So(country("1.0.0.7:443", "129.97.208.23"), ShouldEqual, "CA")
+			// Without X-Forwarded-For, the client's country is unknown,
+			// rather than that of the CDN.
+			So(country("1.0.0.7:443"), ShouldEqual, "")
+			// X-Forwarded-For from anywhere else is ignored.
+			So(country("129.97.208.23:8888", "1.0.0.8"), ShouldEqual, "CA")
+		})
+
 		//Test addition of proxy polls
 		Convey("for proxy polls", func() {
 			w := httptest.NewRecorder()
@@ -4,6 +4,12 @@ Keeping track of pending available snowflake proxies.
 
 package main
 
+import (
+	"container/heap"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+)
+
 /*
 The Snowflake struct contains a single interaction
 over the offer and answer channels.
@@ -12,10 +18,51 @@ type Snowflake struct {
 	id            string
 	proxyType     string
 	natType       string
+	natBehavior   *nat.Behavior
+	country       string
 	offerChannel  chan *ClientOffer
 	answerChannel chan string
 	clients       int
-	index         int
+	identity      string
+	reputation    float64
+	trickle       bool
+	turn          bool
+	// The heap of SnowflakeHeaps that the snowflake is in, its position in
+	// the order of arrival, and its index in the heap
+	class natClass
+	seq   uint64
+	index int
+}
+
+// snowflakeOf returns a Snowflake that describes proxy, without channels.
+func snowflakeOf(proxy ProxyEntry) *Snowflake {
+	return &Snowflake{
+		id:          proxy.ID,
+		proxyType:   proxy.Type,
+		natType:     proxy.NAT,
+		natBehavior: proxy.NATBehavior,
+		country:     proxy.Country,
+		clients:     proxy.Clients,
+		identity:    proxy.Identity,
+		reputation:  proxy.Reputation,
+		trickle:     proxy.Trickle,
+		turn:        proxy.TURN,
+	}
+}
+
+func (s *Snowflake) proxyEntry() ProxyEntry {
+	return ProxyEntry{
+		ID:          s.id,
+		Type:        s.proxyType,
+		NAT:         s.natType,
+		NATBehavior: s.natBehavior,
+		Country:     s.country,
+		Clients:     s.clients,
+		Identity:    s.identity,
+		Reputation:  s.reputation,
+		Trickle:     s.trickle,
+		TURN:        s.turn,
+	}
 }
 
 // Implements heap.Interface, and holds Snowflakes.
@@ -24,8 +71,15 @@ type SnowflakeHeap []*Snowflake
 func (sh SnowflakeHeap) Len() int { return len(sh) }
 
 func (sh SnowflakeHeap) Less(i, j int) bool {
-	// Snowflakes serving less clients should sort earlier.
-	return sh[i].clients < sh[j].clients
+	return sh[i].less(sh[j])
+}
+
+// less reports whether s should be matched before other: snowflakes serving
+// less clients, or with a better reputation, sort earlier, and then those
+// that have waited longest.
+func (s *Snowflake) less(other *Snowflake) bool {
+	load, otherLoad := s.proxyEntry().load(), other.proxyEntry().load()
+	return load < otherLoad || (load == otherLoad && s.seq < other.seq)
 }
 
 func (sh SnowflakeHeap) Swap(i, j int) {
@@ -50,3 +104,83 @@ func (sh *SnowflakeHeap) Pop() interface{} {
 	*sh = flakes[0 : n-1]
 	return snowflake
 }
+
+// SnowflakeHeaps holds the available snowflakes in one SnowflakeHeap per NAT
+// class. All snowflakes of a class can serve the same clients, so without a
+// matching policy, the best snowflake for a client is at the top of the heap
+// of one of the classes that can serve it, and matching takes logarithmic
+// time however many snowflakes are waiting.
+type SnowflakeHeaps struct {
+	// The classes in the order in which they first had a snowflake, which
+	// keeps matching deterministic
+	classes []natClass
+	heaps   map[natClass]*SnowflakeHeap
+	seq     uint64
+	len     int
+}
+
+func NewSnowflakeHeaps() *SnowflakeHeaps {
+	return &SnowflakeHeaps{heaps: make(map[natClass]*SnowflakeHeap)}
+}
+
+func (sh *SnowflakeHeaps) Len() int { return sh.len }
+
+// Push adds a snowflake to the heap of its NAT class.
+func (sh *SnowflakeHeaps) Push(snowflake *Snowflake) {
+	snowflake.class = snowflake.proxyEntry().natClass()
+	h, ok := sh.heaps[snowflake.class]
+	if !ok {
+		h = new(SnowflakeHeap)
+		sh.heaps[snowflake.class] = h
+		sh.classes = append(sh.classes, snowflake.class)
+	}
+	sh.seq++
+	snowflake.seq = sh.seq
+	heap.Push(h, snowflake)
+	sh.len++
+}
+
+// Remove removes a snowflake that Push added, unless it was already removed.
+func (sh *SnowflakeHeaps) Remove(snowflake *Snowflake) {
+	if snowflake.index == -1 {
+		return
+	}
+	heap.Remove(sh.heaps[snowflake.class], snowflake.index)
+	sh.len--
+}
+
+// Select removes the snowflake that the policy prefers among those that can
+// serve the client, or returns nil if there are none. Only with a policy does
+// it look past the top of each heap.
+func (sh *SnowflakeHeaps) Select(client ClientEntry, policy *MatchingPolicy) *Snowflake {
+	var match *Snowflake
+	var matchPenalty int
+	for _, class := range sh.classes {
+		h := sh.heaps[class]
+		if h.Len() == 0 || !class.canServe(client) {
+			continue
+		}
+		if policy.Empty() {
+			if match == nil || (*h)[0].less(match) {
+				match = (*h)[0]
+			}
+			continue
+		}
+		for _, snowflake := range *h {
+			allowed, penalty := policy.Evaluate(client, snowflake.proxyEntry())
+			if !allowed {
+				continue
+			}
+			if match == nil || penalty < matchPenalty ||
+				(penalty == matchPenalty && snowflake.less(match)) {
+				match = snowflake
+				matchPenalty = penalty
+			}
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	sh.Remove(match)
+	return match
+}
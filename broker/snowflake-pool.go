@@ -0,0 +1,175 @@
+/*
+Matching proxies with clients, either in process or through a backend shared
+by several broker instances.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SnowflakePool holds the proxies that are waiting to be matched with
+// clients. The BrokerContext implements an in-process pool, and
+// sharedSnowflakePool implements one on top of a MatchingBackend.
+type SnowflakePool interface {
+	// RequestOffer registers a polling proxy and blocks until a client
+	// offer is available for it, or returns nil on timeout.
+	RequestOffer(proxy ProxyEntry) *ClientOffer
+	// MatchSnowflake removes a proxy suitable for the client from the pool
+	// and hands it the client's offer. The proxy's answer is sent on the
+	// answerChannel of the returned snowflake. It returns nil if no proxy
+	// is available.
+	MatchSnowflake(offer *ClientOffer) *Snowflake
+	// ReleaseSnowflake forgets a snowflake returned by MatchSnowflake once
+	// the client has stopped waiting for its answer.
+	ReleaseSnowflake(snowflake *Snowflake)
+	// SendAnswer passes the answer of the proxy with the given id to the
+	// client it was matched with. It returns false if the client is gone.
+	SendAnswer(id string, answer string) bool
+	// Snowflakes returns the proxies currently known to the pool.
+	Snowflakes() []*Snowflake
+}
+
+// clientOfferMessage is the serialized form of a ClientOffer, as it is
+// passed through a MatchingBackend.
+type clientOfferMessage struct {
+	NAT         string
+	NATBehavior *nat.Behavior
+	Country     string
+	SDP         []byte
+	Fingerprint []byte
+}
+
+// sharedSnowflakePool implements SnowflakePool on top of a MatchingBackend,
+// so that a client polling one broker can be matched with a proxy polling
+// another.
+type sharedSnowflakePool struct {
+	backend MatchingBackend
+	metrics *Metrics
+}
+
+func NewSharedSnowflakePool(backend MatchingBackend, metrics *Metrics) SnowflakePool {
+	return &sharedSnowflakePool{backend: backend, metrics: metrics}
+}
+
+func (p *sharedSnowflakePool) RequestOffer(proxy ProxyEntry) *ClientOffer {
+	labels := prometheus.Labels{"nat": proxy.NAT, "type": proxy.Type}
+	p.metrics.promMetrics.AvailableProxies.With(labels).Inc()
+	defer p.metrics.promMetrics.AvailableProxies.With(labels).Dec()
+
+	data, err := p.backend.WaitForOffer(proxy, time.Second*ProxyTimeout)
+	if err != nil {
+		log.Printf("Error waiting for client offer: %v", err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+
+	var message clientOfferMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		log.Printf("Error decoding client offer: %v", err)
+		return nil
+	}
+	return &ClientOffer{
+		natType:     message.NAT,
+		natBehavior: message.NATBehavior,
+		country:     message.Country,
+		sdp:         message.SDP,
+		fingerprint: message.Fingerprint,
+	}
+}
+
+func (p *sharedSnowflakePool) MatchSnowflake(offer *ClientOffer) *Snowflake {
+	data, err := json.Marshal(clientOfferMessage{
+		NAT:         offer.natType,
+		NATBehavior: offer.natBehavior,
+		Country:     offer.country,
+		SDP:         offer.sdp,
+		Fingerprint: offer.fingerprint,
+	})
+	if err != nil {
+		log.Printf("Error encoding client offer: %v", err)
+		return nil
+	}
+	proxy, err := p.backend.AssignOffer(offer.clientEntry(), data)
+	if err != nil {
+		log.Printf("Error matching client offer: %v", err)
+		return nil
+	}
+	if proxy == nil {
+		return nil
+	}
+
+	snowflake := &Snowflake{
+		id:          proxy.ID,
+		proxyType:   proxy.Type,
+		natType:     proxy.NAT,
+		natBehavior: proxy.NATBehavior,
+		country:     proxy.Country,
+		clients:     proxy.Clients,
+		identity:    proxy.Identity,
+		reputation:  proxy.Reputation,
+		trickle:     proxy.Trickle,
+		turn:        proxy.TURN,
+		// Buffered so that the answer can be delivered even if the
+		// client has already timed out.
+		answerChannel: make(chan string, 1),
+		index:         -1,
+	}
+	go func() {
+		answer, err := p.backend.WaitForAnswer(proxy.ID, time.Second*ClientTimeout)
+		if err != nil {
+			log.Printf("Error waiting for proxy answer: %v", err)
+			return
+		}
+		if answer != nil {
+			snowflake.answerChannel <- string(answer)
+		}
+	}()
+	return snowflake
+}
+
+func (p *sharedSnowflakePool) ReleaseSnowflake(snowflake *Snowflake) {
+	// The backend forgets the match once WaitForAnswer returns.
+}
+
+func (p *sharedSnowflakePool) SendAnswer(id string, answer string) bool {
+	ok, err := p.backend.SendAnswer(id, []byte(answer))
+	if err != nil {
+		log.Printf("Error sending proxy answer: %v", err)
+		return false
+	}
+	return ok
+}
+
+func (p *sharedSnowflakePool) Snowflakes() []*Snowflake {
+	proxies, err := p.backend.ListProxies()
+	if err != nil {
+		log.Printf("Error listing proxies: %v", err)
+		return nil
+	}
+	snowflakes := make([]*Snowflake, 0, len(proxies))
+	for _, proxy := range proxies {
+		snowflakes = append(snowflakes, &Snowflake{
+			id:          proxy.ID,
+			proxyType:   proxy.Type,
+			natType:     proxy.NAT,
+			natBehavior: proxy.NATBehavior,
+			country:     proxy.Country,
+			clients:     proxy.Clients,
+			identity:    proxy.Identity,
+			reputation:  proxy.Reputation,
+			trickle:     proxy.Trickle,
+			turn:        proxy.TURN,
+			index:       -1,
+		})
+	}
+	return snowflakes
+}
@@ -0,0 +1,100 @@
+/*
+Persisting broker state across restarts.
+
+The broker keeps its metrics window and bridge list in memory. A StateStore
+allows this state to be checkpointed and restored on startup, so that a
+redeploy does not reset the current metrics window.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	stateKeyMetrics    = "metrics"
+	stateKeyBridgeList = "bridge-list"
+)
+
+var ErrStateNotFound = errors.New("state not found")
+
+// StateStore is a key-value store used to checkpoint broker state.
+// Get returns ErrStateNotFound if no value was stored under the key.
+type StateStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+}
+
+// fileStateStore implements StateStore by keeping one file per key in a
+// directory. Values are written to a temporary file and renamed into place,
+// so that a crash in the middle of a checkpoint leaves the previous value
+// intact.
+type fileStateStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewFileStateStore returns a StateStore that keeps its state in dir,
+// creating the directory if necessary. The stored metrics contain proxy IP
+// addresses, so the directory is only readable by the broker's user.
+func NewFileStateStore(dir string) (StateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileStateStore{dir: dir}, nil
+}
+
+func (s *fileStateStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key[0] == '.' {
+		return "", errors.New("invalid state key")
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *fileStateStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrStateNotFound
+	}
+	return value, err
+}
+
+func (s *fileStateStore) Put(key string, value []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := ioutil.TempFile(s.dir, "."+key+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/bridgefingerprint"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStateStore(t *testing.T) {
+	Convey("File state store", t, func() {
+		dir, err := ioutil.TempDir("", "snowflake-broker-state")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		store, err := NewFileStateStore(dir)
+		So(err, ShouldBeNil)
+
+		Convey("returns ErrStateNotFound for missing keys", func() {
+			_, err := store.Get("missing")
+			So(err, ShouldEqual, ErrStateNotFound)
+		})
+
+		Convey("stores and overwrites values", func() {
+			So(store.Put("key", []byte("value 1")), ShouldBeNil)
+			So(store.Put("key", []byte("value 2")), ShouldBeNil)
+			value, err := store.Get("key")
+			So(err, ShouldBeNil)
+			So(value, ShouldResemble, []byte("value 2"))
+
+			// The same values are visible through a new store.
+			store, err = NewFileStateStore(dir)
+			So(err, ShouldBeNil)
+			value, err = store.Get("key")
+			So(err, ShouldBeNil)
+			So(value, ShouldResemble, []byte("value 2"))
+		})
+
+		Convey("rejects keys that escape the state directory", func() {
+			So(store.Put("../key", []byte("value")), ShouldNotBeNil)
+			So(store.Put(".hidden", []byte("value")), ShouldNotBeNil)
+		})
+
+		Convey("restores the metrics window after a restart", func() {
+			buf := new(bytes.Buffer)
+			ctx := NewBrokerContext(log.New(buf, "", 0))
+			So(ctx.RestoreState(store), ShouldBeNil)
+			So(ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6"), ShouldBeNil)
+
+			ctx.metrics.lock.Lock()
+			ctx.metrics.UpdateCountryStats("129.97.208.23", "standalone", NATRestricted)
+			ctx.metrics.clientDeniedCount = 3
+			ctx.metrics.clientProxyMatchCount = 9
+			windowStart := ctx.metrics.windowStart
+			ctx.metrics.lock.Unlock()
+			So(ctx.CheckpointState(), ShouldBeNil)
+
+			restarted := NewBrokerContext(log.New(buf, "", 0))
+			So(restarted.RestoreState(store), ShouldBeNil)
+			So(restarted.metrics.windowStart.Equal(windowStart), ShouldBeTrue)
+
+			restarted.metrics.printMetrics()
+			So(buf.String(), ShouldContainSubstring, "snowflake-ips CA=1\n")
+			So(buf.String(), ShouldContainSubstring, "\nsnowflake-ips-standalone 1\n")
+			So(buf.String(), ShouldContainSubstring, "\nclient-denied-count 8\n")
+			So(buf.String(), ShouldContainSubstring, "\nclient-snowflake-match-count 16\n")
+			So(buf.String(), ShouldContainSubstring, "\nsnowflake-ips-nat-restricted 1\n")
+		})
+
+		Convey("saves the state when the broker shuts down", func() {
+			ctx := NewBrokerContext(NullLogger())
+			So(ctx.RestoreState(store), ShouldBeNil)
+			ctx.metrics.lock.Lock()
+			ctx.metrics.clientDeniedCount = 3
+			ctx.metrics.lock.Unlock()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			server := &http.Server{Handler: http.NotFoundHandler()}
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(ln) }()
+			So(ctx.Shutdown(server, time.Second), ShouldBeNil)
+			So(<-served, ShouldEqual, http.ErrServerClosed)
+
+			restarted := NewBrokerContext(NullLogger())
+			So(restarted.RestoreState(store), ShouldBeNil)
+			So(restarted.metrics.clientDeniedCount, ShouldEqual, uint(3))
+		})
+
+		Convey("discards a metrics window that has already ended", func() {
+			ctx := NewBrokerContext(NullLogger())
+			So(ctx.RestoreState(store), ShouldBeNil)
+			ctx.metrics.lock.Lock()
+			ctx.metrics.clientDeniedCount = 3
+			ctx.metrics.windowStart = time.Now().Add(-2 * metricsResolution)
+			ctx.metrics.lock.Unlock()
+			So(ctx.CheckpointState(), ShouldBeNil)
+
+			restarted := NewBrokerContext(NullLogger())
+			So(restarted.RestoreState(store), ShouldBeNil)
+			So(restarted.metrics.clientDeniedCount, ShouldEqual, 0)
+			So(time.Since(restarted.metrics.windowStart), ShouldBeLessThan, time.Minute)
+		})
+
+		Convey("restores the bridge list after a restart", func() {
+			ctx := NewBrokerContext(NullLogger())
+			So(ctx.RestoreState(store), ShouldBeNil)
+			So(ctx.InstallBridgeListProfile(bytes.NewReader([]byte(ImaginaryBridges)), "", ""), ShouldBeNil)
+
+			restarted := NewBrokerContext(NullLogger())
+			So(restarted.RestoreState(store), ShouldBeNil)
+			So(restarted.RestoreBridgeListProfile("", ""), ShouldBeNil)
+			fingerprint, err := bridgefingerprint.FingerprintFromHexString("2B280B23E1107BB62ABFC40DDCC8824814F80B07")
+			So(err, ShouldBeNil)
+			info, err := restarted.GetBridgeInfo(fingerprint)
+			So(err, ShouldBeNil)
+			So(info.DisplayName, ShouldEqual, "imaginary-8")
+		})
+	})
+}
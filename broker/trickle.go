@@ -0,0 +1,152 @@
+/*
+Relaying ICE candidates between clients and proxies that use trickle ICE,
+after the broker has matched them.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+)
+
+const (
+	// How long the candidates of a match may be exchanged. This leaves
+	// room for ClientTimeout before the answer arrives, and for the
+	// proxy's data channel timeout after that.
+	trickleSessionTimeout = time.Minute
+	// How long a trickle request without candidates is held while waiting
+	// for candidates from the other peer.
+	trickleWaitTimeout = 5 * time.Second
+	// The maximum number of candidates that each peer may send.
+	maxTrickleCandidates = 32
+)
+
+// trickleSession holds the candidates of a match that have not been
+// delivered yet.
+type trickleSession struct {
+	// Candidates waiting for each role, by recipient
+	pending map[string][]string
+	// How many candidates each role has sent, and whether it has sent
+	// all of them
+	sent map[string]int
+	done map[string]bool
+	// Closed and replaced whenever candidates arrive
+	changed chan struct{}
+	expires time.Time
+}
+
+// TrickleTracker hands out trickle ids for matches between clients and
+// proxies that use trickle ICE, and relays their candidates.
+type TrickleTracker struct {
+	lock     sync.Mutex
+	sessions map[string]*trickleSession
+	now      func() time.Time
+}
+
+func NewTrickleTracker() *TrickleTracker {
+	return &TrickleTracker{
+		sessions: make(map[string]*trickleSession),
+		now:      time.Now,
+	}
+}
+
+// Add starts a trickle session and returns its id.
+func (t *TrickleTracker) Add() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(buf[:])
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	for oldID, s := range t.sessions {
+		if now.After(s.expires) {
+			delete(t.sessions, oldID)
+		}
+	}
+	t.sessions[id] = &trickleSession{
+		pending: make(map[string][]string),
+		sent:    make(map[string]int),
+		done:    make(map[string]bool),
+		changed: make(chan struct{}),
+		expires: now.Add(trickleSessionTimeout),
+	}
+	return id
+}
+
+// Remove forgets a trickle session, for example because the client's offer
+// was never answered.
+func (t *TrickleTracker) Remove(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.sessions, id)
+}
+
+// Exchange passes the candidates that one peer sent to the other, and
+// returns the candidates that the other peer sent, and whether it is done.
+// A request without candidates is held until the other peer sends some, or
+// is done, or until trickleWaitTimeout. It returns false if the session is
+// unknown or has expired.
+func (t *TrickleTracker) Exchange(req *messages.TrickleRequest) ([]string, bool, bool) {
+	other := messages.TrickleRoleProxy
+	if req.Role == messages.TrickleRoleProxy {
+		other = messages.TrickleRoleClient
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.sessions[req.ID]
+	if !ok || t.now().After(s.expires) {
+		return nil, false, false
+	}
+
+	candidates := req.Candidates
+	if n := maxTrickleCandidates - s.sent[req.Role]; len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	s.sent[req.Role] += len(candidates)
+	s.pending[other] = append(s.pending[other], candidates...)
+	if req.Done {
+		s.done[req.Role] = true
+	}
+	if len(candidates) > 0 || req.Done {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	} else if len(req.Candidates) == 0 && len(s.pending[req.Role]) == 0 && !s.done[other] {
+		timer := time.NewTimer(trickleWaitTimeout)
+		defer timer.Stop()
+		for len(s.pending[req.Role]) == 0 && !s.done[other] {
+			changed := s.changed
+			t.lock.Unlock()
+			timedOut := false
+			select {
+			case <-changed:
+			case <-timer.C:
+				timedOut = true
+			}
+			t.lock.Lock()
+			if t.sessions[req.ID] != s {
+				return nil, false, false
+			}
+			if timedOut {
+				break
+			}
+		}
+	}
+	return t.take(s, req.Role, other)
+}
+
+// take returns and clears the candidates waiting for role. Must be called
+// with the lock held.
+func (t *TrickleTracker) take(s *trickleSession, role, other string) ([]string, bool, bool) {
+	candidates := s.pending[role]
+	s.pending[role] = nil
+	return candidates, s.done[other], true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTrickle(t *testing.T) {
+	Convey("Trickle tracker", t, func() {
+		tracker := NewTrickleTracker()
+		now := time.Unix(1000000, 0)
+		tracker.now = func() time.Time { return now }
+		id := tracker.Add()
+		exchange := func(role string, candidates []string, done bool) ([]string, bool, bool) {
+			return tracker.Exchange(&messages.TrickleRequest{ID: id, Role: role, Candidates: candidates, Done: done})
+		}
+
+		Convey("passes candidates to the other peer", func() {
+			candidates, done, ok := exchange(messages.TrickleRoleClient, []string{"c1", "c2"}, false)
+			So(ok, ShouldBeTrue)
+			So(candidates, ShouldBeEmpty)
+			So(done, ShouldBeFalse)
+
+			candidates, done, ok = exchange(messages.TrickleRoleProxy, []string{"p1"}, true)
+			So(ok, ShouldBeTrue)
+			So(candidates, ShouldResemble, []string{"c1", "c2"})
+			So(done, ShouldBeFalse)
+
+			candidates, done, ok = exchange(messages.TrickleRoleClient, nil, false)
+			So(ok, ShouldBeTrue)
+			So(candidates, ShouldResemble, []string{"p1"})
+			So(done, ShouldBeTrue)
+		})
+
+		Convey("holds empty requests until the other peer sends candidates", func() {
+			result := make(chan []string)
+			go func() {
+				candidates, _, _ := exchange(messages.TrickleRoleProxy, nil, false)
+				result <- candidates
+			}()
+			select {
+			case <-result:
+				So("request was not held", ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+			exchange(messages.TrickleRoleClient, []string{"c1"}, false)
+			So(<-result, ShouldResemble, []string{"c1"})
+
+			go func() {
+				candidates, _, _ := exchange(messages.TrickleRoleProxy, nil, false)
+				result <- candidates
+			}()
+			exchange(messages.TrickleRoleClient, nil, true)
+			So(<-result, ShouldBeEmpty)
+		})
+
+		Convey("limits the number of candidates of each peer", func() {
+			many := make([]string, maxTrickleCandidates+1)
+			exchange(messages.TrickleRoleClient, many, false)
+			exchange(messages.TrickleRoleClient, []string{"more"}, false)
+			candidates, _, _ := exchange(messages.TrickleRoleProxy, []string{"p1"}, false)
+			So(len(candidates), ShouldEqual, maxTrickleCandidates)
+		})
+
+		Convey("forgets removed and expired sessions", func() {
+			_, _, ok := tracker.Exchange(&messages.TrickleRequest{ID: "unknown", Role: messages.TrickleRoleClient})
+			So(ok, ShouldBeFalse)
+
+			tracker.Remove(id)
+			_, _, ok = exchange(messages.TrickleRoleClient, []string{"c1"}, false)
+			So(ok, ShouldBeFalse)
+
+			id = tracker.Add()
+			now = now.Add(trickleSessionTimeout + time.Second)
+			_, _, ok = exchange(messages.TrickleRoleClient, []string{"c1"}, false)
+			So(ok, ShouldBeFalse)
+			tracker.Add()
+			So(len(tracker.sessions), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Trickle ICE matching", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		i := &IPC{ctx}
+
+		// Requests are made in the test goroutine, so that they can be
+		// served in others.
+		proxyPoll := func(trickle bool) *http.Request {
+			body, err := messages.EncodeProxyPollRequestWithOptions("sid", "standalone", NATUnrestricted, 0, "", messages.ProxyPollOptions{Trickle: trickle})
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "snowflake.broker/proxy", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			return r
+		}
+		clientPoll := func(trickle bool) *http.Request {
+			body, err := (&messages.ClientPollRequest{Offer: "fake", NAT: NATRestricted, Trickle: trickle}).EncodeClientPollRequest()
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			return r
+		}
+		serve := func(handler func(*IPC, http.ResponseWriter, *http.Request), r *http.Request) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler(i, w, r)
+			return w
+		}
+		trickle := func(req *messages.TrickleRequest) *messages.TrickleResponse {
+			body, err := req.EncodeTrickleRequest()
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "snowflake.broker/trickle", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			trickleCandidates(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			resp, err := messages.DecodeTrickleResponse(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			return resp
+		}
+
+		Convey("only hands trickle offers to proxies that support it", func() {
+			old := ctx.AddSnowflake("old", "", NATUnrestricted, 0)
+			w := serve(clientOffers, clientPoll(true))
+			resp, err := messages.DecodeClientPollResponse(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			So(resp.Error, ShouldEqual, messages.StrTrickleUnavailable)
+			So(ctx.snowflakes.Len(), ShouldEqual, 1)
+			So(old.index, ShouldNotEqual, -1)
+		})
+
+		Convey("relays the candidates of matched peers", func() {
+			go ctx.Broker()
+			proxyDone := make(chan *httptest.ResponseRecorder)
+			r := proxyPoll(true)
+			go func() {
+				proxyDone <- serve(proxyPolls, r)
+			}()
+			// Wait for the proxy to be available.
+			for {
+				ctx.snowflakeLock.Lock()
+				n := ctx.snowflakes.Len()
+				ctx.snowflakeLock.Unlock()
+				if n > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			clientDone := make(chan *httptest.ResponseRecorder)
+			r = clientPoll(true)
+			go func() {
+				clientDone <- serve(clientOffers, r)
+			}()
+			w := <-proxyDone
+			offer, _, _, proxyTrickleID, err := messages.DecodePollResponseWithTrickleID(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			So(offer, ShouldEqual, "fake")
+			So(proxyTrickleID, ShouldNotEqual, "")
+			So(ctx.pool.SendAnswer("sid", "fake answer"), ShouldBeTrue)
+
+			w = <-clientDone
+			resp, err := messages.DecodeClientPollResponse(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			So(resp.Answer, ShouldEqual, "fake answer")
+			So(resp.Trickle, ShouldEqual, proxyTrickleID)
+
+			trickle(&messages.TrickleRequest{ID: resp.Trickle, Role: messages.TrickleRoleClient, Candidates: []string{"candidate:1"}, Done: true})
+			proxyResp := trickle(&messages.TrickleRequest{ID: proxyTrickleID, Role: messages.TrickleRoleProxy})
+			So(proxyResp.Candidates, ShouldResemble, []string{"candidate:1"})
+			So(proxyResp.Done, ShouldBeTrue)
+
+			unknown := trickle(&messages.TrickleRequest{ID: "unknown", Role: messages.TrickleRoleProxy})
+			So(unknown.Error, ShouldEqual, messages.StrUnknownTrickleID)
+		})
+
+		Convey("ignores the trickle support of proxies with a shared pool", func() {
+			ctx.SetSnowflakePool(NewSharedSnowflakePool(NewMemoryMatchingBackend(nil), ctx.metrics))
+			proxyDone := make(chan *httptest.ResponseRecorder)
+			r := proxyPoll(true)
+			go func() {
+				proxyDone <- serve(proxyPolls, r)
+			}()
+			for {
+				snowflakes := ctx.pool.Snowflakes()
+				if len(snowflakes) > 0 {
+					So(snowflakes[0].trickle, ShouldBeFalse)
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			w := serve(clientOffers, clientPoll(true))
+			resp, err := messages.DecodeClientPollResponse(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			So(resp.Error, ShouldEqual, messages.StrTrickleUnavailable)
+
+			// Clients with a complete offer are still matched.
+			r = clientPoll(false)
+			go serve(clientOffers, r)
+			w = <-proxyDone
+			offer, _, _, trickleID, err := messages.DecodePollResponseWithTrickleID(w.Body.Bytes())
+			So(err, ShouldBeNil)
+			So(offer, ShouldEqual, "fake")
+			So(trickleID, ShouldEqual, "")
+		})
+
+		Convey("rejects malformed requests", func() {
+			r, err := http.NewRequest("POST", "snowflake.broker/trickle", bytes.NewReader([]byte("1.0\n{}")))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			trickleCandidates(i, w, r)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
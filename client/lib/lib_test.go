@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/iceservers"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -23,6 +24,14 @@ func (w FakeDialer) GetMax() int {
 	return w.max
 }
 
+type recordingEventReceiver struct {
+	events []event.SnowflakeEvent
+}
+
+func (r *recordingEventReceiver) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	r.events = append(r.events, e)
+}
+
 type FakeSocksConn struct {
 	net.Conn
 	rejected bool
@@ -131,6 +140,89 @@ func TestSnowflakeClient(t *testing.T) {
 			So(r, ShouldEqual, wc4)
 		})
 
+		Convey("Pop prefers the best scoring peer.", func() {
+			p, _ := NewPeers(FakeDialer{max: 3})
+			wc1, _ := p.Collect()
+			wc2, _ := p.Collect()
+			wc3, _ := p.Collect()
+			wc1.rtt = 800 * time.Millisecond
+			wc2.rtt = 50 * time.Millisecond
+			wc3.rtt = 200 * time.Millisecond
+			So(p.Pop(), ShouldEqual, wc2)
+			So(p.Pop(), ShouldEqual, wc3)
+			So(p.Pop(), ShouldEqual, wc1)
+		})
+
+		Convey("Pop leaves the other idle peers open while more are collected.", func() {
+			p, _ := NewPeers(FakeDialer{max: 3})
+			wc1, _ := p.Collect()
+			wc2, _ := p.Collect()
+			wc3, _ := p.Collect()
+			wc1.Close()
+			// The closed peer still takes up room in snowflakeChan, so
+			// this collection waits for a Pop.
+			collected := make(chan *WebRTCPeer)
+			go func() {
+				wc4, _ := p.Collect()
+				collected <- wc4
+			}()
+			popped := []*WebRTCPeer{p.Pop()}
+			wc4 := <-collected
+			popped = append(popped, p.Pop(), p.Pop())
+			for _, wc := range []*WebRTCPeer{wc2, wc3, wc4} {
+				So(popped, ShouldContain, wc)
+				So(wc.Closed(), ShouldBeFalse)
+			}
+		})
+
+		Convey("Underperforming peers are retired.", func() {
+			p, _ := NewPeers(FakeDialer{max: 3})
+			events := &recordingEventReceiver{}
+			p.eventsLogger = events
+			slow, _ := p.Collect()
+			slow.rtt = 5 * time.Second
+			active, _ := p.Collect()
+			active.rtt = 1500 * time.Millisecond
+			idle, _ := p.Collect()
+			idle.rtt = 50 * time.Millisecond
+
+			active.activated = time.Now().Add(-2 * peerEvaluationTime)
+			p.updateScores()
+			So(slow.Closed(), ShouldBeTrue)
+			So(active.Closed(), ShouldBeFalse)
+			So(idle.Closed(), ShouldBeFalse)
+
+			So(events.events, ShouldHaveLength, 2)
+			So(events.events[0], ShouldHaveSameTypeAs, event.EventOnSnowflakeRetired{})
+			scores := events.events[1].(event.EventOnSnowflakePeerScores).Scores
+			So(scores, ShouldHaveLength, 3)
+			So(scores[1].Active, ShouldBeTrue)
+			So(scores[2].Active, ShouldBeFalse)
+			So(scores[2].Score, ShouldBeGreaterThan, scores[1].Score)
+		})
+
+		Convey("An active peer is not retired for carrying little traffic.", func() {
+			p, _ := NewPeers(FakeDialer{max: 2})
+			events := &recordingEventReceiver{}
+			p.eventsLogger = events
+			active, _ := p.Collect()
+			active.rtt = 200 * time.Millisecond
+			idle, _ := p.Collect()
+			idle.rtt = 200 * time.Millisecond
+
+			// The user has not sent anything over the active peer for
+			// a long time, while the idle peer is just as fast.
+			active.activated = time.Now().Add(-10 * peerEvaluationTime)
+			p.updateScores()
+			So(active.Closed(), ShouldBeFalse)
+			So(idle.Closed(), ShouldBeFalse)
+			So(events.events, ShouldHaveLength, 1)
+			scores := events.events[0].(event.EventOnSnowflakePeerScores).Scores
+			So(scores[0].Active, ShouldBeTrue)
+			So(scores[0].Throughput, ShouldEqual, 0)
+			So(scores[0].Score, ShouldEqual, scores[1].Score)
+		})
+
 		Convey("Terminate Connect() loop", func() {
 			p, _ := NewPeers(FakeDialer{max: 4})
 			go func() {
@@ -205,7 +297,7 @@ func TestICEServerParser(t *testing.T) {
 				2,
 			},
 		} {
-			servers := parseIceServers(test.input)
+			servers := parseIceServers(test.input, iceservers.TURNCredentials{})
 
 			if test.urls == nil {
 				So(servers, ShouldBeNil)
@@ -221,5 +313,15 @@ func TestICEServerParser(t *testing.T) {
 
 		}
 
+		Convey("sets credentials on TURN servers", func() {
+			servers := parseIceServers([]string{"stun:stun.l.google.com:19302", " turn:turn.example.com:3478"},
+				iceservers.TURNCredentials{Username: "user", Credential: "pass"})
+			So(len(servers), ShouldEqual, 2)
+			So(servers[0].Username, ShouldEqual, "")
+			So(servers[1].URLs, ShouldResemble, []string{"turn:turn.example.com:3478"})
+			So(servers[1].Username, ShouldEqual, "user")
+			So(servers[1].Credential, ShouldEqual, "pass")
+		})
+
 	})
 }
@@ -0,0 +1,146 @@
+package snowflake_client
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+)
+
+const (
+	// The number of round trips between setting the remote description and
+	// the DataChannel opening: ICE connectivity checks, the DTLS handshake,
+	// the SCTP association and the DataChannel establishment. The time this
+	// takes is used to estimate the round trip time to a peer.
+	connectRoundTrips = 6
+
+	// PeerScoreInterval is how often the scores of peers are updated.
+	PeerScoreInterval = 10 * time.Second
+	// The round trip time at which the RTT part of a peer's score is 0.5.
+	referencePeerRTT = 300 * time.Millisecond
+	// Peers with a higher round trip time than this are retired.
+	maxPeerRTT = 3 * time.Second
+	// How long a peer has to be connected before it counts as stable.
+	peerEvaluationTime = time.Minute
+)
+
+// RTT returns the estimated round trip time to the peer, or 0 if it is not
+// known.
+func (c *WebRTCPeer) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// activate records that the peer has started carrying traffic.
+func (c *WebRTCPeer) activate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.activated.IsZero() {
+		c.activated = time.Now()
+	}
+}
+
+// measure returns the RTT, lifetime, traffic and throughput of the peer.
+// The score is left for the caller to fill in.
+func (c *WebRTCPeer) measure(now time.Time) event.PeerScore {
+	c.mu.Lock()
+	rtt := c.rtt
+	activated := c.activated
+	c.mu.Unlock()
+
+	s := event.PeerScore{
+		ID:              c.id,
+		Active:          !activated.IsZero(),
+		RTT:             rtt,
+		InboundTraffic:  atomic.LoadInt64(&c.inboundBytes),
+		OutboundTraffic: atomic.LoadInt64(&c.outboundBytes),
+	}
+	if !c.created.IsZero() {
+		s.Lifetime = now.Sub(c.created)
+	}
+	if s.Active {
+		if active := now.Sub(activated).Seconds(); active > 0 {
+			s.Throughput = float64(s.InboundTraffic+s.OutboundTraffic) / active
+		}
+	}
+	return s
+}
+
+// peerScore rates a peer between 0 and 1 from its round trip time, and
+// discounts peers that have only just connected. Throughput does not count,
+// as it says how much the user is doing, not how much the peer could carry.
+func peerScore(s event.PeerScore) float64 {
+	rttScore := 0.5
+	if s.RTT > 0 {
+		rttScore = float64(referencePeerRTT) / float64(referencePeerRTT+s.RTT)
+	}
+	stability := 0.5 + 0.5*math.Min(1, float64(s.Lifetime)/float64(peerEvaluationTime))
+	return rttScore * stability
+}
+
+// score measures and rates the peer.
+func (p *Peers) score(c *WebRTCPeer, now time.Time) event.PeerScore {
+	s := c.measure(now)
+	s.Score = peerScore(s)
+	return s
+}
+
+// scoreLoop periodically updates the scores of the peers until the
+// collection of peers stops.
+func (p *Peers) scoreLoop() {
+	ticker := time.NewTicker(PeerScoreInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.melt:
+			return
+		case <-ticker.C:
+			p.updateScores()
+		}
+	}
+}
+
+// updateScores rates all connected peers, retires the ones whose measured
+// round trip time is too high, and reports the scores through the event bus.
+// Peers are not retired for carrying little traffic, which only means that
+// the user is not doing much; peers that stop answering are closed by
+// checkForStaleness instead.
+func (p *Peers) updateScores() {
+	now := time.Now()
+
+	p.peersLock.Lock()
+	var peers []*WebRTCPeer
+	for e := p.activePeers.Front(); e != nil; e = e.Next() {
+		if peer := e.Value.(*WebRTCPeer); !peer.Closed() {
+			peers = append(peers, peer)
+		}
+	}
+	scores := make([]event.PeerScore, len(peers))
+	for i, peer := range peers {
+		scores[i] = p.score(peer, now)
+	}
+	p.peersLock.Unlock()
+
+	for i, peer := range peers {
+		s := scores[i]
+		if s.RTT <= maxPeerRTT {
+			continue
+		}
+		reason := fmt.Sprintf("round trip time %v", s.RTT.Round(time.Millisecond))
+		log.Printf("WebRTC: Retiring underperforming snowflake: %s", reason)
+		p.onEvent(event.EventOnSnowflakeRetired{Score: s, Reason: reason})
+		peer.Close()
+	}
+
+	p.onEvent(event.EventOnSnowflakePeerScores{Scores: scores})
+}
+
+func (p *Peers) onEvent(e event.SnowflakeEvent) {
+	if p.eventsLogger != nil {
+		p.eventsLogger.OnNewSnowflakeEvent(e)
+	}
+}
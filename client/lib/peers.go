@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
 )
 
 // Peers is a container that keeps track of multiple WebRTC remote peers.
@@ -14,6 +17,10 @@ import (
 // Maintaining a set of pre-connected Peers with fresh but inactive datachannels
 // allows allows rapid recovery when the current WebRTC Peer disconnects.
 //
+// Peers are scored by their round trip time and lifetime. Pop returns the
+// best idle peer, and peers whose round trip time is too high are retired
+// early.
+//
 // Note: For now, only one remote can be active at any given moment.
 // This is a property of Tor circuits & its current multiplexing constraints,
 // but could be updated if that changes.
@@ -21,14 +28,21 @@ import (
 // version of Snowflake)
 type Peers struct {
 	Tongue
-	bytesLogger bytesLogger
+	bytesLogger  bytesLogger
+	eventsLogger event.SnowflakeEventReceiver
 
+	// Every collected snowflake is sent on snowflakeChan, which Pop waits
+	// on, and kept in idlePeers, in the order of collection, until it is
+	// popped.
 	snowflakeChan chan *WebRTCPeer
+	idlePeers     []*WebRTCPeer
 	activePeers   *list.List
 
 	melt chan struct{}
 
 	collectLock sync.Mutex
+	// Synchronization for activePeers and idlePeers
+	peersLock sync.Mutex
 }
 
 // NewPeers constructs a fresh container of remote peers.
@@ -42,6 +56,7 @@ func NewPeers(tongue Tongue) (*Peers, error) {
 	p.activePeers = list.New()
 	p.melt = make(chan struct{})
 	p.Tongue = tongue
+	go p.scoreLoop()
 	return p, nil
 }
 
@@ -71,28 +86,63 @@ func (p *Peers) Collect() (*WebRTCPeer, error) {
 		return nil, err
 	}
 	// Track new valid Snowflake in internal collection and pass along.
+	p.peersLock.Lock()
 	p.activePeers.PushBack(connection)
+	p.idlePeers = append(p.idlePeers, connection)
+	p.peersLock.Unlock()
 	p.snowflakeChan <- connection
 	return connection, nil
 }
 
-// Pop blocks until an available, valid snowflake appears.
+// Pop blocks until an available, valid snowflake appears, and returns the
+// best scoring of the idle snowflakes.
 // Pop will return nil after End has been called.
 func (p *Peers) Pop() *WebRTCPeer {
 	for {
-		snowflake, ok := <-p.snowflakeChan
-		if !ok {
+		if _, ok := <-p.snowflakeChan; !ok {
 			return nil
 		}
-		if snowflake.Closed() {
+		snowflake := p.popBest()
+		if snowflake == nil {
 			continue
 		}
 		// Set to use the same rate-limited traffic logger to keep consistency.
 		snowflake.bytesLogger = p.bytesLogger
+		snowflake.activate()
 		return snowflake
 	}
 }
 
+// popBest removes the best scoring snowflake from idlePeers and returns it,
+// or returns nil if every idle snowflake has closed. The other idle
+// snowflakes stay where they are. Ties go to the snowflake that was
+// collected first.
+func (p *Peers) popBest() *WebRTCPeer {
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
+
+	now := time.Now()
+	best := -1
+	var bestScore float64
+	var idle []*WebRTCPeer
+	for _, snowflake := range p.idlePeers {
+		if snowflake.Closed() {
+			continue
+		}
+		if score := p.score(snowflake, now).Score; best < 0 || score > bestScore {
+			best, bestScore = len(idle), score
+		}
+		idle = append(idle, snowflake)
+	}
+	if best < 0 {
+		p.idlePeers = nil
+		return nil
+	}
+	snowflake := idle[best]
+	p.idlePeers = append(idle[:best:best], idle[best+1:]...)
+	return snowflake
+}
+
 // Melted returns a channel that will close when peers stop being collected.
 // Melted is a necessary part of |SnowflakeCollector| interface.
 func (p *Peers) Melted() <-chan struct{} {
@@ -108,6 +158,8 @@ func (p *Peers) Count() int {
 }
 
 func (p *Peers) purgeClosedPeers() {
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
 		conn := e.Value.(*WebRTCPeer)
@@ -125,8 +177,13 @@ func (p *Peers) End() {
 	close(p.melt)
 	p.collectLock.Lock()
 	defer p.collectLock.Unlock()
+	p.peersLock.Lock()
 	close(p.snowflakeChan)
+	p.idlePeers = nil
+	p.peersLock.Unlock()
 	cnt := p.Count()
+	p.peersLock.Lock()
+	defer p.peersLock.Unlock()
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
 		conn := e.Value.(*WebRTCPeer)
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/iceservers"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/util"
@@ -35,6 +36,20 @@ type RendezvousMethod interface {
 	Exchange([]byte) ([]byte, error)
 }
 
+// MatchReporter may be implemented by a RendezvousMethod that can also send
+// an encoded client match feedback message to the broker, and receive an
+// encoded response in return.
+type MatchReporter interface {
+	Report([]byte) ([]byte, error)
+}
+
+// Trickler may be implemented by a RendezvousMethod that can also send an
+// encoded trickle request to the broker, and receive an encoded trickle
+// response in return.
+type Trickler interface {
+	Trickle([]byte) ([]byte, error)
+}
+
 // BrokerChannel uses a RendezvousMethod to communicate with the Snowflake broker.
 // The BrokerChannel is responsible for encoding and decoding SDP offers and answers;
 // RendezvousMethod is responsible for the exchange of encoded information.
@@ -42,6 +57,9 @@ type BrokerChannel struct {
 	Rendezvous         RendezvousMethod
 	keepLocalAddresses bool
 	natType            string
+	natBehavior        *nat.Behavior
+	trickle            bool
+	reportMatches      bool
 	lock               sync.Mutex
 	BridgeFingerprint  string
 }
@@ -50,7 +68,7 @@ type BrokerChannel struct {
 // and TLSHandshakeTimeout settings. But we want to disable the default
 // ProxyFromEnvironment setting.
 func createBrokerTransport() http.RoundTripper {
-	transport := http.DefaultTransport.(*http.Transport)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.Proxy = nil
 	transport.ResponseHeaderTimeout = 15 * time.Second
 	return transport
@@ -93,6 +111,8 @@ func newBrokerChannelFromConfig(config ClientConfig) (*BrokerChannel, error) {
 		Rendezvous:         rendezvous,
 		keepLocalAddresses: config.KeepLocalAddresses,
 		natType:            nat.NATUnknown,
+		trickle:            config.Trickle,
+		reportMatches:      config.ReportMatches,
 		BridgeFingerprint:  config.BridgeFingerprint,
 	}, nil
 }
@@ -101,6 +121,16 @@ func newBrokerChannelFromConfig(config ClientConfig) (*BrokerChannel, error) {
 // and receive a snowflake proxy WebRTC SDP answer in return.
 func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	*webrtc.SessionDescription, error) {
+	answer, _, err := bc.negotiate(offer, false)
+	return answer, err
+}
+
+// negotiate is like Negotiate, but also returns the broker's response, which
+// holds the id that the broker gave the match, if any, with which to report
+// its outcome. If trickle is set, the offer may lack ICE candidates, and the
+// response holds the trickle id with which to exchange them.
+func (bc *BrokerChannel) negotiate(offer *webrtc.SessionDescription, trickle bool) (
+	*webrtc.SessionDescription, *messages.ClientPollResponse, error) {
 	// Ideally, we could specify an `RTCIceTransportPolicy` that would handle
 	// this for us.  However, "public" was removed from the draft spec.
 	// See https://developer.mozilla.org/en-US/docs/Web/API/RTCConfiguration#RTCIceTransportPolicy_enum
@@ -112,54 +142,138 @@ func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	}
 	offerSDP, err := util.SerializeSessionDescription(offer)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Encode the client poll request.
 	bc.lock.Lock()
+	_, canReport := bc.Rendezvous.(MatchReporter)
+	canReport = canReport && bc.reportMatches
 	req := &messages.ClientPollRequest{
 		Offer:       offerSDP,
 		NAT:         bc.natType,
+		NATBehavior: bc.natBehavior,
 		Fingerprint: bc.BridgeFingerprint,
+		Feedback:    canReport,
+		Trickle:     trickle,
 	}
 	encReq, err := req.EncodeClientPollRequest()
 	bc.lock.Unlock()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Do the exchange using our RendezvousMethod.
 	encResp, err := bc.Rendezvous.Exchange(encReq)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	log.Printf("Received answer: %s", string(encResp))
 
 	// Decode the client poll response.
 	resp, err := messages.DecodeClientPollResponse(encResp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if resp.Error != "" {
-		return nil, errors.New(resp.Error)
+		return nil, nil, errors.New(resp.Error)
 	}
-	return util.DeserializeSessionDescription(resp.Answer)
+	answer, err := util.DeserializeSessionDescription(resp.Answer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trickle && resp.Trickle == "" {
+		// The broker does not know about trickle ICE, so send complete
+		// offers from now on.
+		log.Printf("Broker does not support trickle ICE")
+		bc.lock.Lock()
+		bc.trickle = false
+		bc.lock.Unlock()
+	}
+	return answer, resp, nil
+}
+
+// useTrickle returns whether the next offer should be sent before ICE
+// candidate gathering is complete, with the remaining candidates trickled
+// through the broker.
+func (bc *BrokerChannel) useTrickle() bool {
+	if _, ok := bc.Rendezvous.(Trickler); !ok {
+		return false
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.trickle
+}
+
+// exchangeCandidates sends an encoded trickle request to the broker using
+// the RendezvousMethod, which must be a Trickler.
+func (bc *BrokerChannel) exchangeCandidates(encReq []byte) ([]byte, error) {
+	return bc.Rendezvous.(Trickler).Trickle(encReq)
+}
+
+// ReportMatch tells the broker whether the client could connect to the
+// proxy it was matched with. It does nothing if reporting matches is not
+// enabled, if the broker gave the match no id, or if the RendezvousMethod is
+// not a MatchReporter.
+func (bc *BrokerChannel) ReportMatch(matchID string, connected bool) error {
+	reporter, ok := bc.Rendezvous.(MatchReporter)
+	if !bc.reportMatches || matchID == "" || !ok {
+		return nil
+	}
+	feedback := &messages.ClientMatchFeedback{
+		MatchID: matchID,
+		Outcome: messages.MatchOutcomeFailed,
+	}
+	if connected {
+		feedback.Outcome = messages.MatchOutcomeConnected
+	}
+	encFeedback, err := feedback.EncodeClientMatchFeedback()
+	if err != nil {
+		return err
+	}
+	encResp, err := reporter.Report(encFeedback)
+	if err != nil {
+		return err
+	}
+	resp, err := messages.DecodeClientMatchFeedbackResponse(encResp)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
 }
 
 // SetNATType sets the NAT type of the client so we can send it to the WebRTC broker.
 func (bc *BrokerChannel) SetNATType(NATType string) {
 	bc.lock.Lock()
 	bc.natType = NATType
+	bc.natBehavior = nil
 	bc.lock.Unlock()
 	log.Printf("NAT Type: %s", NATType)
 }
 
+// SetNATBehavior sets the RFC 5780 classification of the client's NAT, which
+// is sent to the broker along with the NAT type that it implies.
+func (bc *BrokerChannel) SetNATBehavior(behavior *nat.Behavior) {
+	bc.lock.Lock()
+	bc.natType = behavior.Type()
+	bc.natBehavior = behavior
+	bc.lock.Unlock()
+	log.Printf("NAT Type: %s (%s)", behavior.Type(), behavior)
+}
+
 // WebRTCDialer implements the |Tongue| interface to catch snowflakes, using BrokerChannel.
 type WebRTCDialer struct {
 	*BrokerChannel
 	webrtcConfig *webrtc.Configuration
 	max          int
 
+	// The credentials of the TURN servers in webrtcConfig, which are
+	// derived anew for each connection if they come from a shared secret
+	turnCredentials iceservers.TURNCredentials
+
 	eventLogger event.SnowflakeEventReceiver
 }
 
@@ -185,8 +299,13 @@ func NewWebRTCDialerWithEvents(broker *BrokerChannel, iceServers []webrtc.ICESer
 // Catch initializes a WebRTC Connection by signaling through the BrokerChannel.
 func (w WebRTCDialer) Catch() (*WebRTCPeer, error) {
 	// TODO: [#25591] Fetch ICE server information from Broker.
-	// TODO: [#25596] Consider TURN servers here too.
-	return NewWebRTCPeerWithEvents(w.webrtcConfig, w.BrokerChannel, w.eventLogger)
+	config := w.webrtcConfig
+	if w.turnCredentials.Secret != "" {
+		config = &webrtc.Configuration{
+			ICEServers: iceservers.Refresh(config.ICEServers, w.turnCredentials, time.Now()),
+		}
+	}
+	return NewWebRTCPeerWithEvents(config, w.BrokerChannel, w.eventLogger)
 }
 
 // GetMax returns the maximum number of snowflakes to collect.
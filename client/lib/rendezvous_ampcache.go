@@ -52,10 +52,20 @@ func (r *ampCacheRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
 	log.Println("AMP cache URL:", r.cacheURL)
 	log.Println("Front domain:", r.front)
 
+	return r.get("amp/client/", encPollReq)
+}
+
+// Report implements MatchReporter, sending the client's feedback about a
+// match to the .../amp/feedback route of the broker.
+func (r *ampCacheRendezvous) Report(encFeedback []byte) ([]byte, error) {
+	return r.get("amp/feedback/", encFeedback)
+}
+
+func (r *ampCacheRendezvous) get(route string, message []byte) ([]byte, error) {
 	// We cannot POST a body through an AMP cache, so instead we GET and
-	// encode the client poll request message into the URL.
+	// encode the message into the URL.
 	reqURL := r.brokerURL.ResolveReference(&url.URL{
-		Path: "amp/client/" + amp.EncodePath(encPollReq),
+		Path: route + amp.EncodePath(message),
 	})
 
 	if r.cacheURL != nil {
@@ -111,7 +121,7 @@ func (r *ampCacheRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	encPollResp, err := ioutil.ReadAll(dec)
+	encResp, err := ioutil.ReadAll(dec)
 	if err != nil {
 		return nil, err
 	}
@@ -120,5 +130,5 @@ func (r *ampCacheRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
 		return nil, io.ErrUnexpectedEOF
 	}
 
-	return encPollResp, err
+	return encResp, err
 }
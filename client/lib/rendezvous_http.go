@@ -39,8 +39,24 @@ func (r *httpRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
 	log.Println("Front URL:  ", r.front)
 
 	// Suffix the path with the broker's client registration handler.
-	reqURL := r.brokerURL.ResolveReference(&url.URL{Path: "client"})
-	req, err := http.NewRequest("POST", reqURL.String(), bytes.NewReader(encPollReq))
+	return r.post("client", encPollReq)
+}
+
+// Report implements MatchReporter, sending the client's feedback about a
+// match to the .../feedback route of the broker.
+func (r *httpRendezvous) Report(encFeedback []byte) ([]byte, error) {
+	return r.post("feedback", encFeedback)
+}
+
+// Trickle implements Trickler, exchanging ICE candidates with the proxy of a
+// match through the .../trickle route of the broker.
+func (r *httpRendezvous) Trickle(encReq []byte) ([]byte, error) {
+	return r.post("trickle", encReq)
+}
+
+func (r *httpRendezvous) post(path string, body []byte) ([]byte, error) {
+	reqURL := r.brokerURL.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequest("POST", reqURL.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -8,10 +8,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/amp"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
+	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -89,6 +91,17 @@ func TestHTTPRendezvous(t *testing.T) {
 			So(rend.transport, ShouldEqual, transport)
 		})
 
+		Convey("The broker transport leaves http.DefaultTransport alone", func() {
+			defaultTransport := http.DefaultTransport.(*http.Transport)
+			timeout := defaultTransport.ResponseHeaderTimeout
+			transport := createBrokerTransport().(*http.Transport)
+			So(transport, ShouldNotEqual, defaultTransport)
+			So(transport.Proxy, ShouldBeNil)
+			So(transport.ResponseHeaderTimeout, ShouldEqual, 15*time.Second)
+			So(defaultTransport.Proxy, ShouldNotBeNil)
+			So(defaultTransport.ResponseHeaderTimeout, ShouldEqual, timeout)
+		})
+
 		Convey("httpRendezvous.Exchange responds with answer", func() {
 			fakeEncPollResp := makeEncPollResp(
 				`{"answer": "{\"type\":\"answer\",\"sdp\":\"fake\"}" }`,
@@ -271,3 +284,218 @@ func TestAMPCacheRendezvous(t *testing.T) {
 		})
 	})
 }
+
+// fakeReporter is a RendezvousMethod that answers every poll with response,
+// and keeps the feedback it is sent.
+type fakeReporter struct {
+	response []byte
+	request  []byte
+	feedback [][]byte
+}
+
+func (r *fakeReporter) Exchange(encPollReq []byte) ([]byte, error) {
+	r.request = encPollReq
+	return r.response, nil
+}
+
+func (r *fakeReporter) Report(encFeedback []byte) ([]byte, error) {
+	r.feedback = append(r.feedback, encFeedback)
+	return []byte(`{}`), nil
+}
+
+// urlTransport keeps the URL of the last request, and responds like
+// mockTransport.
+type urlTransport struct {
+	mockTransport
+	url string
+}
+
+func (t *urlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.url = req.URL.String()
+	return t.mockTransport.RoundTrip(req)
+}
+
+func TestMatchFeedback(t *testing.T) {
+	Convey("Match feedback", t, func() {
+		offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "test"}
+		response, err := (&messages.ClientPollResponse{
+			Answer:  `{"type":"answer","sdp":"fake"}`,
+			MatchID: "fake match",
+		}).EncodePollResponse()
+		So(err, ShouldBeNil)
+		rend := &fakeReporter{response: response}
+		broker := &BrokerChannel{Rendezvous: rend, keepLocalAddresses: true, reportMatches: true}
+
+		Convey("carries the match id from the broker", func() {
+			answer, resp, err := broker.negotiate(offer, false)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldEqual, "fake")
+			So(resp.MatchID, ShouldEqual, "fake match")
+			req, err := messages.DecodeClientPollRequest(rend.request)
+			So(err, ShouldBeNil)
+			So(req.Feedback, ShouldBeTrue)
+		})
+
+		Convey("reports the outcome of a match", func() {
+			So(broker.ReportMatch("fake match", false), ShouldBeNil)
+			So(broker.ReportMatch("fake match", true), ShouldBeNil)
+			So(len(rend.feedback), ShouldEqual, 2)
+			feedback, err := messages.DecodeClientMatchFeedback(rend.feedback[0])
+			So(err, ShouldBeNil)
+			So(feedback, ShouldResemble, &messages.ClientMatchFeedback{MatchID: "fake match", Outcome: messages.MatchOutcomeFailed})
+			feedback, err = messages.DecodeClientMatchFeedback(rend.feedback[1])
+			So(err, ShouldBeNil)
+			So(feedback.Outcome, ShouldEqual, messages.MatchOutcomeConnected)
+		})
+
+		Convey("is not offered or sent unless enabled", func() {
+			broker.reportMatches = false
+			_, _, err := broker.negotiate(offer, false)
+			So(err, ShouldBeNil)
+			req, err := messages.DecodeClientPollRequest(rend.request)
+			So(err, ShouldBeNil)
+			So(req.Feedback, ShouldBeFalse)
+			So(broker.ReportMatch("fake match", false), ShouldBeNil)
+			So(len(rend.feedback), ShouldEqual, 0)
+		})
+
+		Convey("does nothing without a match id", func() {
+			So(broker.ReportMatch("", false), ShouldBeNil)
+			So(len(rend.feedback), ShouldEqual, 0)
+		})
+
+		Convey("does nothing if the rendezvous method cannot report", func() {
+			broker.Rendezvous = struct{ RendezvousMethod }{rend}
+			So(broker.ReportMatch("fake match", false), ShouldBeNil)
+			So(len(rend.feedback), ShouldEqual, 0)
+		})
+
+		Convey("is sent to the feedback route of the broker", func() {
+			transport := &urlTransport{mockTransport: mockTransport{http.StatusOK, []byte(`{}`)}}
+			httpRend, err := newHTTPRendezvous("http://test.broker/", "", transport)
+			So(err, ShouldBeNil)
+			broker.Rendezvous = httpRend
+			So(broker.ReportMatch("fake match", false), ShouldBeNil)
+			So(transport.url, ShouldEqual, "http://test.broker/feedback")
+
+			transport.body = ampArmorEncode([]byte(`{"error":"cannot decode match feedback"}`))
+			ampRend, err := newAMPCacheRendezvous("http://test.broker/", "", "", transport)
+			So(err, ShouldBeNil)
+			broker.Rendezvous = ampRend
+			So(broker.ReportMatch("fake match", false), ShouldNotBeNil)
+			So(transport.url, ShouldStartWith, "http://test.broker/amp/feedback/")
+		})
+	})
+}
+
+func TestNATBehavior(t *testing.T) {
+	Convey("NAT behavior", t, func() {
+		offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "test"}
+		response, err := (&messages.ClientPollResponse{
+			Answer: `{"type":"answer","sdp":"fake"}`,
+		}).EncodePollResponse()
+		So(err, ShouldBeNil)
+		rend := &fakeReporter{response: response}
+		broker := &BrokerChannel{Rendezvous: rend, keepLocalAddresses: true}
+
+		behavior := &nat.Behavior{Mapping: nat.EndpointIndependent, Filtering: nat.AddressDependent}
+		broker.SetNATBehavior(behavior)
+
+		Convey("is sent to the broker with the NAT type it implies", func() {
+			_, _, err := broker.negotiate(offer, false)
+			So(err, ShouldBeNil)
+			req, err := messages.DecodeClientPollRequest(rend.request)
+			So(err, ShouldBeNil)
+			So(req.NAT, ShouldEqual, nat.NATUnrestricted)
+			So(req.NATBehavior, ShouldResemble, behavior)
+		})
+
+		Convey("is forgotten when the NAT type is set", func() {
+			broker.SetNATType(nat.NATRestricted)
+			_, _, err := broker.negotiate(offer, false)
+			So(err, ShouldBeNil)
+			req, err := messages.DecodeClientPollRequest(rend.request)
+			So(err, ShouldBeNil)
+			So(req.NAT, ShouldEqual, nat.NATRestricted)
+			So(req.NATBehavior, ShouldBeNil)
+		})
+	})
+}
+
+// fakeTrickler is a fakeReporter that can also exchange ICE candidates.
+type fakeTrickler struct {
+	fakeReporter
+	trickle [][]byte
+}
+
+func (r *fakeTrickler) Trickle(encReq []byte) ([]byte, error) {
+	r.trickle = append(r.trickle, encReq)
+	return []byte(`{}`), nil
+}
+
+func TestTrickleNegotiation(t *testing.T) {
+	Convey("Trickle ICE negotiation", t, func() {
+		offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "test"}
+		rend := &fakeTrickler{}
+		broker := &BrokerChannel{Rendezvous: rend, keepLocalAddresses: true, trickle: true}
+
+		Convey("asks the broker for a proxy that supports trickle ICE", func() {
+			response, err := (&messages.ClientPollResponse{
+				Answer:  `{"type":"answer","sdp":"fake"}`,
+				Trickle: "fake trickle",
+			}).EncodePollResponse()
+			So(err, ShouldBeNil)
+			rend.response = response
+
+			So(broker.useTrickle(), ShouldBeTrue)
+			_, resp, err := broker.negotiate(offer, true)
+			So(err, ShouldBeNil)
+			So(resp.Trickle, ShouldEqual, "fake trickle")
+			req, err := messages.DecodeClientPollRequest(rend.request)
+			So(err, ShouldBeNil)
+			So(req.Trickle, ShouldBeTrue)
+			So(broker.useTrickle(), ShouldBeTrue)
+		})
+
+		Convey("reports that no proxy supports trickle ICE", func() {
+			response, err := (&messages.ClientPollResponse{
+				Error: messages.StrTrickleUnavailable,
+			}).EncodePollResponse()
+			So(err, ShouldBeNil)
+			rend.response = response
+
+			_, _, err = broker.negotiate(offer, true)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, messages.StrTrickleUnavailable)
+			So(broker.useTrickle(), ShouldBeTrue)
+		})
+
+		Convey("stops using trickle ICE with a broker that does not support it", func() {
+			response, err := (&messages.ClientPollResponse{
+				Answer: `{"type":"answer","sdp":"fake"}`,
+			}).EncodePollResponse()
+			So(err, ShouldBeNil)
+			rend.response = response
+
+			_, _, err = broker.negotiate(offer, true)
+			So(err, ShouldBeNil)
+			So(broker.useTrickle(), ShouldBeFalse)
+		})
+
+		Convey("is not used if the rendezvous method cannot trickle", func() {
+			broker.Rendezvous = &rend.fakeReporter
+			So(broker.useTrickle(), ShouldBeFalse)
+		})
+
+		Convey("sends candidates to the trickle route of the broker", func() {
+			transport := &urlTransport{mockTransport: mockTransport{http.StatusOK, []byte(`{}`)}}
+			httpRend, err := newHTTPRendezvous("http://test.broker/", "", transport)
+			So(err, ShouldBeNil)
+			broker.Rendezvous = httpRend
+			So(broker.useTrickle(), ShouldBeTrue)
+			_, err = broker.exchangeCandidates([]byte("request"))
+			So(err, ShouldBeNil)
+			So(transport.url, ShouldEqual, "http://test.broker/trickle")
+		})
+	})
+}
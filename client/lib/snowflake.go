@@ -36,6 +36,8 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/iceservers"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
 	"github.com/pion/webrtc/v3"
@@ -57,8 +59,12 @@ const (
 	DataChannelTimeout = 10 * time.Second
 
 	// WindowSize is the number of packets in the send and receive window of a KCP connection.
+	//
+	// Deprecated: KCP parameters come from ClientConfig.KCPProfile.
 	WindowSize = 65535
 	// StreamSize controls the maximum amount of in flight data between a client and server.
+	//
+	// Deprecated: KCP parameters come from ClientConfig.KCPProfile.
 	StreamSize = 1048576 //1MB
 )
 
@@ -72,6 +78,18 @@ func (addr dummyAddr) String() string  { return "dummy" }
 type Transport struct {
 	dialer *WebRTCDialer
 
+	// If multipath is set, packets are spread among all peers using the
+	// scheduler, instead of going through one peer at a time.
+	multipath bool
+	scheduler turbotunnel.MultipathScheduler
+
+	// profile holds the KCP and smux parameters of sessions.
+	profile kcpprofile.Profile
+
+	// If authenticate is set, sessions prove to the server that their
+	// ClientID is their own.
+	authenticate bool
+
 	// EventDispatcher is the event bus for snowflake events.
 	// When an important event happens, it will be distributed here.
 	eventDispatcher event.SnowflakeEventDispatcher
@@ -90,6 +108,17 @@ type ClientConfig struct {
 	// ICEAddresses are a slice of ICE server URLs that will be used for NAT traversal and
 	// the creation of the client's WebRTC SDP offer.
 	ICEAddresses []string
+	// TURNUsername and TURNCredential are the credentials for the TURN servers
+	// ("turn:" or "turns:" URLs) among ICEAddresses. TURN servers relay traffic
+	// when the client and the proxy cannot reach each other directly, for example
+	// because both are behind symmetric NATs.
+	TURNUsername   string
+	TURNCredential string
+	// TURNSecret is an optional secret shared with the TURN servers, from which
+	// short-lived credentials are derived for each connection instead, as coturn
+	// expects with its static-auth-secret option. TURNUsername, if set, becomes
+	// part of the derived username.
+	TURNSecret string
 	// KeepLocalAddresses is an optional setting that will prevent the removal of local or
 	// invalid addresses from the client's SDP offer. This is useful for local deployments
 	// and testing.
@@ -106,6 +135,32 @@ type ClientConfig struct {
 	// BridgeFingerprint is the fingerprint of the bridge that the client will eventually
 	// connect to, as specified in the Bridge line of the torrc.
 	BridgeFingerprint string
+	// Multipath is an optional setting that makes the client send and receive packets
+	// through up to Max snowflake proxy peers at the same time, instead of through one
+	// peer at a time.
+	Multipath bool
+	// MultipathScheduler decides which peer each packet is sent through when Multipath
+	// is set, either "round-robin" (the default) or "lowest-latency".
+	MultipathScheduler string
+	// KCPProfile is the name of the set of KCP and smux parameters to use: "default",
+	// "low-latency" for interactive use over slow proxies, or "bulk" for large transfers
+	// over fast proxies.
+	KCPProfile string
+	// Trickle is an optional setting that makes the client send its SDP offer before
+	// ICE candidate gathering is complete, and exchange the remaining candidates with
+	// the proxy through the broker. The client falls back to sending a complete offer
+	// if the broker has no proxy that supports this. It has no effect with the AMP
+	// cache rendezvous method.
+	Trickle bool
+	// AuthenticateClientID is an optional setting that makes the client prove to the
+	// server, on every connection through a proxy, that its ClientID is its own, so
+	// that nobody who learns the ClientID can inject packets into the session. The
+	// server must support it.
+	AuthenticateClientID bool
+	// ReportMatches is an optional setting that makes the client tell the broker
+	// whether it could connect to each proxy it was matched with, which the broker
+	// uses for its metrics and the reputation of proxies.
+	ReportMatches bool
 }
 
 // NewSnowflakeClient creates a new Snowflake transport client that can spawn multiple
@@ -119,15 +174,34 @@ func NewSnowflakeClient(config ClientConfig) (*Transport, error) {
 
 	log.Println("\n\n\n --- Starting Snowflake Client ---")
 
-	iceServers := parseIceServers(config.ICEAddresses)
-	// chooses a random subset of servers from inputs
+	turnCredentials := iceservers.TURNCredentials{
+		Username:   config.TURNUsername,
+		Credential: config.TURNCredential,
+		Secret:     config.TURNSecret,
+	}
+	var stunServers, turnServers []webrtc.ICEServer
+	for _, server := range parseIceServers(config.ICEAddresses, turnCredentials) {
+		if iceservers.IsTURN(server.URLs[0]) {
+			turnServers = append(turnServers, server)
+		} else {
+			stunServers = append(stunServers, server)
+		}
+	}
+	if len(turnServers) > 0 && turnCredentials.Empty() {
+		return nil, errors.New("TURN servers require a TURN username and credential, or secret")
+	}
+	// chooses a random subset of STUN servers from inputs, and keeps all
+	// TURN servers, which are only configured where they are needed
 	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(iceServers), func(i, j int) {
-		iceServers[i], iceServers[j] = iceServers[j], iceServers[i]
+	rand.Shuffle(len(stunServers), func(i, j int) {
+		stunServers[i], stunServers[j] = stunServers[j], stunServers[i]
 	})
-	if len(iceServers) > 2 {
-		iceServers = iceServers[:(len(iceServers)+1)/2]
+	if len(stunServers) > 2 {
+		stunServers = stunServers[:(len(stunServers)+1)/2]
 	}
+	iceServers := make([]webrtc.ICEServer, 0, len(stunServers)+len(turnServers))
+	iceServers = append(iceServers, stunServers...)
+	iceServers = append(iceServers, turnServers...)
 	log.Printf("Using ICE servers:")
 	for _, server := range iceServers {
 		log.Printf("url: %v", strings.Join(server.URLs, " "))
@@ -138,14 +212,31 @@ func NewSnowflakeClient(config ClientConfig) (*Transport, error) {
 	if err != nil {
 		return nil, err
 	}
-	go updateNATType(iceServers, broker)
+	go updateNATType(stunServers, broker)
 
 	max := 1
 	if config.Max > max {
 		max = config.Max
 	}
+	scheduler := turbotunnel.SchedulerRoundRobin
+	if config.MultipathScheduler != "" {
+		scheduler, err = turbotunnel.ParseMultipathScheduler(config.MultipathScheduler)
+		if err != nil {
+			return nil, err
+		}
+	}
+	profile, err := kcpprofile.Get(config.KCPProfile)
+	if err != nil {
+		return nil, err
+	}
 	eventsLogger := event.NewSnowflakeEventDispatcher()
-	transport := &Transport{dialer: NewWebRTCDialerWithEvents(broker, iceServers, max, eventsLogger), eventDispatcher: eventsLogger}
+	dialer := NewWebRTCDialerWithEvents(broker, iceServers, max, eventsLogger)
+	dialer.turnCredentials = turnCredentials
+	transport := &Transport{dialer: dialer, eventDispatcher: eventsLogger}
+	transport.multipath = config.Multipath
+	transport.scheduler = scheduler
+	transport.profile = profile
+	transport.authenticate = config.AuthenticateClientID
 
 	return transport, nil
 }
@@ -173,13 +264,22 @@ func (t *Transport) Dial() (net.Conn, error) {
 
 	// Use a real logger to periodically output how much traffic is happening.
 	snowflakes.bytesLogger = newBytesSyncLogger()
+	snowflakes.eventsLogger = t.eventDispatcher
 
 	log.Printf("---- SnowflakeConn: begin collecting snowflakes ---")
 	go connectLoop(snowflakes)
 
 	// Create a new smux session
 	log.Printf("---- SnowflakeConn: starting a new session ---")
-	pconn, sess, err := newSession(snowflakes)
+	paths := 0
+	if t.multipath {
+		paths = t.dialer.GetMax()
+	}
+	var key *turbotunnel.ClientKey
+	if t.authenticate {
+		key = turbotunnel.NewClientKey()
+	}
+	pconn, sess, err := newSession(snowflakes, paths, t.scheduler, t.profile, key)
 	if err != nil {
 		return nil, err
 	}
@@ -237,51 +337,52 @@ func (conn *SnowflakeConn) Close() error {
 }
 
 // loop through all provided STUN servers until we exhaust the list or find
-// one that is compatible with RFC 5780
+// one that is compatible with RFC 5780 and answers
 func updateNATType(servers []webrtc.ICEServer, broker *BrokerChannel) {
 
-	var restrictedNAT bool
+	var behavior *nat.Behavior
 	var err error
 	for _, server := range servers {
 		addr := strings.TrimPrefix(server.URLs[0], "stun:")
-		restrictedNAT, err = nat.CheckIfRestrictedNAT(addr)
+		behavior, err = nat.Classify(addr)
 
 		if err != nil {
 			log.Printf("Warning: NAT checking failed for server at %s: %s", addr, err)
+		} else if behavior.UDPBlocked {
+			// The server may be down rather than UDP blocked, so try
+			// the others.
+			log.Printf("Warning: no answer from STUN server at %s", addr)
 		} else {
-			if restrictedNAT {
-				broker.SetNATType(nat.NATRestricted)
-			} else {
-				broker.SetNATType(nat.NATUnrestricted)
-			}
 			break
 		}
 	}
-	if err != nil {
+	if err != nil || (behavior != nil && behavior.UDPBlocked) {
+		// Without an answer, the NAT is unknown, which the broker
+		// matches as it always has.
 		broker.SetNATType(nat.NATUnknown)
+	} else if behavior != nil {
+		broker.SetNATBehavior(behavior)
 	}
 }
 
-// Returns a slice of webrtc.ICEServer given a slice of addresses
-func parseIceServers(addresses []string) []webrtc.ICEServer {
-	var servers []webrtc.ICEServer
-	if len(addresses) == 0 {
-		return nil
-	}
-	for _, url := range addresses {
-		url = strings.TrimSpace(url)
-		servers = append(servers, webrtc.ICEServer{
-			URLs: []string{url},
-		})
-	}
-	return servers
+// Returns a slice of webrtc.ICEServer given a slice of addresses, with the
+// given credentials on TURN servers
+func parseIceServers(addresses []string, credentials iceservers.TURNCredentials) []webrtc.ICEServer {
+	return iceservers.Servers(addresses, credentials, time.Now())
 }
 
 // newSession returns a new smux.Session and the net.PacketConn it is running
 // over. The net.PacketConn successively connects through Snowflake proxies
-// pulled from snowflakes.
-func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, error) {
+// pulled from snowflakes. If paths is greater than zero, it connects through
+// up to that many proxies at once, spreading packets among them according to
+// scheduler. The KCP and smux sessions are tuned according to profile. If key
+// is not nil, the ClientID of the session is the one of key, and every
+// connection proves possession of it.
+func newSession(snowflakes SnowflakeCollector, paths int, scheduler turbotunnel.MultipathScheduler, profile kcpprofile.Profile, key *turbotunnel.ClientKey) (net.PacketConn, *smux.Session, error) {
 	clientID := turbotunnel.NewClientID()
+	if key != nil {
+		clientID = key.ClientID()
+	}
 
 	// We build a persistent KCP session on a sequence of ephemeral WebRTC
 	// connections. This dialContext tells RedialPacketConn how to get a new
@@ -296,6 +397,16 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 			return nil, errors.New("handler: Received invalid Snowflake")
 		}
 		log.Println("---- Handler: snowflake assigned ----")
+		if key != nil {
+			// Send the authenticated Turbo Tunnel token and
+			// ClientID, and answer the challenge of the server.
+			err := key.Handshake(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return newEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, conn), nil
+		}
 		// Send the magic Turbo Tunnel token.
 		_, err := conn.Write(turbotunnel.Token[:])
 		if err != nil {
@@ -308,7 +419,12 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 		}
 		return newEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, conn), nil
 	}
-	pconn := turbotunnel.NewRedialPacketConn(dummyAddr{}, dummyAddr{}, dialContext)
+	var pconn net.PacketConn
+	if paths > 0 {
+		pconn = turbotunnel.NewMultipathPacketConn(dummyAddr{}, dummyAddr{}, dialContext, paths, scheduler)
+	} else {
+		pconn = turbotunnel.NewRedialPacketConn(dummyAddr{}, dummyAddr{}, dialContext)
+	}
 
 	// conn is built on the underlying RedialPacketConn—when one WebRTC
 	// connection dies, another one will be found to take its place. The
@@ -319,31 +435,15 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 		pconn.Close()
 		return nil, nil, err
 	}
-	// Permit coalescing the payloads of consecutive sends.
-	conn.SetStreamMode(true)
-	// Set the maximum send and receive window sizes to a high number
-	// Removes KCP bottlenecks: https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40026
-	conn.SetWindowSize(WindowSize, WindowSize)
-	// Disable the dynamic congestion window (limit only by the
-	// maximum of local and remote static windows).
-	conn.SetNoDelay(
-		0, // default nodelay
-		0, // default interval
-		0, // default resend
-		1, // nc=1 => congestion window off
-	)
+	profile.Configure(conn)
 	// On the KCP connection we overlay an smux session and stream.
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = 10 * time.Minute
-	smuxConfig.MaxStreamBuffer = StreamSize
-
-	sess, err := smux.Client(conn, smuxConfig)
+	sess, err := smux.Client(conn, profile.SmuxConfig())
 	if err != nil {
 		conn.Close()
 		pconn.Close()
 		return nil, nil, err
 	}
+	profile.StartDelayController(conn, sess.IsClosed)
 
 	return pconn, sess, err
 }
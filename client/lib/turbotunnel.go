@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
 )
 
 var errNotImplemented = errors.New("not implemented")
@@ -57,6 +58,14 @@ func (c *encapsulationPacketConn) WriteTo(p []byte, addr net.Addr) (int, error)
 	return len(p), nil
 }
 
+// RTT returns the round trip time of the underlying stream, if known.
+func (c *encapsulationPacketConn) RTT() time.Duration {
+	if r, ok := c.ReadWriteCloser.(turbotunnel.RTTReporter); ok {
+		return r.RTT()
+	}
+	return 0
+}
+
 // LocalAddr returns the localAddr value that was passed to
 // NewEncapsulationPacketConn.
 func (c *encapsulationPacketConn) LocalAddr() net.Addr {
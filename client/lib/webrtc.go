@@ -7,9 +7,12 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/trickle"
 	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 )
@@ -18,6 +21,11 @@ import (
 //
 // Each WebRTCPeer only ever has one DataChannel that is used as the peer's transport.
 type WebRTCPeer struct {
+	// Traffic counters, accessed atomically. Kept first in the struct for
+	// 64-bit alignment.
+	inboundBytes  int64
+	outboundBytes int64
+
 	id        string
 	pc        *webrtc.PeerConnection
 	transport *webrtc.DataChannel
@@ -27,6 +35,10 @@ type WebRTCPeer struct {
 
 	mu          sync.Mutex // protects the following:
 	lastReceive time.Time
+	rtt         time.Duration
+	activated   time.Time
+
+	created time.Time
 
 	open   chan struct{} // Channel to notify when datachannel opens
 	closed chan struct{}
@@ -62,6 +74,7 @@ func NewWebRTCPeerWithEvents(config *webrtc.Configuration,
 		connection.id = "snowflake-" + hex.EncodeToString(buf[:])
 	}
 	connection.closed = make(chan struct{})
+	connection.created = time.Now()
 
 	// Override with something that's not NullLogger to have real logging.
 	connection.bytesLogger = &bytesNullLogger{}
@@ -93,6 +106,7 @@ func (c *WebRTCPeer) Write(b []byte) (int, error) {
 		return 0, err
 	}
 	c.bytesLogger.addOutbound(len(b))
+	atomic.AddInt64(&c.outboundBytes, int64(len(b)))
 	return len(b), nil
 }
 
@@ -147,7 +161,8 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 	log.Println(c.id, " connecting...")
 	// TODO: When go-webrtc is more stable, it's possible that a new
 	// PeerConnection won't need to be re-prepared each time.
-	err := c.preparePeerConnection(config)
+	trickling := broker.useTrickle()
+	candidates, err := c.preparePeerConnection(config, trickling, broker.keepLocalAddresses)
 	localDescription := c.pc.LocalDescription()
 	c.eventsLogger.OnNewSnowflakeEvent(event.EventOnOfferCreated{
 		WebRTCLocalDescription: localDescription,
@@ -157,7 +172,15 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 		return err
 	}
 
-	answer, err := broker.Negotiate(localDescription)
+	answer, resp, err := broker.negotiate(localDescription, trickling)
+	if trickling && err != nil && err.Error() == messages.StrTrickleUnavailable {
+		// No available proxy can get the rest of our candidates through
+		// the broker, so send a complete offer instead.
+		log.Println("WebRTC: No proxy supports trickle ICE, waiting for ICE candidate gathering to complete")
+		<-candidates.GatheringComplete()
+		trickling = false
+		answer, resp, err = broker.negotiate(c.pc.LocalDescription(), false)
+	}
 	c.eventsLogger.OnNewSnowflakeEvent(event.EventOnBrokerRendezvous{
 		WebRTCRemoteDescription: answer,
 		Error:                   err,
@@ -166,19 +189,30 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 		return err
 	}
 	log.Printf("Received Answer.\n")
+	handshakeStart := time.Now()
 	err = c.pc.SetRemoteDescription(*answer)
 	if nil != err {
 		log.Println("WebRTC: Unable to SetRemoteDescription:", err)
+		go reportMatch(broker, resp.MatchID, false)
 		return err
 	}
+	if trickling && resp.Trickle != "" {
+		go candidates.Run(resp.Trickle, broker.exchangeCandidates)
+		defer candidates.Stop()
+	}
 
 	// Wait for the datachannel to open or time out
 	select {
 	case <-c.open:
+		c.mu.Lock()
+		c.rtt = time.Since(handshakeStart) / connectRoundTrips
+		c.mu.Unlock()
+		go reportMatch(broker, resp.MatchID, true)
 	case <-time.After(DataChannelTimeout):
 		c.transport.Close()
 		err = errors.New("timeout waiting for DataChannel.OnOpen")
 		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: err})
+		go reportMatch(broker, resp.MatchID, false)
 		return err
 	}
 
@@ -186,9 +220,20 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 	return nil
 }
 
+// reportMatch tells the broker whether the client could connect to the proxy
+// of a match, logging any error. Feedback is best effort and does not hold
+// up the connection.
+func reportMatch(broker *BrokerChannel, matchID string, connected bool) {
+	if err := broker.ReportMatch(matchID, connected); err != nil {
+		log.Printf("Error reporting match outcome to broker: %v", err)
+	}
+}
+
 // preparePeerConnection creates a new WebRTC PeerConnection and returns it
-// after ICE candidate gathering is complete..
-func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
+// after ICE candidate gathering is complete.. If trickling is set, it returns
+// as soon as the local description is set, along with the collector of the
+// local candidates that are gathered after that.
+func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration, trickling bool, keepLocalAddresses bool) (*trickle.Candidates, error) {
 	var err error
 	s := webrtc.SettingEngine{}
 	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
@@ -196,7 +241,7 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 	c.pc, err = api.NewPeerConnection(*config)
 	if err != nil {
 		log.Printf("NewPeerConnection ERROR: %s", err)
-		return err
+		return nil, err
 	}
 	ordered := true
 	dataChannelOptions := &webrtc.DataChannelInit{
@@ -207,7 +252,7 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 	dc, err := c.pc.CreateDataChannel(c.id, dataChannelOptions)
 	if err != nil {
 		log.Printf("CreateDataChannel ERROR: %s", err)
-		return err
+		return nil, err
 	}
 	dc.OnOpen(func() {
 		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
@@ -227,6 +272,7 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 		}
 		n, err := c.writePipe.Write(msg.Data)
 		c.bytesLogger.addInbound(n)
+		atomic.AddInt64(&c.inboundBytes, int64(n))
 		if err != nil {
 			// TODO: Maybe shouldn't actually close.
 			log.Println("Error writing to SOCKS pipe")
@@ -244,25 +290,31 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 
 	// Allow candidates to accumulate until ICEGatheringStateComplete.
 	done := webrtc.GatheringCompletePromise(c.pc)
+	var candidates *trickle.Candidates
+	if trickling {
+		candidates = trickle.New(c.pc, messages.TrickleRoleClient, keepLocalAddresses)
+	}
 	offer, err := c.pc.CreateOffer(nil)
 	// TODO: Potentially timeout and retry if ICE isn't working.
 	if err != nil {
 		log.Println("Failed to prepare offer", err)
 		c.pc.Close()
-		return err
+		return nil, err
 	}
 	log.Println("WebRTC: Created offer")
 	err = c.pc.SetLocalDescription(offer)
 	if err != nil {
 		log.Println("Failed to prepare offer", err)
 		c.pc.Close()
-		return err
+		return nil, err
 	}
 	log.Println("WebRTC: Set local description")
 
-	<-done // Wait for ICE candidate gathering to complete.
+	if !trickling {
+		<-done // Wait for ICE candidate gathering to complete.
+	}
 	log.Println("WebRTC: PeerConnection created.")
-	return nil
+	return candidates, nil
 }
 
 // cleanup closes all channels and transports
@@ -33,6 +33,10 @@ func NewPTEventLogger() event.SnowflakeEventReceiver {
 }
 
 func (p ptEventLogger) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	// Peer scores are updated too often to be worth a notice.
+	if _, ok := e.(event.EventOnSnowflakePeerScores); ok {
+		return
+	}
 	pt.Log(pt.LogSeverityNotice, e.String())
 }
 
@@ -84,6 +88,15 @@ func socksAcceptLoop(ln *pt.SocksListener, config sf.ClientConfig, shutdown chan
 			if arg, ok := conn.Req.Args.Get("ice"); ok {
 				config.ICEAddresses = strings.Split(strings.TrimSpace(arg), ",")
 			}
+			if arg, ok := conn.Req.Args.Get("turn-username"); ok {
+				config.TURNUsername = arg
+			}
+			if arg, ok := conn.Req.Args.Get("turn-credential"); ok {
+				config.TURNCredential = arg
+			}
+			if arg, ok := conn.Req.Args.Get("turn-secret"); ok {
+				config.TURNSecret = arg
+			}
 			if arg, ok := conn.Req.Args.Get("max"); ok {
 				max, err := strconv.Atoi(arg)
 				if err != nil {
@@ -110,6 +123,44 @@ func socksAcceptLoop(ln *pt.SocksListener, config sf.ClientConfig, shutdown chan
 			if arg, ok := conn.Req.Args.Get("fingerprint"); ok {
 				config.BridgeFingerprint = arg
 			}
+			if arg, ok := conn.Req.Args.Get("multipath"); ok {
+				switch strings.ToLower(arg) {
+				case "true":
+					fallthrough
+				case "yes":
+					config.Multipath = true
+				}
+			}
+			if arg, ok := conn.Req.Args.Get("multipath-scheduler"); ok {
+				config.MultipathScheduler = arg
+			}
+			if arg, ok := conn.Req.Args.Get("kcp-profile"); ok {
+				config.KCPProfile = arg
+			}
+			if arg, ok := conn.Req.Args.Get("trickle"); ok {
+				switch strings.ToLower(arg) {
+				case "true":
+					fallthrough
+				case "yes":
+					config.Trickle = true
+				}
+			}
+			if arg, ok := conn.Req.Args.Get("authenticate-client-id"); ok {
+				switch strings.ToLower(arg) {
+				case "true":
+					fallthrough
+				case "yes":
+					config.AuthenticateClientID = true
+				}
+			}
+			if arg, ok := conn.Req.Args.Get("report-matches"); ok {
+				switch strings.ToLower(arg) {
+				case "true":
+					fallthrough
+				case "yes":
+					config.ReportMatches = true
+				}
+			}
 			transport, err := sf.NewSnowflakeClient(config)
 			if err != nil {
 				conn.Reject()
@@ -148,6 +199,9 @@ func socksAcceptLoop(ln *pt.SocksListener, config sf.ClientConfig, shutdown chan
 
 func main() {
 	iceServersCommas := flag.String("ice", "", "comma-separated list of ICE servers")
+	turnUsername := flag.String("turn-username", "", "username for the TURN servers among the ICE servers")
+	turnCredential := flag.String("turn-credential", "", "credential for the TURN servers among the ICE servers")
+	turnSecret := flag.String("turn-secret", "", "secret shared with the TURN servers, from which to derive short-lived credentials")
 	brokerURL := flag.String("url", "", "URL of signaling broker")
 	frontDomain := flag.String("front", "", "front domain")
 	ampCacheURL := flag.String("ampcache", "", "URL of AMP cache to use as a proxy for signaling")
@@ -157,6 +211,12 @@ func main() {
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
 	max := flag.Int("max", DefaultSnowflakeCapacity,
 		"capacity for number of multiplexed WebRTC peers")
+	multipath := flag.Bool("multipath", false, "send packets through all WebRTC peers at once")
+	multipathScheduler := flag.String("multipath-scheduler", "", "how to spread packets among peers with -multipath: round-robin or lowest-latency")
+	kcpProfile := flag.String("kcp-profile", "", "KCP tuning profile: default, low-latency or bulk")
+	trickle := flag.Bool("trickle", false, "send the offer before ICE gathering completes and trickle candidates through the broker")
+	reportMatches := flag.Bool("report-matches", false, "tell the broker whether each proxy it matched could be reached")
+	authenticateClientID := flag.Bool("authenticate-client-id", false, "prove possession of the ClientID to the server, which must support it")
 
 	// Deprecated
 	oldLogToStateDir := flag.Bool("logToStateDir", false, "use -log-to-state-dir instead")
@@ -202,8 +262,18 @@ func main() {
 		AmpCacheURL:        *ampCacheURL,
 		FrontDomain:        *frontDomain,
 		ICEAddresses:       iceAddresses,
+		TURNUsername:       *turnUsername,
+		TURNCredential:     *turnCredential,
+		TURNSecret:         *turnSecret,
 		KeepLocalAddresses: *keepLocalAddresses || *oldKeepLocalAddresses,
 		Max:                *max,
+		Multipath:          *multipath,
+		MultipathScheduler: *multipathScheduler,
+		KCPProfile:         *kcpProfile,
+		Trickle:            *trickle,
+
+		AuthenticateClientID: *authenticateClientID,
+		ReportMatches:        *reportMatches,
 	}
 
 	// Begin goptlib client process.
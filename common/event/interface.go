@@ -2,6 +2,7 @@ package event
 
 import (
 	"fmt"
+	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/safelog"
 	"github.com/pion/webrtc/v3"
@@ -68,6 +69,139 @@ func (e EventOnProxyConnectionOver) String() string {
 	return fmt.Sprintf("Proxy connection closed (↑ %d, ↓ %d)", e.InboundTraffic, e.OutboundTraffic)
 }
 
+// EventOnProxyPollResult is sent when a proxy gets the answer to a poll of
+// the broker.
+type EventOnProxyPollResult struct {
+	SnowflakeEvent
+	// Matched is true if the broker handed out a client offer.
+	Matched bool
+	Error   error
+}
+
+func (e EventOnProxyPollResult) String() string {
+	if e.Error != nil {
+		scrubbed := safelog.Scrub([]byte(e.Error.Error()))
+		return fmt.Sprintf("broker poll failure %s", scrubbed)
+	}
+	if e.Matched {
+		return "broker poll matched a client"
+	}
+	return "broker poll found no client"
+}
+
+// EventOnProxyClientConnected is sent when a client opens a data channel to
+// a proxy.
+type EventOnProxyClientConnected struct {
+	SnowflakeEvent
+}
+
+func (e EventOnProxyClientConnected) String() string {
+	return "client connected"
+}
+
+// EventOnProxyConnectionFailed is sent when a proxy that was matched with a
+// client fails to connect to it.
+type EventOnProxyConnectionFailed struct {
+	SnowflakeEvent
+	Error error
+}
+
+func (e EventOnProxyConnectionFailed) String() string {
+	scrubbed := safelog.Scrub([]byte(e.Error.Error()))
+	return fmt.Sprintf("failed to connect to client: %s", scrubbed)
+}
+
+// EventOnCurrentNATTypeDetermined is sent when a proxy has measured its NAT
+// type.
+type EventOnCurrentNATTypeDetermined struct {
+	SnowflakeEvent
+	CurNATType string
+}
+
+func (e EventOnCurrentNATTypeDetermined) String() string {
+	return fmt.Sprintf("NAT type: %v", e.CurNATType)
+}
+
+// EventOnProxyScheduleChange is sent when a proxy enters or leaves the time
+// windows of its schedule, outside which it does not poll for clients.
+type EventOnProxyScheduleChange struct {
+	SnowflakeEvent
+	Active bool
+	// Clients is the number of clients being served, which are left to
+	// finish when the schedule becomes inactive.
+	Clients int
+}
+
+func (e EventOnProxyScheduleChange) String() string {
+	if e.Active {
+		return "Schedule window opened, polling for clients"
+	}
+	return fmt.Sprintf("Schedule window closed, stopped polling and draining %d clients", e.Clients)
+}
+
+// EventOnProxyShutdown is sent when a proxy has shut down gracefully.
+type EventOnProxyShutdown struct {
+	SnowflakeEvent
+	// Drained is the number of clients that finished before the deadline,
+	// and Killed the number whose connections were closed.
+	Drained int
+	Killed  int
+}
+
+func (e EventOnProxyShutdown) String() string {
+	return fmt.Sprintf("Shut down: %d clients finished, %d cut off", e.Drained, e.Killed)
+}
+
+// PeerScore describes the measured quality of a snowflake proxy peer.
+type PeerScore struct {
+	// ID identifies the peer for as long as it is connected.
+	ID string
+	// Active is true for the peer currently carrying traffic, and false
+	// for idle peers waiting to be used.
+	Active bool
+	// RTT is the round trip time to the peer, or 0 if not yet known.
+	RTT time.Duration
+	// Lifetime is the time since the peer was connected.
+	Lifetime time.Duration
+	// InboundTraffic and OutboundTraffic are the number of bytes received
+	// from and sent to the peer.
+	InboundTraffic  int64
+	OutboundTraffic int64
+	// Throughput is the number of bytes per second exchanged with the peer
+	// since it became active.
+	Throughput float64
+	// Score is the overall quality of the peer, between 0 and 1. Higher
+	// is better.
+	Score float64
+}
+
+type EventOnSnowflakePeerScores struct {
+	SnowflakeEvent
+	Scores []PeerScore
+}
+
+func (e EventOnSnowflakePeerScores) String() string {
+	s := fmt.Sprintf("%d snowflake peers", len(e.Scores))
+	for _, score := range e.Scores {
+		state := "idle"
+		if score.Active {
+			state = "active"
+		}
+		s += fmt.Sprintf(", %s: score %.2f rtt %v", state, score.Score, score.RTT.Round(time.Millisecond))
+	}
+	return s
+}
+
+type EventOnSnowflakeRetired struct {
+	SnowflakeEvent
+	Score  PeerScore
+	Reason string
+}
+
+func (e EventOnSnowflakeRetired) String() string {
+	return fmt.Sprintf("retiring underperforming proxy: %s", e.Reason)
+}
+
 type SnowflakeEventReceiver interface {
 	// OnNewSnowflakeEvent notify receiver about a new event
 	// This method MUST not block
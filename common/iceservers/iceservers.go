@@ -0,0 +1,102 @@
+/*
+Package iceservers builds the STUN and TURN server configurations of WebRTC
+peer connections.
+
+TURN servers relay traffic for peers that cannot reach each other directly,
+such as a client and a proxy that are both behind symmetric NATs. Unlike
+STUN servers, they require credentials: either a fixed username and
+credential, or short-lived ones derived from a secret shared with the TURN
+server, as in the TURN REST API that coturn implements with its
+static-auth-secret option.
+*/
+package iceservers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// CredentialLifetime is how long the credentials derived from a shared
+// secret are valid. It bounds how long a connection can keep refreshing its
+// TURN allocation.
+const CredentialLifetime = 24 * time.Hour
+
+// IsTURN reports whether url is the URL of a TURN server, rather than a STUN
+// server.
+func IsTURN(url string) bool {
+	return strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:")
+}
+
+// TURNCredentials authenticate to TURN servers.
+type TURNCredentials struct {
+	// Username and Credential are fixed credentials, for example ones
+	// issued by the TURN server's REST API.
+	Username   string
+	Credential string
+	// Secret, if set, is a secret shared with the TURN server, from which
+	// credentials are derived instead. Username is then optional, and is
+	// appended to the expiry time in the derived username.
+	Secret string
+}
+
+// Empty reports whether no credentials are set.
+func (c TURNCredentials) Empty() bool {
+	return c.Username == "" && c.Credential == "" && c.Secret == ""
+}
+
+// Get returns the username and credential with which to authenticate to a
+// TURN server at time now. Credentials derived from Secret have the form
+// that coturn expects: the username is the Unix time at which they expire,
+// followed by ":" and Username if it is set, and the credential is the
+// base64 HMAC-SHA1 of the username keyed with Secret.
+func (c TURNCredentials) Get(now time.Time) (username string, credential string) {
+	if c.Secret == "" {
+		return c.Username, c.Credential
+	}
+	username = strconv.FormatInt(now.Add(CredentialLifetime).Unix(), 10)
+	if c.Username != "" {
+		username += ":" + c.Username
+	}
+	mac := hmac.New(sha1.New, []byte(c.Secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Servers returns an ICE server for each of urls, ignoring empty ones. The
+// credentials, as of time now, are set on those of TURN servers.
+func Servers(urls []string, credentials TURNCredentials, now time.Time) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	for _, url := range urls {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		server := webrtc.ICEServer{URLs: []string{url}}
+		if IsTURN(url) {
+			server.Username, server.Credential = credentials.Get(now)
+			server.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// Refresh returns a copy of servers in which the credentials of TURN
+// servers are replaced by those as of time now. This keeps credentials
+// derived from a shared secret from expiring in long-running processes.
+func Refresh(servers []webrtc.ICEServer, credentials TURNCredentials, now time.Time) []webrtc.ICEServer {
+	refreshed := make([]webrtc.ICEServer, len(servers))
+	for i, server := range servers {
+		refreshed[i] = server
+		if len(server.URLs) > 0 && IsTURN(server.URLs[0]) {
+			refreshed[i].Username, refreshed[i].Credential = credentials.Get(now)
+		}
+	}
+	return refreshed
+}
@@ -0,0 +1,158 @@
+package iceservers
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startTURNServer starts a TURN server on the loopback interface that
+// accepts credentials derived from secret, and returns its URL.
+func startTURNServer(secret string) (*turn.Server, string, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: "snowflake.test",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			// Check credentials the way coturn does with
+			// static-auth-secret.
+			parts := strings.SplitN(username, ":", 2)
+			expiry, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil || time.Now().Unix() > expiry {
+				return nil, false
+			}
+			user := ""
+			if len(parts) == 2 {
+				user = parts[1]
+			}
+			derivedUsername, credential := TURNCredentials{Username: user, Secret: secret}.Get(time.Unix(expiry, 0).Add(-CredentialLifetime))
+			if derivedUsername != username {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, credential), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: conn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return server, "turn:" + conn.LocalAddr().String() + "?transport=udp", nil
+}
+
+// relayedPeerConnection creates a PeerConnection that only uses relay
+// candidates from the given ICE servers.
+func relayedPeerConnection(servers []webrtc.ICEServer) (*webrtc.PeerConnection, error) {
+	return webrtc.NewPeerConnection(webrtc.Configuration{
+		ICEServers:         servers,
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+	})
+}
+
+func TestICEServers(t *testing.T) {
+	Convey("ICE servers", t, func() {
+		now := time.Unix(1600000000, 0)
+
+		Convey("sets credentials only on TURN servers", func() {
+			servers := Servers([]string{"stun:stun.example.com:3478", "", " turns:turn.example.com:5349"},
+				TURNCredentials{Username: "user", Credential: "pass"}, now)
+			So(len(servers), ShouldEqual, 2)
+			So(servers[0], ShouldResemble, webrtc.ICEServer{URLs: []string{"stun:stun.example.com:3478"}})
+			So(servers[1].URLs, ShouldResemble, []string{"turns:turn.example.com:5349"})
+			So(servers[1].Username, ShouldEqual, "user")
+			So(servers[1].Credential, ShouldEqual, "pass")
+		})
+
+		Convey("derives short-lived credentials from a shared secret", func() {
+			credentials := TURNCredentials{Secret: "secret"}
+			username, credential := credentials.Get(now)
+			So(username, ShouldEqual, strconv.FormatInt(now.Add(CredentialLifetime).Unix(), 10))
+			// The credential is the base64 HMAC-SHA1 of the username.
+			So(credential, ShouldEqual, "N0hJnjNv6MR73b3FtamTQ+xXIiQ=")
+
+			credentials.Username = "snowflake"
+			username, _ = credentials.Get(now)
+			So(username, ShouldEqual, strconv.FormatInt(now.Add(CredentialLifetime).Unix(), 10)+":snowflake")
+
+			servers := Servers([]string{"turn:turn.example.com:3478"}, credentials, now)
+			refreshed := Refresh(servers, credentials, now.Add(time.Hour))
+			So(refreshed[0].Username, ShouldNotEqual, servers[0].Username)
+			So(refreshed[0].URLs, ShouldResemble, servers[0].URLs)
+		})
+
+		Convey("connects peers through a TURN server", func() {
+			server, url, err := startTURNServer("secret")
+			So(err, ShouldBeNil)
+			defer server.Close()
+
+			offerer, err := relayedPeerConnection(Servers([]string{url}, TURNCredentials{Username: "client", Secret: "secret"}, time.Now()))
+			So(err, ShouldBeNil)
+			defer offerer.Close()
+			answerer, err := relayedPeerConnection(Servers([]string{url}, TURNCredentials{Secret: "secret"}, time.Now()))
+			So(err, ShouldBeNil)
+			defer answerer.Close()
+
+			open := make(chan struct{})
+			answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+				dc.OnOpen(func() { close(open) })
+			})
+			_, err = offerer.CreateDataChannel("test", nil)
+			So(err, ShouldBeNil)
+
+			offer, err := offerer.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			gathered := webrtc.GatheringCompletePromise(offerer)
+			So(offerer.SetLocalDescription(offer), ShouldBeNil)
+			<-gathered
+			So(offerer.LocalDescription().SDP, ShouldContainSubstring, "typ relay")
+
+			So(answerer.SetRemoteDescription(*offerer.LocalDescription()), ShouldBeNil)
+			answer, err := answerer.CreateAnswer(nil)
+			So(err, ShouldBeNil)
+			gathered = webrtc.GatheringCompletePromise(answerer)
+			So(answerer.SetLocalDescription(answer), ShouldBeNil)
+			<-gathered
+			So(offerer.SetRemoteDescription(*answerer.LocalDescription()), ShouldBeNil)
+
+			select {
+			case <-open:
+			case <-time.After(10 * time.Second):
+				So("timed out waiting for data channel", ShouldBeEmpty)
+			}
+		})
+
+		Convey("are refused by a TURN server with wrong credentials", func() {
+			server, url, err := startTURNServer("secret")
+			So(err, ShouldBeNil)
+			defer server.Close()
+
+			pc, err := relayedPeerConnection(Servers([]string{url}, TURNCredentials{Secret: "wrong"}, time.Now()))
+			So(err, ShouldBeNil)
+			defer pc.Close()
+			_, err = pc.CreateDataChannel("test", nil)
+			So(err, ShouldBeNil)
+			offer, err := pc.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			gathered := webrtc.GatheringCompletePromise(pc)
+			So(pc.SetLocalDescription(offer), ShouldBeNil)
+			<-gathered
+			So(pc.LocalDescription().SDP, ShouldNotContainSubstring, "typ relay")
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package kcpprofile
+
+import (
+	"time"
+)
+
+const (
+	// DelayTarget is the queuing delay that a DelayController aims for.
+	DelayTarget = 100 * time.Millisecond
+	// How often a DelayController updates the send window.
+	delayControlInterval = 100 * time.Millisecond
+	// The base delay is the lowest round trip time seen in the current and
+	// the previous period of this length, so that the controller adapts when
+	// a session moves to a slower path.
+	baseDelayPeriod = time.Minute
+
+	minDelayWindow     = 16
+	initialDelayWindow = 128
+)
+
+// windowedConn is the part of a *kcp.UDPSession that a DelayController uses.
+type windowedConn interface {
+	GetSRTT() int32
+	SetWindowSize(sndwnd, rcvwnd int)
+}
+
+// DelayController is a delay-based congestion controller for a KCP session.
+// KCP's own congestion window is loss-based, and Snowflake turns it off
+// because proxies rarely drop packets: they queue them instead. The
+// DelayController takes the queuing delay to be how much the smoothed round
+// trip time exceeds the lowest one recently seen, and limits the send window
+// to keep it near DelayTarget, growing the window while the delay is low and
+// shrinking it when the delay is high.
+type DelayController struct {
+	minWindow int
+	maxWindow int
+	window    int
+	target    time.Duration
+
+	// The lowest round trip times seen in the current and previous base
+	// delay periods.
+	curMin      time.Duration
+	prevMin     time.Duration
+	periodStart time.Time
+	// The window is not shrunk again before this time, to give the smoothed
+	// round trip time a chance to reflect the previous decrease.
+	holdUntil time.Time
+}
+
+// NewDelayController returns a DelayController that keeps the send window
+// at most maxWindow packets.
+func NewDelayController(maxWindow int) *DelayController {
+	c := &DelayController{
+		minWindow: minDelayWindow,
+		maxWindow: maxWindow,
+		window:    initialDelayWindow,
+		target:    DelayTarget,
+	}
+	if c.minWindow > maxWindow {
+		c.minWindow = maxWindow
+	}
+	c.clamp()
+	return c
+}
+
+func (c *DelayController) clamp() {
+	if c.window < c.minWindow {
+		c.window = c.minWindow
+	}
+	if c.window > c.maxWindow {
+		c.window = c.maxWindow
+	}
+}
+
+// Window returns the current send window, in packets.
+func (c *DelayController) Window() int {
+	return c.window
+}
+
+// Update takes a new smoothed round trip time measured at now, and returns
+// the new send window. A zero srtt, meaning no measurement yet, leaves the
+// window unchanged.
+func (c *DelayController) Update(srtt time.Duration, now time.Time) int {
+	if srtt <= 0 {
+		return c.window
+	}
+	if c.periodStart.IsZero() || now.Sub(c.periodStart) >= baseDelayPeriod {
+		c.prevMin, c.curMin = c.curMin, 0
+		c.periodStart = now
+	}
+	if c.curMin == 0 || srtt < c.curMin {
+		c.curMin = srtt
+	}
+	base := c.curMin
+	if c.prevMin != 0 && c.prevMin < base {
+		base = c.prevMin
+	}
+
+	queuing := srtt - base
+	switch {
+	case queuing > c.target:
+		if now.Before(c.holdUntil) {
+			break
+		}
+		c.window -= c.window / 4
+		c.holdUntil = now.Add(srtt)
+	case queuing < c.target/2:
+		increase := c.window / 8
+		if increase < 1 {
+			increase = 1
+		}
+		c.window += increase
+	}
+	c.clamp()
+	return c.window
+}
+
+// Run periodically updates the send window of conn from its smoothed round
+// trip time, until closed returns true.
+func (c *DelayController) Run(conn windowedConn, closed func() bool) {
+	conn.SetWindowSize(c.window, 0)
+	ticker := time.NewTicker(delayControlInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if closed() {
+			return
+		}
+		srtt := time.Duration(conn.GetSRTT()) * time.Millisecond
+		// A zero receive window leaves the receive window unchanged.
+		conn.SetWindowSize(c.Update(srtt, time.Now()), 0)
+	}
+}
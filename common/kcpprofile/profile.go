@@ -0,0 +1,130 @@
+// Package kcpprofile provides named sets of KCP and smux parameters for the
+// sessions that Snowflake clients and servers run over turbotunnel, and an
+// optional delay-based congestion controller for them.
+package kcpprofile
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// Profile is a set of tuning parameters for a KCP session and the smux
+// session on top of it.
+type Profile struct {
+	// Name is the name the profile is selected by.
+	Name string
+
+	// WindowSize is the number of packets in the send and receive window of
+	// a KCP connection.
+	WindowSize int
+	// NoDelay, Interval, Resend and NoCongestion are the arguments of
+	// kcp.UDPSession.SetNoDelay.
+	NoDelay      int
+	Interval     int
+	Resend       int
+	NoCongestion int
+
+	// StreamSize controls the maximum amount of in flight data in each smux
+	// stream.
+	StreamSize int
+	// ReceiveBuffer is the maximum amount of data buffered for all the
+	// streams of an smux session.
+	ReceiveBuffer int
+
+	// DelayControl enables a DelayController that limits the send window in
+	// order to keep queuing delay low.
+	DelayControl bool
+}
+
+var (
+	// Default is the profile Snowflake has always used. The send and receive
+	// windows are set to a high number, and the dynamic congestion window is
+	// turned off, so throughput is limited only by the smux stream buffer.
+	// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40026
+	Default = Profile{
+		Name:          "default",
+		WindowSize:    65535,
+		NoDelay:       0,
+		Interval:      0,
+		Resend:        0,
+		NoCongestion:  1,
+		StreamSize:    1048576, // 1MB
+		ReceiveBuffer: 4194304, // 4MB
+	}
+
+	// LowLatency suits interactive use over slow proxies. It retransmits
+	// sooner, keeps less data in flight per stream, and lets a
+	// DelayController shrink the send window when packets start to queue.
+	LowLatency = Profile{
+		Name:          "low-latency",
+		WindowSize:    65535,
+		NoDelay:       1,
+		Interval:      10,
+		Resend:        2,
+		NoCongestion:  1,
+		StreamSize:    262144, // 256KB
+		ReceiveBuffer: 4194304,
+		DelayControl:  true,
+	}
+
+	// Bulk suits large transfers over fast proxies, allowing more data in
+	// flight per stream than the default.
+	Bulk = Profile{
+		Name:          "bulk",
+		WindowSize:    65535,
+		NoDelay:       0,
+		Interval:      0,
+		Resend:        0,
+		NoCongestion:  1,
+		StreamSize:    4194304,  // 4MB
+		ReceiveBuffer: 16777216, // 16MB
+	}
+)
+
+// Profiles lists the available profiles.
+var Profiles = []Profile{Default, LowLatency, Bulk}
+
+// Get returns the profile with the given name. The empty name selects the
+// default profile.
+func Get(name string) (Profile, error) {
+	if name == "" {
+		return Default, nil
+	}
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("unknown KCP profile %q", name)
+}
+
+// Configure applies the KCP parameters of the profile to conn.
+func (p Profile) Configure(conn *kcp.UDPSession) {
+	// Permit coalescing the payloads of consecutive sends.
+	conn.SetStreamMode(true)
+	conn.SetWindowSize(p.WindowSize, p.WindowSize)
+	conn.SetNoDelay(p.NoDelay, p.Interval, p.Resend, p.NoCongestion)
+}
+
+// SmuxConfig returns the configuration of an smux session using the stream
+// buffer sizes of the profile.
+func (p Profile) SmuxConfig() *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	smuxConfig.KeepAliveTimeout = 10 * time.Minute
+	smuxConfig.MaxStreamBuffer = p.StreamSize
+	smuxConfig.MaxReceiveBuffer = p.ReceiveBuffer
+	return smuxConfig
+}
+
+// StartDelayController starts a DelayController on conn if the profile has
+// DelayControl set. It runs until closed returns true.
+func (p Profile) StartDelayController(conn *kcp.UDPSession, closed func() bool) {
+	if !p.DelayControl {
+		return
+	}
+	go NewDelayController(p.WindowSize).Run(conn, closed)
+}
@@ -0,0 +1,476 @@
+package kcpprofile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+type memAddr string
+
+func (addr memAddr) Network() string { return "mem" }
+func (addr memAddr) String() string  { return string(addr) }
+
+// linkConfig describes one direction of an emulated network path. Packets
+// wait in a queue of queueLen packets for a bottleneck of the given
+// bandwidth, in bytes per second, and then take latency to arrive. A zero
+// bandwidth means the bottleneck is infinitely fast.
+type linkConfig struct {
+	latency   time.Duration
+	bandwidth int
+	queueLen  int
+}
+
+type delayedPacket struct {
+	p         []byte
+	deliverAt time.Time
+}
+
+// memPacketConn is one end of an in-memory net.PacketConn pair, made by
+// newMemPacketConnPair.
+type memPacketConn struct {
+	local, remote memAddr
+	recv          chan []byte
+	// The bottleneck queue of the link to the other end.
+	queue     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newMemPacketConnPair returns two connected memPacketConns. Packets between
+// them go over links emulated according to lc.
+func newMemPacketConnPair(lc linkConfig) (*memPacketConn, *memPacketConn) {
+	newConn := func(local, remote memAddr) *memPacketConn {
+		return &memPacketConn{
+			local:  local,
+			remote: remote,
+			recv:   make(chan []byte, 4096),
+			queue:  make(chan []byte, lc.queueLen),
+			closed: make(chan struct{}),
+		}
+	}
+	a := newConn("a", "b")
+	b := newConn("b", "a")
+	go a.runLink(lc, b)
+	go b.runLink(lc, a)
+	return a, b
+}
+
+// runLink moves packets from c's queue to dst's receive queue, at the speed
+// of the bottleneck and after the latency of the link.
+func (c *memPacketConn) runLink(lc linkConfig, dst *memPacketConn) {
+	inFlight := make(chan delayedPacket, 65536)
+	go func() {
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-dst.closed:
+				return
+			case dp := <-inFlight:
+				time.Sleep(time.Until(dp.deliverAt))
+				select {
+				case dst.recv <- dp.p:
+				default: // OK to drop packets.
+				}
+			}
+		}
+	}()
+
+	var next time.Time
+	for {
+		var p []byte
+		select {
+		case <-c.closed:
+			return
+		case p = <-c.queue:
+		}
+		now := time.Now()
+		if lc.bandwidth > 0 {
+			if next.Before(now) {
+				next = now
+			}
+			next = next.Add(time.Duration(len(p)) * time.Second / time.Duration(lc.bandwidth))
+			time.Sleep(time.Until(next))
+			now = next
+		}
+		select {
+		case inFlight <- delayedPacket{p: p, deliverAt: now.Add(lc.latency)}:
+		default:
+		}
+	}
+}
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, io.ErrClosedPipe
+	case buf := <-c.recv:
+		return copy(p, buf), c.remote, nil
+	}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.queue <- append([]byte(nil), p...):
+	default: // The bottleneck queue is full.
+	}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr                { return c.local }
+func (c *memPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sessionPair is a client and a server smux session tuned with the same
+// profile, over a memPacketConn pair.
+type sessionPair struct {
+	client  *smux.Session
+	server  *smux.Session
+	cleanup []func()
+}
+
+func (sp *sessionPair) Close() {
+	for i := len(sp.cleanup) - 1; i >= 0; i-- {
+		sp.cleanup[i]()
+	}
+}
+
+func newSessionPair(tb testing.TB, profile Profile, lc linkConfig) *sessionPair {
+	tb.Helper()
+	sp := &sessionPair{}
+	clientPconn, serverPconn := newMemPacketConnPair(lc)
+	sp.cleanup = append(sp.cleanup, func() {
+		clientPconn.Close()
+		serverPconn.Close()
+	})
+
+	ln, err := kcp.ServeConn(nil, 0, 0, serverPconn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sp.cleanup = append(sp.cleanup, func() { ln.Close() })
+
+	clientConn, err := kcp.NewConn2(clientPconn.remote, nil, 0, 0, clientPconn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	profile.Configure(clientConn)
+	sp.client, err = smux.Client(clientConn, profile.SmuxConfig())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sp.cleanup = append(sp.cleanup, func() {
+		sp.client.Close()
+		clientConn.Close()
+	})
+	profile.StartDelayController(clientConn, sp.client.IsClosed)
+	// KCP creates the server's session when the first packet arrives.
+	if _, err := sp.client.OpenStream(); err != nil {
+		tb.Fatal(err)
+	}
+
+	serverConn, err := ln.AcceptKCP()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	profile.Configure(serverConn)
+	sp.server, err = smux.Server(serverConn, profile.SmuxConfig())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sp.cleanup = append(sp.cleanup, func() {
+		sp.server.Close()
+		serverConn.Close()
+	})
+	profile.StartDelayController(serverConn, sp.server.IsClosed)
+	if _, err := sp.server.AcceptStream(); err != nil {
+		tb.Fatal(err)
+	}
+	return sp
+}
+
+// serve handles the streams opened by the client. A stream starting with
+// 'p' is echoed back. A stream starting with 'b' carries an 8-byte length,
+// and then that many bytes, which are discarded before a single byte is sent
+// in acknowledgement.
+func (sp *sessionPair) serve() {
+	for {
+		stream, err := sp.server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			var kind [1]byte
+			if _, err := io.ReadFull(stream, kind[:]); err != nil {
+				return
+			}
+			switch kind[0] {
+			case 'p':
+				io.Copy(stream, stream)
+			case 'b':
+				var length [8]byte
+				if _, err := io.ReadFull(stream, length[:]); err != nil {
+					return
+				}
+				if _, err := io.CopyN(ioutil.Discard, stream, int64(binary.BigEndian.Uint64(length[:]))); err != nil {
+					return
+				}
+				stream.Write([]byte{0})
+			}
+		}()
+	}
+}
+
+// bulk sends total bytes, in chunks of chunkSize, and waits for the server to
+// receive them.
+func (sp *sessionPair) bulk(total int64, chunkSize int) error {
+	stream, err := sp.client.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	var header [9]byte
+	header[0] = 'b'
+	binary.BigEndian.PutUint64(header[1:], uint64(total))
+	if _, err := stream.Write(header[:]); err != nil {
+		return err
+	}
+	chunk := make([]byte, chunkSize)
+	rand.Read(chunk)
+	for sent := int64(0); sent < total; sent += int64(len(chunk)) {
+		if total-sent < int64(len(chunk)) {
+			chunk = chunk[:total-sent]
+		}
+		if _, err := stream.Write(chunk); err != nil {
+			return err
+		}
+	}
+	var ack [1]byte
+	_, err = io.ReadFull(stream, ack[:])
+	return err
+}
+
+// pingLoop measures round trips of one byte on its own stream, while the
+// link may be busy with other streams, until done is closed. It returns the
+// mean round trip time.
+func (sp *sessionPair) pingLoop(done <-chan struct{}) (time.Duration, error) {
+	stream, err := sp.client.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte{'p'}); err != nil {
+		return 0, err
+	}
+	var total time.Duration
+	var count int
+	for {
+		select {
+		case <-done:
+			if count == 0 {
+				return 0, nil
+			}
+			return total / time.Duration(count), nil
+		case <-time.After(10 * time.Millisecond):
+		}
+		start := time.Now()
+		var b [1]byte
+		if _, err := stream.Write(b[:]); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(stream, b[:]); err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+		count++
+	}
+}
+
+func TestGet(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"", "default"},
+		{"default", "default"},
+		{"low-latency", "low-latency"},
+		{"bulk", "bulk"},
+	} {
+		p, err := Get(test.name)
+		if err != nil {
+			t.Errorf("Get(%q) returned error %v", test.name, err)
+		} else if p.Name != test.expected {
+			t.Errorf("Get(%q) returned profile %q, expected %q", test.name, p.Name, test.expected)
+		}
+	}
+	if _, err := Get("fast"); err == nil {
+		t.Errorf("Get of an unknown profile did not return an error")
+	}
+}
+
+func TestSmuxConfig(t *testing.T) {
+	for _, p := range Profiles {
+		if err := smux.VerifyConfig(p.SmuxConfig()); err != nil {
+			t.Errorf("profile %q: %v", p.Name, err)
+		}
+	}
+}
+
+func TestDelayController(t *testing.T) {
+	now := time.Now()
+	c := NewDelayController(1000)
+	if c.Window() != initialDelayWindow {
+		t.Fatalf("initial window %d, expected %d", c.Window(), initialDelayWindow)
+	}
+
+	// No measurement yet.
+	if w := c.Update(0, now); w != initialDelayWindow {
+		t.Errorf("window changed to %d without a measurement", w)
+	}
+
+	// The window grows while there is no queuing delay, up to the maximum.
+	for i := 0; i < 100; i++ {
+		now = now.Add(delayControlInterval)
+		c.Update(50*time.Millisecond, now)
+	}
+	if c.Window() != 1000 {
+		t.Errorf("window %d after low delay, expected 1000", c.Window())
+	}
+
+	// The window shrinks when the delay exceeds the target, but not again
+	// until a round trip time has passed.
+	now = now.Add(delayControlInterval)
+	w := c.Update(400*time.Millisecond, now)
+	if w != 750 {
+		t.Errorf("window %d after high delay, expected 750", w)
+	}
+	now = now.Add(delayControlInterval)
+	if w := c.Update(400*time.Millisecond, now); w != 750 {
+		t.Errorf("window shrunk to %d within a round trip time", w)
+	}
+	for i := 0; i < 100; i++ {
+		now = now.Add(400 * time.Millisecond)
+		c.Update(400*time.Millisecond, now)
+	}
+	if c.Window() != minDelayWindow {
+		t.Errorf("window %d after persistent high delay, expected %d", c.Window(), minDelayWindow)
+	}
+
+	// Once the low round trip time is older than two base delay periods,
+	// the higher one becomes the base delay and the window grows again.
+	for i := 0; i < 100; i++ {
+		now = now.Add(2 * baseDelayPeriod / 100)
+		c.Update(400*time.Millisecond, now)
+	}
+	if c.Window() <= minDelayWindow {
+		t.Errorf("window %d did not grow after the base delay changed", c.Window())
+	}
+}
+
+func TestProfilesTransfer(t *testing.T) {
+	for _, p := range Profiles {
+		t.Run(p.Name, func(t *testing.T) {
+			sp := newSessionPair(t, p, linkConfig{latency: 5 * time.Millisecond, queueLen: 1024})
+			defer sp.Close()
+			go sp.serve()
+
+			stream, err := sp.client.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			data := make([]byte, 256*1024)
+			rand.Read(data)
+			if _, err := stream.Write([]byte{'p'}); err != nil {
+				t.Fatal(err)
+			}
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(data)
+				errCh <- err
+			}()
+			received := make([]byte, len(data))
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(stream, received); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Fatal("received data differs from sent data")
+			}
+		})
+	}
+}
+
+// BenchmarkProfiles compares the throughput of each profile on emulated slow
+// and fast proxy links with deep queues, and the round trip time of another
+// stream on the same session meanwhile, reported as ping-ms.
+func BenchmarkProfiles(b *testing.B) {
+	links := []struct {
+		name string
+		lc   linkConfig
+	}{
+		{"slow", linkConfig{latency: 50 * time.Millisecond, bandwidth: 125000, queueLen: 1000}},
+		{"fast", linkConfig{latency: 20 * time.Millisecond, bandwidth: 12500000, queueLen: 1000}},
+	}
+	const chunkSize = 64 * 1024
+	for _, link := range links {
+		for _, p := range Profiles {
+			b.Run(link.name+"/"+p.Name, func(b *testing.B) {
+				sp := newSessionPair(b, p, link.lc)
+				defer sp.Close()
+				go sp.serve()
+
+				done := make(chan struct{})
+				type pingResult struct {
+					rtt time.Duration
+					err error
+				}
+				pingCh := make(chan pingResult, 1)
+				go func() {
+					rtt, err := sp.pingLoop(done)
+					pingCh <- pingResult{rtt, err}
+				}()
+
+				b.SetBytes(chunkSize)
+				b.ResetTimer()
+				err := sp.bulk(int64(b.N)*chunkSize, chunkSize)
+				b.StopTimer()
+				close(done)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ping := <-pingCh
+				if ping.err != nil && !errors.Is(ping.err, io.ErrClosedPipe) {
+					b.Fatal(ping.err)
+				}
+				b.ReportMetric(float64(ping.rtt)/float64(time.Millisecond), "ping-ms")
+			})
+		}
+	}
+}
@@ -20,36 +20,86 @@ All messages contain the version number
 followed by a new line and then the message body
 <message> := <version>\n<body>
 <version> := <digit>.<digit>
-<body> := <poll request>|<poll response>
+<body> := <poll request>|<poll response>|<match feedback>
 
-There are two different types of body messages,
-each encoded in JSON format
+There are three different types of body messages,
+each encoded in JSON format. Responses are not prefixed
+with a version number.
 
 == ClientPollRequest ==
 <poll request> :=
 {
   offer: <sdp offer>
   [nat: (unknown|restricted|unrestricted)]
+  [nat_behavior: <nat behavior>]
   [fingerprint: <fingerprint string>]
+  [feedback: true]
+  [trickle: true]
 }
 
 The NAT field is optional, and if it is missing a
-value of "unknown" will be assumed.  The fingerprint
+value of "unknown" will be assumed. The optional
+nat_behavior field is the RFC 5780 classification of the
+client's NAT, as measured by common/nat.Classify:
+{
+  [mapping: (endpoint-independent|address-dependent|address-and-port-dependent)]
+  [filtering: (endpoint-independent|address-dependent|address-and-port-dependent)]
+  [hairpinning: true]
+  [udp_blocked: true]
+}
+The broker prefers it to the NAT field, which clients that
+send it should still set for older brokers. The fingerprint
 is also optional and, if absent, will be assigned the
-fingerprint of the default bridge.
+fingerprint of the default bridge. The feedback field
+is set by clients that will report the outcome of the
+match in a ClientMatchFeedback message. The trickle field
+is set by clients that sent their offer before ICE candidate
+gathering was complete, and will send the rest of their
+candidates in trickle requests.
 
 == ClientPollResponse ==
 <poll response> :=
 {
   [answer: <sdp answer>]
   [error: <error string>]
+  [match_id: <match id string>]
+  [trickle: <trickle id string>]
 }
 
 If the broker succeeded in matching the client with a proxy,
 the answer field MUST contain a valid SDP answer, and the
 error field MUST be empty. If the answer field is empty, the
 error field MUST contain a string explaining with a reason
-for the error.
+for the error. If the poll request had the feedback field
+set, the broker MAY include an opaque match id along with
+an answer, which the client can use to report the outcome
+of the match.
+
+If the poll request had the trickle field set, the broker
+only matches the client with a proxy that supports trickle
+ICE, and includes a trickle id along with the answer. If no
+such proxy is available, the error is "no snowflake proxies
+supporting trickle ICE currently available", and the client
+should try again with a complete offer.
+
+== ClientMatchFeedback ==
+<match feedback> :=
+{
+  match_id: <match id from the poll response>
+  outcome: (connected|failed)
+}
+
+The client sends this message once it knows whether it could
+connect to the proxy it was matched with: "connected" if the
+data channel opened, "failed" if it did not. The broker
+forgets match ids after a while, and ignores feedback for
+match ids it does not know.
+
+== ClientMatchFeedbackResponse ==
+<feedback response> :=
+{
+  [error: <error string>]
+}
 
 */
 
@@ -62,9 +112,12 @@ for the error.
 const defaultBridgeFingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
 
 type ClientPollRequest struct {
-	Offer       string `json:"offer"`
-	NAT         string `json:"nat"`
-	Fingerprint string `json:"fingerprint"`
+	Offer       string        `json:"offer"`
+	NAT         string        `json:"nat"`
+	NATBehavior *nat.Behavior `json:"nat_behavior,omitempty"`
+	Fingerprint string        `json:"fingerprint"`
+	Feedback    bool          `json:"feedback,omitempty"`
+	Trickle     bool          `json:"trickle,omitempty"`
 }
 
 // Encodes a poll message from a snowflake client
@@ -121,12 +174,18 @@ func DecodeClientPollRequest(data []byte) (*ClientPollRequest, error) {
 		return nil, fmt.Errorf("invalid NAT type")
 	}
 
+	if message.NATBehavior != nil && !message.NATBehavior.Valid() {
+		return nil, fmt.Errorf("invalid NAT behavior")
+	}
+
 	return &message, nil
 }
 
 type ClientPollResponse struct {
-	Answer string `json:"answer,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Answer  string `json:"answer,omitempty"`
+	Error   string `json:"error,omitempty"`
+	MatchID string `json:"match_id,omitempty"`
+	Trickle string `json:"trickle,omitempty"`
 }
 
 // Encodes a poll response for a snowflake client
@@ -149,3 +208,71 @@ func DecodeClientPollResponse(data []byte) (*ClientPollResponse, error) {
 
 	return &message, nil
 }
+
+// The outcomes of a match that a client can report.
+const (
+	MatchOutcomeConnected = "connected"
+	MatchOutcomeFailed    = "failed"
+)
+
+type ClientMatchFeedback struct {
+	MatchID string `json:"match_id"`
+	Outcome string `json:"outcome"`
+}
+
+// Encodes a match feedback message from a snowflake client
+func (feedback *ClientMatchFeedback) EncodeClientMatchFeedback() ([]byte, error) {
+	body, err := json.Marshal(feedback)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ClientVersion+"\n"), body...), nil
+}
+
+// Decodes a match feedback message from a snowflake client
+func DecodeClientMatchFeedback(data []byte) (*ClientMatchFeedback, error) {
+	parts := bytes.SplitN(data, []byte("\n"), 2)
+
+	if len(parts) < 2 || string(parts[0]) != ClientVersion {
+		return nil, fmt.Errorf("unsupported message version")
+	}
+
+	var message ClientMatchFeedback
+	err := json.Unmarshal(parts[1], &message)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.MatchID == "" {
+		return nil, fmt.Errorf("no supplied match id")
+	}
+
+	switch message.Outcome {
+	case MatchOutcomeConnected:
+	case MatchOutcomeFailed:
+	default:
+		return nil, fmt.Errorf("invalid match outcome")
+	}
+
+	return &message, nil
+}
+
+type ClientMatchFeedbackResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Encodes a match feedback response for a snowflake client
+func (resp *ClientMatchFeedbackResponse) EncodeClientMatchFeedbackResponse() ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+// Decodes a match feedback response for a snowflake client
+func DecodeClientMatchFeedbackResponse(data []byte) (*ClientMatchFeedbackResponse, error) {
+	var message ClientMatchFeedbackResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
@@ -16,4 +16,9 @@ var (
 
 	StrTimedOut  = "timed out waiting for answer!"
 	StrNoProxies = "no snowflake proxies currently available"
+
+	StrBridgeUnavailable = "requested bridge is currently unavailable"
+
+	StrTrickleUnavailable = "no snowflake proxies supporting trickle ICE currently available"
+	StrUnknownTrickleID   = "unknown trickle id"
 )
@@ -1,10 +1,14 @@
 package messages
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -133,6 +137,112 @@ func TestEncodeProxyPollRequests(t *testing.T) {
 	})
 }
 
+func TestSignedProxyPollRequests(t *testing.T) {
+	Convey("Context", t, func() {
+		public, private, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		b, err := EncodeSignedProxyPollRequest("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "snowflake.torproject.net$", private)
+		So(err, ShouldBeNil)
+
+		sid, proxyType, natType, clients, relayPattern, _, err := DecodeProxyPollRequestWithRelayPrefix(b)
+		So(err, ShouldBeNil)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(proxyType, ShouldEqual, "standalone")
+		So(natType, ShouldEqual, "unrestricted")
+		So(clients, ShouldEqual, 8)
+		So(relayPattern, ShouldEqual, "snowflake.torproject.net$")
+
+		message, err := DecodeProxyPollRequestMessage(b)
+		So(err, ShouldBeNil)
+		identity, timestamp, err := message.Identity()
+		So(err, ShouldBeNil)
+		So(identity, ShouldEqual, base64.StdEncoding.EncodeToString(public))
+		So(time.Since(timestamp), ShouldBeLessThan, time.Minute)
+
+		Convey("the signature covers the fields as the proxy sent them", func() {
+			b, err := EncodeSignedProxyPollRequest("ymbcCMto7KHNGYlp", "embedded", "", 8, "", private)
+			So(err, ShouldBeNil)
+			message, err := DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			So(message.Type, ShouldEqual, ProxyUnknown)
+			So(message.NAT, ShouldEqual, nat.NATUnknown)
+			identity, _, err := message.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, base64.StdEncoding.EncodeToString(public))
+		})
+
+		Convey("anonymous requests have no identity", func() {
+			b, err := EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "")
+			So(err, ShouldBeNil)
+			message, err := DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			identity, _, err := message.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, "")
+		})
+
+		Convey("signed requests may advertise trickle ICE", func() {
+			b, err := EncodeProxyPollRequestWithOptions("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "", ProxyPollOptions{Key: private, Trickle: true})
+			So(err, ShouldBeNil)
+			message, err := DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			identity, _, err := message.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, base64.StdEncoding.EncodeToString(public))
+			So(message.Trickle, ShouldBeTrue)
+
+			b, err = EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "")
+			So(err, ShouldBeNil)
+			message, err = DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			So(message.Trickle, ShouldBeFalse)
+		})
+
+		Convey("signed requests may advertise a TURN server", func() {
+			b, err := EncodeProxyPollRequestWithOptions("ymbcCMto7KHNGYlp", "standalone", "restricted", 8, "", ProxyPollOptions{Key: private, TURN: true})
+			So(err, ShouldBeNil)
+			message, err := DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			identity, _, err := message.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, base64.StdEncoding.EncodeToString(public))
+			So(message.TURN, ShouldBeTrue)
+			So(message.Trickle, ShouldBeFalse)
+		})
+
+		Convey("tampered requests are rejected", func() {
+			var message ProxyPollRequest
+			So(json.Unmarshal(b, &message), ShouldBeNil)
+			for _, tamper := range []func(*ProxyPollRequest){
+				func(m *ProxyPollRequest) { m.Sid = "another" },
+				func(m *ProxyPollRequest) { m.NAT = "restricted" },
+				func(m *ProxyPollRequest) { m.Clients = 0 },
+				func(m *ProxyPollRequest) { m.AcceptedRelayPattern = nil },
+				func(m *ProxyPollRequest) { m.Timestamp++ },
+				func(m *ProxyPollRequest) { m.Signature = "" },
+				func(m *ProxyPollRequest) { m.Trickle = true },
+				func(m *ProxyPollRequest) { m.TURN = true },
+				func(m *ProxyPollRequest) { m.NATBehavior = &nat.Behavior{Mapping: nat.EndpointIndependent} },
+				func(m *ProxyPollRequest) { m.PublicKey = "AAAA" },
+				func(m *ProxyPollRequest) {
+					other, _, _ := ed25519.GenerateKey(nil)
+					m.PublicKey = base64.StdEncoding.EncodeToString(other)
+				},
+			} {
+				tampered := message
+				tamper(&tampered)
+				data, err := json.Marshal(tampered)
+				So(err, ShouldBeNil)
+				decoded, err := DecodeProxyPollRequestMessage(data)
+				So(err, ShouldBeNil)
+				identity, _, err := decoded.Identity()
+				So(err, ShouldNotBeNil)
+				So(identity, ShouldEqual, "")
+			}
+		})
+	})
+}
+
 func TestDecodeProxyPollResponse(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -470,3 +580,136 @@ func TestEncodeClientPollResponse(t *testing.T) {
 		So(resp1, ShouldResemble, resp2)
 	})
 }
+
+func TestClientMatchFeedback(t *testing.T) {
+	Convey("Context", t, func() {
+		resp1 := &ClientPollResponse{
+			Answer:  "fake answer",
+			MatchID: "fake match",
+		}
+		b, err := resp1.EncodePollResponse()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `{"answer":"fake answer","match_id":"fake match"}`)
+		resp2, err := DecodeClientPollResponse(b)
+		So(err, ShouldBeNil)
+		So(resp2, ShouldResemble, resp1)
+
+		feedback := &ClientMatchFeedback{MatchID: "fake match", Outcome: MatchOutcomeFailed}
+		b, err = feedback.EncodeClientMatchFeedback()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "1.0\n"+`{"match_id":"fake match","outcome":"failed"}`)
+		decoded, err := DecodeClientMatchFeedback(b)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, feedback)
+
+		for _, data := range []string{
+			`{"match_id":"fake match","outcome":"failed"}`,
+			"2.0\n" + `{"match_id":"fake match","outcome":"failed"}`,
+			"1.0\n" + `{"outcome":"failed"}`,
+			"1.0\n" + `{"match_id":"fake match","outcome":"maybe"}`,
+			"1.0\n" + `not json`,
+		} {
+			_, err := DecodeClientMatchFeedback([]byte(data))
+			So(err, ShouldNotBeNil)
+		}
+
+		b, err = (&ClientMatchFeedbackResponse{}).EncodeClientMatchFeedbackResponse()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `{}`)
+		resp, err := DecodeClientMatchFeedbackResponse([]byte(`{"error":"oops"}`))
+		So(err, ShouldBeNil)
+		So(resp.Error, ShouldEqual, "oops")
+	})
+}
+
+func TestTrickleMessages(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodePollResponseWithTrickleID("fake offer", "restricted", "wss://snowflake.torproject.net/", "fake trickle")
+		So(err, ShouldBeNil)
+		offer, natType, relayURL, trickleID, err := DecodePollResponseWithTrickleID(b)
+		So(err, ShouldBeNil)
+		So(offer, ShouldEqual, "fake offer")
+		So(natType, ShouldEqual, "restricted")
+		So(relayURL, ShouldEqual, "wss://snowflake.torproject.net/")
+		So(trickleID, ShouldEqual, "fake trickle")
+
+		b, err = EncodePollResponse("", false, "")
+		So(err, ShouldBeNil)
+		_, _, _, trickleID, err = DecodePollResponseWithTrickleID(b)
+		So(err, ShouldBeNil)
+		So(trickleID, ShouldEqual, "")
+
+		req := &TrickleRequest{ID: "fake trickle", Role: TrickleRoleClient, Candidates: []string{"candidate:1"}, Done: true}
+		b, err = req.EncodeTrickleRequest()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "1.0\n"+`{"id":"fake trickle","role":"client","candidates":["candidate:1"],"done":true}`)
+		decoded, err := DecodeTrickleRequest(b)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, req)
+
+		for _, data := range []string{
+			`{"id":"fake trickle","role":"client"}`,
+			"2.0\n" + `{"id":"fake trickle","role":"client"}`,
+			"1.0\n" + `{"role":"client"}`,
+			"1.0\n" + `{"id":"fake trickle","role":"broker"}`,
+			"1.0\n" + `not json`,
+		} {
+			_, err := DecodeTrickleRequest([]byte(data))
+			So(err, ShouldNotBeNil)
+		}
+
+		b, err = (&TrickleResponse{Candidates: []string{"candidate:1"}}).EncodeTrickleResponse()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `{"candidates":["candidate:1"]}`)
+		resp, err := DecodeTrickleResponse([]byte(`{"done":true,"error":"oops"}`))
+		So(err, ShouldBeNil)
+		So(resp.Done, ShouldBeTrue)
+		So(resp.Error, ShouldEqual, "oops")
+	})
+}
+
+func TestNATBehaviorMessages(t *testing.T) {
+	Convey("Context", t, func() {
+		behavior := &nat.Behavior{
+			Mapping:     nat.EndpointIndependent,
+			Filtering:   nat.AddressAndPortDependent,
+			Hairpinning: true,
+		}
+
+		Convey("client polls carry the NAT behavior", func() {
+			b, err := (&ClientPollRequest{Offer: "fake", NAT: behavior.Type(), NATBehavior: behavior}).EncodeClientPollRequest()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldContainSubstring, `"nat_behavior":{"mapping":"endpoint-independent","filtering":"address-and-port-dependent","hairpinning":true}`)
+			req, err := DecodeClientPollRequest(b)
+			So(err, ShouldBeNil)
+			So(req.NAT, ShouldEqual, nat.NATUnrestricted)
+			So(req.NATBehavior, ShouldResemble, behavior)
+
+			_, err = DecodeClientPollRequest([]byte(`1.0
+{"offer":"fake","nat_behavior":{"mapping":"symmetric"}}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("signed proxy polls carry the NAT behavior", func() {
+			_, private, err := ed25519.GenerateKey(nil)
+			So(err, ShouldBeNil)
+			b, err := EncodeProxyPollRequestWithOptions("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "", ProxyPollOptions{Key: private, NATBehavior: behavior})
+			So(err, ShouldBeNil)
+			decoded, err := DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			identity, _, err := decoded.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldNotEqual, "")
+			So(decoded.NATBehavior, ShouldResemble, behavior)
+
+			b, err = EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "unrestricted", 8, "")
+			So(err, ShouldBeNil)
+			decoded, err = DecodeProxyPollRequestMessage(b)
+			So(err, ShouldBeNil)
+			So(decoded.NATBehavior, ShouldBeNil)
+
+			_, err = DecodeProxyPollRequestMessage([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.3","NATBehavior":{"filtering":"full cone"}}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -4,10 +4,14 @@
 package messages
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 )
@@ -33,9 +37,21 @@ var KnownProxyTypes = map[string]bool{
   Type: ["badge"|"webext"|"standalone"],
   NAT: ["unknown"|"restricted"|"unrestricted"],
   Clients: [number of current clients, rounded down to multiples of 8],
-  AcceptedRelayPattern: [a pattern representing accepted set of relay domains]
+  AcceptedRelayPattern: [a pattern representing accepted set of relay domains],
+  PublicKey: [optional base64 Ed25519 public key identifying the proxy],
+  Timestamp: [Unix time at which the request was signed, if PublicKey is set],
+  Signature: [base64 Ed25519 signature of the request, if PublicKey is set],
+  Trickle: [optional, true if the proxy supports trickle ICE],
+  TURN: [optional, true if the proxy gathers relay candidates from a TURN server],
+  NATBehavior: [optional RFC 5780 classification of the proxy's NAT]
 }
 
+NATBehavior has the same form as the nat_behavior field of client poll
+requests, and the broker prefers it to NAT.
+
+The signature covers the other fields of the request, as described in
+proxyPollSignedData. Proxies that send no PublicKey are anonymous.
+
 == ProxyPollResponse ==
 1) If a client is matched:
 HTTP 200 OK
@@ -46,9 +62,15 @@ HTTP 200 OK
     sdp: [WebRTC SDP]
   },
   NAT: ["unknown"|"restricted"|"unrestricted"],
-  RelayURL: [the WebSocket URL proxy should connect to relay Snowflake traffic]
+  RelayURL: [the WebSocket URL proxy should connect to relay Snowflake traffic],
+  Trickle: [optional trickle id, if the client uses trickle ICE]
 }
 
+A trickle id is only sent to proxies that set Trickle in their poll. The
+offer may then be missing ICE candidates, and the proxy should send its
+answer without waiting for its own candidates, and exchange candidates with
+the client through the broker as described in trickle.go.
+
 2) If a client is not matched:
 HTTP 200 OK
 
@@ -98,6 +120,32 @@ type ProxyPollRequest struct {
 	Clients int
 
 	AcceptedRelayPattern *string
+
+	PublicKey string `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	Signature string `json:",omitempty"`
+
+	Trickle     bool          `json:",omitempty"`
+	TURN        bool          `json:",omitempty"`
+	NATBehavior *nat.Behavior `json:",omitempty"`
+
+	// The result of checking the signature in DecodeProxyPollRequest
+	identity    string
+	identityErr error
+}
+
+// ProxyPollOptions are the optional features of a proxy poll request.
+type ProxyPollOptions struct {
+	// Key, if set, is the long-lived identity key with which the request
+	// is signed.
+	Key ed25519.PrivateKey
+	// Trickle advertises that the proxy supports trickle ICE.
+	Trickle bool
+	// TURN advertises that the proxy has a TURN server, through which it
+	// can reach clients behind any NAT.
+	TURN bool
+	// NATBehavior, if set, is the classification of the proxy's NAT.
+	NATBehavior *nat.Behavior
 }
 
 func EncodeProxyPollRequest(sid string, proxyType string, natType string, clients int) ([]byte, error) {
@@ -115,6 +163,71 @@ func EncodeProxyPollRequestWithRelayPrefix(sid string, proxyType string, natType
 	})
 }
 
+// Like EncodeProxyPollRequestWithRelayPrefix, but signs the request with the
+// long-lived identity key of the proxy.
+func EncodeSignedProxyPollRequest(sid string, proxyType string, natType string, clients int, relayPattern string, key ed25519.PrivateKey) ([]byte, error) {
+	return EncodeProxyPollRequestWithOptions(sid, proxyType, natType, clients, relayPattern, ProxyPollOptions{Key: key})
+}
+
+// Like EncodeProxyPollRequestWithRelayPrefix, with the given optional
+// features.
+func EncodeProxyPollRequestWithOptions(sid string, proxyType string, natType string, clients int, relayPattern string, options ProxyPollOptions) ([]byte, error) {
+	message := ProxyPollRequest{
+		Sid:                  sid,
+		Version:              version,
+		Type:                 proxyType,
+		NAT:                  natType,
+		Clients:              clients,
+		AcceptedRelayPattern: &relayPattern,
+		Trickle:              options.Trickle,
+		TURN:                 options.TURN,
+		NATBehavior:          options.NATBehavior,
+	}
+	if options.Key != nil {
+		message.PublicKey = base64.StdEncoding.EncodeToString(options.Key.Public().(ed25519.PublicKey))
+		message.Timestamp = time.Now().Unix()
+		message.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(options.Key, proxyPollSignedData(&message)))
+	}
+	return json.Marshal(message)
+}
+
+// proxyPollSignedData returns the bytes that the signature of a poll request
+// covers: a context string and every other field of the request, separated
+// by newlines. The fields are escaped so that none can contain a newline.
+// Fields added after signing was introduced are only included when set, so
+// that the signatures of older proxies remain valid.
+func proxyPollSignedData(message *ProxyPollRequest) []byte {
+	relayPattern := "-"
+	if message.AcceptedRelayPattern != nil {
+		relayPattern = strconv.Quote(*message.AcceptedRelayPattern)
+	}
+	fields := []string{
+		"snowflake proxy poll",
+		strconv.Quote(message.Sid),
+		strconv.Quote(message.Version),
+		strconv.Quote(message.Type),
+		strconv.Quote(message.NAT),
+		strconv.Itoa(message.Clients),
+		relayPattern,
+		message.PublicKey,
+		strconv.FormatInt(message.Timestamp, 10),
+	}
+	if message.Trickle {
+		fields = append(fields, "trickle")
+	}
+	if message.TURN {
+		fields = append(fields, "turn")
+	}
+	if b := message.NATBehavior; b != nil {
+		fields = append(fields, "nat behavior",
+			strconv.Quote(b.Mapping),
+			strconv.Quote(b.Filtering),
+			strconv.FormatBool(b.Hairpinning),
+			strconv.FormatBool(b.UDPBlocked))
+	}
+	return []byte(strings.Join(fields, "\n"))
+}
+
 func DecodeProxyPollRequest(data []byte) (sid string, proxyType string, natType string, clients int, err error) {
 	var relayPrefix string
 	sid, proxyType, natType, clients, relayPrefix, _, err = DecodeProxyPollRequestWithRelayPrefix(data)
@@ -124,46 +237,95 @@ func DecodeProxyPollRequest(data []byte) (sid string, proxyType string, natType
 	return
 }
 
-// Decodes a poll message from a snowflake proxy and returns the
-// sid, proxy type, nat type and clients of the proxy on success
-// and an error if it failed
-func DecodeProxyPollRequestWithRelayPrefix(data []byte) (
-	sid string, proxyType string, natType string, clients int, relayPrefix string, relayPrefixAware bool, err error) {
+// Decodes a poll message from a snowflake proxy. An empty NAT type is
+// replaced by unknown, and a proxy type that is not in KnownProxyTypes by
+// ProxyUnknown. The signature of the message, if any, is checked against the
+// fields as the proxy sent them, and its result is returned by Identity. It
+// returns an error if the message is malformed, but not if only its
+// signature is invalid.
+func DecodeProxyPollRequestMessage(data []byte) (*ProxyPollRequest, error) {
 	var message ProxyPollRequest
 
-	err = json.Unmarshal(data, &message)
+	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	majorVersion := strings.Split(message.Version, ".")[0]
 	if majorVersion != "1" {
-		err = fmt.Errorf("using unknown version")
-		return
+		return nil, fmt.Errorf("using unknown version")
 	}
 
 	// Version 1.x requires an Sid
 	if message.Sid == "" {
-		err = fmt.Errorf("no supplied session id")
-		return
+		return nil, fmt.Errorf("no supplied session id")
 	}
 
 	switch message.NAT {
 	case "":
-		message.NAT = nat.NATUnknown
 	case nat.NATUnknown:
 	case nat.NATRestricted:
 	case nat.NATUnrestricted:
 	default:
-		err = fmt.Errorf("invalid NAT type")
-		return
+		return nil, fmt.Errorf("invalid NAT type")
 	}
 
+	if message.NATBehavior != nil && !message.NATBehavior.Valid() {
+		return nil, fmt.Errorf("invalid NAT behavior")
+	}
+
+	message.identity, message.identityErr = message.verifySignature()
+
+	if message.NAT == "" {
+		message.NAT = nat.NATUnknown
+	}
 	// we don't reject polls with an unknown proxy type because we encourage
 	// projects that embed proxy code to include their own type
 	if !KnownProxyTypes[message.Type] {
 		message.Type = ProxyUnknown
 	}
+	return &message, nil
+}
+
+// verifySignature returns the public key of a signed message whose signature
+// is valid, an empty identity for an anonymous message, and an error if the
+// message carries a public key but the signature does not match it.
+func (message *ProxyPollRequest) verifySignature() (string, error) {
+	if message.PublicKey == "" {
+		return "", nil
+	}
+	key, err := base64.StdEncoding.DecodeString(message.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid public key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil || !ed25519.Verify(key, proxyPollSignedData(message), signature) {
+		return "", fmt.Errorf("invalid signature")
+	}
+	return message.PublicKey, nil
+}
+
+// Identity returns the identity of the proxy that sent a poll message decoded
+// by DecodeProxyPollRequestMessage. It is empty if the proxy is anonymous, or the
+// proxy's public key, with the time at which the message was signed, if the
+// signature is valid. It returns an error if the message carries a public key
+// but the signature does not match it.
+func (message *ProxyPollRequest) Identity() (identity string, timestamp time.Time, err error) {
+	if message.identityErr != nil || message.identity == "" {
+		return "", time.Time{}, message.identityErr
+	}
+	return message.identity, time.Unix(message.Timestamp, 0), nil
+}
+
+// Decodes a poll message from a snowflake proxy and returns the
+// sid, proxy type, nat type and clients of the proxy on success
+// and an error if it failed
+func DecodeProxyPollRequestWithRelayPrefix(data []byte) (
+	sid string, proxyType string, natType string, clients int, relayPrefix string, relayPrefixAware bool, err error) {
+	message, err := DecodeProxyPollRequestMessage(data)
+	if err != nil {
+		return
+	}
 	var acceptedRelayPattern = ""
 	if message.AcceptedRelayPattern != nil {
 		acceptedRelayPattern = *message.AcceptedRelayPattern
@@ -178,6 +340,8 @@ type ProxyPollResponse struct {
 	NAT    string
 
 	RelayURL string
+
+	Trickle string `json:",omitempty"`
 }
 
 func EncodePollResponse(offer string, success bool, natType string) ([]byte, error) {
@@ -198,6 +362,19 @@ func EncodePollResponseWithRelayURL(offer string, success bool, natType, relayUR
 		Status: failReason,
 	})
 }
+
+// Like EncodePollResponseWithRelayURL for a successful match, with the
+// trickle id of a client that uses trickle ICE.
+func EncodePollResponseWithTrickleID(offer string, natType, relayURL, trickleID string) ([]byte, error) {
+	return json.Marshal(ProxyPollResponse{
+		Status:   "client match",
+		Offer:    offer,
+		NAT:      natType,
+		RelayURL: relayURL,
+		Trickle:  trickleID,
+	})
+}
+
 func DecodePollResponse(data []byte) (string, string, error) {
 	offer, natType, relayURL, err := DecodePollResponseWithRelayURL(data)
 	if relayURL != "" {
@@ -209,23 +386,31 @@ func DecodePollResponse(data []byte) (string, string, error) {
 // Decodes a poll response from the broker and returns an offer and the client's NAT type
 // If there is a client match, the returned offer string will be non-empty
 func DecodePollResponseWithRelayURL(data []byte) (string, string, string, error) {
+	offer, natType, relayURL, _, err := DecodePollResponseWithTrickleID(data)
+	return offer, natType, relayURL, err
+}
+
+// Like DecodePollResponseWithRelayURL, but also returns the trickle id of the
+// client, which is empty unless the client uses trickle ICE
+func DecodePollResponseWithTrickleID(data []byte) (string, string, string, string, error) {
 	var message ProxyPollResponse
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", "", err
 	}
 	if message.Status == "" {
-		return "", "", "", fmt.Errorf("received invalid data")
+		return "", "", "", "", fmt.Errorf("received invalid data")
 	}
 
 	err = nil
 	if message.Status == "client match" {
 		if message.Offer == "" {
-			return "", "", "", fmt.Errorf("no supplied offer")
+			return "", "", "", "", fmt.Errorf("no supplied offer")
 		}
 	} else {
 		message.Offer = ""
+		message.Trickle = ""
 		if message.Status != "no match" {
 			err = errors.New(message.Status)
 		}
@@ -236,7 +421,7 @@ func DecodePollResponseWithRelayURL(data []byte) (string, string, string, error)
 		natType = "unknown"
 	}
 
-	return message.Offer, natType, message.RelayURL, err
+	return message.Offer, natType, message.RelayURL, message.Trickle, err
 }
 
 type ProxyAnswerRequest struct {
@@ -0,0 +1,118 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/* Trickle ICE protocol v1.x specification:
+
+Clients and proxies that support trickle ICE send their offer and answer
+before ICE candidate gathering is complete, and exchange the remaining
+candidates through the broker. A client asks for this by setting the
+trickle field of its poll request. If the broker matches it with a proxy
+that advertised trickle support in its poll, both the proxy's poll response
+and the client's poll response carry the same opaque trickle id, and both
+peers then send trickle requests, prefixed with a version number as client
+messages are.
+
+== TrickleRequest ==
+<version>\n
+{
+  id: <trickle id from the poll response>
+  role: (client|proxy)
+  [candidates: [<ICE candidate string>, ...]]
+  [done: true]
+}
+
+The candidates are the sender's new local candidates, as in the
+"candidate:" attribute of an SDP. The done field is set once the sender
+has gathered all its candidates. A request with neither candidates nor
+done is held by the broker until the other peer has sent candidates or
+finished, or until a timeout.
+
+== TrickleResponse ==
+{
+  [candidates: [<ICE candidate string>, ...]]
+  [done: true]
+  [error: <error string>]
+}
+
+The candidates are those of the other peer that have not been returned in
+an earlier response. The done field is set once the other peer has sent
+all its candidates. The error field is set if the broker does not know the
+trickle id, for example because it has expired.
+
+*/
+
+const (
+	TrickleRoleClient = "client"
+	TrickleRoleProxy  = "proxy"
+)
+
+type TrickleRequest struct {
+	ID         string   `json:"id"`
+	Role       string   `json:"role"`
+	Candidates []string `json:"candidates,omitempty"`
+	Done       bool     `json:"done,omitempty"`
+}
+
+// Encodes a trickle request from a snowflake client or proxy
+func (req *TrickleRequest) EncodeTrickleRequest() ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ClientVersion+"\n"), body...), nil
+}
+
+// Decodes a trickle request from a snowflake client or proxy
+func DecodeTrickleRequest(data []byte) (*TrickleRequest, error) {
+	parts := bytes.SplitN(data, []byte("\n"), 2)
+
+	if len(parts) < 2 || string(parts[0]) != ClientVersion {
+		return nil, fmt.Errorf("unsupported message version")
+	}
+
+	var message TrickleRequest
+	err := json.Unmarshal(parts[1], &message)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.ID == "" {
+		return nil, fmt.Errorf("no supplied trickle id")
+	}
+
+	switch message.Role {
+	case TrickleRoleClient:
+	case TrickleRoleProxy:
+	default:
+		return nil, fmt.Errorf("invalid trickle role")
+	}
+
+	return &message, nil
+}
+
+type TrickleResponse struct {
+	Candidates []string `json:"candidates,omitempty"`
+	Done       bool     `json:"done,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Encodes a trickle response for a snowflake client or proxy
+func (resp *TrickleResponse) EncodeTrickleResponse() ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+// Decodes a trickle response for a snowflake client or proxy
+func DecodeTrickleResponse(data []byte) (*TrickleResponse, error) {
+	var message TrickleResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
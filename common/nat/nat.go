@@ -31,6 +31,126 @@ const (
 	NATUnrestricted = "unrestricted"
 )
 
+// The mapping and filtering behaviours of a NAT, as defined in RFC 4787.
+const (
+	EndpointIndependent     = "endpoint-independent"
+	AddressDependent        = "address-dependent"
+	AddressAndPortDependent = "address-and-port-dependent"
+)
+
+var (
+	// How long to wait for the STUN server to answer a request.
+	responseTimeout = 10 * time.Second
+	// How long to wait for an answer that the NAT may filter out, in the
+	// filtering and hairpinning tests. No answer is an expected result
+	// there, so this is shorter than responseTimeout.
+	filteredTimeout = 3 * time.Second
+)
+
+// Behavior is the classification of a NAT according to the tests of RFC 5780.
+// An empty Mapping or Filtering means that it could not be determined.
+type Behavior struct {
+	Mapping   string `json:"mapping,omitempty"`
+	Filtering string `json:"filtering,omitempty"`
+	// Whether the NAT forwards packets sent to its external address from
+	// behind it
+	Hairpinning bool `json:"hairpinning,omitempty"`
+	// Whether the STUN server could not be reached over UDP at all
+	UDPBlocked bool `json:"udp_blocked,omitempty"`
+}
+
+func validBehavior(behavior string) bool {
+	switch behavior {
+	case "", EndpointIndependent, AddressDependent, AddressAndPortDependent:
+		return true
+	}
+	return false
+}
+
+// Valid reports whether the mapping and filtering of b are known values or
+// empty.
+func (b Behavior) Valid() bool {
+	return validBehavior(b.Mapping) && validBehavior(b.Filtering)
+}
+
+// Type returns the NAT type that summarizes b for peers that only know
+// NATUnknown, NATRestricted and NATUnrestricted: the NAT is restricted unless
+// its mapping is endpoint-independent.
+func (b Behavior) Type() string {
+	switch {
+	case b.UDPBlocked || b.Mapping == "":
+		return NATUnknown
+	case b.Mapping == EndpointIndependent:
+		return NATUnrestricted
+	default:
+		return NATRestricted
+	}
+}
+
+func (b Behavior) String() string {
+	if b.UDPBlocked {
+		return "UDP blocked"
+	}
+	mapping, filtering := b.Mapping, b.Filtering
+	if mapping == "" {
+		mapping = NATUnknown
+	}
+	if filtering == "" {
+		filtering = NATUnknown
+	}
+	return fmt.Sprintf("%s mapping, %s filtering, hairpinning %t", mapping, filtering, b.Hairpinning)
+}
+
+// BehaviorOfType returns the behaviour that the broker assumed for peers that
+// only report a NAT type: an unrestricted NAT maps and filters independently
+// of the endpoint, and any other NAT, including an unknown one, is assumed to
+// be as restrictive as possible.
+func BehaviorOfType(natType string) Behavior {
+	if natType == NATUnrestricted {
+		return Behavior{Mapping: EndpointIndependent, Filtering: EndpointIndependent}
+	}
+	return Behavior{Mapping: AddressAndPortDependent, Filtering: AddressAndPortDependent}
+}
+
+// Compatible reports whether two peers behind NATs with the given behaviours
+// can be expected to connect to each other directly, without a TURN server.
+// Unknown mappings and filterings count as address-and-port-dependent. The
+// resulting matrix, for peers whose UDP is not blocked, is:
+//
+//	                     | EI mapping,     | EI mapping, | other
+//	                     | EI or AD filt.  | APD filt.   | mapping
+//	---------------------+-----------------+-------------+--------
+//	EI mapping, EI or AD |       yes       |     yes     |  yes
+//	EI mapping, APD      |       yes       |     yes     |  no
+//	other mapping        |       yes       |     no      |  no
+//
+// When both mappings are endpoint-independent, the server-reflexive
+// candidates of both peers are valid and each opens its NAT towards the
+// other. When only one of them is, the other peer's checks reach it from an
+// unexpected port, which its NAT must let through. Hairpinning only matters
+// for peers behind the same NAT, which the matrix does not consider.
+func Compatible(a, b Behavior) bool {
+	if a.UDPBlocked || b.UDPBlocked {
+		return false
+	}
+	aIndependent := a.Mapping == EndpointIndependent
+	bIndependent := b.Mapping == EndpointIndependent
+	switch {
+	case aIndependent && bIndependent:
+		return true
+	case aIndependent:
+		return a.filtersByAddressOnly()
+	case bIndependent:
+		return b.filtersByAddressOnly()
+	default:
+		return false
+	}
+}
+
+func (b Behavior) filtersByAddressOnly() bool {
+	return b.Filtering == EndpointIndependent || b.Filtering == AddressDependent
+}
+
 // This function checks the NAT mapping and filtering
 // behaviour and returns true if the NAT is restrictive
 // (address-dependent mapping and/or port-dependent filtering)
@@ -40,13 +160,10 @@ func CheckIfRestrictedNAT(server string) (bool, error) {
 	return isRestrictedMapping(server)
 }
 
-// Performs two tests from RFC 5780 to determine whether the mapping type
+// Performs the tests from RFC 5780 to determine whether the mapping type
 // of the client's NAT is address-independent or address-dependent
 // Returns true if the mapping is address-dependent and false otherwise
 func isRestrictedMapping(addrStr string) (bool, error) {
-	var xorAddr1 stun.XORMappedAddress
-	var xorAddr2 stun.XORMappedAddress
-
 	mapTestConn, err := connect(addrStr)
 	if err != nil {
 		return false, fmt.Errorf("Error creating STUN connection: %w", err)
@@ -54,91 +171,185 @@ func isRestrictedMapping(addrStr string) (bool, error) {
 
 	defer mapTestConn.Close()
 
-	// Test I: Regular binding request
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	xorAddr, err := mapTestConn.discover()
+	if err != nil {
+		return false, err
+	}
+	mapping, err := mapTestConn.mappingBehavior(xorAddr)
+	if err != nil {
+		return false, err
+	}
+	return mapping != EndpointIndependent, nil
+}
 
-	resp, err := mapTestConn.RoundTrip(message, mapTestConn.PrimaryAddr)
+// Classify runs the tests of RFC 5780 against the STUN server at server,
+// which must support them, and returns the mapping, filtering and
+// hairpinning behaviour of the NAT. If the server does not answer at all,
+// the returned behaviour has UDPBlocked set.
+func Classify(server string) (*Behavior, error) {
+	mapTestConn, err := connect(server)
 	if err != nil {
-		return false, fmt.Errorf("Error completing roundtrip map test: %w", err)
+		return nil, fmt.Errorf("Error creating STUN connection: %w", err)
 	}
+	defer mapTestConn.Close()
 
-	// Decoding XOR-MAPPED-ADDRESS attribute from message.
-	if err = xorAddr1.GetFrom(resp); err != nil {
-		return false, fmt.Errorf("Error retrieving XOR-MAPPED-ADDRESS resonse: %w", err)
+	xorAddr, err := mapTestConn.discover()
+	if err == ErrTimedOut {
+		return &Behavior{UDPBlocked: true}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Decoding OTHER-ADDRESS attribute from message.
-	var otherAddr stun.OtherAddress
-	if err = otherAddr.GetFrom(resp); err != nil {
-		return false, fmt.Errorf("NAT discovery feature not supported: %w", err)
+	behavior := &Behavior{}
+	behavior.Mapping, err = mapTestConn.mappingBehavior(xorAddr)
+	if err != nil {
+		return nil, err
+	}
+	behavior.Hairpinning, err = mapTestConn.hairpinning(xorAddr)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = mapTestConn.AddOtherAddr(otherAddr.String()); err != nil {
-		return false, fmt.Errorf("Error resolving address %s: %w", otherAddr.String(), err)
+	// The mapping tests have opened the NAT towards the other addresses of
+	// the server, so the filtering tests use a fresh port.
+	filterTestConn, err := connect(server)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating STUN connection: %w", err)
 	}
+	defer filterTestConn.Close()
+	behavior.Filtering, err = filterTestConn.filteringBehavior()
+	if err != nil {
+		return nil, err
+	}
+	return behavior, nil
+}
 
-	// Test II: Send binding request to other address
-	resp, err = mapTestConn.RoundTrip(message, mapTestConn.OtherAddr)
+// discover performs Test I of RFC 5780, a regular binding request, and
+// returns the mapped address. It also learns the other address of the
+// server.
+func (c *StunServerConn) discover() (*stun.XORMappedAddress, error) {
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+
+	resp, err := c.RoundTrip(message, c.PrimaryAddr)
+	if err == ErrTimedOut {
+		return nil, err
+	}
 	if err != nil {
-		return false, fmt.Errorf("Error retrieveing server response: %w", err)
+		return nil, fmt.Errorf("Error completing roundtrip map test: %w", err)
 	}
 
 	// Decoding XOR-MAPPED-ADDRESS attribute from message.
-	if err = xorAddr2.GetFrom(resp); err != nil {
-		return false, fmt.Errorf("Error retrieving XOR-MAPPED-ADDRESS resonse: %w", err)
+	var xorAddr stun.XORMappedAddress
+	if err = xorAddr.GetFrom(resp); err != nil {
+		return nil, fmt.Errorf("Error retrieving XOR-MAPPED-ADDRESS resonse: %w", err)
 	}
 
-	return xorAddr1.String() != xorAddr2.String(), nil
+	// Decoding OTHER-ADDRESS attribute from message.
+	var otherAddr stun.OtherAddress
+	if err = otherAddr.GetFrom(resp); err != nil {
+		return nil, fmt.Errorf("NAT discovery feature not supported: %w", err)
+	}
 
+	if err = c.AddOtherAddr(otherAddr.String()); err != nil {
+		return nil, fmt.Errorf("Error resolving address %s: %w", otherAddr.String(), err)
+	}
+	return &xorAddr, nil
 }
 
-// Performs two tests from RFC 5780 to determine whether the filtering type
-// of the client's NAT is port-dependent.
-// Returns true if the filtering is port-dependent and false otherwise
-// Note: This function is no longer used because a client's NAT type is
-// determined only by their mapping type, but the functionality might
-// be useful in the future and remains here.
-func isRestrictedFiltering(addrStr string) (bool, error) {
-	var xorAddr stun.XORMappedAddress
-
-	mapTestConn, err := connect(addrStr)
+// mappingBehavior performs Tests II and III of RFC 5780, which send binding
+// requests to the other IP address of the server, first with its primary
+// port and then with its other port, and compares the mapped addresses with
+// the one of Test I.
+func (c *StunServerConn) mappingBehavior(xorAddr1 *stun.XORMappedAddress) (string, error) {
+	// Test II: Send binding request to the other IP address, primary port
+	xorAddr2, err := c.mappedAddress(&net.UDPAddr{IP: c.OtherAddr.IP, Port: c.PrimaryAddr.Port})
 	if err != nil {
-		log.Printf("Error creating STUN connection: %s", err.Error())
-		return false, err
+		return "", err
+	}
+	if xorAddr2.String() == xorAddr1.String() {
+		return EndpointIndependent, nil
 	}
 
-	defer mapTestConn.Close()
+	// Test III: Send binding request to the other address
+	xorAddr3, err := c.mappedAddress(c.OtherAddr)
+	if err != nil {
+		return "", err
+	}
+	if xorAddr3.String() == xorAddr2.String() {
+		return AddressDependent, nil
+	}
+	return AddressAndPortDependent, nil
+}
 
-	// Test I: Regular binding request
+func (c *StunServerConn) mappedAddress(addr *net.UDPAddr) (*stun.XORMappedAddress, error) {
 	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-
-	resp, err := mapTestConn.RoundTrip(message, mapTestConn.PrimaryAddr)
-	if err == ErrTimedOut {
-		log.Printf("Error: no response from server")
-		return false, err
-	}
+	resp, err := c.RoundTrip(message, addr)
 	if err != nil {
-		log.Printf("Error: %s", err.Error())
-		return false, err
+		return nil, fmt.Errorf("Error retrieveing server response: %w", err)
 	}
 
 	// Decoding XOR-MAPPED-ADDRESS attribute from message.
+	var xorAddr stun.XORMappedAddress
 	if err = xorAddr.GetFrom(resp); err != nil {
-		log.Printf("Error retrieving XOR-MAPPED-ADDRESS from resonse: %s", err.Error())
-		return false, err
+		return nil, fmt.Errorf("Error retrieving XOR-MAPPED-ADDRESS resonse: %w", err)
+	}
+	return &xorAddr, nil
+}
+
+// filteringBehavior performs the filtering tests of RFC 5780, which ask the
+// server to answer binding requests from its other IP address and port,
+// then from its other port only. The NAT lets through the answers that its
+// filtering allows.
+func (c *StunServerConn) filteringBehavior() (string, error) {
+	// Test I: Regular binding request, which learns the other address
+	if _, err := c.discover(); err != nil {
+		return "", err
+	}
+
+	// Test II: Request IP address and port change
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	message.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x06})
+	_, err := c.roundTrip(message, c.PrimaryAddr, filteredTimeout)
+	if err == nil {
+		return EndpointIndependent, nil
+	}
+	if err != ErrTimedOut {
+		return "", fmt.Errorf("Error reading response from server: %w", err)
 	}
 
 	// Test III: Request port change
+	message = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
 	message.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x02})
+	_, err = c.roundTrip(message, c.PrimaryAddr, filteredTimeout)
+	if err == nil {
+		return AddressDependent, nil
+	}
+	if err != ErrTimedOut {
+		return "", fmt.Errorf("Error reading response from server: %w", err)
+	}
+	return AddressAndPortDependent, nil
+}
 
-	_, err = mapTestConn.RoundTrip(message, mapTestConn.PrimaryAddr)
-	if err != ErrTimedOut && err != nil {
-		// something else went wrong
-		log.Printf("Error reading response from server: %s", err.Error())
+// hairpinning performs the hairpinning test of RFC 5780: it sends a binding
+// request from another port to the mapped address of c, and checks whether
+// it comes back to c.
+func (c *StunServerConn) hairpinning(xorAddr *stun.XORMappedAddress) (bool, error) {
+	hairpinConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
 		return false, err
 	}
+	defer hairpinConn.Close()
 
-	return err == ErrTimedOut, nil
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := hairpinConn.WriteTo(message.Raw, &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}); err != nil {
+		return false, err
+	}
+	_, err = c.wait(message.TransactionID, filteredTimeout)
+	if err == ErrTimedOut {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 // Given an address string, returns a StunServerConn
@@ -176,20 +387,35 @@ func (c *StunServerConn) Close() {
 }
 
 func (c *StunServerConn) RoundTrip(msg *stun.Message, addr net.Addr) (*stun.Message, error) {
+	return c.roundTrip(msg, addr, responseTimeout)
+}
+
+func (c *StunServerConn) roundTrip(msg *stun.Message, addr net.Addr, timeout time.Duration) (*stun.Message, error) {
 	_, err := c.conn.WriteTo(msg.Raw, addr)
 	if err != nil {
 		return nil, err
 	}
+	return c.wait(msg.TransactionID, timeout)
+}
 
-	// Wait for response or timeout
-	select {
-	case m, ok := <-c.messageChan:
-		if !ok {
-			return nil, fmt.Errorf("error reading from messageChan")
+// wait returns the next message with the given transaction id, skipping
+// late answers to earlier requests, or ErrTimedOut.
+func (c *StunServerConn) wait(id [stun.TransactionIDSize]byte, timeout time.Duration) (*stun.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case m, ok := <-c.messageChan:
+			if !ok {
+				return nil, fmt.Errorf("error reading from messageChan")
+			}
+			if m.TransactionID != id {
+				continue
+			}
+			return m, nil
+		case <-timer.C:
+			return nil, ErrTimedOut
 		}
-		return m, nil
-	case <-time.After(10 * time.Second):
-		return nil, ErrTimedOut
 	}
 }
 
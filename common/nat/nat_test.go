@@ -0,0 +1,198 @@
+package nat
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeSTUNServer is an RFC 5780 STUN server on two loopback addresses and
+// two ports. It emulates a NAT in front of its clients: it reports mapped
+// addresses that depend on the server address that a request was sent to,
+// according to mapping, and drops the answers to CHANGE-REQUESTs that
+// filtering would not let through.
+type fakeSTUNServer struct {
+	// Indexed by IP address, then by port
+	conns     [2][2]*net.UDPConn
+	mapping   string
+	filtering string
+}
+
+func newFakeSTUNServer(mapping, filtering string) (*fakeSTUNServer, error) {
+	s := &fakeSTUNServer{mapping: mapping, filtering: filtering}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	var err error
+	// The ports are chosen for the first address and reused for the
+	// second.
+	for p := 0; p < 2; p++ {
+		s.conns[0][p], err = net.ListenUDP("udp4", &net.UDPAddr{IP: ips[0]})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		port := s.conns[0][p].LocalAddr().(*net.UDPAddr).Port
+		s.conns[1][p], err = net.ListenUDP("udp4", &net.UDPAddr{IP: ips[1], Port: port})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for i := 0; i < 2; i++ {
+		for p := 0; p < 2; p++ {
+			go s.serve(i, p)
+		}
+	}
+	return s, nil
+}
+
+func (s *fakeSTUNServer) Addr() string {
+	return s.conns[0][0].LocalAddr().String()
+}
+
+func (s *fakeSTUNServer) Close() {
+	for i := range s.conns {
+		for _, conn := range s.conns[i] {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+func (s *fakeSTUNServer) serve(i, p int) {
+	conn := s.conns[i][p]
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+			continue
+		}
+
+		// Answer from the address that the CHANGE-REQUEST asks for, if
+		// the emulated filtering lets the answer through.
+		fromI, fromP := i, p
+		if change, err := req.Get(stun.AttrChangeRequest); err == nil && len(change) == 4 {
+			if change[3]&0x04 != 0 {
+				fromI = 1 - i
+			}
+			if change[3]&0x02 != 0 {
+				fromP = 1 - p
+			}
+		}
+		if fromI != i && s.filtering != EndpointIndependent {
+			continue
+		}
+		if fromP != p && s.filtering == AddressAndPortDependent {
+			continue
+		}
+
+		// A NAT with a dependent mapping uses another external port for
+		// each server address.
+		mapped := *addr
+		switch s.mapping {
+		case AddressDependent:
+			mapped.Port += 1000 * (i + 1)
+		case AddressAndPortDependent:
+			mapped.Port += 1000 * (2*i + p + 1)
+		}
+		other := s.conns[1][1].LocalAddr().(*net.UDPAddr)
+		resp, err := stun.Build(req, stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port},
+			&stun.OtherAddress{IP: other.IP, Port: other.Port})
+		if err != nil {
+			continue
+		}
+		s.conns[fromI][fromP].WriteTo(resp.Raw, addr)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	Convey("NAT classification", t, func() {
+		savedResponseTimeout, savedFilteredTimeout := responseTimeout, filteredTimeout
+		responseTimeout, filteredTimeout = 500*time.Millisecond, 200*time.Millisecond
+		defer func() {
+			responseTimeout, filteredTimeout = savedResponseTimeout, savedFilteredTimeout
+		}()
+
+		for _, test := range []struct {
+			mapping, filtering string
+		}{
+			{EndpointIndependent, EndpointIndependent},
+			{EndpointIndependent, AddressDependent},
+			{AddressDependent, AddressAndPortDependent},
+			{AddressAndPortDependent, AddressAndPortDependent},
+		} {
+			test := test
+			Convey("detects "+test.mapping+" mapping and "+test.filtering+" filtering", func() {
+				server, err := newFakeSTUNServer(test.mapping, test.filtering)
+				So(err, ShouldBeNil)
+				defer server.Close()
+
+				behavior, err := Classify(server.Addr())
+				So(err, ShouldBeNil)
+				So(behavior.Mapping, ShouldEqual, test.mapping)
+				So(behavior.Filtering, ShouldEqual, test.filtering)
+				So(behavior.UDPBlocked, ShouldBeFalse)
+				// On loopback, only an endpoint-independent mapping
+				// reports the real address, to which a request from
+				// another port can be sent.
+				So(behavior.Hairpinning, ShouldEqual, test.mapping == EndpointIndependent)
+
+				restricted, err := CheckIfRestrictedNAT(server.Addr())
+				So(err, ShouldBeNil)
+				So(restricted, ShouldEqual, test.mapping != EndpointIndependent)
+			})
+		}
+
+		Convey("detects that UDP is blocked", func() {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			behavior, err := Classify(conn.LocalAddr().String())
+			So(err, ShouldBeNil)
+			So(behavior.UDPBlocked, ShouldBeTrue)
+			So(behavior.Type(), ShouldEqual, NATUnknown)
+		})
+	})
+
+	Convey("NAT behaviour", t, func() {
+		open := Behavior{Mapping: EndpointIndependent, Filtering: EndpointIndependent}
+		portRestricted := Behavior{Mapping: EndpointIndependent, Filtering: AddressAndPortDependent}
+		symmetric := Behavior{Mapping: AddressAndPortDependent, Filtering: AddressAndPortDependent}
+
+		Convey("summarizes into a NAT type", func() {
+			So(open.Type(), ShouldEqual, NATUnrestricted)
+			So(portRestricted.Type(), ShouldEqual, NATUnrestricted)
+			So(symmetric.Type(), ShouldEqual, NATRestricted)
+			So(Behavior{}.Type(), ShouldEqual, NATUnknown)
+			So(BehaviorOfType(NATUnrestricted).Type(), ShouldEqual, NATUnrestricted)
+			So(BehaviorOfType(NATUnknown).Type(), ShouldEqual, NATRestricted)
+		})
+
+		Convey("tells which peers can connect", func() {
+			So(Compatible(open, symmetric), ShouldBeTrue)
+			So(Compatible(symmetric, open), ShouldBeTrue)
+			So(Compatible(portRestricted, portRestricted), ShouldBeTrue)
+			So(Compatible(portRestricted, symmetric), ShouldBeFalse)
+			So(Compatible(symmetric, symmetric), ShouldBeFalse)
+			So(Compatible(open, Behavior{UDPBlocked: true}), ShouldBeFalse)
+			// Unknown behaviour counts as the most restrictive.
+			So(Compatible(open, Behavior{}), ShouldBeTrue)
+			So(Compatible(portRestricted, Behavior{}), ShouldBeFalse)
+		})
+
+		Convey("rejects unknown values", func() {
+			So(open.Valid(), ShouldBeTrue)
+			So(Behavior{}.Valid(), ShouldBeTrue)
+			So(Behavior{Mapping: "symmetric"}.Valid(), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,193 @@
+// Package trickle exchanges ICE candidates between a Snowflake client and
+// proxy through the broker, so that they can send their offer and answer
+// before ICE candidate gathering is complete.
+package trickle
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/util"
+	"github.com/pion/webrtc/v3"
+)
+
+// How long to wait before retrying a request that failed.
+const retryDelay = time.Second
+
+// Exchange sends an encoded trickle request to the broker and returns the
+// encoded response.
+type Exchange func([]byte) ([]byte, error)
+
+// Candidates collects the local ICE candidates of a PeerConnection as they
+// are gathered, and exchanges them with those of the peer.
+type Candidates struct {
+	pc                 *webrtc.PeerConnection
+	role               string
+	keepLocalAddresses bool
+
+	lock sync.Mutex
+	// Local candidates that have not been sent yet
+	pending  []string
+	gathered bool
+	// Signaled when a candidate is gathered or gathering completes
+	newLocal chan struct{}
+	complete chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New starts collecting the local candidates of pc. It must be called before
+// SetLocalDescription, which starts the gathering of candidates. role is
+// messages.TrickleRoleClient or messages.TrickleRoleProxy. Local LAN
+// addresses are left out unless keepLocalAddresses is set.
+func New(pc *webrtc.PeerConnection, role string, keepLocalAddresses bool) *Candidates {
+	c := &Candidates{
+		pc:                 pc,
+		role:               role,
+		keepLocalAddresses: keepLocalAddresses,
+		newLocal:           make(chan struct{}, 1),
+		complete:           make(chan struct{}),
+		stop:               make(chan struct{}),
+	}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if candidate == nil {
+			// Gathering is complete.
+			if !c.gathered {
+				c.gathered = true
+				close(c.complete)
+			}
+		} else {
+			s := candidate.ToJSON().Candidate
+			if !c.keepLocalAddresses && util.IsLocalCandidate(s) {
+				return
+			}
+			c.pending = append(c.pending, s)
+		}
+		select {
+		case c.newLocal <- struct{}{}:
+		default:
+		}
+	})
+	return c
+}
+
+// GatheringComplete returns a channel that is closed once all the local
+// candidates have been gathered.
+func (c *Candidates) GatheringComplete() <-chan struct{} {
+	return c.complete
+}
+
+// Run exchanges candidates with the peer through the broker, using the
+// trickle id that the broker gave the match, until both sides have sent all
+// their candidates, the broker no longer knows the id, or Stop is called.
+// The remote description must have been set.
+func (c *Candidates) Run(id string, exchange Exchange) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.send(id, exchange)
+	}()
+	go func() {
+		defer wg.Done()
+		c.receive(id, exchange)
+	}()
+	wg.Wait()
+}
+
+// Stop stops the exchange of candidates, for example once the connection is
+// established.
+func (c *Candidates) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// send sends local candidates as they are gathered.
+func (c *Candidates) send(id string, exchange Exchange) {
+	for {
+		select {
+		case <-c.newLocal:
+		case <-c.stop:
+			return
+		}
+		c.lock.Lock()
+		candidates := c.pending
+		c.pending = nil
+		done := c.gathered
+		c.lock.Unlock()
+
+		if _, ok := c.request(id, candidates, done, exchange); !ok || done {
+			return
+		}
+	}
+}
+
+// receive polls the broker for the candidates of the peer.
+func (c *Candidates) receive(id string, exchange Exchange) {
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		peerDone, ok := c.request(id, nil, false, exchange)
+		if !ok || peerDone {
+			return
+		}
+	}
+}
+
+// request sends a trickle request, retrying until it succeeds, and adds the
+// candidates of the peer in the response. It returns whether the peer has
+// sent all its candidates, and false if the exchange should end.
+func (c *Candidates) request(id string, candidates []string, done bool, exchange Exchange) (peerDone bool, ok bool) {
+	req := &messages.TrickleRequest{
+		ID:         id,
+		Role:       c.role,
+		Candidates: candidates,
+		Done:       done,
+	}
+	encReq, err := req.EncodeTrickleRequest()
+	if err != nil {
+		log.Printf("Error encoding trickle request: %v", err)
+		c.Stop()
+		return false, false
+	}
+
+	var resp *messages.TrickleResponse
+	for {
+		var encResp []byte
+		encResp, err = exchange(encReq)
+		if err == nil {
+			resp, err = messages.DecodeTrickleResponse(encResp)
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Error exchanging ICE candidates: %v", err)
+		select {
+		case <-c.stop:
+			return false, false
+		case <-time.After(retryDelay):
+		}
+	}
+	if resp.Error != "" {
+		log.Printf("Error exchanging ICE candidates: %s", resp.Error)
+		c.Stop()
+		return false, false
+	}
+
+	for _, candidate := range resp.Candidates {
+		err := c.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate})
+		if err != nil {
+			log.Printf("Error adding remote ICE candidate: %v", err)
+		}
+	}
+	return resp.Done, true
+}
@@ -0,0 +1,131 @@
+package trickle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"github.com/pion/webrtc/v3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeBroker relays candidates between the roles of a single match, like the
+// broker's /trickle endpoint.
+type fakeBroker struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending map[string][]string
+	done    map[string]bool
+}
+
+func newFakeBroker() *fakeBroker {
+	b := &fakeBroker{pending: make(map[string][]string), done: make(map[string]bool)}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *fakeBroker) exchange(data []byte) ([]byte, error) {
+	req, err := messages.DecodeTrickleRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if req.ID != "id" {
+		return (&messages.TrickleResponse{Error: messages.StrUnknownTrickleID}).EncodeTrickleResponse()
+	}
+	other := messages.TrickleRoleProxy
+	if req.Role == messages.TrickleRoleProxy {
+		other = messages.TrickleRoleClient
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[other] = append(b.pending[other], req.Candidates...)
+	if req.Done {
+		b.done[req.Role] = true
+	}
+	b.cond.Broadcast()
+	if len(req.Candidates) == 0 && !req.Done {
+		for len(b.pending[req.Role]) == 0 && !b.done[other] {
+			b.cond.Wait()
+		}
+	}
+	resp := &messages.TrickleResponse{Candidates: b.pending[req.Role], Done: b.done[other]}
+	b.pending[req.Role] = nil
+	return resp.EncodeTrickleResponse()
+}
+
+func TestTrickle(t *testing.T) {
+	Convey("Trickle ICE", t, func() {
+		offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		So(err, ShouldBeNil)
+		defer offerer.Close()
+		answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		So(err, ShouldBeNil)
+		defer answerer.Close()
+
+		open := make(chan struct{})
+		answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+			dc.OnOpen(func() { close(open) })
+		})
+		_, err = offerer.CreateDataChannel("test", nil)
+		So(err, ShouldBeNil)
+
+		Convey("connects peers whose descriptions have no candidates", func() {
+			client := New(offerer, messages.TrickleRoleClient, true)
+			offer, err := offerer.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			// The offer is sent before any candidate is gathered.
+			So(offer.SDP, ShouldNotContainSubstring, "a=candidate")
+			So(offerer.SetLocalDescription(offer), ShouldBeNil)
+
+			So(answerer.SetRemoteDescription(offer), ShouldBeNil)
+			proxy := New(answerer, messages.TrickleRoleProxy, true)
+			answer, err := answerer.CreateAnswer(nil)
+			So(err, ShouldBeNil)
+			So(answerer.SetLocalDescription(answer), ShouldBeNil)
+			So(offerer.SetRemoteDescription(answer), ShouldBeNil)
+
+			broker := newFakeBroker()
+			finished := make(chan struct{}, 2)
+			go func() {
+				client.Run("id", broker.exchange)
+				finished <- struct{}{}
+			}()
+			go func() {
+				proxy.Run("id", broker.exchange)
+				finished <- struct{}{}
+			}()
+
+			select {
+			case <-open:
+			case <-time.After(10 * time.Second):
+				So("timed out waiting for data channel", ShouldBeEmpty)
+			}
+			<-client.GatheringComplete()
+			<-proxy.GatheringComplete()
+			// Both sides finish once all candidates are exchanged.
+			<-finished
+			<-finished
+		})
+
+		Convey("stops when the broker forgets the match", func() {
+			client := New(offerer, messages.TrickleRoleClient, true)
+			offer, err := offerer.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			So(offerer.SetLocalDescription(offer), ShouldBeNil)
+
+			broker := newFakeBroker()
+			finished := make(chan struct{})
+			go func() {
+				client.Run("unknown", broker.exchange)
+				close(finished)
+			}()
+			select {
+			case <-finished:
+			case <-time.After(10 * time.Second):
+				So("timed out waiting for exchange to end", ShouldBeEmpty)
+			}
+		})
+	})
+}
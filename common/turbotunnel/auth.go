@@ -0,0 +1,120 @@
+package turbotunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// AuthToken is how a client opts into turbo tunnel mode with an authenticated
+// ClientID, instead of Token. After AuthToken and its ClientID, the client
+// sends the public key from which the ClientID is derived, and signs a
+// challenge from the server, so that nobody else can use its ClientID.
+var AuthToken = [8]byte{0x4c, 0x2a, 0xd6, 0x0e, 0xb1, 0x97, 0x3f, 0x68}
+
+const (
+	// The size of the random challenge that the server sends.
+	authChallengeSize = 32
+)
+
+// The context of the signatures in the handshake, which keeps them from
+// being valid for anything else.
+var authContext = []byte("snowflake turbotunnel ClientID authentication")
+
+var errAuthClientID = errors.New("ClientID does not match public key")
+var errAuthSignature = errors.New("invalid ClientID signature")
+
+// ClientKey is the secret of a client that proves that its ClientID is its
+// own.
+type ClientKey struct {
+	private ed25519.PrivateKey
+}
+
+// NewClientKey generates a new random ClientKey.
+func NewClientKey() *ClientKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &ClientKey{private: private}
+}
+
+// ClientID returns the ClientID that belongs to the key.
+func (key *ClientKey) ClientID() ClientID {
+	return clientIDFromPublicKey(key.private.Public().(ed25519.PublicKey))
+}
+
+// clientIDFromPublicKey derives a ClientID from a public key.
+func clientIDFromPublicKey(public ed25519.PublicKey) ClientID {
+	var id ClientID
+	h := sha256.Sum256(public)
+	copy(id[:], h[:])
+	return id
+}
+
+// authMessage is what the client signs to prove possession of the key of
+// clientID.
+func authMessage(clientID ClientID, challenge []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(authContext)
+	buf.Write(clientID[:])
+	buf.Write(challenge)
+	return buf.Bytes()
+}
+
+// Handshake runs the client side of the authenticated handshake on a new
+// connection to the server: it sends AuthToken, the ClientID and the public
+// key, and signs the challenge that the server sends back. Encapsulated
+// packets may follow.
+func (key *ClientKey) Handshake(rw io.ReadWriter) error {
+	clientID := key.ClientID()
+	var buf bytes.Buffer
+	buf.Write(AuthToken[:])
+	buf.Write(clientID[:])
+	buf.Write(key.private.Public().(ed25519.PublicKey))
+	if _, err := rw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	challenge := make([]byte, authChallengeSize)
+	if _, err := io.ReadFull(rw, challenge); err != nil {
+		return err
+	}
+	_, err := rw.Write(ed25519.Sign(key.private, authMessage(clientID, challenge)))
+	return err
+}
+
+// AcceptHandshake runs the server side of the authenticated handshake, after
+// the server has read AuthToken: it reads the ClientID and the public key,
+// sends a challenge, and checks the client's signature of it. It returns the
+// ClientID, which only the holder of its ClientKey can have used.
+func AcceptHandshake(rw io.ReadWriter) (ClientID, error) {
+	var clientID ClientID
+	if _, err := io.ReadFull(rw, clientID[:]); err != nil {
+		return clientID, err
+	}
+	public := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	if _, err := io.ReadFull(rw, public); err != nil {
+		return clientID, err
+	}
+	if clientIDFromPublicKey(public) != clientID {
+		return clientID, errAuthClientID
+	}
+	challenge := make([]byte, authChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return clientID, err
+	}
+	if _, err := rw.Write(challenge); err != nil {
+		return clientID, err
+	}
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(rw, signature); err != nil {
+		return clientID, err
+	}
+	if !ed25519.Verify(public, authMessage(clientID, challenge), signature) {
+		return clientID, errAuthSignature
+	}
+	return clientID, nil
+}
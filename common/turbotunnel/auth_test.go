@@ -0,0 +1,137 @@
+package turbotunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/websocketconn"
+	"github.com/gorilla/websocket"
+)
+
+// webSocketPair returns a (server, client) pair of connected
+// websocketconn.Conns.
+func webSocketPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	serverConns := make(chan net.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- websocketconn.New(ws)
+	}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-serverConns, websocketconn.New(ws)
+}
+
+// acceptAuthToken reads AuthToken on conn and runs AcceptHandshake.
+func acceptAuthToken(conn net.Conn) (ClientID, error) {
+	var token [len(AuthToken)]byte
+	if _, err := io.ReadFull(conn, token[:]); err != nil {
+		return ClientID{}, err
+	}
+	if token != AuthToken {
+		return ClientID{}, fmt.Errorf("unexpected token %x", token)
+	}
+	return AcceptHandshake(conn)
+}
+
+func TestHandshake(t *testing.T) {
+	key := NewClientKey()
+	if key.ClientID() != key.ClientID() {
+		t.Fatal("ClientID of key is not stable")
+	}
+	if NewClientKey().ClientID() == key.ClientID() {
+		t.Fatal("two keys have the same ClientID")
+	}
+
+	// Like a multipath client, do the handshake on several connections.
+	for i := 0; i < 2; i++ {
+		s, c := webSocketPair(t)
+		defer s.Close()
+		defer c.Close()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- key.Handshake(c)
+		}()
+		clientID, err := acceptAuthToken(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if clientID != key.ClientID() {
+			t.Errorf("got ClientID %v, expected %v", clientID, key.ClientID())
+		}
+	}
+}
+
+// TestHandshakeSpoofed checks that a client cannot use the ClientID of
+// another key, even with a signature that it has seen.
+func TestHandshakeSpoofed(t *testing.T) {
+	victim := NewClientKey()
+	attacker := NewClientKey()
+	victimID := victim.ClientID()
+	attackerPublic := attacker.private.Public().(ed25519.PublicKey)
+	victimPublic := victim.private.Public().(ed25519.PublicKey)
+
+	for _, test := range []struct {
+		name   string
+		public ed25519.PublicKey
+		sign   func(challenge []byte) []byte
+		err    error
+	}{
+		{
+			"another public key",
+			attackerPublic,
+			func(challenge []byte) []byte {
+				return ed25519.Sign(attacker.private, authMessage(victimID, challenge))
+			},
+			errAuthClientID,
+		},
+		{
+			"a replayed signature",
+			victimPublic,
+			func(challenge []byte) []byte {
+				// A signature of some other challenge, as
+				// seen on an earlier connection.
+				return ed25519.Sign(victim.private, authMessage(victimID, make([]byte, authChallengeSize)))
+			},
+			errAuthSignature,
+		},
+	} {
+		s, c := webSocketPair(t)
+		go func() {
+			var buf bytes.Buffer
+			buf.Write(AuthToken[:])
+			buf.Write(victimID[:])
+			buf.Write(test.public)
+			if _, err := c.Write(buf.Bytes()); err != nil {
+				return
+			}
+			challenge := make([]byte, authChallengeSize)
+			if _, err := io.ReadFull(c, challenge); err != nil {
+				return
+			}
+			c.Write(test.sign(challenge))
+		}()
+		if _, err := acceptAuthToken(s); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		s.Close()
+		c.Close()
+	}
+}
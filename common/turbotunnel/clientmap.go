@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +14,43 @@ type clientRecord struct {
 	Addr      net.Addr
 	LastSeen  time.Time
 	SendQueue chan []byte
+	// QueuedBytes is the total size of the packets in SendQueue.
+	QueuedBytes int
+	// Removed is set when the record is removed from the map, after which
+	// its packets no longer count against the total.
+	Removed bool
+}
+
+// ClientMapLimits bounds the resources that the clients of a ClientMap may
+// use. A zero field means no limit.
+type ClientMapLimits struct {
+	// MaxClients is the maximum number of clients. Adding a client beyond
+	// it evicts the least recently seen one.
+	MaxClients int
+	// MaxQueuedBytesPerClient is the maximum total size of the packets in
+	// the send queue of one client. Packets beyond it are dropped.
+	MaxQueuedBytesPerClient int
+	// MaxQueuedBytes is the maximum total size of the packets in all send
+	// queues. Packets beyond it evict the least recently seen clients, or
+	// are dropped if that is not enough.
+	MaxQueuedBytes int
+	// OnEvict, if not nil, is called with the address of every client that
+	// is evicted to stay within MaxClients or MaxQueuedBytes, but not of
+	// clients that expire.
+	OnEvict func(addr net.Addr)
+}
+
+// ClientMapStats is a snapshot of the resources used by a ClientMap.
+type ClientMapStats struct {
+	// Clients is the number of clients in the map.
+	Clients int
+	// QueuedBytes is the total size of the packets in all send queues.
+	QueuedBytes int
+	// Evicted is the number of clients evicted because of the limits.
+	Evicted uint64
+	// Dropped is the number of packets dropped because a send queue was
+	// full or a limit was reached.
+	Dropped uint64
 }
 
 // ClientMap manages a mapping of live clients (keyed by address, which will be
@@ -24,6 +62,10 @@ type ClientMap struct {
 	inner clientMapInner
 	// Synchronizes access to inner.
 	lock sync.Mutex
+
+	limits  ClientMapLimits
+	evicted uint64 // atomic
+	dropped uint64 // atomic
 }
 
 // NewClientMap creates a ClientMap that expires clients after a timeout.
@@ -35,11 +77,18 @@ type ClientMap struct {
 // same client, we'll instantiate a new send queue, and if the client ever
 // connects again with the proper client ID, we'll deliver them.
 func NewClientMap(timeout time.Duration) *ClientMap {
+	return NewClientMapWithLimits(timeout, ClientMapLimits{})
+}
+
+// NewClientMapWithLimits is like NewClientMap, but keeps the clients within
+// limits.
+func NewClientMapWithLimits(timeout time.Duration, limits ClientMapLimits) *ClientMap {
 	m := &ClientMap{
 		inner: clientMapInner{
 			byAge:  make([]*clientRecord, 0),
 			byAddr: make(map[net.Addr]int),
 		},
+		limits: limits,
 	}
 	go func() {
 		for {
@@ -54,11 +103,134 @@ func NewClientMap(timeout time.Duration) *ClientMap {
 }
 
 // SendQueue returns the send queue corresponding to addr, creating it if
-// necessary.
+// necessary. Packets sent directly to the queue are not counted against the
+// limits; use Enqueue and Dequeue instead.
 func (m *ClientMap) SendQueue(addr net.Addr) chan []byte {
+	return m.sendQueue(addr).SendQueue
+}
+
+// sendQueue returns the client record of addr, creating it if necessary, and
+// updates its LastSeen time.
+func (m *ClientMap) sendQueue(addr net.Addr) *clientRecord {
+	m.lock.Lock()
+	record, evicted := m.getRecord(addr, time.Now(), true)
+	m.lock.Unlock()
+	m.evict(evicted)
+	return record
+}
+
+// getRecord returns the client record of addr, creating it if necessary and
+// evicting the least recently seen clients to stay within MaxClients. If
+// touch is true, it updates the LastSeen time of an existing record. It
+// returns the evicted addresses, which must be passed to evict after m.lock
+// is released.
+func (m *ClientMap) getRecord(addr net.Addr, now time.Time, touch bool) (*clientRecord, []net.Addr) {
+	var evicted []net.Addr
+	if _, ok := m.inner.byAddr[addr]; !ok && m.limits.MaxClients > 0 {
+		for m.inner.Len() >= m.limits.MaxClients {
+			evicted = append(evicted, heap.Pop(&m.inner).(*clientRecord).Addr)
+		}
+	}
+	return m.inner.SendQueue(addr, now, touch), evicted
+}
+
+// evict counts evicted clients and calls the OnEvict callback for them.
+func (m *ClientMap) evict(evicted []net.Addr) {
+	atomic.AddUint64(&m.evicted, uint64(len(evicted)))
+	if m.limits.OnEvict != nil {
+		for _, addr := range evicted {
+			m.limits.OnEvict(addr)
+		}
+	}
+}
+
+// Enqueue adds p to the send queue of addr, creating the queue if necessary,
+// unless that would exceed a limit. It returns false if the packet was
+// dropped. Enqueue does not update the LastSeen time of an existing client:
+// a client is seen when its packets are taken from the queue with Dequeue.
+func (m *ClientMap) Enqueue(addr net.Addr, p []byte) bool {
+	m.lock.Lock()
+	record, evicted := m.getRecord(addr, time.Now(), false)
+	ok := m.enqueue(record, p, &evicted)
+	m.lock.Unlock()
+	m.evict(evicted)
+	if !ok {
+		atomic.AddUint64(&m.dropped, 1)
+	}
+	return ok
+}
+
+// enqueue is the part of Enqueue that requires m.lock to be held.
+func (m *ClientMap) enqueue(record *clientRecord, p []byte, evicted *[]net.Addr) bool {
+	if m.limits.MaxQueuedBytesPerClient > 0 && record.QueuedBytes+len(p) > m.limits.MaxQueuedBytesPerClient {
+		return false
+	}
+	if m.limits.MaxQueuedBytes > 0 {
+		// Make room by evicting the least recently seen clients, but
+		// never the one that the packet is for.
+		for m.inner.queuedBytes+len(p) > m.limits.MaxQueuedBytes {
+			if m.inner.Len() == 0 || m.inner.byAge[0] == record {
+				return false
+			}
+			*evicted = append(*evicted, heap.Pop(&m.inner).(*clientRecord).Addr)
+		}
+	}
+	select {
+	case record.SendQueue <- p:
+		record.QueuedBytes += len(p)
+		m.inner.queuedBytes += len(p)
+		return true
+	default:
+		return false
+	}
+}
+
+// Dequeue blocks until there is a packet in the send queue of addr, and
+// returns it. It updates the LastSeen time of the client before and after
+// waiting. It returns false if done is closed first, or if the client is
+// removed from the map before a packet arrives.
+func (m *ClientMap) Dequeue(addr net.Addr, done <-chan struct{}) ([]byte, bool) {
+	record := m.sendQueue(addr)
+	select {
+	case <-done:
+		return nil, false
+	case p, ok := <-record.SendQueue:
+		if !ok {
+			return nil, false
+		}
+		m.lock.Lock()
+		record.QueuedBytes -= len(p)
+		if !record.Removed {
+			m.inner.queuedBytes -= len(p)
+			m.inner.touch(record, time.Now())
+		}
+		m.lock.Unlock()
+		return p, true
+	}
+}
+
+// LastSeen returns the LastSeen time of the client with address addr, and
+// false if there is no such client.
+func (m *ClientMap) LastSeen(addr net.Addr) (time.Time, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.inner.SendQueue(addr, time.Now())
+	i, ok := m.inner.byAddr[addr]
+	if !ok {
+		return time.Time{}, false
+	}
+	return m.inner.byAge[i].LastSeen, true
+}
+
+// Stats returns the current use of resources by the clients.
+func (m *ClientMap) Stats() ClientMapStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return ClientMapStats{
+		Clients:     m.inner.Len(),
+		QueuedBytes: m.inner.queuedBytes,
+		Evicted:     atomic.LoadUint64(&m.evicted),
+		Dropped:     atomic.LoadUint64(&m.dropped),
+	}
 }
 
 // clientMapInner is the inner type of ClientMap, implementing heap.Interface.
@@ -69,6 +241,8 @@ func (m *ClientMap) SendQueue(addr net.Addr) chan []byte {
 type clientMapInner struct {
 	byAge  []*clientRecord
 	byAddr map[net.Addr]int
+	// queuedBytes is the total QueuedBytes of the records in byAge.
+	queuedBytes int
 }
 
 // removeExpired removes all client records whose LastSeen timestamp is more
@@ -80,16 +254,17 @@ func (inner *clientMapInner) removeExpired(now time.Time, timeout time.Duration)
 }
 
 // SendQueue finds the existing client record corresponding to addr, or creates
-// a new one if none exists yet. It updates the client record's LastSeen time
-// and returns its SendQueue.
-func (inner *clientMapInner) SendQueue(addr net.Addr, now time.Time) chan []byte {
+// a new one if none exists yet. If touch is true, it updates the client
+// record's LastSeen time. It returns the client record.
+func (inner *clientMapInner) SendQueue(addr net.Addr, now time.Time, touch bool) *clientRecord {
 	var record *clientRecord
 	i, ok := inner.byAddr[addr]
 	if ok {
-		// Found one, update its LastSeen.
 		record = inner.byAge[i]
-		record.LastSeen = now
-		heap.Fix(inner, i)
+		if touch {
+			// Found one, update its LastSeen.
+			inner.touch(record, now)
+		}
 	} else {
 		// Not found, create a new one.
 		record = &clientRecord{
@@ -99,7 +274,13 @@ func (inner *clientMapInner) SendQueue(addr net.Addr, now time.Time) chan []byte
 		}
 		heap.Push(inner, record)
 	}
-	return record.SendQueue
+	return record
+}
+
+// touch updates the LastSeen time of a record that is in the map.
+func (inner *clientMapInner) touch(record *clientRecord, now time.Time) {
+	record.LastSeen = now
+	heap.Fix(inner, inner.byAddr[record.Addr])
 }
 
 // heap.Interface for clientMapInner.
@@ -140,6 +321,8 @@ func (inner *clientMapInner) Pop() interface{} {
 	inner.byAge = inner.byAge[:n-1]
 	// Remove from byAddr map.
 	delete(inner.byAddr, record.Addr)
+	inner.queuedBytes -= record.QueuedBytes
+	record.Removed = true
 	close(record.SendQueue)
 	return record
 }
@@ -0,0 +1,140 @@
+package turbotunnel
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientMapMaxClients(t *testing.T) {
+	var evicted []net.Addr
+	m := NewClientMapWithLimits(time.Hour, ClientMapLimits{
+		MaxClients: 2,
+		OnEvict:    func(addr net.Addr) { evicted = append(evicted, addr) },
+	})
+	a, b, c := NewClientID(), NewClientID(), NewClientID()
+	m.Enqueue(a, []byte("a"))
+	m.Enqueue(b, []byte("b"))
+	// Taking a packet for a makes b the least recently seen.
+	if p, ok := m.Dequeue(a, nil); !ok || string(p) != "a" {
+		t.Fatalf("got %q, %v", p, ok)
+	}
+	m.Enqueue(c, []byte("c"))
+
+	if len(evicted) != 1 || evicted[0] != b {
+		t.Fatalf("expected %v to be evicted, got %v", b, evicted)
+	}
+	stats := m.Stats()
+	if stats.Clients != 2 || stats.Evicted != 1 || stats.QueuedBytes != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, ok := m.LastSeen(b); ok {
+		t.Errorf("%v is still in the map", b)
+	}
+}
+
+func TestClientMapQueuedBytes(t *testing.T) {
+	m := NewClientMapWithLimits(time.Hour, ClientMapLimits{
+		MaxQueuedBytesPerClient: 10,
+		MaxQueuedBytes:          15,
+	})
+	a, b := NewClientID(), NewClientID()
+
+	// The per-client limit drops packets.
+	if !m.Enqueue(a, make([]byte, 6)) {
+		t.Fatal("packet under the limit was dropped")
+	}
+	if m.Enqueue(a, make([]byte, 6)) {
+		t.Fatal("packet over the per-client limit was queued")
+	}
+	if stats := m.Stats(); stats.QueuedBytes != 6 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The total limit evicts the least recently seen client, but not the
+	// one that the packet is for.
+	if !m.Enqueue(b, make([]byte, 8)) {
+		t.Fatal("packet under the limit was dropped")
+	}
+	if m.Enqueue(b, make([]byte, 8)) {
+		t.Fatal("packet over the per-client limit was queued")
+	}
+	if !m.Enqueue(b, make([]byte, 2)) {
+		t.Fatal("packet under the limit was dropped")
+	}
+	if stats := m.Stats(); stats.Clients != 1 || stats.QueuedBytes != 10 || stats.Evicted != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// Taking packets from the queue frees their bytes.
+	m.Dequeue(b, nil)
+	if stats := m.Stats(); stats.QueuedBytes != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestQueuePacketConnStress writes to thousands of ClientIDs at once, some of
+// which have a reader, and checks that the queues stay within the limits.
+func TestQueuePacketConnStress(t *testing.T) {
+	const (
+		numClients     = 5000
+		maxClients     = 500
+		maxQueuedBytes = 256 * 1024
+		packetSize     = 1000
+	)
+	c := NewQueuePacketConnWithLimits(dummyAddr{}, time.Hour, ClientMapLimits{
+		MaxClients:              maxClients,
+		MaxQueuedBytesPerClient: 16 * packetSize,
+		MaxQueuedBytes:          maxQueuedBytes,
+	})
+	defer c.Close()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	var writers sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			p := make([]byte, packetSize)
+			for i := 0; i < numClients/10; i++ {
+				clientID := NewClientID()
+				for j := 0; j < 20; j++ {
+					c.WriteTo(p, clientID)
+				}
+				if i%100 == 0 {
+					// Drain some of the clients, like a
+					// WebSocket connection would.
+					readers.Add(1)
+					go func() {
+						defer readers.Done()
+						for {
+							if _, ok := c.DequeueOutgoing(clientID, done); !ok {
+								return
+							}
+						}
+					}()
+				}
+				if stats := c.Stats(); stats.Clients > maxClients || stats.QueuedBytes > maxQueuedBytes {
+					t.Errorf("over the limits: %+v", stats)
+					return
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	stats := c.Stats()
+	if stats.Clients > maxClients || stats.QueuedBytes > maxQueuedBytes || stats.QueuedBytes < 0 {
+		t.Errorf("over the limits: %+v", stats)
+	}
+	if stats.Evicted < numClients-maxClients {
+		t.Errorf("expected at least %d evictions, got %+v", numClients-maxClients, stats)
+	}
+	if stats.Dropped == 0 {
+		t.Errorf("expected dropped packets, got %+v", stats)
+	}
+}
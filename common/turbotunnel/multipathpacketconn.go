@@ -0,0 +1,359 @@
+package turbotunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultipathScheduler decides which of several paths a MultipathPacketConn
+// sends each packet on.
+type MultipathScheduler int
+
+const (
+	// SchedulerRoundRobin sends packets on each path in turn.
+	SchedulerRoundRobin MultipathScheduler = iota
+	// SchedulerLowestLatency sends packets on the path with the lowest
+	// round trip time, as reported by paths that implement RTTReporter.
+	// Other paths are used when its send queue is full.
+	SchedulerLowestLatency
+)
+
+// ParseMultipathScheduler returns the scheduler with the given name,
+// "round-robin" or "lowest-latency".
+func ParseMultipathScheduler(name string) (MultipathScheduler, error) {
+	switch name {
+	case "round-robin":
+		return SchedulerRoundRobin, nil
+	case "lowest-latency":
+		return SchedulerLowestLatency, nil
+	}
+	return 0, fmt.Errorf("unknown multipath scheduler %q", name)
+}
+
+// RTTReporter is implemented by paths that know their round trip time.
+type RTTReporter interface {
+	// RTT returns the round trip time of the path, or 0 if it is unknown.
+	RTT() time.Duration
+}
+
+// multipath is one of the net.PacketConns of a MultipathPacketConn, with the
+// queue of packets scheduled to be sent on it.
+type multipath struct {
+	conn      net.PacketConn
+	sendQueue chan []byte
+}
+
+func (p *multipath) rtt() time.Duration {
+	if r, ok := p.conn.(RTTReporter); ok {
+		return r.RTT()
+	}
+	return 0
+}
+
+// MultipathPacketConn implements a long-lived net.PacketConn atop several
+// simultaneous, transient net.PacketConns. Like RedialPacketConn, it creates
+// net.PacketConns by calling a provided dialContext function, and replaces
+// each one that experiences a ReadFrom or WriteTo error by dialing again.
+// Unlike RedialPacketConn, it keeps up to a given number of them open at
+// once, receives packets from all of them, and spreads outgoing packets
+// among them according to a MultipathScheduler. When a path fails, the
+// packets that were queued on it are sent on the remaining paths.
+//
+// MultipathPacketConn's own ReadFrom and WriteTo methods return an error
+// only when the dialContext function returns an error.
+type MultipathPacketConn struct {
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	dialContext func(context.Context) (net.PacketConn, error)
+	scheduler   MultipathScheduler
+	recvQueue   chan []byte
+	// Packets not yet assigned to any path, taken by whichever path is
+	// ready first.
+	sendQueue chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// The first dial error, which causes the MultipathPacketConn to be
+	// closed and is returned from future read/write operations.
+	err atomic.Value
+
+	// Synchronization for paths and next
+	lock  sync.Mutex
+	paths []*multipath
+	// The index of the next path for SchedulerRoundRobin
+	next int
+}
+
+// NewMultipathPacketConn makes a new MultipathPacketConn, with the given
+// static local and remote addresses, and dialContext function. It keeps up to
+// maxPaths paths open.
+func NewMultipathPacketConn(
+	localAddr, remoteAddr net.Addr,
+	dialContext func(context.Context) (net.PacketConn, error),
+	maxPaths int,
+	scheduler MultipathScheduler,
+) *MultipathPacketConn {
+	c := &MultipathPacketConn{
+		localAddr:   localAddr,
+		remoteAddr:  remoteAddr,
+		dialContext: dialContext,
+		scheduler:   scheduler,
+		recvQueue:   make(chan []byte, queueSize),
+		sendQueue:   make(chan []byte, queueSize),
+		closed:      make(chan struct{}),
+		err:         atomic.Value{},
+	}
+	if maxPaths < 1 {
+		maxPaths = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.closed
+		cancel()
+	}()
+	for i := 0; i < maxPaths; i++ {
+		go c.dialLoop(ctx)
+	}
+	return c
+}
+
+// dialLoop repeatedly calls c.dialContext and passes the resulting
+// net.PacketConn to c.exchange. It returns only when c is closed or
+// dialContext returns an error.
+func (c *MultipathPacketConn) dialLoop(ctx context.Context) {
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		conn, err := c.dialContext(ctx)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		path := &multipath{
+			conn:      conn,
+			sendQueue: make(chan []byte, queueSize),
+		}
+		c.addPath(path)
+		c.exchange(path)
+		c.removePath(path)
+		conn.Close()
+	}
+}
+
+func (c *MultipathPacketConn) addPath(path *multipath) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paths = append(c.paths, path)
+}
+
+// removePath stops scheduling packets on the path, and moves the packets
+// still queued on it to the shared send queue.
+func (c *MultipathPacketConn) removePath(path *multipath) {
+	c.lock.Lock()
+	for i, p := range c.paths {
+		if p == path {
+			c.paths = append(c.paths[:i], c.paths[i+1:]...)
+			break
+		}
+	}
+	c.lock.Unlock()
+
+	for {
+		select {
+		case p := <-path.sendQueue:
+			select {
+			case c.sendQueue <- p:
+			default: // OK to drop packets.
+			}
+		default:
+			return
+		}
+	}
+}
+
+// exchange calls ReadFrom on the path's net.PacketConn and places the
+// resulting packets in the receive queue, and takes packets from the path's
+// send queue and the shared send queue and calls WriteTo on them.
+func (c *MultipathPacketConn) exchange(path *multipath) {
+	// Buffered so that neither goroutine blocks reporting its error after
+	// exchange has returned.
+	readErrCh := make(chan error, 1)
+	writeErrCh := make(chan error, 1)
+
+	go func() {
+		defer close(readErrCh)
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-writeErrCh:
+				return
+			default:
+			}
+
+			var buf [1500]byte
+			n, _, err := path.conn.ReadFrom(buf[:])
+			if err != nil {
+				readErrCh <- err
+				return
+			}
+			p := make([]byte, n)
+			copy(p, buf[:])
+			select {
+			case c.recvQueue <- p:
+			default: // OK to drop packets.
+			}
+		}
+	}()
+
+	go func() {
+		defer close(writeErrCh)
+		for {
+			var p []byte
+			select {
+			case <-c.closed:
+				return
+			case <-readErrCh:
+				return
+			case p = <-path.sendQueue:
+			case p = <-c.sendQueue:
+			}
+			_, err := path.conn.WriteTo(p, c.remoteAddr)
+			if err != nil {
+				// Give the packet another chance on another path.
+				select {
+				case c.sendQueue <- p:
+				default:
+				}
+				writeErrCh <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-readErrCh:
+	case <-writeErrCh:
+	}
+}
+
+// schedule returns the current paths in the order in which they should be
+// tried for the next packet.
+func (c *MultipathPacketConn) schedule() []*multipath {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	paths := make([]*multipath, len(c.paths))
+	switch c.scheduler {
+	case SchedulerLowestLatency:
+		copy(paths, c.paths)
+		sort.SliceStable(paths, func(i, j int) bool {
+			ri, rj := paths[i].rtt(), paths[j].rtt()
+			// Paths of unknown RTT go last.
+			if ri == 0 || rj == 0 {
+				return ri != 0 && rj == 0
+			}
+			return ri < rj
+		})
+	default:
+		if len(c.paths) > 0 {
+			c.next %= len(c.paths)
+			n := copy(paths, c.paths[c.next:])
+			copy(paths[n:], c.paths[:c.next])
+			c.next++
+		}
+	}
+	return paths
+}
+
+// Paths returns the number of paths currently open.
+func (c *MultipathPacketConn) Paths() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.paths)
+}
+
+// ReadFrom reads a packet from any of the open paths. The packet's original
+// remote address is replaced with the MultipathPacketConn's own remote
+// address.
+func (c *MultipathPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	default:
+	}
+	select {
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	case buf := <-c.recvQueue:
+		return copy(p, buf), c.remoteAddr, nil
+	}
+}
+
+// WriteTo queues a packet on one of the open paths, chosen by the
+// scheduler, or on the shared send queue if there are none. The addr
+// argument is ignored and instead replaced with the MultipathPacketConn's
+// own remote address.
+func (c *MultipathPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	// addr is ignored.
+	select {
+	case <-c.closed:
+		return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	default:
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	for _, path := range c.schedule() {
+		select {
+		case path.sendQueue <- buf:
+			return len(buf), nil
+		default:
+		}
+	}
+	select {
+	case c.sendQueue <- buf:
+	default:
+		// Drop the outgoing packet if all send queues are full.
+	}
+	return len(buf), nil
+}
+
+// closeWithError unblocks pending operations and makes future operations fail
+// with the given error. If err is nil, it becomes errClosedPacketConn.
+func (c *MultipathPacketConn) closeWithError(err error) error {
+	var once bool
+	c.closeOnce.Do(func() {
+		// Store the error to be returned by future read/write
+		// operations.
+		if err == nil {
+			err = errClosedPacketConn
+		}
+		c.err.Store(err)
+		close(c.closed)
+		once = true
+	})
+	if !once {
+		return &net.OpError{Op: "close", Net: c.LocalAddr().Network(), Addr: c.LocalAddr(), Err: c.err.Load().(error)}
+	}
+	return nil
+}
+
+// Close unblocks pending operations and makes future operations fail with a
+// "closed connection" error.
+func (c *MultipathPacketConn) Close() error {
+	return c.closeWithError(nil)
+}
+
+// LocalAddr returns the localAddr value that was passed to
+// NewMultipathPacketConn.
+func (c *MultipathPacketConn) LocalAddr() net.Addr { return c.localAddr }
+
+func (c *MultipathPacketConn) SetDeadline(t time.Time) error      { return errNotImplemented }
+func (c *MultipathPacketConn) SetReadDeadline(t time.Time) error  { return errNotImplemented }
+func (c *MultipathPacketConn) SetWriteDeadline(t time.Time) error { return errNotImplemented }
@@ -0,0 +1,180 @@
+package turbotunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummyAddr struct{}
+
+func (addr dummyAddr) Network() string { return "dummy" }
+func (addr dummyAddr) String() string  { return "dummy" }
+
+// chanPacketConn is a net.PacketConn whose packets are written to and read
+// from channels, with a fixed RTT.
+type chanPacketConn struct {
+	sent      chan []byte
+	received  chan []byte
+	rtt       time.Duration
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanPacketConn(rtt time.Duration) *chanPacketConn {
+	return &chanPacketConn{
+		sent:     make(chan []byte, 100),
+		received: make(chan []byte, 100),
+		rtt:      rtt,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *chanPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case buf := <-c.received:
+		return copy(p, buf), dummyAddr{}, nil
+	case <-c.closed:
+		return 0, nil, errClosedPacketConn
+	}
+}
+
+func (c *chanPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosedPacketConn
+	default:
+	}
+	c.sent <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *chanPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *chanPacketConn) RTT() time.Duration                 { return c.rtt }
+func (c *chanPacketConn) LocalAddr() net.Addr                { return dummyAddr{} }
+func (c *chanPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *chanPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *chanPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newTestMultipathPacketConn returns a MultipathPacketConn dialing the given
+// paths, once they are all open.
+func newTestMultipathPacketConn(t *testing.T, paths []*chanPacketConn, scheduler MultipathScheduler) *MultipathPacketConn {
+	t.Helper()
+	dials := make(chan *chanPacketConn, len(paths))
+	for _, path := range paths {
+		dials <- path
+	}
+	dial := func(ctx context.Context) (net.PacketConn, error) {
+		select {
+		case path := <-dials:
+			return path, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := NewMultipathPacketConn(dummyAddr{}, dummyAddr{}, dial, len(paths), scheduler)
+	for c.Paths() < len(paths) {
+		time.Sleep(time.Millisecond)
+	}
+	return c
+}
+
+func expectPacket(t *testing.T, ch <-chan []byte, expected string) {
+	t.Helper()
+	select {
+	case p := <-ch:
+		if string(p) != expected {
+			t.Fatalf("expected %q, got %q", expected, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
+
+func TestMultipathPacketConnRoundRobin(t *testing.T) {
+	paths := []*chanPacketConn{newChanPacketConn(0), newChanPacketConn(0), newChanPacketConn(0)}
+	c := newTestMultipathPacketConn(t, paths, SchedulerRoundRobin)
+	defer c.Close()
+
+	counts := make(map[*chanPacketConn]int)
+	for i := 0; i < 30; i++ {
+		c.WriteTo([]byte("packet"), nil)
+	}
+	for i := 0; i < 30; i++ {
+		select {
+		case <-paths[0].sent:
+			counts[paths[0]]++
+		case <-paths[1].sent:
+			counts[paths[1]]++
+		case <-paths[2].sent:
+			counts[paths[2]]++
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for packets")
+		}
+	}
+	for i, path := range paths {
+		if counts[path] != 10 {
+			t.Errorf("path %d sent %d packets, expected 10", i, counts[path])
+		}
+	}
+
+	// Packets from every path are received.
+	for i, path := range paths {
+		path.received <- []byte{byte(i)}
+	}
+	seen := make(map[byte]bool)
+	for range paths {
+		var buf [10]byte
+		n, _, err := c.ReadFrom(buf[:])
+		if err != nil || n != 1 {
+			t.Fatalf("ReadFrom returned %d, %v", n, err)
+		}
+		seen[buf[0]] = true
+	}
+	if len(seen) != len(paths) {
+		t.Errorf("received packets from %d paths, expected %d", len(seen), len(paths))
+	}
+}
+
+func TestMultipathPacketConnLowestLatency(t *testing.T) {
+	slow := newChanPacketConn(300 * time.Millisecond)
+	fast := newChanPacketConn(50 * time.Millisecond)
+	unknown := newChanPacketConn(0)
+	c := newTestMultipathPacketConn(t, []*chanPacketConn{slow, unknown, fast}, SchedulerLowestLatency)
+	defer c.Close()
+
+	c.WriteTo([]byte("first"), nil)
+	c.WriteTo([]byte("second"), nil)
+	expectPacket(t, fast.sent, "first")
+	expectPacket(t, fast.sent, "second")
+
+	// When the fastest path fails, the next fastest takes over.
+	fast.Close()
+	for c.Paths() > 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c.WriteTo([]byte("third"), nil)
+	expectPacket(t, slow.sent, "third")
+}
+
+func TestMultipathPacketConnDialError(t *testing.T) {
+	dialErr := errors.New("no more peers")
+	c := NewMultipathPacketConn(dummyAddr{}, dummyAddr{}, func(ctx context.Context) (net.PacketConn, error) {
+		return nil, dialErr
+	}, 2, SchedulerRoundRobin)
+	var buf [10]byte
+	_, _, err := c.ReadFrom(buf[:])
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Err != dialErr {
+		t.Errorf("expected dial error, got %v", err)
+	}
+	if _, err := c.WriteTo([]byte("packet"), nil); err == nil {
+		t.Errorf("expected WriteTo to fail after dial error")
+	}
+}
@@ -20,7 +20,7 @@ type taggedPacket struct {
 // for each client address that has been recently seen. The QueueIncoming method
 // inserts a packet into the incoming queue, to eventually be returned by
 // ReadFrom. WriteTo inserts a packet into an address-specific outgoing queue,
-// which can later by accessed through the OutgoingQueue method.
+// from which the DequeueOutgoing method later takes it.
 type QueuePacketConn struct {
 	clients   *ClientMap
 	localAddr net.Addr
@@ -34,8 +34,14 @@ type QueuePacketConn struct {
 // NewQueuePacketConn makes a new QueuePacketConn, set to track recent clients
 // for at least a duration of timeout.
 func NewQueuePacketConn(localAddr net.Addr, timeout time.Duration) *QueuePacketConn {
+	return NewQueuePacketConnWithLimits(localAddr, timeout, ClientMapLimits{})
+}
+
+// NewQueuePacketConnWithLimits is like NewQueuePacketConn, but keeps the
+// outgoing queues within limits.
+func NewQueuePacketConnWithLimits(localAddr net.Addr, timeout time.Duration, limits ClientMapLimits) *QueuePacketConn {
 	return &QueuePacketConn{
-		clients:   NewClientMap(timeout),
+		clients:   NewClientMapWithLimits(timeout, limits),
 		localAddr: localAddr,
 		recvQueue: make(chan taggedPacket, queueSize),
 		closed:    make(chan struct{}),
@@ -61,11 +67,24 @@ func (c *QueuePacketConn) QueueIncoming(p []byte, addr net.Addr) {
 	}
 }
 
-// OutgoingQueue returns the queue of outgoing packets corresponding to addr,
-// creating it if necessary. The contents of the queue will be packets that are
-// written to the address in question using WriteTo.
-func (c *QueuePacketConn) OutgoingQueue(addr net.Addr) <-chan []byte {
-	return c.clients.SendQueue(addr)
+// DequeueOutgoing blocks until there is a packet in the queue of outgoing
+// packets corresponding to addr, creating the queue if necessary, and returns
+// it. The contents of the queue will be packets that are written to the
+// address in question using WriteTo. It returns false if done is closed first,
+// or if the queue is removed because it expired or was evicted.
+func (c *QueuePacketConn) DequeueOutgoing(addr net.Addr, done <-chan struct{}) ([]byte, bool) {
+	return c.clients.Dequeue(addr, done)
+}
+
+// LastSeen returns the last time that a packet was taken from the queue of
+// outgoing packets corresponding to addr, and false if there is no such queue.
+func (c *QueuePacketConn) LastSeen(addr net.Addr) (time.Time, bool) {
+	return c.clients.LastSeen(addr)
+}
+
+// Stats returns the current use of resources by the outgoing queues.
+func (c *QueuePacketConn) Stats() ClientMapStats {
+	return c.clients.Stats()
 }
 
 // ReadFrom returns a packet and address previously stored by QueueIncoming.
@@ -83,8 +102,9 @@ func (c *QueuePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	}
 }
 
-// WriteTo queues an outgoing packet for the given address. The queue can later
-// be retrieved using the OutgoingQueue method.
+// WriteTo queues an outgoing packet for the given address, to be taken by the
+// DequeueOutgoing method. The packet is silently dropped if the queue is full
+// or over its limits.
 func (c *QueuePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	select {
 	case <-c.closed:
@@ -94,13 +114,9 @@ func (c *QueuePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	// Copy the slice so that the caller may reuse it.
 	buf := make([]byte, len(p))
 	copy(buf, p)
-	select {
-	case c.clients.SendQueue(addr) <- buf:
-		return len(buf), nil
-	default:
-		// Drop the outgoing packet if the send queue is full.
-		return len(buf), nil
-	}
+	// Drop the outgoing packet if the send queue is full.
+	c.clients.Enqueue(addr, buf)
+	return len(buf), nil
 }
 
 // closeWithError unblocks pending operations and makes future operations fail
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"strings"
 
 	"github.com/pion/ice/v2"
 	"github.com/pion/sdp/v3"
@@ -67,6 +68,19 @@ func IsLocal(ip net.IP) bool {
 	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
 }
 
+// Reports whether an ICE candidate, as in the value of an SDP candidate
+// attribute, is a host candidate with a local LAN address
+func IsLocalCandidate(candidate string) bool {
+	c, err := ice.UnmarshalCandidate(strings.TrimPrefix(candidate, "candidate:"))
+	if err == nil && c.Type() == ice.CandidateTypeHost {
+		ip := net.ParseIP(c.Address())
+		if ip != nil && (IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback()) {
+			return true
+		}
+	}
+	return false
+}
+
 // Removes local LAN address ICE candidates
 func StripLocalAddresses(str string) string {
 	var desc sdp.SessionDescription
@@ -77,15 +91,9 @@ func StripLocalAddresses(str string) string {
 	for _, m := range desc.MediaDescriptions {
 		attrs := make([]sdp.Attribute, 0)
 		for _, a := range m.Attributes {
-			if a.IsICECandidate() {
-				c, err := ice.UnmarshalCandidate(a.Value)
-				if err == nil && c.Type() == ice.CandidateTypeHost {
-					ip := net.ParseIP(c.Address())
-					if ip != nil && (IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback()) {
-						/* no append in this case */
-						continue
-					}
-				}
+			if a.IsICECandidate() && IsLocalCandidate(a.Value) {
+				/* no append in this case */
+				continue
 			}
 			attrs = append(attrs, a)
 		}
@@ -25,4 +25,13 @@ func TestUtil(t *testing.T) {
 
 		So(StripLocalAddresses(offer), ShouldEqual, offerStart+goodCandidate+offerEnd)
 	})
+
+	Convey("IsLocalCandidate", t, func() {
+		So(IsLocalCandidate("candidate:3769337065 1 udp 2122260223 192.168.0.100 56688 typ host"), ShouldBeTrue)
+		So(IsLocalCandidate("3769337065 1 udp 2122260223 ::1 56688 typ host"), ShouldBeTrue)
+		So(IsLocalCandidate("candidate:3769337065 1 udp 2122260223 8.8.8.8 56688 typ host"), ShouldBeFalse)
+		// Only host candidates reveal local addresses.
+		So(IsLocalCandidate("candidate:3769337065 1 udp 1694498815 8.8.8.8 56688 typ srflx raddr 192.168.0.100 rport 56688"), ShouldBeFalse)
+		So(IsLocalCandidate("not a candidate"), ShouldBeFalse)
+	})
 }
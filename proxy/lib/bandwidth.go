@@ -0,0 +1,245 @@
+package snowflake_proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of slots in which a traffic quota counts traffic. Traffic
+// leaves the rolling period one slot at a time, so a daily quota is freed up
+// hour by hour.
+const trafficQuotaSlots = 24
+
+// DefaultTrafficQuotaPeriod is the period over which a traffic quota applies
+// if none is given.
+const DefaultTrafficQuotaPeriod = 24 * time.Hour
+
+// ParseTraffic parses an amount of traffic in bytes, with an optional
+// decimal unit as printed in throughput summaries: "B", "KB", "MB", "GB" or
+// "TB". The empty string means zero.
+func ParseTraffic(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := uint64(1)
+	upper := strings.ToUpper(s)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(upper, unit) {
+			upper = strings.TrimSuffix(upper, unit)
+			for j := 0; j <= i; j++ {
+				multiplier *= 1000
+			}
+			break
+		}
+	}
+	upper = strings.TrimSpace(strings.TrimSuffix(upper, "B"))
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid amount of traffic %q", s)
+	}
+	return uint64(value * float64(multiplier)), nil
+}
+
+// byteBucket is a token bucket that gains rate bytes per second, up to a
+// second's worth. Traffic may take more tokens than are left, and then
+// waits until the bucket is out of debt.
+type byteBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newByteBucket returns a full bucket, or nil if rate is zero, which does
+// not limit anything.
+func newByteBucket(rate uint64, now time.Time) *byteBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take takes n bytes from the bucket at now, and returns how long to wait
+// before sending them.
+func (b *byteBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// trafficQuota counts traffic over a rolling period, in trafficQuotaSlots
+// slots of equal length.
+type trafficQuota struct {
+	lock   sync.Mutex
+	limit  uint64
+	period time.Duration
+	slots  [trafficQuotaSlots]uint64
+	// The index of the current slot, and when it started
+	current   int
+	slotStart time.Time
+}
+
+// newTrafficQuota returns a quota of limit bytes per period, or nil if limit
+// is zero, which never runs out.
+func newTrafficQuota(limit uint64, period time.Duration, now time.Time) *trafficQuota {
+	if limit == 0 {
+		return nil
+	}
+	if period <= 0 {
+		period = DefaultTrafficQuotaPeriod
+	}
+	return &trafficQuota{limit: limit, period: period, slotStart: now}
+}
+
+// advance moves to the slot that now falls in, forgetting the traffic of the
+// slots that have left the period. Must be called with the lock held.
+func (q *trafficQuota) advance(now time.Time) {
+	slotLength := q.period / trafficQuotaSlots
+	for i := 0; i < trafficQuotaSlots && now.Sub(q.slotStart) >= slotLength; i++ {
+		q.current = (q.current + 1) % trafficQuotaSlots
+		q.slots[q.current] = 0
+		q.slotStart = q.slotStart.Add(slotLength)
+	}
+	if now.Sub(q.slotStart) >= slotLength {
+		// All slots have been cleared.
+		q.slotStart = now
+	}
+}
+
+func (q *trafficQuota) add(n int, now time.Time) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.advance(now)
+	q.slots[q.current] += uint64(n)
+}
+
+// used returns the traffic in the period up to now.
+func (q *trafficQuota) used(now time.Time) uint64 {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.advance(now)
+	var used uint64
+	for _, n := range q.slots {
+		used += n
+	}
+	return used
+}
+
+func (q *trafficQuota) exhausted(now time.Time) bool {
+	return q != nil && q.used(now) >= q.limit
+}
+
+// bandwidthLimiter enforces the bandwidth limits of a proxy: the rate of
+// traffic of all clients together and of each client, and the traffic
+// quota. A nil bandwidthLimiter does not limit anything.
+type bandwidthLimiter struct {
+	global     *byteBucket
+	clientRate uint64
+	quota      *trafficQuota
+	now        func() time.Time
+}
+
+func newBandwidthLimiter(rate, clientRate, quota uint64, quotaPeriod time.Duration) *bandwidthLimiter {
+	if rate == 0 && clientRate == 0 && quota == 0 {
+		return nil
+	}
+	now := time.Now()
+	return &bandwidthLimiter{
+		global:     newByteBucket(rate, now),
+		clientRate: clientRate,
+		quota:      newTrafficQuota(quota, quotaPeriod, now),
+		now:        time.Now,
+	}
+}
+
+// quotaExhausted reports whether the traffic quota is used up, in which case
+// the proxy should not take new clients.
+func (l *bandwidthLimiter) quotaExhausted() bool {
+	return l != nil && l.quota.exhausted(l.now())
+}
+
+// newClient returns the limiter of a new client.
+func (l *bandwidthLimiter) newClient() *clientLimiter {
+	if l == nil {
+		return nil
+	}
+	return &clientLimiter{bandwidthLimiter: l, bucket: newByteBucket(l.clientRate, l.now())}
+}
+
+// summary describes the limits, for throughput summaries.
+func (l *bandwidthLimiter) summary() string {
+	var limits []string
+	if l.global != nil {
+		rate, unit := formatTraffic(int(l.global.rate))
+		limits = append(limits, fmt.Sprintf("%d %s/s overall", rate, unit))
+	}
+	if l.clientRate != 0 {
+		rate, unit := formatTraffic(int(l.clientRate))
+		limits = append(limits, fmt.Sprintf("%d %s/s per client", rate, unit))
+	}
+	if l.quota != nil {
+		used, usedUnit := formatTraffic(int(l.quota.used(l.now())))
+		limit, limitUnit := formatTraffic(int(l.quota.limit))
+		limits = append(limits, fmt.Sprintf("%d %s of %d %s per %v used", used, usedUnit, limit, limitUnit, l.quota.period))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// clientLimiter limits the traffic of a single client. A nil clientLimiter
+// does not limit anything.
+type clientLimiter struct {
+	*bandwidthLimiter
+	bucket *byteBucket
+	// The total time that the client's traffic was held back, accessed
+	// atomically
+	throttled int64
+}
+
+// wait counts n bytes of the client's traffic, and blocks until the rate
+// limits allow them.
+func (c *clientLimiter) wait(n int) {
+	if c == nil || n <= 0 {
+		return
+	}
+	now := c.now()
+	c.quota.add(n, now)
+	delay := c.bucket.take(n, now)
+	if global := c.global.take(n, now); global > delay {
+		delay = global
+	}
+	if delay > 0 {
+		atomic.AddInt64(&c.throttled, int64(delay))
+		time.Sleep(delay)
+	}
+}
+
+// summary describes the limits and how long they held back the client.
+func (c *clientLimiter) summary() string {
+	throttled := time.Duration(atomic.LoadInt64(&c.throttled))
+	return fmt.Sprintf("limited to %s, throttled for %d seconds", c.bandwidthLimiter.summary(), int(throttled.Seconds()))
+}
@@ -0,0 +1,107 @@
+package snowflake_proxy
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBandwidth(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	Convey("Traffic amounts", t, func() {
+		for _, test := range []struct {
+			s     string
+			bytes uint64
+		}{
+			{"", 0},
+			{"1234", 1234},
+			{"500B", 500},
+			{"100KB", 100000},
+			{"1.5MB", 1500000},
+			{"10 gb", 10000000000},
+			{"2TB", 2000000000000},
+		} {
+			bytes, err := ParseTraffic(test.s)
+			So(err, ShouldBeNil)
+			So(bytes, ShouldEqual, test.bytes)
+		}
+		for _, s := range []string{"MB", "-1KB", "10PB", "lots"} {
+			_, err := ParseTraffic(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Byte buckets", t, func() {
+		So(newByteBucket(0, now), ShouldBeNil)
+		So((*byteBucket)(nil).take(1000000, now), ShouldEqual, 0)
+
+		b := newByteBucket(1000, now)
+		// A full bucket lets a second's worth through at once.
+		So(b.take(1000, now), ShouldEqual, 0)
+		// Then traffic waits until the bucket is out of debt.
+		So(b.take(500, now), ShouldEqual, 500*time.Millisecond)
+		So(b.take(500, now.Add(time.Second)), ShouldEqual, 0)
+		// The bucket holds at most a second's worth.
+		So(b.take(1500, now.Add(time.Hour)), ShouldEqual, 500*time.Millisecond)
+	})
+
+	Convey("Traffic quotas", t, func() {
+		So(newTrafficQuota(0, time.Hour, now), ShouldBeNil)
+		So((*trafficQuota)(nil).exhausted(now), ShouldBeFalse)
+
+		q := newTrafficQuota(1000, 24*time.Hour, now)
+		q.add(600, now)
+		q.add(300, now.Add(12*time.Hour))
+		So(q.used(now.Add(12*time.Hour)), ShouldEqual, 900)
+		So(q.exhausted(now.Add(12*time.Hour)), ShouldBeFalse)
+		q.add(100, now.Add(18*time.Hour))
+		So(q.exhausted(now.Add(18*time.Hour)), ShouldBeTrue)
+
+		// The first traffic leaves the rolling period after a day.
+		So(q.exhausted(now.Add(24*time.Hour)), ShouldBeFalse)
+		So(q.used(now.Add(24*time.Hour)), ShouldEqual, 400)
+		// And all of it after another day.
+		So(q.used(now.Add(48*time.Hour)), ShouldEqual, 0)
+		q.add(200, now.Add(100*time.Hour))
+		So(q.used(now.Add(100*time.Hour)), ShouldEqual, 200)
+	})
+
+	Convey("Bandwidth limiters", t, func() {
+		So(newBandwidthLimiter(0, 0, 0, 0), ShouldBeNil)
+		var none *bandwidthLimiter
+		So(none.quotaExhausted(), ShouldBeFalse)
+		So(none.newClient(), ShouldBeNil)
+		(*clientLimiter)(nil).wait(1000)
+
+		l := newBandwidthLimiter(2000, 1000, 10000, 0)
+		l.now = func() time.Time { return now }
+		So(l.quota.period, ShouldEqual, DefaultTrafficQuotaPeriod)
+		c1, c2 := l.newClient(), l.newClient()
+
+		// Each client gets its own share, up to the overall limit.
+		c1.wait(1000)
+		c2.wait(1000)
+		So(c1.throttled, ShouldEqual, int64(0))
+		So(c2.throttled, ShouldEqual, int64(0))
+		start := time.Now()
+		c1.wait(100)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+		So(time.Duration(c1.throttled), ShouldEqual, 100*time.Millisecond)
+
+		So(l.quotaExhausted(), ShouldBeFalse)
+		c2.bucket = nil
+		l.global = nil
+		c2.wait(8000)
+		So(l.quotaExhausted(), ShouldBeTrue)
+	})
+
+	Convey("Throughput summaries include the limits", t, func() {
+		l := newBandwidthLimiter(1000000, 100000, 10000000000, 0)
+		b := newBytesSyncLogger(l.newClient())
+		So(b.ThroughputSummary(), ShouldEndWith,
+			"-- (limited to 1 MB/s overall, 100 KB/s per client, 0 B of 10 GB per 24h0m0s used, throttled for 0 seconds)")
+		So(newBytesSyncLogger(nil).ThroughputSummary(), ShouldNotContainSubstring, "limited")
+	})
+}
@@ -2,16 +2,24 @@ package snowflake_proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/util"
 	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
@@ -33,6 +41,21 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// Like MockTransport, but keeps the body of the last request.
+type RecordingTransport struct {
+	MockTransport
+	request []byte
+}
+
+func (r *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.request = body
+	return r.MockTransport.RoundTrip(req)
+}
+
 // Set up a mock faulty transport
 type FaultyTransport struct {
 	statusOverride int
@@ -44,6 +67,25 @@ func (f *FaultyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, fmt.Errorf("TransportFailed")
 }
 
+// A transport that calls a function for each request.
+type FuncTransport func(req *http.Request) (*http.Response, error)
+
+func (f FuncTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// A transport whose requests hang until they are cancelled, like a poll that
+// the broker holds open. It signals each request on requests.
+type HangingTransport struct {
+	requests chan struct{}
+}
+
+func (h *HangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.requests <- struct{}{}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
 func TestRemoteIPFromSDP(t *testing.T) {
 	tests := []struct {
 		sdp      string
@@ -355,6 +397,12 @@ func TestBrokerInteractions(t *testing.T) {
 		answer, _ := pc.CreateAnswer(nil)
 		pc.SetLocalDescription(answer)
 
+		Convey("leaves http.DefaultTransport alone", func() {
+			So(broker.transport, ShouldNotEqual, http.DefaultTransport)
+			So(broker.transport.(*http.Transport).ResponseHeaderTimeout, ShouldBeGreaterThan, 0)
+			So(http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout, ShouldEqual, 0)
+		})
+
 		Convey("polls broker correctly", func() {
 			var err error
 
@@ -365,10 +413,85 @@ func TestBrokerInteractions(t *testing.T) {
 				b,
 			}
 
-			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "", nil)
+			sdp, _, _ := broker.pollOffer(context.Background(), sampleOffer, DefaultProxyType, "")
 			expectedSDP, _ := strconv.Unquote(sampleSDP)
 			So(sdp.SDP, ShouldResemble, expectedSDP)
 		})
+		Convey("signs polls with its identity key", func() {
+			// An invalid response ends the poll after one request.
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, []byte("test")}}
+			broker.transport = transport
+
+			broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			request, err := messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			identity, _, err := request.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, "")
+
+			dir, err := ioutil.TempDir("", "snowflake-proxy")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			key, err := LoadIdentityKey(filepath.Join(dir, "identity"))
+			So(err, ShouldBeNil)
+			reloaded, err := LoadIdentityKey(filepath.Join(dir, "identity"))
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldResemble, key)
+
+			broker.identityKey = key
+			broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			request, err = messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			identity, _, err = request.Identity()
+			So(err, ShouldBeNil)
+			So(identity, ShouldEqual, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		})
+		Convey("advertises trickle ICE and returns the trickle id", func() {
+			b, err := messages.EncodePollResponseWithTrickleID(sampleOffer, "unknown", "", "fake trickle")
+			So(err, ShouldBeNil)
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, b}}
+			broker.transport = transport
+
+			_, _, trickleID := broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			So(trickleID, ShouldEqual, "fake trickle")
+			request, err := messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			So(request.Trickle, ShouldBeFalse)
+
+			broker.trickle = true
+			broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			request, err = messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			So(request.Trickle, ShouldBeTrue)
+		})
+		Convey("advertises a TURN server", func() {
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, []byte("test")}}
+			broker.transport = transport
+
+			broker.turn = true
+			broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			request, err := messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			So(request.TURN, ShouldBeTrue)
+		})
+		Convey("sends the NAT behavior", func() {
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, []byte("test")}}
+			broker.transport = transport
+
+			behavior := &nat.Behavior{Mapping: nat.EndpointIndependent, Filtering: nat.AddressDependent}
+			currentNATTypeAccess.Lock()
+			currentNATBehavior = behavior
+			currentNATTypeAccess.Unlock()
+			defer func() {
+				currentNATTypeAccess.Lock()
+				currentNATBehavior = nil
+				currentNATTypeAccess.Unlock()
+			}()
+			broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			request, err := messages.DecodeProxyPollRequestMessage(transport.request)
+			So(err, ShouldBeNil)
+			So(request.NATBehavior, ShouldResemble, behavior)
+		})
 		Convey("handles poll error", func() {
 			var err error
 
@@ -379,9 +502,135 @@ func TestBrokerInteractions(t *testing.T) {
 				b,
 			}
 
-			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "", nil)
+			sdp, _, _ := broker.pollOffer(context.Background(), sampleOffer, DefaultProxyType, "")
 			So(sdp, ShouldBeNil)
 		})
+		Convey("stops polling at the end of the schedule window", func() {
+			schedule, err := ParseSchedule("10:00-11:00")
+			So(err, ShouldBeNil)
+			var lock sync.Mutex
+			now := time.Date(2021, time.January, 4, 10, 59, 0, 0, time.Local)
+			sf := &SnowflakeProxy{
+				Schedule: schedule,
+				clock: func() time.Time {
+					lock.Lock()
+					defer lock.Unlock()
+					return now
+				},
+			}
+			sf.initialize()
+			transport := &HangingTransport{requests: make(chan struct{}, 1)}
+			broker.transport = transport
+
+			done := make(chan *webrtc.SessionDescription)
+			go func() {
+				ctx, cancel := sf.pollContext()
+				defer cancel()
+				offer, _, _ := broker.pollOffer(ctx, "sid", DefaultProxyType, "")
+				done <- offer
+			}()
+			// Let the window end while a poll is in progress.
+			<-transport.requests
+			lock.Lock()
+			now = now.Add(time.Minute)
+			lock.Unlock()
+			select {
+			case offer := <-done:
+				So(offer, ShouldBeNil)
+			case <-time.After(3 * pollCheckInterval):
+				So("still polling", ShouldBeEmpty)
+			}
+			So(transport.requests, ShouldBeEmpty)
+		})
+		Convey("stops polling when the traffic quota runs out", func() {
+			sf := &SnowflakeProxy{
+				bandwidth: newBandwidthLimiter(0, 0, 1000, 0),
+			}
+			sf.initialize()
+			client := sf.bandwidth.newClient()
+			transport := &HangingTransport{requests: make(chan struct{}, 1)}
+			broker.transport = transport
+
+			done := make(chan *webrtc.SessionDescription)
+			go func() {
+				ctx, cancel := sf.pollContext()
+				defer cancel()
+				offer, _, _ := broker.pollOffer(ctx, "sid", DefaultProxyType, "")
+				done <- offer
+			}()
+			// Let a client use up the quota while a poll is in
+			// progress.
+			<-transport.requests
+			client.wait(1000)
+			select {
+			case offer := <-done:
+				So(offer, ShouldBeNil)
+			case <-time.After(3 * pollCheckInterval):
+				So("still polling", ShouldBeEmpty)
+			}
+			So(transport.requests, ShouldBeEmpty)
+
+			Convey("and drops an offer that arrives as it runs out", func() {
+				sf.bandwidth = newBandwidthLimiter(0, 0, 1000, 0)
+				client := sf.bandwidth.newClient()
+				b, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+				So(err, ShouldBeNil)
+				var paths []string
+				broker.transport = FuncTransport(func(req *http.Request) (*http.Response, error) {
+					paths = append(paths, req.URL.Path)
+					client.wait(1000)
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+				})
+
+				tokens.get()
+				sf.runSession("sid")
+				So(tokens.count(), ShouldEqual, 0)
+				// No answer was sent.
+				So(paths, ShouldResemble, []string{"/proxy"})
+			})
+		})
+		Convey("counts a client in a shutdown from when its offer is accepted", func() {
+			sf := &SnowflakeProxy{}
+			sf.initialize()
+			poll, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+			So(err, ShouldBeNil)
+			answer, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			broker.transport = FuncTransport(func(req *http.Request) (*http.Response, error) {
+				body := poll
+				if req.URL.Path == "/answer" {
+					body = answer
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+			})
+			// Gather only host candidates.
+			config = webrtc.Configuration{}
+
+			tokens.get()
+			done := make(chan struct{})
+			go func() {
+				sf.runSession("sid")
+				close(done)
+			}()
+			// The client never opens its data channel.
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if active, _ := sf.sessions.count(); active == 1 {
+					break
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			drained, killed, err := sf.Shutdown(ctx)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+			So(drained, ShouldEqual, 0)
+			So(killed, ShouldEqual, 1)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				So("still waiting for the client", ShouldBeEmpty)
+			}
+			So(tokens.count(), ShouldEqual, 0)
+		})
 		Convey("sends answer to broker", func() {
 			var err error
 
@@ -440,6 +689,31 @@ func TestBrokerInteractions(t *testing.T) {
 	})
 }
 
+func TestSessionConfig(t *testing.T) {
+	Convey("Session configuration", t, func() {
+		config = webrtc.Configuration{
+			ICEServers: []webrtc.ICEServer{{URLs: []string{DefaultSTUNURL}}},
+		}
+
+		Convey("only uses the STUN server without a TURN server", func() {
+			sf := &SnowflakeProxy{}
+			So(sf.sessionConfig().ICEServers, ShouldResemble, config.ICEServers)
+		})
+
+		Convey("adds the TURN server with its credentials", func() {
+			sf := &SnowflakeProxy{TURNURL: "turn:turn.example.com:3478", TURNSecret: "secret"}
+			servers := sf.sessionConfig().ICEServers
+			So(len(servers), ShouldEqual, 2)
+			So(servers[0].URLs, ShouldResemble, []string{"turn:turn.example.com:3478"})
+			So(servers[0].Username, ShouldNotEqual, "")
+			So(servers[0].Credential, ShouldNotEqual, "")
+			So(servers[1].URLs, ShouldResemble, []string{DefaultSTUNURL})
+			// The configuration for NAT checks is unchanged.
+			So(len(config.ICEServers), ShouldEqual, 1)
+		})
+	})
+}
+
 func TestUtilityFuncs(t *testing.T) {
 	Convey("LimitedRead", t, func() {
 		c, s := net.Pipe()
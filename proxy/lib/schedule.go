@@ -0,0 +1,180 @@
+package snowflake_proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of weekly time windows, in local time, during which a
+// proxy serves clients. A nil Schedule is always active.
+type Schedule struct {
+	windows []scheduleWindow
+}
+
+// scheduleWindow is a daily window on some days of the week. A window whose
+// end is not after its start runs past midnight into the next day.
+type scheduleWindow struct {
+	// Indexed by time.Weekday, the days on which the window starts
+	days [7]bool
+	// Minutes since midnight
+	start, end int
+}
+
+// ParseSchedule parses a schedule of windows separated by ";". Each window
+// is a time range "HH:MM-HH:MM", optionally preceded by the days of the week
+// on which it starts, in the manner of cron: "*", a list such as "Sat,Sun",
+// a range such as "Mon-Fri", or numbers with 0 for Sunday. For example,
+// "Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00" serves clients overnight during
+// the week and all day at weekends.
+func ParseSchedule(s string) (*Schedule, error) {
+	schedule := &Schedule{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		window, err := parseScheduleWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %v", spec, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	if len(schedule.windows) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	return schedule, nil
+}
+
+func parseScheduleWindow(spec string) (scheduleWindow, error) {
+	var window scheduleWindow
+	fields := strings.Fields(spec)
+	days := "*"
+	switch len(fields) {
+	case 1:
+	case 2:
+		days = fields[0]
+	default:
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+	if err := window.parseDays(days); err != nil {
+		return window, err
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return window, fmt.Errorf("expected a time range HH:MM-HH:MM")
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(times[0]); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(times[1]); err != nil {
+		return window, err
+	}
+	if window.start == 24*60 {
+		return window, fmt.Errorf("window cannot start at 24:00")
+	}
+	return window, nil
+}
+
+func (w *scheduleWindow) parseDays(days string) error {
+	if days == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(days, ",") {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid day range %q", item)
+		}
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(bounds[1]); err != nil {
+				return err
+			}
+		}
+		// Ranges may wrap around the end of the week, as in "Fri-Mon".
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	if day, ok := weekdayNames[strings.ToLower(s)]; ok {
+		return day, nil
+	}
+	// cron allows 7 for Sunday as well as 0.
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 7 {
+		return 0, fmt.Errorf("invalid day of the week %q", s)
+	}
+	return time.Weekday(n % 7), nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight. "24:00" is the
+// end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains reports whether the window includes t, which is minutes since
+// midnight on the given day of the week.
+func (w scheduleWindow) contains(day time.Weekday, t int) bool {
+	if w.start < w.end {
+		return w.days[day] && w.start <= t && t < w.end
+	}
+	// The window runs past midnight: it includes the evening of the days on
+	// which it starts, and the morning after.
+	yesterday := (day + 6) % 7
+	return (w.days[day] && t >= w.start) || (w.days[yesterday] && t < w.end)
+}
+
+// Active reports whether t falls within one of the windows of the schedule,
+// in t's location.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	for _, window := range s.windows {
+		if window.contains(t.Weekday(), minutes) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package snowflake_proxy
+
+import (
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchedule(t *testing.T) {
+	// 7 June 2021 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, time.June, day, hour, minute, 0, 0, time.Local)
+	}
+	monday, wednesday, friday, saturday, sunday := 7, 9, 4, 5, 6
+
+	Convey("Schedules", t, func() {
+		Convey("are always active if unset", func() {
+			var schedule *Schedule
+			So(schedule.Active(time.Now()), ShouldBeTrue)
+		})
+
+		Convey("are active within a daily window", func() {
+			schedule, err := ParseSchedule("09:30-17:00")
+			So(err, ShouldBeNil)
+			So(schedule.Active(at(monday, 9, 29)), ShouldBeFalse)
+			So(schedule.Active(at(monday, 9, 30)), ShouldBeTrue)
+			So(schedule.Active(at(sunday, 16, 59)), ShouldBeTrue)
+			So(schedule.Active(at(monday, 17, 0)), ShouldBeFalse)
+		})
+
+		Convey("run windows past midnight", func() {
+			schedule, err := ParseSchedule("Mon-Fri 22:00-07:00")
+			So(err, ShouldBeNil)
+			So(schedule.Active(at(monday, 23, 0)), ShouldBeTrue)
+			So(schedule.Active(at(friday, 23, 0)), ShouldBeTrue)
+			// The window that starts on Friday evening ends on
+			// Saturday morning.
+			So(schedule.Active(at(saturday, 6, 59)), ShouldBeTrue)
+			So(schedule.Active(at(saturday, 7, 0)), ShouldBeFalse)
+			So(schedule.Active(at(saturday, 23, 0)), ShouldBeFalse)
+			So(schedule.Active(at(sunday, 6, 0)), ShouldBeFalse)
+			So(schedule.Active(at(monday, 6, 0)), ShouldBeFalse)
+		})
+
+		Convey("combine windows and days as in cron", func() {
+			schedule, err := ParseSchedule("1-5 22:00-07:00; sat,0 00:00-24:00")
+			So(err, ShouldBeNil)
+			So(schedule.Active(at(saturday, 12, 0)), ShouldBeTrue)
+			So(schedule.Active(at(sunday, 23, 59)), ShouldBeTrue)
+			So(schedule.Active(at(monday, 12, 0)), ShouldBeFalse)
+
+			schedule, err = ParseSchedule("Fri-Mon 12:00-13:00")
+			So(err, ShouldBeNil)
+			So(schedule.Active(at(sunday, 12, 0)), ShouldBeTrue)
+			So(schedule.Active(at(monday, 12, 0)), ShouldBeTrue)
+			So(schedule.Active(at(wednesday, 12, 0)), ShouldBeFalse)
+		})
+
+		Convey("reject invalid specifications", func() {
+			for _, s := range []string{
+				"",
+				";",
+				"22:00",
+				"22:00-25:00",
+				"24:00-07:00",
+				"09:60-10:00",
+				"Mon-Fri-Sat 09:00-10:00",
+				"Someday 09:00-10:00",
+				"8 09:00-10:00",
+				"Mon 09:00-10:00 extra",
+			} {
+				_, err := ParseSchedule(s)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Schedule changes", t, func() {
+		So(event.EventOnProxyScheduleChange{Active: false, Clients: 3}.String(), ShouldContainSubstring, "draining 3 clients")
+	})
+}
@@ -0,0 +1,45 @@
+package snowflake_proxy
+
+import (
+	"sync"
+)
+
+// sessions_t keeps count of the sessions that are relaying traffic for
+// clients, so that a shutdown can wait for them to end.
+type sessions_t struct {
+	lock   sync.Mutex
+	active int
+	ended  int
+	// ch receives a value, without blocking, whenever a session ends.
+	ch chan struct{}
+}
+
+func newSessions() *sessions_t {
+	return &sessions_t{ch: make(chan struct{}, 1)}
+}
+
+func (s *sessions_t) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active++
+}
+
+func (s *sessions_t) end() {
+	s.lock.Lock()
+	s.active--
+	s.ended++
+	s.lock.Unlock()
+
+	select {
+	case s.ch <- struct{}{}:
+	default:
+	}
+}
+
+// count returns the number of active sessions, and the number of sessions
+// that have ended so far.
+func (s *sessions_t) count() (active int, ended int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active, s.ended
+}
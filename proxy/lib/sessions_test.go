@@ -0,0 +1,108 @@
+package snowflake_proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingEventReceiver struct {
+	events chan event.SnowflakeEvent
+}
+
+func (r *recordingEventReceiver) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	r.events <- e
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Shutdown", t, func() {
+		receiver := &recordingEventReceiver{events: make(chan event.SnowflakeEvent, 10)}
+		dispatcher := event.NewSnowflakeEventDispatcher()
+		dispatcher.AddSnowflakeEventListener(receiver)
+		sf := &SnowflakeProxy{EventDispatcher: dispatcher}
+		sf.initialize()
+		// startSession relays between two pipes, the way
+		// datachannelHandler relays between a client and the server, and
+		// returns the client end.
+		startSession := func() net.Conn {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+			sf.sessions.start()
+			go func() {
+				defer sf.sessions.end()
+				defer server.Close()
+				copyLoop(c1, c2, sf.closeConnections)
+			}()
+			return client
+		}
+
+		Convey("waits for clients to finish", func() {
+			client1, client2 := startSession(), startSession()
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				client1.Close()
+				client2.Close()
+			}()
+			drained, killed, err := sf.Shutdown(context.Background())
+			So(err, ShouldBeNil)
+			So(drained, ShouldEqual, 2)
+			So(killed, ShouldEqual, 0)
+			// Polling stopped at once.
+			select {
+			case <-sf.shutdown:
+			default:
+				So("polling not stopped", ShouldBeEmpty)
+			}
+			So(<-receiver.events, ShouldResemble, event.EventOnProxyShutdown{Drained: 2})
+		})
+
+		Convey("cuts off clients at the deadline", func() {
+			finished, stuck := startSession(), startSession()
+			defer stuck.Close()
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				finished.Close()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			drained, killed, err := sf.Shutdown(ctx)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+			So(drained, ShouldEqual, 1)
+			So(killed, ShouldEqual, 1)
+			So(<-receiver.events, ShouldResemble, event.EventOnProxyShutdown{Drained: 1, Killed: 1})
+
+			// The connection of the remaining client is closed.
+			stuck.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = stuck.Read(make([]byte, 1))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "timeout")
+
+			// Stop may still be called.
+			sf.Stop()
+		})
+
+		Convey("returns at once without clients", func() {
+			drained, killed, err := sf.Shutdown(context.Background())
+			So(err, ShouldBeNil)
+			So(drained+killed, ShouldEqual, 0)
+		})
+
+		Convey("may come before Start", func() {
+			sf := &SnowflakeProxy{}
+			drained, killed, err := sf.Shutdown(context.Background())
+			So(err, ShouldBeNil)
+			So(drained+killed, ShouldEqual, 0)
+			sf.Stop()
+			// Start then stops polling at once.
+			select {
+			case <-sf.shutdown:
+			default:
+				So("polling not stopped", ShouldBeEmpty)
+			}
+		})
+	})
+}
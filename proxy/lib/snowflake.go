@@ -27,8 +27,11 @@ package snowflake_proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -41,9 +44,12 @@ import (
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/iceservers"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/namematcher"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/task"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/trickle"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/util"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/websocketconn"
 	"github.com/gorilla/websocket"
@@ -61,6 +67,10 @@ const DefaultSTUNURL = "stun:stun.stunprotocol.org:3478"
 const DefaultProxyType = "standalone"
 const pollInterval = 5 * time.Second
 
+// pollCheckInterval is how often a poll in progress checks whether the proxy
+// should still be polling for clients.
+const pollCheckInterval = time.Second
+
 const (
 	// NATUnknown represents a NAT type which is unknown.
 	NATUnknown = "unknown"
@@ -84,12 +94,22 @@ var currentNATTypeAccess = &sync.RWMutex{}
 // Obtain currentNATTypeAccess before access.
 var currentNATType = NATUnknown
 
+// currentNATBehavior is the RFC 5780 classification of the local NAT, nil
+// until it is known. Obtain currentNATTypeAccess before access.
+var currentNATBehavior *nat.Behavior
+
 func getCurrentNATType() string {
 	currentNATTypeAccess.RLock()
 	defer currentNATTypeAccess.RUnlock()
 	return currentNATType
 }
 
+func getCurrentNATBehavior() *nat.Behavior {
+	currentNATTypeAccess.RLock()
+	defer currentNATTypeAccess.RUnlock()
+	return currentNATBehavior
+}
+
 const (
 	sessionIDLength = 16
 )
@@ -108,6 +128,19 @@ type SnowflakeProxy struct {
 	Capacity uint
 	// STUNURL is the URL of the STUN server the proxy will use
 	STUNURL string
+	// TURNURL, if set, is the URL of a TURN server through which the proxy
+	// relays traffic for clients that it cannot reach directly, for example
+	// because both are behind symmetric NATs. The proxy then tells the
+	// broker that it can serve clients behind any NAT.
+	TURNURL string
+	// TURNUsername and TURNCredential are the credentials for the TURN
+	// server.
+	TURNUsername   string
+	TURNCredential string
+	// TURNSecret, if set, is a secret shared with the TURN server, from
+	// which short-lived credentials are derived for each client instead, as
+	// coturn expects with its static-auth-secret option.
+	TURNSecret string
 	// BrokerURL is the URL of the Snowflake broker
 	BrokerURL string
 	// KeepLocalAddresses indicates whether local SDP candidates will be sent to the broker
@@ -128,7 +161,45 @@ type SnowflakeProxy struct {
 	// ProxyType is the type reported to the broker, if not provided it "standalone" will be used
 	ProxyType       string
 	EventDispatcher event.SnowflakeEventDispatcher
-	shutdown        chan struct{}
+	// IdentityKey, if set, is the long-lived key with which the proxy signs
+	// its polls, so that the broker can keep track of its reputation. If it
+	// is nil, the proxy is anonymous.
+	IdentityKey ed25519.PrivateKey
+	// Trickle advertises to the broker that the proxy supports trickle ICE.
+	// Clients that send their offer before ICE candidate gathering is
+	// complete may then be matched with the proxy, which answers them
+	// without waiting for its own gathering to complete, and exchanges
+	// candidates with them through the broker.
+	Trickle bool
+	// BandwidthLimit and ClientBandwidthLimit are the maximum rates, in
+	// bytes per second in both directions together, of the traffic of all
+	// clients and of each client. Zero means no limit.
+	BandwidthLimit       uint64
+	ClientBandwidthLimit uint64
+	// TrafficQuota, if not zero, is the maximum traffic in bytes over any
+	// TrafficQuotaPeriod, which defaults to DefaultTrafficQuotaPeriod. Once
+	// the quota is used up, the proxy stops polling for new clients until
+	// enough of it is freed up again.
+	TrafficQuota       uint64
+	TrafficQuotaPeriod time.Duration
+	// Schedule, if set, restricts polling for clients to its time windows.
+	// Clients that are being served when a window ends are not dropped,
+	// but are left to finish.
+	Schedule *Schedule
+	// clock, if set, replaces time.Now for the Schedule.
+	clock func() time.Time
+	// shutdown is closed to stop polling the broker, and closeConnections
+	// to close the connections of the clients being served. They,
+	// sessions and tokens are set up by initialize, whichever of Start,
+	// Stop, Shutdown and the StatusServer comes first.
+	shutdown         chan struct{}
+	closeConnections chan struct{}
+	initOnce         sync.Once
+	shutdownOnce     sync.Once
+	closeOnce        sync.Once
+	sessions         *sessions_t
+	tokens           *tokens_t
+	bandwidth        *bandwidthLimiter
 }
 
 // Checks whether an IP address is a remote address for the client
@@ -160,6 +231,11 @@ type SignalingServer struct {
 	url                *url.URL
 	transport          http.RoundTripper
 	keepLocalAddresses bool
+	identityKey        ed25519.PrivateKey
+	trickle            bool
+	turn               bool
+	// eventDispatcher, if not nil, is told the result of every poll.
+	eventDispatcher event.SnowflakeEventReceiver
 }
 
 func newSignalingServer(rawURL string, keepLocalAddresses bool) (*SignalingServer, error) {
@@ -171,16 +247,22 @@ func newSignalingServer(rawURL string, keepLocalAddresses bool) (*SignalingServe
 		return nil, fmt.Errorf("invalid broker url: %s", err)
 	}
 
-	s.transport = http.DefaultTransport.(*http.Transport)
-	s.transport.(*http.Transport).ResponseHeaderTimeout = 30 * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	s.transport = transport
 
 	return s, nil
 }
 
 // Post sends a POST request to the SignalingServer
 func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
+	return s.post(context.Background(), path, payload)
+}
+
+// post is Post with a context, which aborts the request when it is done.
+func (s *SignalingServer) post(ctx context.Context, path string, payload io.Reader) ([]byte, error) {
 
-	req, err := http.NewRequest("POST", path, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", path, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -197,7 +279,11 @@ func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
 	return limitedRead(resp.Body, readLimit)
 }
 
-func (s *SignalingServer) pollOffer(sid string, proxyType string, acceptedRelayPattern string, shutdown chan struct{}) (*webrtc.SessionDescription, string) {
+// pollOffer polls the broker until it hands out a client offer, and returns
+// the offer, the relay URL, and the trickle id of the client, which is empty
+// unless the client uses trickle ICE. It gives up, aborting the poll in
+// progress and dropping any offer it brings, when ctx is done.
+func (s *SignalingServer) pollOffer(ctx context.Context, sid string, proxyType string, acceptedRelayPattern string) (*webrtc.SessionDescription, string, string) {
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
 
 	ticker := time.NewTicker(pollInterval)
@@ -206,39 +292,62 @@ func (s *SignalingServer) pollOffer(sid string, proxyType string, acceptedRelayP
 	// Run the loop once before hitting the ticker
 	for ; true; <-ticker.C {
 		select {
-		case <-shutdown:
-			return nil, ""
+		case <-ctx.Done():
+			return nil, "", ""
 		default:
 			numClients := int((tokens.count() / 8) * 8) // Round down to 8
 			currentNATTypeLoaded := getCurrentNATType()
-			body, err := messages.EncodeProxyPollRequestWithRelayPrefix(sid, proxyType, currentNATTypeLoaded, numClients, acceptedRelayPattern)
+			body, err := messages.EncodeProxyPollRequestWithOptions(sid, proxyType, currentNATTypeLoaded, numClients, acceptedRelayPattern, messages.ProxyPollOptions{
+				Key:         s.identityKey,
+				Trickle:     s.trickle,
+				TURN:        s.turn,
+				NATBehavior: getCurrentNATBehavior(),
+			})
 			if err != nil {
 				log.Printf("Error encoding poll message: %s", err.Error())
-				return nil, ""
+				return nil, "", ""
 			}
-			resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
-			if err != nil {
-				log.Printf("error polling broker: %s", err.Error())
+			resp, postErr := s.post(ctx, brokerPath.String(), bytes.NewBuffer(body))
+			if ctx.Err() != nil {
+				log.Printf("Stopped polling broker")
+				return nil, "", ""
+			}
+			if postErr != nil {
+				log.Printf("error polling broker: %s", postErr.Error())
 			}
 
-			offer, _, relayURL, err := messages.DecodePollResponseWithRelayURL(resp)
+			offer, _, relayURL, trickleID, err := messages.DecodePollResponseWithTrickleID(resp)
 			if err != nil {
 				log.Printf("Error reading broker response: %s", err.Error())
 				log.Printf("body: %s", resp)
-				return nil, ""
+				if postErr != nil {
+					err = postErr
+				}
+				s.dispatch(event.EventOnProxyPollResult{Error: err})
+				return nil, "", ""
 			}
 			if offer != "" {
 				offer, err := util.DeserializeSessionDescription(offer)
 				if err != nil {
 					log.Printf("Error processing session description: %s", err.Error())
-					return nil, ""
+					s.dispatch(event.EventOnProxyPollResult{Error: err})
+					return nil, "", ""
 				}
-				return offer, relayURL
+				s.dispatch(event.EventOnProxyPollResult{Matched: true})
+				return offer, relayURL, trickleID
 
 			}
+			s.dispatch(event.EventOnProxyPollResult{})
 		}
 	}
-	return nil, ""
+	return nil, "", ""
+}
+
+// dispatch passes e on to the event dispatcher, if any.
+func (s *SignalingServer) dispatch(e event.SnowflakeEvent) {
+	if s.eventDispatcher != nil {
+		s.eventDispatcher.OnNewSnowflakeEvent(e)
+	}
 }
 
 func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) error {
@@ -274,6 +383,13 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 	return nil
 }
 
+// exchangeCandidates sends an encoded trickle request to the broker, and
+// returns the encoded response.
+func (s *SignalingServer) exchangeCandidates(body []byte) ([]byte, error) {
+	brokerPath := s.url.ResolveReference(&url.URL{Path: "trickle"})
+	return s.Post(brokerPath.String(), bytes.NewBuffer(body))
+}
+
 func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct{}) {
 	var once sync.Once
 	defer c2.Close()
@@ -306,7 +422,8 @@ func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct
 // RemoteAddr). https://bugs.torproject.org/18628#comment:8
 func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Addr, relayURL string) {
 	defer conn.Close()
-	defer tokens.ret()
+	// The session started when the offer was accepted.
+	defer sf.endSession()
 
 	if relayURL == "" {
 		relayURL = sf.RelayURL
@@ -334,7 +451,7 @@ func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Ad
 	wsConn := websocketconn.New(ws)
 	log.Printf("connected to relay: %v", relayURL)
 	defer wsConn.Close()
-	copyLoop(conn, wsConn, sf.shutdown)
+	copyLoop(conn, wsConn, sf.closeConnections)
 	log.Printf("datachannelHandler ends")
 }
 
@@ -350,18 +467,25 @@ func (d dataChannelHandlerWithRelayURL) datachannelHandler(conn *webRTCConn, rem
 // Create a PeerConnection from an SDP offer. Blocks until the gathering of ICE
 // candidates is complete and the answer is available in LocalDescription.
 // Installs an OnDataChannel callback that creates a webRTCConn and passes it to
-// datachannelHandler.
+// datachannelHandler. If trickling is set, it returns as soon as the answer
+// is available, along with the collector of the local candidates that are
+// gathered after that.
 func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescription,
 	config webrtc.Configuration,
 	dataChan chan struct{},
-	handler func(conn *webRTCConn, remoteAddr net.Addr)) (*webrtc.PeerConnection, error) {
+	handler func(conn *webRTCConn, remoteAddr net.Addr),
+	trickling bool) (*webrtc.PeerConnection, *trickle.Candidates, error) {
 
 	s := webrtc.SettingEngine{}
 	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
 	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
 	pc, err := api.NewPeerConnection(config)
 	if err != nil {
-		return nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
+		return nil, nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
+	}
+	var candidates *trickle.Candidates
+	if trickling {
+		candidates = trickle.New(pc, messages.TrickleRoleProxy, sf.KeepLocalAddresses)
 	}
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
 		log.Println("OnDataChannel")
@@ -369,7 +493,8 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 
 		pr, pw := io.Pipe()
 		conn := &webRTCConn{pc: pc, dc: dc, pr: pr, eventLogger: sf.EventDispatcher}
-		conn.bytesLogger = newBytesSyncLogger()
+		conn.limiter = sf.bandwidth.newClient()
+		conn.bytesLogger = newBytesSyncLogger(conn.limiter)
 
 		dc.OnOpen(func() {
 			log.Println("OnOpen channel")
@@ -413,7 +538,7 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 		if inerr := pc.Close(); inerr != nil {
 			log.Printf("unable to call pc.Close after pc.SetRemoteDescription with error: %v", inerr)
 		}
-		return nil, fmt.Errorf("accept: SetRemoteDescription: %s", err)
+		return nil, nil, fmt.Errorf("accept: SetRemoteDescription: %s", err)
 	}
 	log.Println("sdp offer successfully received.")
 
@@ -426,7 +551,7 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 		if inerr := pc.Close(); inerr != nil {
 			log.Printf("ICE gathering has generated an error when calling pc.Close: %v", inerr)
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = pc.SetLocalDescription(answer)
@@ -434,11 +559,13 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 		if err = pc.Close(); err != nil {
 			log.Printf("pc.Close after setting local description returned : %v", err)
 		}
-		return nil, err
+		return nil, nil, err
 	}
-	// Wait for ICE candidate gathering to complete
-	<-done
-	return pc, nil
+	if !trickling {
+		// Wait for ICE candidate gathering to complete
+		<-done
+	}
+	return pc, candidates, nil
 }
 
 // Create a new PeerConnection. Blocks until the gathering of ICE
@@ -497,54 +624,140 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(config webrtc.Configuration,
 }
 
 func (sf *SnowflakeProxy) runSession(sid string) {
-	offer, relayURL := broker.pollOffer(sid, sf.ProxyType, sf.RelayDomainNamePattern, sf.shutdown)
+	ctx, cancel := sf.pollContext()
+	offer, relayURL, trickleID := broker.pollOffer(ctx, sid, sf.ProxyType, sf.RelayDomainNamePattern)
+	cancel()
+	if offer != nil && !sf.shouldPoll() {
+		// The poll ended just as the proxy stopped taking clients.
+		log.Printf("dropping offer from broker: not taking clients")
+		tokens.ret()
+		return
+	}
 	if offer == nil {
 		log.Printf("bad offer from broker")
 		tokens.ret()
 		return
 	}
+	// From here on, the client counts as being served, so that a shutdown
+	// waits for it to connect and finish.
+	sf.sessions.start()
 	matcher := namematcher.NewNameMatcher(sf.RelayDomainNamePattern)
 	parsedRelayURL, err := url.Parse(relayURL)
 	if err != nil {
 		log.Printf("bad offer from broker: bad Relay URL %v", err.Error())
-		tokens.ret()
+		sf.endSession()
 		return
 	}
 	if relayURL != "" && (!matcher.IsMember(parsedRelayURL.Hostname()) || (!sf.AllowNonTLSRelay && parsedRelayURL.Scheme != "wss")) {
 		log.Printf("bad offer from broker: rejected Relay URL")
-		tokens.ret()
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionFailed{Error: errors.New("rejected relay URL")})
+		sf.endSession()
 		return
 	}
 	dataChan := make(chan struct{})
 	dataChannelAdaptor := dataChannelHandlerWithRelayURL{RelayURL: relayURL, sf: sf}
-	pc, err := sf.makePeerConnectionFromOffer(offer, config, dataChan, dataChannelAdaptor.datachannelHandler)
+	pc, candidates, err := sf.makePeerConnectionFromOffer(offer, sf.sessionConfig(), dataChan, dataChannelAdaptor.datachannelHandler, trickleID != "")
 	if err != nil {
 		log.Printf("error making WebRTC connection: %s", err)
-		tokens.ret()
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionFailed{Error: err})
+		sf.endSession()
 		return
 	}
 	err = broker.sendAnswer(sid, pc)
 	if err != nil {
 		log.Printf("error sending answer to client through broker: %s", err)
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionFailed{Error: err})
 		if inerr := pc.Close(); inerr != nil {
 			log.Printf("error calling pc.Close: %v", inerr)
 		}
-		tokens.ret()
+		sf.endSession()
 		return
 	}
+	if candidates != nil {
+		go candidates.Run(trickleID, broker.exchangeCandidates)
+		defer candidates.Stop()
+	}
 	// Set a timeout on peerconnection. If the connection state has not
 	// advanced to PeerConnectionStateConnected in this time,
 	// destroy the peer connection and return the token.
 	select {
 	case <-dataChan:
 		log.Println("Connection successful.")
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyClientConnected{})
 	case <-time.After(dataChannelTimeout):
 		log.Println("Timed out waiting for client to open data channel.")
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionFailed{Error: errors.New("timed out waiting for data channel")})
 		if err := pc.Close(); err != nil {
 			log.Printf("error calling pc.Close: %v", err)
 		}
-		tokens.ret()
+		sf.endSession()
+	case <-sf.closeConnections:
+		log.Println("Stopped waiting for client to open data channel.")
+		if err := pc.Close(); err != nil {
+			log.Printf("error calling pc.Close: %v", err)
+		}
+		sf.endSession()
+	}
+}
+
+// endSession ends a session that started when the proxy accepted an offer,
+// and returns its token.
+func (sf *SnowflakeProxy) endSession() {
+	tokens.ret()
+	sf.sessions.end()
+}
+
+func (sf *SnowflakeProxy) now() time.Time {
+	if sf.clock != nil {
+		return sf.clock()
 	}
+	return time.Now()
+}
+
+// shouldPoll reports whether the proxy should poll the broker for new
+// clients, which it does only within the windows of its Schedule, and while
+// its traffic quota lasts.
+func (sf *SnowflakeProxy) shouldPoll() bool {
+	return sf.Schedule.Active(sf.now()) && !sf.bandwidth.quotaExhausted()
+}
+
+// pollContext returns a context for polling the broker for a client, which
+// is done when the proxy shuts down or should no longer poll.
+func (sf *SnowflakeProxy) pollContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(pollCheckInterval)
+		defer ticker.Stop()
+		for sf.shouldPoll() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sf.shutdown:
+				cancel()
+				return
+			case <-ticker.C:
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// sessionConfig returns the WebRTC configuration for a new client session.
+// It adds the TURN server, if any, to the configuration used for NAT checks,
+// with fresh credentials.
+func (sf *SnowflakeProxy) sessionConfig() webrtc.Configuration {
+	if sf.TURNURL == "" {
+		return config
+	}
+	credentials := iceservers.TURNCredentials{
+		Username:   sf.TURNUsername,
+		Credential: sf.TURNCredential,
+		Secret:     sf.TURNSecret,
+	}
+	sessionConfig := config
+	sessionConfig.ICEServers = append(iceservers.Servers([]string{sf.TURNURL}, credentials, time.Now()), config.ICEServers...)
+	return sessionConfig
 }
 
 // Start configures and starts a Snowflake, fully formed and special. Configuration
@@ -553,7 +766,7 @@ func (sf *SnowflakeProxy) Start() error {
 	var err error
 
 	log.Println("starting")
-	sf.shutdown = make(chan struct{})
+	sf.initialize()
 
 	// blank configurations revert to default
 	if sf.BrokerURL == "" {
@@ -571,14 +784,15 @@ func (sf *SnowflakeProxy) Start() error {
 	if sf.ProxyType == "" {
 		sf.ProxyType = DefaultProxyType
 	}
-	if sf.EventDispatcher == nil {
-		sf.EventDispatcher = event.NewSnowflakeEventDispatcher()
-	}
 
 	broker, err = newSignalingServer(sf.BrokerURL, sf.KeepLocalAddresses)
 	if err != nil {
 		return fmt.Errorf("error configuring broker: %s", err)
 	}
+	broker.identityKey = sf.IdentityKey
+	broker.trickle = sf.Trickle
+	broker.turn = sf.TURNURL != ""
+	broker.eventDispatcher = sf.EventDispatcher
 
 	_, err = url.Parse(sf.STUNURL)
 	if err != nil {
@@ -588,6 +802,14 @@ func (sf *SnowflakeProxy) Start() error {
 	if err != nil {
 		return fmt.Errorf("invalid relay url: %s", err)
 	}
+	if sf.TURNURL != "" {
+		if !iceservers.IsTURN(sf.TURNURL) {
+			return fmt.Errorf("invalid turn url: %s", sf.TURNURL)
+		}
+		if sf.TURNSecret == "" && (sf.TURNUsername == "" || sf.TURNCredential == "") {
+			return fmt.Errorf("turn server requires a username and credential, or a secret")
+		}
+	}
 
 	if !namematcher.IsValidRule(sf.RelayDomainNamePattern) {
 		return fmt.Errorf("invalid relay domain name pattern")
@@ -600,10 +822,13 @@ func (sf *SnowflakeProxy) Start() error {
 			},
 		},
 	}
-	tokens = newTokens(sf.Capacity)
+	tokens = sf.tokens
+	sf.bandwidth = newBandwidthLimiter(sf.BandwidthLimit, sf.ClientBandwidthLimit, sf.TrafficQuota, sf.TrafficQuotaPeriod)
 
-	// use probetest to determine NAT compatability
+	// use probetest to determine NAT compatability, and the STUN server to
+	// classify the NAT, which does not hold up the first poll
 	sf.checkNATType(config, sf.NATProbeURL)
+	go sf.classifyNAT()
 
 	currentNATTypeLoaded := getCurrentNATType()
 
@@ -613,6 +838,7 @@ func (sf *SnowflakeProxy) Start() error {
 		Interval: sf.NATTypeMeasurementInterval,
 		Execute: func() error {
 			sf.checkNATType(config, sf.NATProbeURL)
+			sf.classifyNAT()
 			return nil
 		},
 	}
@@ -625,12 +851,41 @@ func (sf *SnowflakeProxy) Start() error {
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	scheduled := true
+	quotaExhausted := false
 	for ; true; <-ticker.C {
 		select {
 		case <-sf.shutdown:
 			return nil
 		default:
+			if sf.Schedule.Active(sf.now()) != scheduled {
+				scheduled = !scheduled
+				sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyScheduleChange{
+					Active:  scheduled,
+					Clients: int(tokens.count()),
+				})
+			}
+			if !scheduled {
+				continue
+			}
+			if sf.bandwidth.quotaExhausted() != quotaExhausted {
+				quotaExhausted = !quotaExhausted
+				if quotaExhausted {
+					log.Println("Traffic quota used up, pausing polling")
+				} else {
+					log.Println("Traffic quota available again, resuming polling")
+				}
+			}
+			if quotaExhausted {
+				continue
+			}
 			tokens.get()
+			// The schedule window may have ended, or the quota run
+			// out, while waiting for a token.
+			if !sf.shouldPoll() {
+				tokens.ret()
+				continue
+			}
 			sessionID := genSessionID()
 			sf.runSession(sessionID)
 		}
@@ -638,9 +893,80 @@ func (sf *SnowflakeProxy) Start() error {
 	return nil
 }
 
+// initialize sets up the state that Start shares with Stop, Shutdown and the
+// StatusServer, which may use it before Start, or while it starts.
+func (sf *SnowflakeProxy) initialize() {
+	sf.initOnce.Do(func() {
+		sf.shutdown = make(chan struct{})
+		sf.closeConnections = make(chan struct{})
+		sf.sessions = newSessions()
+		sf.tokens = newTokens(sf.Capacity)
+		if sf.EventDispatcher == nil {
+			sf.EventDispatcher = event.NewSnowflakeEventDispatcher()
+		}
+	})
+}
+
 // Stop closes all existing connections and shuts down the Snowflake.
 func (sf *SnowflakeProxy) Stop() {
-	close(sf.shutdown)
+	sf.stopPolling()
+	sf.closeOnce.Do(func() { close(sf.closeConnections) })
+}
+
+func (sf *SnowflakeProxy) stopPolling() {
+	sf.initialize()
+	sf.shutdownOnce.Do(func() { close(sf.shutdown) })
+}
+
+// Shutdown shuts down the Snowflake gracefully. It stops polling the broker
+// for new clients at once, and waits for the clients being served to finish
+// until ctx is done, at which point it closes the connections of those that
+// remain, as Stop does. It returns the number of sessions that finished
+// while it waited, and the number that it cut off, in which case the error
+// is that of ctx. Both are also reported to the EventDispatcher.
+func (sf *SnowflakeProxy) Shutdown(ctx context.Context) (drained int, killed int, err error) {
+	sf.stopPolling()
+	_, endedBefore := sf.sessions.count()
+	defer func() {
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyShutdown{Drained: drained, Killed: killed})
+	}()
+	for {
+		active, ended := sf.sessions.count()
+		if active == 0 {
+			return ended - endedBefore, 0, nil
+		}
+		select {
+		case <-sf.sessions.ch:
+		case <-ctx.Done():
+			// Count before closing, so that the sessions that are cut
+			// off are not counted as drained.
+			active, ended = sf.sessions.count()
+			sf.Stop()
+			return ended - endedBefore, active, ctx.Err()
+		}
+	}
+}
+
+// classifyNAT runs the tests of RFC 5780 against the STUN server, whose
+// result the broker prefers to the NAT type to match the proxy with clients.
+// A failed classification keeps the previous one. So does no answer from the
+// STUN server, which may be down or blocked, so that it does not override the
+// NAT type from probetest.
+func (sf *SnowflakeProxy) classifyNAT() {
+	behavior, err := nat.Classify(strings.TrimPrefix(sf.STUNURL, "stun:"))
+	if err != nil {
+		log.Printf("Error classifying NAT: %s", err)
+		return
+	}
+	if behavior.UDPBlocked {
+		log.Printf("Error classifying NAT: no answer from STUN server")
+		return
+	}
+	log.Printf("NAT behavior: %s", behavior)
+
+	currentNATTypeAccess.Lock()
+	currentNATBehavior = behavior
+	currentNATTypeAccess.Unlock()
 }
 
 func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL string) {
@@ -721,6 +1047,7 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 	currentNATTypeAccess.Lock()
 	currentNATType = currentNATTypeToStore
 	currentNATTypeAccess.Unlock()
+	sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnCurrentNATTypeDetermined{CurNATType: currentNATTypeToStore})
 
 	if err := pc.Close(); err != nil {
 		log.Printf("error calling pc.Close: %v", err)
@@ -0,0 +1,181 @@
+package snowflake_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const prometheusNamespace = "snowflake_proxy"
+
+// Status is the state of a proxy, as served at /status.
+type Status struct {
+	NATType string `json:"nat_type"`
+	// Clients is the number of clients being served.
+	Clients int64 `json:"clients"`
+	// InboundTraffic and OutboundTraffic are the bytes relayed to and from
+	// the clients whose connections are over.
+	InboundTraffic  int64 `json:"inbound_traffic"`
+	OutboundTraffic int64 `json:"outbound_traffic"`
+	// ConnectionsSucceeded and ConnectionsFailed count the clients that
+	// the proxy was matched with, by whether they connected.
+	ConnectionsSucceeded uint64 `json:"connections_succeeded"`
+	ConnectionsFailed    uint64 `json:"connections_failed"`
+	// Polls counts the polls of the broker by their outcome: "matched",
+	// "idle" or "failed".
+	Polls map[string]uint64 `json:"polls"`
+	// Uptime is the number of seconds since the status server started.
+	Uptime int64 `json:"uptime"`
+}
+
+// StatusServer is an event.SnowflakeEventReceiver that keeps track of the
+// activity of a proxy, and serves it over HTTP: as Prometheus metrics at
+// /metrics, and as JSON at /status.
+type StatusServer struct {
+	lock   sync.Mutex
+	status Status
+	start  time.Time
+
+	registry    *prometheus.Registry
+	natType     *prometheus.GaugeVec
+	traffic     *prometheus.CounterVec
+	connections *prometheus.CounterVec
+	polls       *prometheus.CounterVec
+
+	// proxy is the proxy whose clients are counted, if any.
+	proxy *SnowflakeProxy
+
+	mux *http.ServeMux
+}
+
+// NewStatusServer returns a StatusServer for proxy, which must be added as a
+// listener to the EventDispatcher of the proxy.
+func NewStatusServer(proxy *SnowflakeProxy) *StatusServer {
+	s := &StatusServer{
+		proxy: proxy,
+		status: Status{
+			NATType: NATUnknown,
+			Polls:   make(map[string]uint64),
+		},
+		start:    time.Now(),
+		registry: prometheus.NewRegistry(),
+	}
+
+	s.natType = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "nat_type",
+			Help:      "The NAT type of the proxy, with a value of 1 for the current type",
+		},
+		[]string{"type"},
+	)
+	s.traffic = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "traffic_bytes_total",
+			Help:      "The number of bytes relayed for clients whose connections are over",
+		},
+		[]string{"direction"},
+	)
+	s.connections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "connections_total",
+			Help:      "The number of clients the proxy was matched with, by whether they connected",
+		},
+		[]string{"outcome"},
+	)
+	s.polls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "polls_total",
+			Help:      "The number of polls of the broker, by outcome",
+		},
+		[]string{"outcome"},
+	)
+	clients := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "clients",
+			Help:      "The number of clients being served",
+		},
+		func() float64 { return float64(s.activeClients()) },
+	)
+	s.registry.MustRegister(s.natType, s.traffic, s.connections, s.polls, clients)
+	s.natType.With(prometheus.Labels{"type": NATUnknown}).Set(1)
+
+	s.mux = http.NewServeMux()
+	s.mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	s.mux.HandleFunc("/status", s.serveStatus)
+	return s
+}
+
+// activeClients returns the number of clients being served by the proxy.
+func (s *StatusServer) activeClients() int64 {
+	if s.proxy == nil {
+		return 0
+	}
+	s.proxy.initialize()
+	return s.proxy.tokens.count()
+}
+
+func (s *StatusServer) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch e := e.(type) {
+	case event.EventOnCurrentNATTypeDetermined:
+		s.natType.With(prometheus.Labels{"type": s.status.NATType}).Set(0)
+		s.natType.With(prometheus.Labels{"type": e.CurNATType}).Set(1)
+		s.status.NATType = e.CurNATType
+	case event.EventOnProxyConnectionOver:
+		s.traffic.With(prometheus.Labels{"direction": "inbound"}).Add(float64(e.InboundTraffic))
+		s.traffic.With(prometheus.Labels{"direction": "outbound"}).Add(float64(e.OutboundTraffic))
+		s.status.InboundTraffic += int64(e.InboundTraffic)
+		s.status.OutboundTraffic += int64(e.OutboundTraffic)
+	case event.EventOnProxyClientConnected:
+		s.connections.With(prometheus.Labels{"outcome": "succeeded"}).Inc()
+		s.status.ConnectionsSucceeded++
+	case event.EventOnProxyConnectionFailed:
+		s.connections.With(prometheus.Labels{"outcome": "failed"}).Inc()
+		s.status.ConnectionsFailed++
+	case event.EventOnProxyPollResult:
+		outcome := "idle"
+		if e.Error != nil {
+			outcome = "failed"
+		} else if e.Matched {
+			outcome = "matched"
+		}
+		s.polls.With(prometheus.Labels{"outcome": outcome}).Inc()
+		s.status.Polls[outcome]++
+	}
+}
+
+// Status returns the current status of the proxy.
+func (s *StatusServer) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := s.status
+	status.Polls = make(map[string]uint64, len(s.status.Polls))
+	for outcome, count := range s.status.Polls {
+		status.Polls[outcome] = count
+	}
+	status.Clients = s.activeClients()
+	status.Uptime = int64(time.Since(s.start).Seconds())
+	return status
+}
+
+func (s *StatusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *StatusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
@@ -0,0 +1,110 @@
+package snowflake_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatusServer(t *testing.T) {
+	Convey("Status server", t, func() {
+		proxy := &SnowflakeProxy{}
+		proxy.initialize()
+		status := NewStatusServer(proxy)
+
+		Convey("starts out empty", func() {
+			s := status.Status()
+			So(s.NATType, ShouldEqual, NATUnknown)
+			So(s.Clients, ShouldEqual, 0)
+			So(s.InboundTraffic, ShouldEqual, 0)
+			So(s.Polls, ShouldBeEmpty)
+		})
+
+		Convey("keeps track of events", func() {
+			proxy.tokens.get()
+			proxy.tokens.get()
+			status.OnNewSnowflakeEvent(event.EventOnCurrentNATTypeDetermined{CurNATType: NATRestricted})
+			status.OnNewSnowflakeEvent(event.EventOnCurrentNATTypeDetermined{CurNATType: NATUnrestricted})
+			status.OnNewSnowflakeEvent(event.EventOnProxyClientConnected{})
+			status.OnNewSnowflakeEvent(event.EventOnProxyConnectionFailed{Error: errors.New("timeout")})
+			status.OnNewSnowflakeEvent(event.EventOnProxyConnectionOver{InboundTraffic: 1000, OutboundTraffic: 2000})
+			status.OnNewSnowflakeEvent(event.EventOnProxyConnectionOver{InboundTraffic: 10, OutboundTraffic: 20})
+			status.OnNewSnowflakeEvent(event.EventOnProxyPollResult{})
+			status.OnNewSnowflakeEvent(event.EventOnProxyPollResult{})
+			status.OnNewSnowflakeEvent(event.EventOnProxyPollResult{Matched: true})
+			status.OnNewSnowflakeEvent(event.EventOnProxyPollResult{Error: errors.New("unreachable")})
+
+			expected := Status{
+				NATType:              NATUnrestricted,
+				Clients:              2,
+				InboundTraffic:       1010,
+				OutboundTraffic:      2020,
+				ConnectionsSucceeded: 1,
+				ConnectionsFailed:    1,
+				Polls:                map[string]uint64{"idle": 2, "matched": 1, "failed": 1},
+			}
+			So(status.Status(), ShouldResemble, expected)
+
+			Convey("as JSON", func() {
+				w := httptest.NewRecorder()
+				status.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+				var s Status
+				So(json.Unmarshal(w.Body.Bytes(), &s), ShouldBeNil)
+				So(s, ShouldResemble, expected)
+			})
+
+			Convey("as Prometheus metrics", func() {
+				w := httptest.NewRecorder()
+				status.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+				So(w.Code, ShouldEqual, http.StatusOK)
+				metrics := w.Body.String()
+				So(metrics, ShouldContainSubstring, `snowflake_proxy_nat_type{type="unrestricted"} 1`)
+				So(metrics, ShouldContainSubstring, `snowflake_proxy_nat_type{type="restricted"} 0`)
+				So(metrics, ShouldContainSubstring, "snowflake_proxy_clients 2")
+				So(metrics, ShouldContainSubstring, `snowflake_proxy_traffic_bytes_total{direction="outbound"} 2020`)
+				So(metrics, ShouldContainSubstring, `snowflake_proxy_connections_total{outcome="failed"} 1`)
+				So(metrics, ShouldContainSubstring, `snowflake_proxy_polls_total{outcome="idle"} 2`)
+			})
+		})
+
+		Convey("is told the result of broker polls", func() {
+			var err error
+			broker, err = newSignalingServer("localhost", false)
+			So(err, ShouldBeNil)
+			broker.eventDispatcher = status
+			tokens = newTokens(0)
+
+			b, err := messages.EncodePollResponse(`{"type":"offer","sdp":"test"}`, true, "")
+			So(err, ShouldBeNil)
+			broker.transport = &MockTransport{http.StatusOK, b}
+			offer, _, _ := broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			So(offer, ShouldNotBeNil)
+
+			broker.transport = &MockTransport{http.StatusOK, []byte("test")}
+			offer, _, _ = broker.pollOffer(context.Background(), "sid", DefaultProxyType, "")
+			So(offer, ShouldBeNil)
+
+			So(status.Status().Polls, ShouldResemble, map[string]uint64{"matched": 1, "failed": 1})
+		})
+
+		Convey("answers only at its endpoints", func() {
+			server := httptest.NewServer(status)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/other")
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -2,6 +2,7 @@ package snowflake_proxy
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -31,16 +32,24 @@ func (b bytesNullLogger) GetStat() (in int, out int) { return -1, -1 }
 // bytesSyncLogger uses channels to safely log from multiple sources with output
 // occuring at reasonable intervals.
 type bytesSyncLogger struct {
-	outboundChan, inboundChan              chan int
+	outboundChan, inboundChan chan int
+	start                     time.Time
+	// The bandwidth limits of the connection, if any, which are included
+	// in the throughput summary
+	limiter *clientLimiter
+
+	// Synchronization for the totals, which are updated by log
+	lock                                   sync.Mutex
 	outbound, inbound, outEvents, inEvents int
-	start                                  time.Time
 }
 
 // newBytesSyncLogger returns a new bytesSyncLogger and starts it loggin.
-func newBytesSyncLogger() *bytesSyncLogger {
+// limiter may be nil.
+func newBytesSyncLogger(limiter *clientLimiter) *bytesSyncLogger {
 	b := &bytesSyncLogger{
 		outboundChan: make(chan int, 5),
 		inboundChan:  make(chan int, 5),
+		limiter:      limiter,
 	}
 	go b.log()
 	b.start = time.Now()
@@ -51,11 +60,15 @@ func (b *bytesSyncLogger) log() {
 	for {
 		select {
 		case amount := <-b.outboundChan:
+			b.lock.Lock()
 			b.outbound += amount
 			b.outEvents++
+			b.lock.Unlock()
 		case amount := <-b.inboundChan:
+			b.lock.Lock()
 			b.inbound += amount
 			b.inEvents++
+			b.lock.Unlock()
 		}
 	}
 }
@@ -72,17 +85,28 @@ func (b *bytesSyncLogger) AddInbound(amount int) {
 
 // ThroughputSummary view a formatted summary of the throughput totals
 func (b *bytesSyncLogger) ThroughputSummary() string {
+	b.lock.Lock()
 	inbound := b.inbound
 	outbound := b.outbound
+	outEvents, inEvents := b.outEvents, b.inEvents
+	b.lock.Unlock()
 
 	inbound, inUnit := formatTraffic(inbound)
 	outbound, outUnit := formatTraffic(outbound)
 
 	t := time.Now()
-	return fmt.Sprintf("Traffic throughput (up|down): %d %s|%d %s -- (%d OnMessages, %d Sends, over %d seconds)", inbound, inUnit, outbound, outUnit, b.outEvents, b.inEvents, int(t.Sub(b.start).Seconds()))
+	summary := fmt.Sprintf("Traffic throughput (up|down): %d %s|%d %s -- (%d OnMessages, %d Sends, over %d seconds)", inbound, inUnit, outbound, outUnit, outEvents, inEvents, int(t.Sub(b.start).Seconds()))
+	if b.limiter != nil {
+		summary += " -- (" + b.limiter.summary() + ")"
+	}
+	return summary
 }
 
-func (b *bytesSyncLogger) GetStat() (in int, out int) { return b.inbound, b.outbound }
+func (b *bytesSyncLogger) GetStat() (in int, out int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.inbound, b.outbound
+}
 
 func formatTraffic(amount int) (value int, unit string) {
 	value = amount
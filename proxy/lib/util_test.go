@@ -0,0 +1,41 @@
+package snowflake_proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBytesSyncLogger(t *testing.T) {
+	Convey("bytesSyncLogger", t, func() {
+		b := newBytesSyncLogger(nil)
+
+		Convey("counts traffic while its totals are read", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					b.AddInbound(1)
+					b.AddOutbound(2)
+					b.GetStat()
+					b.ThroughputSummary()
+				}()
+			}
+			wg.Wait()
+
+			// The amounts are added to the totals asynchronously.
+			deadline := time.Now().Add(5 * time.Second)
+			in, out := b.GetStat()
+			for (in != 10 || out != 20) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				in, out = b.GetStat()
+			}
+			So(in, ShouldEqual, 10)
+			So(out, ShouldEqual, 20)
+			So(b.ThroughputSummary(), ShouldStartWith, "Traffic throughput (up|down): 10 B|20 B -- (10 OnMessages, 10 Sends")
+		})
+	})
+}
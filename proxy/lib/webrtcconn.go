@@ -32,13 +32,19 @@ type webRTCConn struct {
 
 	bytesLogger bytesLogger
 	eventLogger event.SnowflakeEventReceiver
+	// limiter, if not nil, holds back reads and writes to keep within the
+	// bandwidth limits of the proxy.
+	limiter *clientLimiter
 }
 
 func (c *webRTCConn) Read(b []byte) (int, error) {
-	return c.pr.Read(b)
+	n, err := c.pr.Read(b)
+	c.limiter.wait(n)
+	return n, err
 }
 
 func (c *webRTCConn) Write(b []byte) (int, error) {
+	c.limiter.wait(len(b))
 	c.bytesLogger.AddInbound(len(b))
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/safelog"
@@ -16,6 +21,10 @@ import (
 func main() {
 	capacity := flag.Uint("capacity", 0, "maximum concurrent clients")
 	stunURL := flag.String("stun", sf.DefaultSTUNURL, "STUN URL")
+	turnURL := flag.String("turn", "", "URL of a TURN server through which to reach clients behind restrictive NATs")
+	turnUsername := flag.String("turn-username", "", "username for the TURN server")
+	turnCredential := flag.String("turn-credential", "", "credential for the TURN server")
+	turnSecret := flag.String("turn-secret", "", "secret shared with the TURN server, from which to derive short-lived credentials")
 	logFilename := flag.String("log", "", "log filename")
 	rawBrokerURL := flag.String("broker", sf.DefaultBrokerURL, "broker URL")
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
@@ -28,14 +37,36 @@ func main() {
 	SummaryInterval := flag.Duration("summary-interval", time.Hour,
 		"the time interval to output summary, 0s disables summaries. Valid time units are \"s\", \"m\", \"h\". ")
 	verboseLogging := flag.Bool("verbose", false, "increase log verbosity")
+	identityKeyFilename := flag.String("identity-key", "", "file holding the key with which to sign polls to the broker, created if it does not exist; the proxy is anonymous if empty")
+	trickle := flag.Bool("trickle", false, "answer clients before ICE gathering completes and trickle candidates through the broker")
+	bandwidthLimit := flag.String("bandwidth-limit", "", "maximum traffic per second of all clients together, such as \"1MB\"; no limit if empty")
+	clientBandwidthLimit := flag.String("client-bandwidth-limit", "", "maximum traffic per second of each client, such as \"100KB\"; no limit if empty")
+	trafficQuota := flag.String("traffic-quota", "", "maximum traffic over the quota period, such as \"10GB\", after which no new clients are taken; no limit if empty")
+	trafficQuotaPeriod := flag.Duration("traffic-quota-period", sf.DefaultTrafficQuotaPeriod, "the rolling period over which the traffic quota applies, such as \"720h\" for a month")
+	statusAddress := flag.String("status-address", "", "local address on which to serve the proxy status as JSON at /status and as Prometheus metrics at /metrics, such as \"localhost:9090\"; disabled if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Minute, "on SIGTERM or SIGINT, how long to wait for clients to finish before closing their connections; a second signal closes them at once")
+	schedule := flag.String("schedule", "", "time windows in local time during which to poll for clients, such as \"Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00\"; always if empty")
 
 	flag.Parse()
 
+	var trafficLimits [3]uint64
+	for i, limit := range []string{*bandwidthLimit, *clientBandwidthLimit, *trafficQuota} {
+		var err error
+		trafficLimits[i], err = sf.ParseTraffic(limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	eventLogger := event.NewSnowflakeEventDispatcher()
 
 	proxy := sf.SnowflakeProxy{
 		Capacity:           uint(*capacity),
 		STUNURL:            *stunURL,
+		TURNURL:            *turnURL,
+		TURNUsername:       *turnUsername,
+		TURNCredential:     *turnCredential,
+		TURNSecret:         *turnSecret,
 		BrokerURL:          *rawBrokerURL,
 		KeepLocalAddresses: *keepLocalAddresses,
 		RelayURL:           *relayURL,
@@ -45,6 +76,29 @@ func main() {
 
 		RelayDomainNamePattern: *allowedRelayHostNamePattern,
 		AllowNonTLSRelay:       *allowNonTLSRelay,
+
+		Trickle: *trickle,
+
+		BandwidthLimit:       trafficLimits[0],
+		ClientBandwidthLimit: trafficLimits[1],
+		TrafficQuota:         trafficLimits[2],
+		TrafficQuotaPeriod:   *trafficQuotaPeriod,
+	}
+
+	if *schedule != "" {
+		var err error
+		proxy.Schedule, err = sf.ParseSchedule(*schedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *identityKeyFilename != "" {
+		key, err := sf.LoadIdentityKey(*identityKeyFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.IdentityKey = key
 	}
 
 	var logOutput io.Writer = os.Stderr
@@ -73,8 +127,43 @@ func main() {
 	periodicEventLogger := sf.NewProxyEventLogger(*SummaryInterval, eventlogOutput)
 	eventLogger.AddSnowflakeEventListener(periodicEventLogger)
 
+	if *statusAddress != "" {
+		statusServer := sf.NewStatusServer(&proxy)
+		eventLogger.AddSnowflakeEventListener(statusServer)
+		ln, err := net.Listen("tcp", *statusAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(http.Serve(ln, statusServer))
+		}()
+	}
+
+	// The first signal stops polling for new clients and lets the clients
+	// being served finish; a second one cuts them off.
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-sigChan
+		log.Printf("shutting down, waiting up to %v for clients to finish", *shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-sigChan:
+				log.Printf("second signal, closing all connections")
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		proxy.Shutdown(ctx)
+	}()
+
 	err := proxy.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
+	<-shutdownDone
 }
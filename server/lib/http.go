@@ -31,10 +31,6 @@ const clientMapTimeout = 1 * time.Minute
 // may outlive any single WebSocket connection.
 const clientIDAddrMapCapacity = 10240
 
-// How long to wait for ListenAndServe or ListenAndServeTLS to return an error
-// before deciding that it's not going to return.
-const listenAndServeErrorTimeout = 100 * time.Millisecond
-
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -52,6 +48,15 @@ type httpHandler struct {
 	// pconn is the adapter layer between stream-oriented WebSocket
 	// connections and the packet-oriented KCP layer.
 	pconn *turbotunnel.QueuePacketConn
+	// sessions, if not nil, counts the WebSocket connections of each
+	// session, and remembers the ClientIDs that were authenticated, for
+	// which connections without authentication are refused.
+	sessions *sessionTable
+	// requireAuthentication refuses every connection that does not
+	// authenticate its ClientID.
+	requireAuthentication bool
+	// metrics, if not nil, records the traffic of WebSocket connections.
+	metrics *Metrics
 }
 
 func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +87,13 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case bytes.Equal(token[:], turbotunnel.Token[:]):
-		err = turbotunnelMode(conn, addr, handler.pconn)
+		if handler.requireAuthentication {
+			err = fmt.Errorf("refusing connection without ClientID authentication")
+			break
+		}
+		err = handler.turbotunnelMode(conn, addr, false)
+	case bytes.Equal(token[:], turbotunnel.AuthToken[:]):
+		err = handler.turbotunnelMode(conn, addr, true)
 	default:
 		// We didn't find a matching token, which means that we are
 		// dealing with a client that doesn't know about such things.
@@ -97,16 +108,35 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// turbotunnelMode handles clients that sent turbotunnel.Token at the start of
-// their stream. These clients expect to send and receive encapsulated packets,
-// with a long-lived session identified by ClientID.
-func turbotunnelMode(conn net.Conn, addr net.Addr, pconn *turbotunnel.QueuePacketConn) error {
+// turbotunnelMode handles clients that sent turbotunnel.Token, or
+// turbotunnel.AuthToken if authenticated is true, at the start of their
+// stream. These clients expect to send and receive encapsulated packets, with
+// a long-lived session identified by ClientID.
+func (handler *httpHandler) turbotunnelMode(conn net.Conn, addr net.Addr, authenticated bool) error {
+	pconn := handler.pconn
 	// Read the ClientID prefix. Every packet encapsulated in this WebSocket
 	// connection pertains to the same ClientID.
 	var clientID turbotunnel.ClientID
-	_, err := io.ReadFull(conn, clientID[:])
-	if err != nil {
-		return fmt.Errorf("reading ClientID: %v", err)
+	var err error
+	if authenticated {
+		// The client proves that the ClientID is its own. As long as
+		// this connection, or the session of the ClientID, is open, only
+		// connections that do the same may use it.
+		clientID, err = turbotunnel.AcceptHandshake(conn)
+		if err != nil {
+			return fmt.Errorf("authenticating ClientID: %v", err)
+		}
+		defer handler.sessions.authenticate(clientID)()
+	} else {
+		_, err = io.ReadFull(conn, clientID[:])
+		if err != nil {
+			return fmt.Errorf("reading ClientID: %v", err)
+		}
+		// Someone who has seen the ClientID of an authenticated client
+		// could otherwise inject packets into its session.
+		if handler.sessions.isAuthenticated(clientID) {
+			return fmt.Errorf("refusing unauthenticated connection for authenticated ClientID")
+		}
 	}
 
 	// Store a a short-term mapping from the ClientID to the client IP
@@ -118,7 +148,16 @@ func turbotunnelMode(conn net.Conn, addr net.Addr, pconn *turbotunnel.QueuePacke
 	// recent WebSocket connection that has had to do with a session, at the
 	// time the session is established, is the IP address that should be
 	// credited for the entire KCP session.
-	clientIDAddrMap.Set(clientID, addr)
+	//
+	// A multipath client uses several WebSocket connections with the same
+	// ClientID at once, all of which feed the same QueuePacketConn queues.
+	// Some proxies do not report the client's address, so do not let such
+	// a connection erase an address learned from another one.
+	if _, ok := clientIDAddrMap.Get(clientID); !ok || addr.String() != "" {
+		clientIDAddrMap.Set(clientID, addr)
+	}
+	handler.sessions.webSocketConnected(clientID)
+	traffic := handler.metrics.webSocketConnected(addr)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -136,12 +175,15 @@ func turbotunnelMode(conn net.Conn, addr net.Addr, pconn *turbotunnel.QueuePacke
 			if err != nil {
 				return
 			}
+			traffic.addInbound(len(p))
 			pconn.QueueIncoming(p, clientID)
 		}
 	}()
 
 	// At the same time, grab packets addressed to this ClientID and
-	// encapsulate them into the downstream.
+	// encapsulate them into the downstream. When there are several
+	// WebSocket connections for the same ClientID, each packet goes out on
+	// whichever one takes it from the queue first.
 	go func() {
 		defer wg.Done()
 		defer conn.Close() // Signal the read loop to finish
@@ -150,20 +192,17 @@ func turbotunnelMode(conn net.Conn, addr net.Addr, pconn *turbotunnel.QueuePacke
 		// prefixes in the same send as the data that follows.
 		bw := bufio.NewWriter(conn)
 		for {
-			select {
-			case <-done:
+			p, ok := pconn.DequeueOutgoing(clientID, done)
+			if !ok {
+				return
+			}
+			traffic.addOutbound(len(p))
+			_, err := encapsulation.WriteData(bw, p)
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
 				return
-			case p, ok := <-pconn.OutgoingQueue(clientID):
-				if !ok {
-					return
-				}
-				_, err := encapsulation.WriteData(bw, p)
-				if err == nil {
-					err = bw.Flush()
-				}
-				if err != nil {
-					return
-				}
 			}
 		}
 	}()
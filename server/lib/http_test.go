@@ -0,0 +1,235 @@
+package snowflake_server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/websocketconn"
+	"github.com/gorilla/websocket"
+)
+
+// dialTurbotunnel opens a WebSocket connection to the server and sends the
+// turbotunnel token and the given ClientID.
+func dialTurbotunnel(t *testing.T, url string, clientID turbotunnel.ClientID) net.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := websocketconn.New(ws)
+	if _, err := conn.Write(turbotunnel.Token[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(clientID[:]); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestMultipleWebSocketsPerClientID(t *testing.T) {
+	pconn := turbotunnel.NewQueuePacketConn(turbotunnel.ClientID{}, clientMapTimeout)
+	defer pconn.Close()
+	server := httptest.NewServer(&httpHandler{pconn: pconn})
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	clientID := turbotunnel.NewClientID()
+	conn1 := dialTurbotunnel(t, url+"?client_ip=192.0.2.1", clientID)
+	defer conn1.Close()
+	conn2 := dialTurbotunnel(t, url, clientID)
+	defer conn2.Close()
+
+	// Packets sent over either connection arrive for the same ClientID.
+	for _, conn := range []net.Conn{conn1, conn2} {
+		if _, err := encapsulation.WriteData(conn, []byte("upstream")); err != nil {
+			t.Fatal(err)
+		}
+		var buf [100]byte
+		n, addr, err := pconn.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "upstream" || addr != clientID {
+			t.Fatalf("got %q from %v", buf[:n], addr)
+		}
+	}
+
+	// The connection without a client_ip does not erase the address of
+	// the one with it.
+	if addr, ok := clientIDAddrMap.Get(clientID); !ok || addr.String() != "192.0.2.1:1" {
+		t.Errorf("expected client address 192.0.2.1:1, got %v", addr)
+	}
+
+	// Packets for the ClientID go out on the remaining connection after one
+	// is closed.
+	conn1.Close()
+	received := make(chan []byte)
+	go func() {
+		for {
+			p, err := encapsulation.ReadData(conn2)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- p
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		if _, err := pconn.WriteTo([]byte("downstream"), clientID); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p, ok := <-received:
+			if !ok {
+				t.Fatal("remaining connection closed")
+			}
+			if string(p) != "downstream" {
+				t.Fatalf("got %q", p)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+			// The closed connection may have taken the packet.
+		case <-deadline:
+			t.Fatal("timed out waiting for a downstream packet")
+		}
+	}
+}
+
+// dialAuthenticated opens a WebSocket connection to the server and does the
+// authenticated turbotunnel handshake with key.
+func dialAuthenticated(t *testing.T, url string, key *turbotunnel.ClientKey) net.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := websocketconn.New(ws)
+	if err := key.Handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// isRefused reports whether the server closed conn instead of forwarding a
+// packet sent on it, which would arrive on received.
+func isRefused(t *testing.T, conn net.Conn, received <-chan net.Addr) bool {
+	t.Helper()
+	if _, err := encapsulation.WriteData(conn, []byte("upstream")); err != nil {
+		return true
+	}
+	closed := make(chan struct{})
+	go func() {
+		var buf [1]byte
+		conn.Read(buf[:])
+		close(closed)
+	}()
+	select {
+	case <-received:
+		return false
+	case <-closed:
+		return true
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server")
+		return false
+	}
+}
+
+// serveTurbotunnel serves handler, whose pconn it sets, on a test server, and
+// returns its URL and a channel on which the ClientIDs of the packets it
+// receives arrive.
+func serveTurbotunnel(t *testing.T, handler *httpHandler) (string, <-chan net.Addr, func()) {
+	t.Helper()
+	handler.pconn = turbotunnel.NewQueuePacketConn(turbotunnel.ClientID{}, clientMapTimeout)
+	server := httptest.NewServer(handler)
+	received := make(chan net.Addr)
+	go func() {
+		for {
+			var buf [100]byte
+			_, addr, err := handler.pconn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			received <- addr
+		}
+	}()
+	closeFunc := func() {
+		server.Close()
+		handler.pconn.Close()
+	}
+	return "ws" + strings.TrimPrefix(server.URL, "http"), received, closeFunc
+}
+
+func TestAuthenticatedClientID(t *testing.T) {
+	handler := &httpHandler{sessions: newSessionTable()}
+	url, received, closeFunc := serveTurbotunnel(t, handler)
+	defer closeFunc()
+
+	key := turbotunnel.NewClientKey()
+	conn1 := dialAuthenticated(t, url, key)
+	defer conn1.Close()
+	if isRefused(t, conn1, received) {
+		t.Fatal("authenticated connection was refused")
+	}
+
+	// A multipath client may add authenticated connections.
+	conn2 := dialAuthenticated(t, url, key)
+	defer conn2.Close()
+	if isRefused(t, conn2, received) {
+		t.Fatal("second authenticated connection was refused")
+	}
+
+	// Someone who knows the ClientID, but not the key, may not.
+	conn3 := dialTurbotunnel(t, url, key.ClientID())
+	defer conn3.Close()
+	if !isRefused(t, conn3, received) {
+		t.Fatal("unauthenticated connection for an authenticated ClientID was accepted")
+	}
+
+	// Unauthenticated clients with their own ClientIDs still work.
+	conn4 := dialTurbotunnel(t, url, turbotunnel.NewClientID())
+	defer conn4.Close()
+	if isRefused(t, conn4, received) {
+		t.Fatal("unauthenticated connection was refused")
+	}
+
+	// The ClientID, which has no session, is forgotten when its last
+	// authenticated connection closes.
+	conn1.Close()
+	if !handler.sessions.isAuthenticated(key.ClientID()) {
+		t.Fatal("ClientID was forgotten while a connection was open")
+	}
+	conn2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for handler.sessions.isAuthenticated(key.ClientID()) {
+		if time.Now().After(deadline) {
+			t.Fatal("ClientID was not forgotten after its connections closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequireClientAuthentication(t *testing.T) {
+	url, received, closeFunc := serveTurbotunnel(t, &httpHandler{
+		sessions:              newSessionTable(),
+		requireAuthentication: true,
+	})
+	defer closeFunc()
+
+	conn1 := dialAuthenticated(t, url, turbotunnel.NewClientKey())
+	defer conn1.Close()
+	if isRefused(t, conn1, received) {
+		t.Fatal("authenticated connection was refused")
+	}
+
+	conn2 := dialTurbotunnel(t, url, turbotunnel.NewClientID())
+	defer conn2.Close()
+	if !isRefused(t, conn2, received) {
+		t.Fatal("unauthenticated connection was accepted")
+	}
+}
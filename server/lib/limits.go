@@ -0,0 +1,259 @@
+package snowflake_server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Limits bounds the resources that the clients of a SnowflakeListener may
+// use, so that a flood of ClientIDs cannot exhaust the memory of the server.
+// A zero field means no limit.
+type Limits struct {
+	// MaxSessions is the maximum number of concurrent client sessions. A
+	// new session beyond it evicts the least recently seen one.
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// MaxStreamsPerSession is the maximum number of open streams in one
+	// session. Streams beyond it are refused.
+	MaxStreamsPerSession int `json:"max_streams_per_session,omitempty"`
+	// MaxQueuedBytesPerClient is the maximum size of the packets waiting to
+	// be sent to one ClientID. Packets beyond it are dropped.
+	MaxQueuedBytesPerClient int `json:"max_queued_bytes_per_client,omitempty"`
+	// MaxQueuedBytes is the maximum size of the packets waiting to be sent
+	// to all ClientIDs. Packets beyond it evict the least recently seen
+	// sessions.
+	MaxQueuedBytes int `json:"max_queued_bytes,omitempty"`
+}
+
+// ParseLimitOption sets the limit named by a transport option, such as
+// "max-sessions", to value. It returns false if name is not the name of a
+// limit.
+func (limits *Limits) ParseLimitOption(name, value string) (bool, error) {
+	var field *int
+	switch name {
+	case "max-sessions":
+		field = &limits.MaxSessions
+	case "max-streams-per-session":
+		field = &limits.MaxStreamsPerSession
+	case "max-queued-bytes-per-client":
+		field = &limits.MaxQueuedBytesPerClient
+	case "max-queued-bytes":
+		field = &limits.MaxQueuedBytes
+	default:
+		return false, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return true, fmt.Errorf("invalid %s %q", name, value)
+	}
+	*field = n
+	return true, nil
+}
+
+// LimitStats is a snapshot of the resources used by the clients of a
+// SnowflakeListener, and of how often the Limits were enforced.
+type LimitStats struct {
+	// Sessions is the number of open client sessions.
+	Sessions int
+	// Clients is the number of ClientIDs with a queue of outgoing packets.
+	Clients int
+	// QueuedBytes is the total size of the queued outgoing packets.
+	QueuedBytes int
+	// EvictedSessions is the number of sessions closed, and ClientIDs
+	// forgotten, to stay within MaxSessions or MaxQueuedBytes.
+	EvictedSessions uint64
+	// RefusedStreams is the number of streams refused because of
+	// MaxStreamsPerSession.
+	RefusedStreams uint64
+	// DroppedPackets is the number of outgoing packets dropped because a
+	// queue was full or over its limit.
+	DroppedPackets uint64
+}
+
+// sessionTable keeps track of the open KCP sessions of a SnowflakeListener,
+// by ClientID, in order to close them when they are evicted, and counts the
+// WebSocket connections that carry them. It also remembers which ClientIDs
+// have proven possession of their turbotunnel.ClientKey.
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[turbotunnel.ClientID]*sessionEntry
+	// authenticated counts the references to each authenticated ClientID:
+	// one for every open WebSocket connection that authenticated it, and
+	// one for its session if the session started while it was
+	// authenticated. A ClientID is forgotten with its last reference, so
+	// that there are never more of them than open connections and
+	// sessions.
+	authenticated map[turbotunnel.ClientID]int
+	// evicted and refusedStreams are accessed atomically.
+	evicted        uint64
+	refusedStreams uint64
+}
+
+// sessionEntry is an open session in a sessionTable.
+type sessionEntry struct {
+	conn *kcp.UDPSession
+	// webSockets is the number of WebSocket connections with the ClientID
+	// of the session, counting the one that started it.
+	webSockets int
+	// authenticated is whether the session holds a reference to its
+	// authenticated ClientID.
+	authenticated bool
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions:      make(map[turbotunnel.ClientID]*sessionEntry),
+		authenticated: make(map[turbotunnel.ClientID]int),
+	}
+}
+
+// add records a new session. If that makes more than maxSessions, it closes
+// the session whose ClientID was least recently seen according to lastSeen.
+func (t *sessionTable) add(conn *kcp.UDPSession, maxSessions int, lastSeen func(net.Addr) (time.Time, bool)) {
+	t.lock.Lock()
+	clientID := conn.RemoteAddr().(turbotunnel.ClientID)
+	entry := &sessionEntry{conn: conn, webSockets: 1}
+	if old := t.sessions[clientID]; old != nil && old.authenticated {
+		// The new session takes over the reference of the old one,
+		// whose remove does nothing.
+		entry.authenticated = true
+	} else if t.authenticated[clientID] > 0 {
+		entry.authenticated = true
+		t.authenticated[clientID]++
+	}
+	t.sessions[clientID] = entry
+	var victim *kcp.UDPSession
+	if maxSessions > 0 && len(t.sessions) > maxSessions {
+		var oldest time.Time
+		for clientID, entry := range t.sessions {
+			if entry.conn == conn {
+				continue
+			}
+			// A session whose ClientID has no queue has not been
+			// seen for a while, and counts as the oldest.
+			seen, _ := lastSeen(clientID)
+			if victim == nil || seen.Before(oldest) {
+				victim, oldest = entry.conn, seen
+			}
+		}
+	}
+	t.lock.Unlock()
+	if victim != nil {
+		atomic.AddUint64(&t.evicted, 1)
+		victim.Close()
+	}
+}
+
+// remove forgets a session that has ended, and returns the number of
+// WebSocket connections that carried it.
+func (t *sessionTable) remove(conn *kcp.UDPSession) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	clientID := conn.RemoteAddr().(turbotunnel.ClientID)
+	entry := t.sessions[clientID]
+	if entry == nil || entry.conn != conn {
+		return 0
+	}
+	delete(t.sessions, clientID)
+	if entry.authenticated {
+		t.release(clientID)
+	}
+	return entry.webSockets
+}
+
+// authenticate records that a WebSocket connection has proven possession of
+// the key of clientID. The returned function, to be called when the
+// connection closes, releases the reference of the connection. It does
+// nothing on a nil *sessionTable.
+func (t *sessionTable) authenticate(clientID turbotunnel.ClientID) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.authenticated[clientID]++
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.release(clientID)
+	}
+}
+
+// release drops a reference to an authenticated ClientID. t.lock must be
+// held.
+func (t *sessionTable) release(clientID turbotunnel.ClientID) {
+	t.authenticated[clientID]--
+	if t.authenticated[clientID] <= 0 {
+		delete(t.authenticated, clientID)
+	}
+}
+
+// isAuthenticated returns whether clientID has proven possession of its key
+// on a WebSocket connection that is still open, or for a session that is
+// still open. It returns false on a nil *sessionTable.
+func (t *sessionTable) isAuthenticated(clientID turbotunnel.ClientID) bool {
+	if t == nil {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.authenticated[clientID] > 0
+}
+
+// webSocketConnected counts a WebSocket connection with clientID, if it has a
+// session. It does nothing on a nil *sessionTable.
+func (t *sessionTable) webSocketConnected(clientID turbotunnel.ClientID) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if entry := t.sessions[clientID]; entry != nil {
+		entry.webSockets++
+	}
+}
+
+// evict closes the session of a ClientID that was evicted from the queues of
+// outgoing packets, if it has one.
+func (t *sessionTable) evict(addr net.Addr) {
+	clientID, ok := addr.(turbotunnel.ClientID)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	entry := t.sessions[clientID]
+	t.lock.Unlock()
+	if entry != nil {
+		entry.conn.Close()
+	}
+}
+
+// count returns the number of open sessions.
+func (t *sessionTable) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.sessions)
+}
+
+// countedStream is a stream that counts against the MaxStreamsPerSession of
+// its session, and in the metrics, until it is closed.
+type countedStream struct {
+	net.Conn
+	open      *int32
+	metrics   *Metrics
+	closeOnce sync.Once
+}
+
+func (s *countedStream) Close() error {
+	s.closeOnce.Do(func() {
+		atomic.AddInt32(s.open, -1)
+		s.metrics.streamClosed()
+	})
+	return s.Conn.Close()
+}
@@ -0,0 +1,223 @@
+package snowflake_server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// wsPacketConn is a net.PacketConn that sends and receives encapsulated
+// packets on a turbotunnel WebSocket connection, like a client does.
+type wsPacketConn struct {
+	net.Conn
+}
+
+func (c wsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	data, err := encapsulation.ReadData(c.Conn)
+	return copy(p, data), c.RemoteAddr(), err
+}
+
+func (c wsPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return encapsulation.WriteData(c.Conn, p)
+}
+
+// dialSession makes a KCP and smux session with a new ClientID to the
+// listener at url.
+func dialSession(t *testing.T, url string) *smux.Session {
+	t.Helper()
+	clientID := turbotunnel.NewClientID()
+	conn := dialTurbotunnel(t, url, clientID)
+	kcpConn, err := kcp.NewConn2(clientID, nil, 0, 0, wsPacketConn{conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcpprofile.Default.Configure(kcpConn)
+	sess, err := smux.Client(kcpConn, kcpprofile.Default.SmuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// checkStream opens a stream and reports whether the server accepted it, by
+// waiting for data that the server echoes.
+func checkStream(t *testing.T, sess *smux.Session) (*smux.Stream, bool) {
+	t.Helper()
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write([]byte("x")); err != nil {
+		return stream, false
+	}
+	var buf [1]byte
+	_, err = io.ReadFull(stream, buf[:])
+	return stream, err == nil
+}
+
+// listenEcho listens with transport on an ephemeral port, and echoes the
+// data of every stream.
+func listenEcho(t *testing.T, transport *Transport) *SnowflakeListener {
+	t.Helper()
+	ln, err := transport.Listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestMaxStreamsPerSession(t *testing.T) {
+	transport := NewSnowflakeServer(nil)
+	transport.Limits = Limits{MaxStreamsPerSession: 2}
+	ln := listenEcho(t, transport)
+	defer ln.Close()
+	sess := dialSession(t, "ws://"+ln.Addr().String())
+	defer sess.Close()
+
+	s1, ok := checkStream(t, sess)
+	if !ok {
+		t.Fatal("first stream was refused")
+	}
+	if _, ok := checkStream(t, sess); !ok {
+		t.Fatal("second stream was refused")
+	}
+	if _, ok := checkStream(t, sess); ok {
+		t.Fatal("third stream was accepted")
+	}
+	if stats := ln.Stats(); stats.RefusedStreams != 1 || stats.Sessions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Closing a stream makes room for another.
+	s1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := checkStream(t, sess); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream was refused after another was closed")
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	transport := NewSnowflakeServer(nil)
+	transport.Limits = Limits{MaxSessions: 2}
+	ln := listenEcho(t, transport)
+	defer ln.Close()
+
+	var sessions []*smux.Session
+	for i := 0; i < 4; i++ {
+		sess := dialSession(t, "ws://"+ln.Addr().String())
+		defer sess.Close()
+		if _, ok := checkStream(t, sess); !ok {
+			t.Fatalf("stream %d was refused", i)
+		}
+		sessions = append(sessions, sess)
+	}
+
+	// The newest session still works, and the older ones were evicted.
+	if _, ok := checkStream(t, sessions[3]); !ok {
+		t.Error("newest session was evicted")
+	}
+	stats := ln.Stats()
+	if stats.Sessions > 2 || stats.Clients > 2 || stats.EvictedSessions < 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestParseLimitOption(t *testing.T) {
+	var limits Limits
+	if ok, err := limits.ParseLimitOption("max-sessions", "100"); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if ok, err := limits.ParseLimitOption("max-queued-bytes", "-1"); !ok || err == nil {
+		t.Fatalf("expected an error for a negative limit, got %v, %v", ok, err)
+	}
+	if ok, err := limits.ParseLimitOption("kcp-profile", "bulk"); ok || err != nil {
+		t.Fatalf("got %v, %v for an option that is not a limit", ok, err)
+	}
+	if limits != (Limits{MaxSessions: 100}) {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+}
+
+// authenticatedRefs returns the number of references to an authenticated
+// ClientID in t.
+func authenticatedRefs(t *sessionTable, clientID turbotunnel.ClientID) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.authenticated[clientID]
+}
+
+// waitForRefs waits until clientID has n references in sessions.
+func waitForRefs(t *testing.T, sessions *sessionTable, clientID turbotunnel.ClientID, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for authenticatedRefs(sessions, clientID) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d references, got %d", n, authenticatedRefs(sessions, clientID))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuthenticatedSession(t *testing.T) {
+	transport := NewSnowflakeServer(nil)
+	transport.Limits = Limits{MaxSessions: 1}
+	ln := listenEcho(t, transport)
+	defer ln.Close()
+	url := "ws://" + ln.Addr().String()
+
+	key := turbotunnel.NewClientKey()
+	conn := dialAuthenticated(t, url, key)
+	kcpConn, err := kcp.NewConn2(key.ClientID(), nil, 0, 0, wsPacketConn{conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcpprofile.Default.Configure(kcpConn)
+	sess, err := smux.Client(kcpConn, kcpprofile.Default.SmuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if _, ok := checkStream(t, sess); !ok {
+		t.Fatal("stream was refused")
+	}
+	// The connection and the session each hold a reference.
+	waitForRefs(t, ln.sessions, key.ClientID(), 2)
+
+	// The ClientID stays authenticated for as long as the session, after
+	// the connection that authenticated it has closed.
+	conn.Close()
+	waitForRefs(t, ln.sessions, key.ClientID(), 1)
+
+	// A new session evicts the old one, which forgets the ClientID.
+	other := dialSession(t, url)
+	defer other.Close()
+	if _, ok := checkStream(t, other); !ok {
+		t.Fatal("stream of the new session was refused")
+	}
+	waitForRefs(t, ln.sessions, key.ClientID(), 0)
+}
@@ -0,0 +1,289 @@
+package snowflake_server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
+)
+
+const (
+	prometheusNamespace = "snowflake_server"
+	// The country of clients whose address is unknown, or not in the
+	// GeoIP database.
+	unknownCountry = "??"
+)
+
+// Metrics keeps track of the activity of the clients of SnowflakeListeners,
+// and serves it as Prometheus metrics. Set it in the Metrics field of a
+// Transport before calling Listen. A nil *Metrics records nothing.
+type Metrics struct {
+	lock      sync.Mutex
+	geoipdb   *geoip.Geoip
+	listeners []*SnowflakeListener
+
+	registry             *prometheus.Registry
+	sessionsTotal        *prometheus.CounterVec
+	streams              prometheus.Gauge
+	streamsTotal         prometheus.Counter
+	webSocketsTotal      *prometheus.CounterVec
+	webSocketsPerSession prometheus.Histogram
+	traffic              *prometheus.CounterVec
+}
+
+// NewMetrics returns a Metrics without GeoIP, under which every client is in
+// the unknown country "??".
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+	}
+
+	m.sessionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "sessions_total",
+			Help:      "The number of KCP sessions of clients, by country",
+		},
+		[]string{"cc"},
+	)
+	m.streams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "streams",
+			Help:      "The number of open smux streams",
+		},
+	)
+	m.streamsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "streams_total",
+			Help:      "The number of smux streams accepted",
+		},
+	)
+	m.webSocketsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "websocket_connections_total",
+			Help:      "The number of WebSocket connections from proxies, by country of the client",
+		},
+		[]string{"cc"},
+	)
+	m.webSocketsPerSession = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "websocket_connections_per_session",
+			Help:      "The number of WebSocket connections that carried each ended KCP session, which shows how often clients redial",
+			Buckets:   []float64{1, 2, 3, 5, 10, 20, 50},
+		},
+	)
+	m.traffic = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "traffic_bytes_total",
+			Help:      "The number of bytes of encapsulated packets, by direction and country of the client",
+		},
+		[]string{"direction", "cc"},
+	)
+
+	m.registry.MustRegister(
+		m.sessionsTotal, m.streams, m.streamsTotal,
+		m.webSocketsTotal, m.webSocketsPerSession, m.traffic,
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "sessions",
+				Help:      "The number of open KCP sessions",
+			},
+			func() float64 { return float64(m.stats().Sessions) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "queued_bytes",
+				Help:      "The number of bytes in the queues of outgoing packets",
+			},
+			func() float64 { return float64(m.stats().QueuedBytes) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "queue_dropped_packets_total",
+				Help:      "The number of outgoing packets dropped because a queue was full or over its limit",
+			},
+			func() float64 { return float64(m.stats().DroppedPackets) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "evicted_sessions_total",
+				Help:      "The number of sessions evicted to stay within the limits",
+			},
+			func() float64 { return float64(m.stats().EvictedSessions) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "refused_streams_total",
+				Help:      "The number of streams refused to stay within the limits",
+			},
+			func() float64 { return float64(m.stats().RefusedStreams) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "client_id_map_entries",
+				Help:      "The number of ClientIDs whose client address is remembered",
+			},
+			func() float64 { return float64(clientIDAddrMap.Len()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "client_id_map_capacity",
+				Help:      "The number of ClientIDs whose client address can be remembered",
+			},
+			func() float64 { return clientIDAddrMapCapacity },
+		),
+	)
+	return m
+}
+
+// LoadGeoipDatabases loads the GeoIP databases that give the countries of
+// clients from the client_ip that proxies report.
+func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
+	geoipdb, err := geoip.New(geoipDB, geoip6DB)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.geoipdb = geoipdb
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// country returns the country code of a client address from clientAddr.
+func (m *Metrics) country(addr net.Addr) string {
+	if addr == nil {
+		return unknownCountry
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return unknownCountry
+	}
+	ip := net.ParseIP(host)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ip == nil || m.geoipdb == nil {
+		return unknownCountry
+	}
+	country, ok := m.geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return unknownCountry
+	}
+	return country
+}
+
+// addListener includes the LimitStats of ln in the metrics.
+func (m *Metrics) addListener(ln *SnowflakeListener) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.listeners = append(m.listeners, ln)
+}
+
+// stats returns the sum of the LimitStats of all listeners.
+func (m *Metrics) stats() LimitStats {
+	m.lock.Lock()
+	listeners := m.listeners
+	m.lock.Unlock()
+	var total LimitStats
+	for _, ln := range listeners {
+		stats := ln.Stats()
+		total.Sessions += stats.Sessions
+		total.Clients += stats.Clients
+		total.QueuedBytes += stats.QueuedBytes
+		total.EvictedSessions += stats.EvictedSessions
+		total.RefusedStreams += stats.RefusedStreams
+		total.DroppedPackets += stats.DroppedPackets
+	}
+	return total
+}
+
+// sessionStarted counts a new KCP session from a client at addr.
+func (m *Metrics) sessionStarted(addr net.Addr) {
+	if m == nil {
+		return
+	}
+	m.sessionsTotal.With(prometheus.Labels{"cc": m.country(addr)}).Inc()
+}
+
+// sessionEnded records how many WebSocket connections carried a session, or
+// nothing if webSockets is 0 because the session was not in the sessionTable.
+func (m *Metrics) sessionEnded(webSockets int) {
+	if m == nil || webSockets == 0 {
+		return
+	}
+	m.webSocketsPerSession.Observe(float64(webSockets))
+}
+
+// streamOpened counts a new smux stream.
+func (m *Metrics) streamOpened() {
+	if m == nil {
+		return
+	}
+	m.streams.Inc()
+	m.streamsTotal.Inc()
+}
+
+// streamClosed counts the end of an smux stream.
+func (m *Metrics) streamClosed() {
+	if m == nil {
+		return
+	}
+	m.streams.Dec()
+}
+
+// webSocketConnected counts a new WebSocket connection for a client at addr,
+// and returns the counters of its traffic.
+func (m *Metrics) webSocketConnected(addr net.Addr) *trafficMetrics {
+	if m == nil {
+		return nil
+	}
+	cc := m.country(addr)
+	m.webSocketsTotal.With(prometheus.Labels{"cc": cc}).Inc()
+	return &trafficMetrics{
+		inbound:  m.traffic.With(prometheus.Labels{"direction": "inbound", "cc": cc}),
+		outbound: m.traffic.With(prometheus.Labels{"direction": "outbound", "cc": cc}),
+	}
+}
+
+// trafficMetrics counts the bytes of one WebSocket connection, labeled with
+// the country of its client. All methods of a nil *trafficMetrics do nothing.
+type trafficMetrics struct {
+	inbound  prometheus.Counter
+	outbound prometheus.Counter
+}
+
+func (t *trafficMetrics) addInbound(n int) {
+	if t == nil {
+		return
+	}
+	t.inbound.Add(float64(n))
+}
+
+func (t *trafficMetrics) addOutbound(n int) {
+	if t == nil {
+		return
+	}
+	t.outbound.Add(float64(n))
+}
@@ -0,0 +1,110 @@
+package snowflake_server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeGeoipDatabases writes GeoIP databases in which 192.0.2.0/24 and
+// 2001:db8::/32 are in the country ZZ, and returns their paths.
+func writeGeoipDatabases(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	geoipDB := filepath.Join(dir, "geoip")
+	geoip6DB := filepath.Join(dir, "geoip6")
+	if err := ioutil.WriteFile(geoipDB, []byte("3221225984,3221226239,ZZ\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(geoip6DB, []byte("2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,ZZ\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return geoipDB, geoip6DB
+}
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snowflake-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metrics := NewMetrics()
+	if err := metrics.LoadGeoipDatabases(writeGeoipDatabases(t, dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := NewSnowflakeServer(nil)
+	transport.Metrics = metrics
+	transport.Limits.MaxSessions = 2
+	ln := listenEcho(t, transport)
+	defer ln.Close()
+
+	url := "ws://" + ln.Addr().String()
+	sess := dialSession(t, url+"?client_ip=192.0.2.1")
+	defer sess.Close()
+	if _, ok := checkStream(t, sess); !ok {
+		t.Fatal("stream was refused")
+	}
+	// A session from a client without client_ip is in the unknown
+	// country.
+	other := dialSession(t, url)
+	defer other.Close()
+	if _, ok := checkStream(t, other); !ok {
+		t.Fatal("stream was refused")
+	}
+
+	for _, test := range []struct {
+		collector prometheus.Collector
+		expected  float64
+	}{
+		{metrics.sessionsTotal.With(prometheus.Labels{"cc": "ZZ"}), 1},
+		{metrics.sessionsTotal.With(prometheus.Labels{"cc": unknownCountry}), 1},
+		{metrics.webSocketsTotal.With(prometheus.Labels{"cc": "ZZ"}), 1},
+		{metrics.streams, 2},
+		{metrics.streamsTotal, 2},
+	} {
+		if value := testutil.ToFloat64(test.collector); value != test.expected {
+			t.Errorf("expected %v, got %v", test.expected, value)
+		}
+	}
+	for _, direction := range []string{"inbound", "outbound"} {
+		if testutil.ToFloat64(metrics.traffic.With(prometheus.Labels{"direction": direction, "cc": "ZZ"})) == 0 {
+			t.Errorf("no %s traffic counted", direction)
+		}
+	}
+
+	// The end of a session, here by eviction, records its number of
+	// WebSocket connections.
+	third := dialSession(t, url)
+	defer third.Close()
+	if _, ok := checkStream(t, third); !ok {
+		t.Fatal("stream was refused")
+	}
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(body, "snowflake_server_websocket_connections_per_session_count 1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no session ended:\n%s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body = w.Body.String()
+	}
+	for _, line := range []string{
+		"snowflake_server_sessions 2",
+		"snowflake_server_queue_dropped_packets_total 0",
+		`snowflake_server_traffic_bytes_total{cc="ZZ",direction="inbound"}`,
+		"snowflake_server_client_id_map_entries",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics lack %q:\n%s", line, body)
+		}
+	}
+}
@@ -32,6 +32,9 @@ The Listen function starts a new listener, and Accept will return incoming Snowf
 		// handle conn
 	}
 
+If the port of addr is 0, ln.Addr reports the port that was chosen. To serve on a
+net.Listener that is already open, such as one from systemd socket activation, use
+ListenOn instead of Listen.
 
 */
 package snowflake_server
@@ -45,8 +48,9 @@ import (
 	"net"
 	"net/http"
 	"sync"
-	"time"
+	"sync/atomic"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
@@ -55,8 +59,12 @@ import (
 
 const (
 	// WindowSize is the number of packets in the send and receive window of a KCP connection.
+	//
+	// Deprecated: KCP parameters come from the profile passed to ListenWithProfile.
 	WindowSize = 65535
 	// StreamSize controls the maximum amount of in flight data between a client and server.
+	//
+	// Deprecated: KCP parameters come from the profile passed to ListenWithProfile.
 	StreamSize = 1048576 //1MB
 )
 
@@ -64,6 +72,16 @@ const (
 // https://github.com/Pluggable-Transports/Pluggable-Transports-spec/blob/master/releases/PTSpecV2.1/Pluggable%20Transport%20Specification%20v2.1%20-%20Go%20Transport%20API.pdf
 type Transport struct {
 	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Limits bounds the resources of the clients of listeners that are
+	// started after it is set.
+	Limits Limits
+	// Metrics, if not nil, records the activity of the clients of
+	// listeners that are started after it is set.
+	Metrics *Metrics
+	// RequireClientAuthentication, if true, makes listeners that are
+	// started after it is set refuse clients that do not authenticate
+	// their ClientID with a turbotunnel.ClientKey.
+	RequireClientAuthentication bool
 }
 
 // NewSnowflakeServer returns a new server-side Transport for Snowflake.
@@ -73,20 +91,64 @@ func NewSnowflakeServer(getCertificate func(*tls.ClientHelloInfo) (*tls.Certific
 }
 
 // Listen starts a listener on addr that will accept both turbotunnel
-// and legacy Snowflake connections.
+// and legacy Snowflake connections. If the port of addr is 0, a port is
+// chosen, which the Addr method of the listener reports.
 func (t *Transport) Listen(addr net.Addr) (*SnowflakeListener, error) {
+	return t.ListenWithProfile(addr, kcpprofile.Default)
+}
+
+// ListenWithProfile is like Listen, but tunes the KCP and smux sessions of
+// turbotunnel connections according to profile.
+func (t *Transport) ListenWithProfile(addr net.Addr, profile kcpprofile.Profile) (*SnowflakeListener, error) {
+	ln, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := t.ListenOnWithProfile(ln, profile)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ListenOn is like Listen, but serves Snowflake connections on a listener
+// that is already open, such as a socket passed by systemd. The returned
+// SnowflakeListener takes ownership of ln, and closes it when it is closed.
+func (t *Transport) ListenOn(ln net.Listener) (*SnowflakeListener, error) {
+	return t.ListenOnWithProfile(ln, kcpprofile.Default)
+}
+
+// ListenOnWithProfile is like ListenOn, but tunes the KCP and smux sessions
+// of turbotunnel connections according to profile.
+func (t *Transport) ListenOnWithProfile(ln net.Listener, profile kcpprofile.Profile) (*SnowflakeListener, error) {
+	addr := ln.Addr()
 	listener := &SnowflakeListener{
-		addr:   addr,
-		queue:  make(chan net.Conn, 65534),
-		closed: make(chan struct{}),
+		addr:     addr,
+		queue:    make(chan net.Conn, 65534),
+		closed:   make(chan struct{}),
+		profile:  profile,
+		limits:   t.Limits,
+		sessions: newSessionTable(),
+		metrics:  t.Metrics,
 	}
 
 	handler := httpHandler{
 		// pconn is shared among all connections to this server. It
 		// overlays packet-based client sessions on top of ephemeral
 		// WebSocket connections.
-		pconn: turbotunnel.NewQueuePacketConn(addr, clientMapTimeout),
+		pconn: turbotunnel.NewQueuePacketConnWithLimits(addr, clientMapTimeout, turbotunnel.ClientMapLimits{
+			MaxClients:              t.Limits.MaxSessions,
+			MaxQueuedBytesPerClient: t.Limits.MaxQueuedBytesPerClient,
+			MaxQueuedBytes:          t.Limits.MaxQueuedBytes,
+			OnEvict:                 listener.sessions.evict,
+		}),
+		sessions:              listener.sessions,
+		metrics:               t.Metrics,
+		requireAuthentication: t.RequireClientAuthentication,
 	}
+	listener.pconn = handler.pconn
+	t.Metrics.addListener(listener)
 	server := &http.Server{
 		Addr:        addr.String(),
 		Handler:     &handler,
@@ -106,40 +168,24 @@ func (t *Transport) Listen(addr net.Addr) (*SnowflakeListener, error) {
 	}
 	server.TLSConfig.GetCertificate = t.getCertificate
 
-	// Another unfortunate effect of the inseparable net/http ListenAndServe
-	// is that we can't check for Listen errors like "permission denied" and
-	// "address already in use" without potentially entering the infinite
-	// loop of Serve. The hack we apply here is to wait a short time,
-	// listenAndServeErrorTimeout, to see if an error is returned (because
-	// it's better if the error message goes to the tor log through
-	// SMETHOD-ERROR than if it only goes to the snowflake log).
-	errChan := make(chan error)
+	// Because the listener is already open, errors such as "permission
+	// denied" and "address already in use" have been reported by now, and
+	// Serve only returns when the server is closed.
 	go func() {
+		var err error
 		if t.getCertificate == nil {
 			// TLS is disabled
 			log.Printf("listening with plain HTTP on %s", addr)
-			err := server.ListenAndServe()
-			if err != nil {
-				log.Printf("error in ListenAndServe: %s", err)
-			}
-			errChan <- err
+			err = server.Serve(ln)
 		} else {
 			log.Printf("listening with HTTPS on %s", addr)
-			err := server.ListenAndServeTLS("", "")
-			if err != nil {
-				log.Printf("error in ListenAndServeTLS: %s", err)
-			}
-			errChan <- err
+			err = server.ServeTLS(ln, "", "")
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("error in Serve: %s", err)
 		}
 	}()
 
-	select {
-	case err = <-errChan:
-		break
-	case <-time.After(listenAndServeErrorTimeout):
-		break
-	}
-
 	listener.server = server
 
 	// Start a KCP engine, set up to read and write its packets over the
@@ -147,20 +193,20 @@ func (t *Transport) Listen(addr net.Addr) (*SnowflakeListener, error) {
 	// handler.ServeHTTP is responsible for encapsulation/decapsulation of
 	// packets on behalf of KCP. KCP takes those packets and turns them into
 	// sessions which appear in the acceptSessions function.
-	ln, err := kcp.ServeConn(nil, 0, 0, handler.pconn)
+	kcpLn, err := kcp.ServeConn(nil, 0, 0, handler.pconn)
 	if err != nil {
 		server.Close()
 		return nil, err
 	}
 	go func() {
-		defer ln.Close()
-		err := listener.acceptSessions(ln)
+		defer kcpLn.Close()
+		err := listener.acceptSessions(kcpLn)
 		if err != nil {
 			log.Printf("acceptSessions: %v", err)
 		}
 	}()
 
-	listener.ln = ln
+	listener.ln = kcpLn
 
 	return listener, nil
 
@@ -171,8 +217,13 @@ type SnowflakeListener struct {
 	queue     chan net.Conn
 	server    *http.Server
 	ln        *kcp.Listener
+	profile   kcpprofile.Profile
 	closed    chan struct{}
 	closeOnce sync.Once
+	pconn     *turbotunnel.QueuePacketConn
+	limits    Limits
+	sessions  *sessionTable
+	metrics   *Metrics
 }
 
 // Accept allows the caller to accept incoming Snowflake connections.
@@ -188,11 +239,25 @@ func (l *SnowflakeListener) Accept() (net.Conn, error) {
 	}
 }
 
-// Addr returns the address of the SnowflakeListener
+// Addr returns the address of the SnowflakeListener, with the port that was
+// chosen if it listened on port 0.
 func (l *SnowflakeListener) Addr() net.Addr {
 	return l.addr
 }
 
+// Stats returns the current use of resources by the clients of the listener.
+func (l *SnowflakeListener) Stats() LimitStats {
+	queues := l.pconn.Stats()
+	return LimitStats{
+		Sessions:        l.sessions.count(),
+		Clients:         queues.Clients,
+		QueuedBytes:     queues.QueuedBytes,
+		EvictedSessions: queues.Evicted + atomic.LoadUint64(&l.sessions.evicted),
+		RefusedStreams:  atomic.LoadUint64(&l.sessions.refusedStreams),
+		DroppedPackets:  queues.Dropped,
+	}
+}
+
 // Close closes the Snowflake connection.
 func (l *SnowflakeListener) Close() error {
 	// Close our HTTP server and our KCP listener
@@ -217,16 +282,16 @@ func (l *SnowflakeListener) acceptStreams(conn *kcp.UDPSession) error {
 		// message means you should increase clientIDAddrMapCapacity.
 		log.Printf("no address in clientID-to-IP map (capacity %d)", clientIDAddrMapCapacity)
 	}
+	l.metrics.sessionStarted(addr)
 
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = 10 * time.Minute
-	smuxConfig.MaxStreamBuffer = StreamSize
-	sess, err := smux.Server(conn, smuxConfig)
+	sess, err := smux.Server(conn, l.profile.SmuxConfig())
 	if err != nil {
 		return err
 	}
+	defer sess.Close()
+	l.profile.StartDelayController(conn, sess.IsClosed)
 
+	var open int32
 	for {
 		stream, err := sess.AcceptStream()
 		if err != nil {
@@ -235,7 +300,14 @@ func (l *SnowflakeListener) acceptStreams(conn *kcp.UDPSession) error {
 			}
 			return err
 		}
-		l.queueConn(&SnowflakeClientConn{Conn: stream, address: addr})
+		if l.limits.MaxStreamsPerSession > 0 && atomic.LoadInt32(&open) >= int32(l.limits.MaxStreamsPerSession) {
+			atomic.AddUint64(&l.sessions.refusedStreams, 1)
+			stream.Close()
+			continue
+		}
+		atomic.AddInt32(&open, 1)
+		l.metrics.streamOpened()
+		l.queueConn(&SnowflakeClientConn{Conn: &countedStream{Conn: stream, open: &open, metrics: l.metrics}, address: addr})
 	}
 }
 
@@ -251,20 +323,12 @@ func (l *SnowflakeListener) acceptSessions(ln *kcp.Listener) error {
 			}
 			return err
 		}
-		// Permit coalescing the payloads of consecutive sends.
-		conn.SetStreamMode(true)
-		// Set the maximum send and receive window sizes to a high number
-		// Removes KCP bottlenecks: https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40026
-		conn.SetWindowSize(WindowSize, WindowSize)
-		// Disable the dynamic congestion window (limit only by the
-		// maximum of local and remote static windows).
-		conn.SetNoDelay(
-			0, // default nodelay
-			0, // default interval
-			0, // default resend
-			1, // nc=1 => congestion window off
-		)
+		l.profile.Configure(conn)
+		l.sessions.add(conn, l.limits.MaxSessions, l.pconn.LastSeen)
 		go func() {
+			defer func() {
+				l.metrics.sessionEnded(l.sessions.remove(conn))
+			}()
 			defer conn.Close()
 			err := l.acceptStreams(conn)
 			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
@@ -0,0 +1,75 @@
+package snowflake_server
+
+import (
+	"net"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/turbotunnel"
+)
+
+// checkServing makes a turbotunnel WebSocket connection to the listener at
+// the address it reports, and sends a packet on it.
+func checkServing(t *testing.T, ln *SnowflakeListener) {
+	t.Helper()
+	conn := dialTurbotunnel(t, "ws://"+ln.Addr().String(), turbotunnel.NewClientID())
+	defer conn.Close()
+	if _, err := encapsulation.WriteData(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenEphemeralPort(t *testing.T) {
+	transport := NewSnowflakeServer(nil)
+	ln, err := transport.Listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected the chosen port, got %v", ln.Addr())
+	}
+	checkServing(t, ln)
+}
+
+func TestListenAddressInUse(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+
+	transport := NewSnowflakeServer(nil)
+	ln, err := transport.Listen(tcpLn.Addr())
+	if err == nil {
+		ln.Close()
+		t.Fatal("expected an error listening on a port in use")
+	}
+}
+
+func TestListenOn(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := NewSnowflakeServer(nil)
+	ln, err := transport.ListenOn(tcpLn)
+	if err != nil {
+		tcpLn.Close()
+		t.Fatal(err)
+	}
+	if ln.Addr().String() != tcpLn.Addr().String() {
+		t.Errorf("expected address %v, got %v", tcpLn.Addr(), ln.Addr())
+	}
+	checkServing(t, ln)
+
+	// Closing the SnowflakeListener closes the listener it was given.
+	ln.Close()
+	if conn, err := net.Dial("tcp", tcpLn.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("listener is still open after Close")
+	}
+}
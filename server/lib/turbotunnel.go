@@ -72,6 +72,13 @@ func (m *clientIDMap) Set(clientID turbotunnel.ClientID, addr net.Addr) {
 	m.oldest = (m.oldest + 1) % len(m.entries)
 }
 
+// Len returns the number of ClientIDs that have a mapping.
+func (m *clientIDMap) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.current)
+}
+
 // Get returns a previously stored mapping. The second return value indicates
 // whether clientID was actually present in the map. If it is false, then the
 // returned address will be nil.
@@ -0,0 +1,194 @@
+package snowflake_server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// How long to wait for an upstream to accept a connection
+const upstreamDialTimeout = 10 * time.Second
+
+// Upstream is where a server that is not run by tor sends the streams of its
+// clients: a TCP or Unix socket, or a target reached through a SOCKS5 proxy.
+type Upstream struct {
+	// Network is "tcp", "unix", or "socks5".
+	Network string `json:"network"`
+	// Address is the address of the upstream, or of the SOCKS5 proxy.
+	Address string `json:"address"`
+	// Target is the address, in host:port form, to which the SOCKS5 proxy
+	// connects.
+	Target string `json:"target,omitempty"`
+	// Username and Password, if set, authenticate to the SOCKS5 proxy.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// ProxyProtocol starts every connection to the upstream with a PROXY
+	// protocol version 2 header that carries the client's IP address, as
+	// reported by the proxy in client_ip.
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+}
+
+// Validate checks that the upstream is complete.
+func (u *Upstream) Validate() error {
+	switch u.Network {
+	case "tcp", "unix":
+		if u.Target != "" {
+			return fmt.Errorf("only a socks5 upstream has a target")
+		}
+	case "socks5":
+		if u.Target == "" {
+			return fmt.Errorf("a socks5 upstream needs a target")
+		}
+		if _, _, err := net.SplitHostPort(u.Target); err != nil {
+			return fmt.Errorf("invalid target: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown upstream network %q", u.Network)
+	}
+	if u.Address == "" {
+		return fmt.Errorf("upstream address is missing")
+	}
+	return nil
+}
+
+// Dial connects to the upstream on behalf of the client at clientAddr, which
+// is the RemoteAddr of a client stream and may be empty, and sends the PROXY
+// protocol header if configured.
+func (u *Upstream) Dial(clientAddr net.Addr) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if u.Network == "socks5" {
+		var auth *proxy.Auth
+		if u.Username != "" || u.Password != "" {
+			auth = &proxy.Auth{User: u.Username, Password: u.Password}
+		}
+		var dialer proxy.Dialer
+		dialer, err = proxy.SOCKS5("tcp", u.Address, auth, &net.Dialer{Timeout: upstreamDialTimeout})
+		if err != nil {
+			return nil, err
+		}
+		conn, err = dialer.Dial("tcp", u.Target)
+	} else {
+		conn, err = net.DialTimeout(u.Network, u.Address, upstreamDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.ProxyProtocol {
+		_, err = conn.Write(proxyProtocolHeader(clientAddr, conn.RemoteAddr()))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Forward connects conn to the upstream and copies data in both directions
+// until either side is done.
+func (u *Upstream) Forward(conn net.Conn) error {
+	upstream, err := u.Dial(conn.RemoteAddr())
+	if err != nil {
+		return fmt.Errorf("failed to connect to upstream: %v", err)
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(conn, upstream); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("error copying upstream to client: %v", err)
+		}
+		conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(upstream, conn); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("error copying client to upstream: %v", err)
+		}
+		// Let the upstream finish sending, if the connection can be
+		// half-closed, as TCP and Unix sockets can.
+		if hc, ok := upstream.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite()
+		} else {
+			upstream.Close()
+		}
+		conn.Close()
+	}()
+	wg.Wait()
+	return nil
+}
+
+// The signature at the start of every PROXY protocol version 2 header
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolLocal = 0x20 // Version 2, LOCAL command
+	proxyProtocolProxy = 0x21 // Version 2, PROXY command
+
+	proxyProtocolUnspec    = 0x00
+	proxyProtocolTCPOverV4 = 0x11
+	proxyProtocolTCPOverV6 = 0x21
+)
+
+// proxyProtocolHeader returns a PROXY protocol version 2 header for a
+// connection from clientAddr to upstreamAddr. Proxies only report the IP
+// address of clients, so the source port is 0. If the client address is
+// unknown, the header has the LOCAL command, which tells the upstream to use
+// the address of the connection instead.
+func proxyProtocolHeader(clientAddr, upstreamAddr net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolSignature)
+
+	var clientIP net.IP
+	if clientAddr != nil {
+		if host, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+			clientIP = net.ParseIP(host)
+		}
+	}
+	if clientIP == nil {
+		buf.Write([]byte{proxyProtocolLocal, proxyProtocolUnspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	// The destination is the upstream if it has an IP address of the same
+	// family as the client, and otherwise unspecified.
+	var dstIP net.IP
+	var dstPort int
+	if tcpAddr, ok := upstreamAddr.(*net.TCPAddr); ok {
+		dstIP, dstPort = tcpAddr.IP, tcpAddr.Port
+	}
+
+	var family byte
+	var src, dst net.IP
+	if ip4 := clientIP.To4(); ip4 != nil {
+		family = proxyProtocolTCPOverV4
+		src, dst = ip4, dstIP.To4()
+		if dst == nil {
+			dst, dstPort = net.IPv4zero.To4(), 0
+		}
+	} else {
+		family = proxyProtocolTCPOverV6
+		src, dst = clientIP.To16(), dstIP.To16()
+		if dst == nil || dstIP.To4() != nil {
+			dst, dstPort = net.IPv6zero, 0
+		}
+	}
+
+	buf.Write([]byte{proxyProtocolProxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(src)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+	return buf.Bytes()
+}
@@ -0,0 +1,208 @@
+package snowflake_server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startEchoUpstream listens on network and returns the listener and a channel
+// that receives everything each connection sent, after echoing it back.
+func startEchoUpstream(network, address string) (net.Listener, chan []byte, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var buf bytes.Buffer
+				io.Copy(io.MultiWriter(&buf, conn), conn)
+				received <- buf.Bytes()
+			}()
+		}
+	}()
+	return ln, received, nil
+}
+
+// startSOCKS5Proxy runs a SOCKS5 proxy without authentication that only
+// handles CONNECT to IPv4 addresses, and returns its listener and a channel
+// that receives the target of each connection.
+func startSOCKS5Proxy() (net.Listener, chan string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Greeting: version, number of methods, methods
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// Request: version, CONNECT, reserved, IPv4, address, port
+				request := make([]byte, 10)
+				if _, err := io.ReadFull(conn, request); err != nil || request[3] != 1 {
+					return
+				}
+				target := (&net.TCPAddr{IP: net.IP(request[4:8]), Port: int(binary.BigEndian.Uint16(request[8:]))}).String()
+				targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln, targets, nil
+}
+
+// forward runs upstream.Forward on a client connection from clientAddr,
+// writes data as the client, and returns what the client got back before it
+// hung up.
+func forward(upstream *Upstream, clientAddr net.Addr, data []byte) ([]byte, error) {
+	client, server := net.Pipe()
+	conn := &SnowflakeClientConn{Conn: server, address: clientAddr}
+	errChan := make(chan error, 1)
+	go func() { errChan <- upstream.Forward(conn) }()
+	go func() {
+		client.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(client, buf)
+	client.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf, <-errChan
+}
+
+func TestUpstream(t *testing.T) {
+	Convey("Upstream", t, func() {
+		data := []byte("hello upstream")
+
+		Convey("validates its configuration", func() {
+			So((&Upstream{Network: "tcp", Address: "127.0.0.1:9001"}).Validate(), ShouldBeNil)
+			So((&Upstream{Network: "unix", Address: "/run/or.sock"}).Validate(), ShouldBeNil)
+			So((&Upstream{Network: "socks5", Address: "127.0.0.1:1080", Target: "example.com:443"}).Validate(), ShouldBeNil)
+			So((&Upstream{Network: "udp", Address: "127.0.0.1:9001"}).Validate(), ShouldNotBeNil)
+			So((&Upstream{Network: "tcp"}).Validate(), ShouldNotBeNil)
+			So((&Upstream{Network: "tcp", Address: "127.0.0.1:9001", Target: "example.com:443"}).Validate(), ShouldNotBeNil)
+			So((&Upstream{Network: "socks5", Address: "127.0.0.1:1080"}).Validate(), ShouldNotBeNil)
+			So((&Upstream{Network: "socks5", Address: "127.0.0.1:1080", Target: "example.com"}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("forwards to a TCP upstream", func() {
+			ln, received, err := startEchoUpstream("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			echoed, err := forward(&Upstream{Network: "tcp", Address: ln.Addr().String()}, clientAddr("1.2.3.4"), data)
+			So(err, ShouldBeNil)
+			So(echoed, ShouldResemble, data)
+			So(<-received, ShouldResemble, data)
+		})
+
+		Convey("forwards to a Unix upstream", func() {
+			dir, err := ioutil.TempDir("", "snowflake-server")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			ln, received, err := startEchoUpstream("unix", filepath.Join(dir, "upstream.sock"))
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			echoed, err := forward(&Upstream{Network: "unix", Address: ln.Addr().String()}, clientAddr(""), data)
+			So(err, ShouldBeNil)
+			So(echoed, ShouldResemble, data)
+			So(<-received, ShouldResemble, data)
+		})
+
+		Convey("forwards to a target through a SOCKS5 proxy", func() {
+			ln, received, err := startEchoUpstream("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			socks, targets, err := startSOCKS5Proxy()
+			So(err, ShouldBeNil)
+			defer socks.Close()
+
+			upstream := &Upstream{Network: "socks5", Address: socks.Addr().String(), Target: ln.Addr().String()}
+			echoed, err := forward(upstream, clientAddr("1.2.3.4"), data)
+			So(err, ShouldBeNil)
+			So(echoed, ShouldResemble, data)
+			So(<-targets, ShouldEqual, ln.Addr().String())
+			So(<-received, ShouldResemble, data)
+		})
+
+		Convey("sends the client address in a PROXY protocol header", func() {
+			ln, received, err := startEchoUpstream("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			upstream := &Upstream{Network: "tcp", Address: ln.Addr().String(), ProxyProtocol: true}
+			conn, err := upstream.Dial(clientAddr("1.2.3.4"))
+			So(err, ShouldBeNil)
+			conn.Write(data)
+			conn.(*net.TCPConn).CloseWrite()
+			ioutil.ReadAll(conn)
+			conn.Close()
+
+			port := ln.Addr().(*net.TCPAddr).Port
+			expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+				1, 2, 3, 4, // Source address
+				127, 0, 0, 1, // Destination address
+				0, 0, // Source port
+				byte(port>>8), byte(port))
+			So(<-received, ShouldResemble, append(expected, data...))
+		})
+	})
+
+	Convey("PROXY protocol headers", t, func() {
+		signature := "\r\n\r\n\x00\r\nQUIT\n"
+		upstreamAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9001}
+
+		Convey("carry IPv6 client addresses", func() {
+			header := proxyProtocolHeader(clientAddr("2001:db8::1"), upstreamAddr)
+			So(string(header[:12]), ShouldEqual, signature)
+			So(header[12:16], ShouldResemble, []byte{0x21, 0x21, 0, 36})
+			So(net.IP(header[16:32]).Equal(net.ParseIP("2001:db8::1")), ShouldBeTrue)
+			// The upstream has an IPv4 address, so the destination is
+			// unspecified.
+			So(net.IP(header[32:48]).Equal(net.IPv6zero), ShouldBeTrue)
+			So(header[48:], ShouldResemble, []byte{0, 0, 0, 0})
+		})
+
+		Convey("are LOCAL without a client address", func() {
+			header := proxyProtocolHeader(clientAddr(""), upstreamAddr)
+			So(string(header), ShouldEqual, signature+"\x20\x00\x00\x00")
+		})
+	})
+}
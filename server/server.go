@@ -14,10 +14,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
 	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/safelog"
 	"golang.org/x/crypto/acme/autocert"
 
@@ -32,11 +34,12 @@ var ptInfo pt.ServerInfo
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage: %s [OPTIONS]
 
-WebSocket server pluggable transport for Snowflake. Works only as a managed
-proxy. Uses TLS with ACME (Let's Encrypt) by default. Set the certificate
-hostnames with the --acme-hostnames option. Use ServerTransportListenAddr in
-torrc to choose the listening port. When using TLS, this program will open an
-additional HTTP listener on port 80 to work with ACME.
+WebSocket server pluggable transport for Snowflake. Works as a managed proxy,
+or without tor with the --standalone option. Uses TLS with ACME (Let's
+Encrypt) by default. Set the certificate hostnames with the --acme-hostnames
+option. Use ServerTransportListenAddr in torrc, or the standalone
+configuration file, to choose the listening port. When using TLS, this
+program will open an additional HTTP listener on port 80 to work with ACME.
 
 `, os.Args[0])
 	flag.PrintDefaults()
@@ -81,7 +84,7 @@ func handleConn(conn net.Conn) error {
 }
 
 //acceptLoop accepts incoming client snowflake connection and passes them to a handler function.
-func acceptLoop(ln net.Listener) {
+func acceptLoop(ln net.Listener, handler func(net.Conn) error) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -93,7 +96,7 @@ func acceptLoop(ln net.Listener) {
 		}
 		go func() {
 			defer conn.Close()
-			err := handleConn(conn)
+			err := handler(conn)
 			if err != nil {
 				log.Printf("handleConn: %v", err)
 			}
@@ -101,6 +104,18 @@ func acceptLoop(ln net.Listener) {
 	}
 }
 
+// parseLimitOptions sets limits from the transport options that name them.
+func parseLimitOptions(limits *sf.Limits, options pt.Args) error {
+	for name, values := range options {
+		for _, value := range values {
+			if _, err := limits.ParseLimitOption(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func getCertificateCacheDir() (string, error) {
 	stateDir, err := pt.MakeStateDir()
 	if err != nil {
@@ -115,6 +130,10 @@ func main() {
 	var disableTLS bool
 	var logFilename string
 	var unsafeLogging bool
+	var standaloneConfigFilename string
+	var metricsAddress string
+	var geoipDatabase string
+	var geoip6Database string
 
 	flag.Usage = usage
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
@@ -122,6 +141,10 @@ func main() {
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
 	flag.StringVar(&logFilename, "log", "", "log file to write to")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.StringVar(&standaloneConfigFilename, "standalone", "", "run without tor, forwarding clients to the upstream in this JSON configuration file")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "serve Prometheus metrics at /metrics on this local address")
+	flag.StringVar(&geoipDatabase, "geoipdb", "", "path to a geoip database mapping IPv4 address ranges to country codes, for metrics")
+	flag.StringVar(&geoip6Database, "geoip6db", "", "path to a geoip database mapping IPv6 address ranges to country codes, for metrics")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -149,25 +172,50 @@ func main() {
 
 	log.Printf("starting")
 	var err error
-	ptInfo, err = pt.ServerSetup(nil)
-	if err != nil {
-		log.Fatalf("error in setup: %s", err)
+	if standaloneConfigFilename == "" {
+		ptInfo, err = pt.ServerSetup(nil)
+		if err != nil {
+			log.Fatalf("error in setup: %s", err)
+		}
 	}
 
 	go statsThread()
 
+	var metrics *sf.Metrics
+	if metricsAddress != "" {
+		metrics = sf.NewMetrics()
+		if geoipDatabase != "" || geoip6Database != "" {
+			if err := metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
+				log.Fatalf("error loading geoip databases: %s", err)
+			}
+		}
+		ln, err := net.Listen("tcp", metricsAddress)
+		if err != nil {
+			log.Fatalf("error opening metrics listener: %s", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.Serve(ln, mux))
+		}()
+	}
+
 	var certManager *autocert.Manager
 	if !disableTLS {
 		log.Printf("ACME hostnames: %q", acmeHostnames)
 
+		// In standalone mode, the cache directory is in the
+		// configuration file, as there is no tor state directory.
 		var cache autocert.Cache
-		var cacheDir string
-		cacheDir, err = getCertificateCacheDir()
-		if err == nil {
-			log.Printf("caching ACME certificates in directory %q", cacheDir)
-			cache = autocert.DirCache(cacheDir)
-		} else {
-			log.Printf("disabling ACME certificate cache: %s", err)
+		if standaloneConfigFilename == "" {
+			var cacheDir string
+			cacheDir, err = getCertificateCacheDir()
+			if err == nil {
+				log.Printf("caching ACME certificates in directory %q", cacheDir)
+				cache = autocert.DirCache(cacheDir)
+			} else {
+				log.Printf("disabling ACME certificate cache: %s", err)
+			}
 		}
 
 		certManager = &autocert.Manager{
@@ -178,6 +226,13 @@ func main() {
 		}
 	}
 
+	if standaloneConfigFilename != "" {
+		if err := runStandalone(standaloneConfigFilename, certManager, metrics); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// The ACME HTTP-01 responder only works when it is running on port 80.
 	// We actually open the port in the loop below, so that any errors can
 	// be reported in the SMETHOD-ERROR of some bindaddr.
@@ -213,21 +268,6 @@ func main() {
 			needHTTP01Listener = false
 		}
 
-		// We're not capable of listening on port 0 (i.e., an ephemeral port
-		// unknown in advance). The reason is that while the net/http package
-		// exposes ListenAndServe and ListenAndServeTLS, those functions never
-		// return, so there's no opportunity to find out what the port number
-		// is, in between the Listen and Serve steps.
-		// https://groups.google.com/d/msg/Golang-nuts/3F1VRCCENp8/3hcayZiwYM8J
-		if bindaddr.Addr.Port == 0 {
-			err := fmt.Errorf(
-				"cannot listen on port %d; configure a port using ServerTransportListenAddr",
-				bindaddr.Addr.Port)
-			log.Printf("error opening listener: %s", err)
-			pt.SmethodError(bindaddr.MethodName, err.Error())
-			continue
-		}
-
 		var transport *sf.Transport
 		args := pt.Args{}
 		if disableTLS {
@@ -240,15 +280,47 @@ func main() {
 			}
 			transport = sf.NewSnowflakeServer(certManager.GetCertificate)
 		}
-		ln, err := transport.Listen(bindaddr.Addr)
+		// The KCP profile may be chosen per listener with
+		// ServerTransportOptions snowflake kcp-profile=<name>.
+		profileName, _ := bindaddr.Options.Get("kcp-profile")
+		profile, err := kcpprofile.Get(profileName)
+		if err != nil {
+			log.Printf("error opening listener: %s", err)
+			pt.SmethodError(bindaddr.MethodName, err.Error())
+			continue
+		}
+		transport.Metrics = metrics
+		// Resource limits may also be set per listener, for example
+		// ServerTransportOptions snowflake max-sessions=10000.
+		err = parseLimitOptions(&transport.Limits, bindaddr.Options)
+		if err != nil {
+			log.Printf("error opening listener: %s", err)
+			pt.SmethodError(bindaddr.MethodName, err.Error())
+			continue
+		}
+		// Clients that do not authenticate their ClientID may be refused
+		// with ServerTransportOptions snowflake require-client-authentication=true.
+		if value, ok := bindaddr.Options.Get("require-client-authentication"); ok {
+			transport.RequireClientAuthentication, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("invalid require-client-authentication %q", value)
+				log.Printf("error opening listener: %s", err)
+				pt.SmethodError(bindaddr.MethodName, err.Error())
+				continue
+			}
+		}
+		ln, err := transport.ListenWithProfile(bindaddr.Addr, profile)
 		if err != nil {
 			log.Printf("error opening listener: %s", err)
 			pt.SmethodError(bindaddr.MethodName, err.Error())
 			continue
 		}
 		defer ln.Close()
-		go acceptLoop(ln)
-		pt.SmethodArgs(bindaddr.MethodName, bindaddr.Addr, args)
+		go acceptLoop(ln, handleConn)
+		go limitStatsThread(ln)
+		// Report the port that was actually chosen, in case the
+		// configured port was 0.
+		pt.SmethodArgs(bindaddr.MethodName, ln.Addr().(*net.TCPAddr), args)
 		listeners = append(listeners, ln)
 	}
 	pt.SmethodsDone()
@@ -0,0 +1,160 @@
+package main
+
+// This code runs the server without tor, forwarding the streams of clients to
+// an upstream given in a configuration file, instead of to tor's ORPort.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
+	"golang.org/x/crypto/acme/autocert"
+
+	sf "git.torproject.org/pluggable-transports/snowflake.git/v2/server/lib"
+)
+
+// standaloneConfig is the configuration file of standalone mode, in JSON.
+type standaloneConfig struct {
+	// Listen is the address on which to accept WebSocket connections. If it
+	// is empty, the server uses a socket passed by systemd socket
+	// activation.
+	Listen string `json:"listen,omitempty"`
+	// KCPProfile is the name of the KCP profile of client sessions.
+	KCPProfile string `json:"kcp_profile,omitempty"`
+	// Upstream is where to send the streams of clients.
+	Upstream sf.Upstream `json:"upstream"`
+	// Limits bounds the resources of clients.
+	Limits sf.Limits `json:"limits,omitempty"`
+	// RequireClientAuthentication refuses clients that do not authenticate
+	// their ClientID, as the require-client-authentication transport option
+	// does under tor.
+	RequireClientAuthentication bool `json:"require_client_authentication,omitempty"`
+	// CacheDir is the directory in which to cache ACME certificates. It is
+	// required unless TLS is disabled, so that certificates are not issued
+	// again on every restart.
+	CacheDir string `json:"cache_dir,omitempty"`
+}
+
+func loadStandaloneConfig(filename string) (*standaloneConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config standaloneConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if err := config.Upstream.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &config, nil
+}
+
+// systemdListener returns the socket passed by systemd socket activation,
+// which must be the only one.
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no listen address is configured, and no socket was passed by systemd")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds != 1 {
+		return nil, fmt.Errorf("expected 1 socket from systemd, got LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+	}
+	// Passed sockets start at file descriptor 3.
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// runStandalone listens as the configuration file says, and forwards clients
+// to its upstream until it receives SIGTERM or SIGINT. If certManager is nil,
+// TLS is disabled; otherwise, it caches certificates in the CacheDir of the
+// configuration file. If metrics is not nil, it records the activity of
+// clients.
+func runStandalone(configFilename string, certManager *autocert.Manager, metrics *sf.Metrics) error {
+	config, err := loadStandaloneConfig(configFilename)
+	if err != nil {
+		return err
+	}
+	if certManager != nil {
+		if config.CacheDir == "" {
+			return fmt.Errorf("%s: cache_dir is required unless TLS is disabled", configFilename)
+		}
+		log.Printf("caching ACME certificates in directory %q", config.CacheDir)
+		certManager.Cache = autocert.DirCache(config.CacheDir)
+	}
+	profile, err := kcpprofile.Get(config.KCPProfile)
+	if err != nil {
+		return err
+	}
+	var lnTCP net.Listener
+	if config.Listen == "" {
+		lnTCP, err = systemdListener()
+	} else {
+		lnTCP, err = net.Listen("tcp", config.Listen)
+	}
+	if err != nil {
+		return err
+	}
+	addr, ok := lnTCP.Addr().(*net.TCPAddr)
+	if !ok {
+		lnTCP.Close()
+		return fmt.Errorf("cannot listen on %s: not a TCP address", lnTCP.Addr())
+	}
+
+	var transport *sf.Transport
+	if certManager == nil {
+		transport = sf.NewSnowflakeServer(nil)
+	} else {
+		// The ACME HTTP-01 responder only works on port 80.
+		addrHTTP01 := *addr
+		addrHTTP01.Port = 80
+		log.Printf("Starting HTTP-01 ACME listener")
+		lnHTTP01, err := net.ListenTCP("tcp", &addrHTTP01)
+		if err != nil {
+			lnTCP.Close()
+			return fmt.Errorf("error opening HTTP-01 ACME listener: %v", err)
+		}
+		defer lnHTTP01.Close()
+		go func() {
+			log.Fatal(http.Serve(lnHTTP01, certManager.HTTPHandler(nil)))
+		}()
+		transport = sf.NewSnowflakeServer(certManager.GetCertificate)
+	}
+
+	transport.Limits = config.Limits
+	transport.RequireClientAuthentication = config.RequireClientAuthentication
+	transport.Metrics = metrics
+	ln, err := transport.ListenOnWithProfile(lnTCP, profile)
+	if err != nil {
+		lnTCP.Close()
+		return err
+	}
+	defer ln.Close()
+	log.Printf("listening on %s", ln.Addr())
+	log.Printf("forwarding clients to %s upstream %s", config.Upstream.Network, config.Upstream.Address)
+	go acceptLoop(ln, func(conn net.Conn) error {
+		statsChannel <- conn.RemoteAddr().String() != ""
+		return config.Upstream.Forward(conn)
+	})
+	go limitStatsThread(ln)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigChan
+	log.Printf("caught signal %q, exiting", sig)
+	return nil
+}
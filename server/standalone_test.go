@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestStandaloneConfig(t *testing.T) {
+	Convey("Standalone configuration", t, func() {
+		dir, err := ioutil.TempDir("", "snowflake-server")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		// writeConfig writes a configuration file, and returns its name.
+		writeConfig := func(config string) string {
+			filename := filepath.Join(dir, "config.json")
+			So(ioutil.WriteFile(filename, []byte(config), 0600), ShouldBeNil)
+			return filename
+		}
+
+		Convey("is parsed", func() {
+			config, err := loadStandaloneConfig(writeConfig(`{
+				"listen": "127.0.0.1:0",
+				"upstream": {"network": "tcp", "address": "127.0.0.1:8080"},
+				"cache_dir": "/var/lib/snowflake",
+				"require_client_authentication": true
+			}`))
+			So(err, ShouldBeNil)
+			So(config.Listen, ShouldEqual, "127.0.0.1:0")
+			So(config.Upstream.Address, ShouldEqual, "127.0.0.1:8080")
+			So(config.CacheDir, ShouldEqual, "/var/lib/snowflake")
+			So(config.RequireClientAuthentication, ShouldBeTrue)
+
+			config, err = loadStandaloneConfig(writeConfig(`{
+				"upstream": {"network": "tcp", "address": "127.0.0.1:8080"}
+			}`))
+			So(err, ShouldBeNil)
+			So(config.RequireClientAuthentication, ShouldBeFalse)
+		})
+
+		Convey("requires a certificate cache with TLS", func() {
+			filename := writeConfig(`{
+				"listen": "127.0.0.1:0",
+				"upstream": {"network": "tcp", "address": "127.0.0.1:8080"}
+			}`)
+			err := runStandalone(filename, &autocert.Manager{}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "cache_dir")
+		})
+	})
+}
@@ -2,13 +2,15 @@ package main
 
 // This code handled periodic statistics logging.
 //
-// The only thing it keeps track of is how many connections had the client_ip
-// parameter. Write true to statsChannel to record a connection with client_ip;
-// write false for without.
+// It keeps track of how many connections had the client_ip parameter. Write
+// true to statsChannel to record a connection with client_ip; write false for
+// without. It also logs the resource use of each listener.
 
 import (
 	"log"
 	"time"
+
+	sf "git.torproject.org/pluggable-transports/snowflake.git/v2/server/lib"
 )
 
 const (
@@ -42,3 +44,20 @@ func statsThread() {
 		}
 	}
 }
+
+// limitStatsThread periodically logs the resources used by the clients of ln,
+// and how often its limits were enforced.
+func limitStatsThread(ln *sf.SnowflakeListener) {
+	var prev sf.LimitStats
+	for {
+		time.Sleep(statsInterval)
+		stats := ln.Stats()
+		log.Printf("in the past %.f s on %s, %d sessions evicted, %d streams refused, %d packets dropped; now %d sessions, %d queued bytes",
+			statsInterval.Seconds(), ln.Addr(),
+			stats.EvictedSessions-prev.EvictedSessions,
+			stats.RefusedStreams-prev.RefusedStreams,
+			stats.DroppedPackets-prev.DroppedPackets,
+			stats.Sessions, stats.QueuedBytes)
+		prev = stats
+	}
+}
@@ -0,0 +1,196 @@
+package testenv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// brokerGate passes requests to the broker's handler, unless it is stalled,
+// in which case requests wait until it is resumed or they are abandoned.
+type brokerGate struct {
+	handler http.Handler
+
+	lock sync.Mutex
+	// Closed when the gate is not stalled.
+	open chan struct{}
+	// The number of requests received for each path
+	requests map[string]int
+}
+
+func newBrokerGate(handler http.Handler) *brokerGate {
+	open := make(chan struct{})
+	close(open)
+	return &brokerGate{
+		handler:  handler,
+		open:     open,
+		requests: make(map[string]int),
+	}
+}
+
+func (g *brokerGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	g.requests[r.URL.Path]++
+	open := g.open
+	g.lock.Unlock()
+
+	select {
+	case <-open:
+		g.handler.ServeHTTP(w, r)
+	case <-r.Context().Done():
+	}
+}
+
+// Stall makes requests wait until Resume is called.
+func (g *brokerGate) Stall() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.open:
+		g.open = make(chan struct{})
+	default:
+	}
+}
+
+// Resume lets waiting and future requests through.
+func (g *brokerGate) Resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.open:
+	default:
+		close(g.open)
+	}
+}
+
+// Requests returns the number of requests received for path.
+func (g *brokerGate) Requests(path string) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.requests[path]
+}
+
+// forwarder accepts TCP connections and forwards them to a target address,
+// keeping track of them so that they can be dropped.
+type forwarder struct {
+	ln     net.Listener
+	target string
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newForwarder(target string) (*forwarder, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{
+		ln:     ln,
+		target: target,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	go f.acceptLoop()
+	return f, nil
+}
+
+func (f *forwarder) Addr() net.Addr {
+	return f.ln.Addr()
+}
+
+func (f *forwarder) acceptLoop() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+func (f *forwarder) track(conn net.Conn, add bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if add {
+		f.conns[conn] = struct{}{}
+	} else {
+		delete(f.conns, conn)
+	}
+}
+
+func (f *forwarder) forward(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", f.target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	f.track(conn, true)
+	defer f.track(conn, false)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// DropAll closes all the connections being forwarded, and returns how many
+// there were.
+func (f *forwarder) DropAll() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := len(f.conns)
+	for conn := range f.conns {
+		conn.Close()
+	}
+	return n
+}
+
+func (f *forwarder) Close() error {
+	err := f.ln.Close()
+	f.DropAll()
+	return err
+}
+
+// StallBroker makes the broker stop answering: requests from clients and
+// proxies wait until ResumeBroker is called, or until they time out.
+func (env *Env) StallBroker() {
+	env.broker.Stall()
+}
+
+// ResumeBroker lets the broker answer requests again, including those that
+// have been waiting since StallBroker.
+func (env *Env) ResumeBroker() {
+	env.broker.Resume()
+}
+
+// BrokerRequests returns the number of requests the broker has received for
+// the given path, such as "/client" or "/proxy".
+func (env *Env) BrokerRequests(path string) int {
+	return env.broker.Requests(path)
+}
+
+// DropProxyConnections closes the connections from the proxy to the relay,
+// as when a proxy goes away mid-stream, and returns how many there were.
+// The proxy closes the WebRTC connections of the affected clients, which
+// then have to find another proxy.
+func (env *Env) DropProxyConnections() int {
+	return env.forwarder.DropAll()
+}
+
+// RestartRelay stops the server and starts it again on the same address.
+// Sessions in progress are lost.
+func (env *Env) RestartRelay() error {
+	env.relayLock.Lock()
+	defer env.relayLock.Unlock()
+	env.relay.Close()
+	env.forwarder.DropAll()
+	return env.startRelay()
+}
@@ -0,0 +1,99 @@
+package testenv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBrokerGate(t *testing.T) {
+	Convey("Broker gate", t, func() {
+		gate := newBrokerGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func() <-chan int {
+			code := make(chan int, 1)
+			go func() {
+				w := httptest.NewRecorder()
+				gate.ServeHTTP(w, httptest.NewRequest("POST", "/client", nil))
+				code <- w.Code
+			}()
+			return code
+		}
+
+		Convey("passes requests through and counts them by path", func() {
+			So(<-serve(), ShouldEqual, http.StatusNoContent)
+			So(gate.Requests("/client"), ShouldEqual, 1)
+			So(gate.Requests("/proxy"), ShouldEqual, 0)
+		})
+
+		Convey("holds requests while stalled", func() {
+			gate.Stall()
+			gate.Stall()
+			code := serve()
+			select {
+			case <-code:
+				So("request was answered while stalled", ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+			gate.Resume()
+			So(<-code, ShouldEqual, http.StatusNoContent)
+			So(gate.Requests("/client"), ShouldEqual, 1)
+			gate.Resume()
+		})
+	})
+}
+
+func TestForwarder(t *testing.T) {
+	Convey("Forwarder", t, func() {
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer target.Close()
+		go func() {
+			for {
+				conn, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		f, err := newForwarder(target.Addr().String())
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		conn, err := net.Dial("tcp", f.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		Convey("forwards data to the target and back", func() {
+			_, err := conn.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "hello")
+		})
+
+		Convey("drops the connections it forwards", func() {
+			// Wait for the connection to be forwarded.
+			_, err := conn.Write([]byte("x"))
+			So(err, ShouldBeNil)
+			_, err = io.ReadFull(conn, make([]byte, 1))
+			So(err, ShouldBeNil)
+
+			So(f.DropAll(), ShouldEqual, 1)
+			_, err = conn.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+	})
+}
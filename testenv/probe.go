@@ -0,0 +1,120 @@
+package testenv
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/util"
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+)
+
+// How long the probe waits for the proxy to open a data channel.
+const probeTimeout = 20 * time.Second
+
+// serveSTUN answers STUN binding requests on conn with the address they came
+// from, until conn is closed.
+func serveSTUN(conn net.PacketConn) {
+	var buf [1500]byte
+	for {
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		m := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := m.Decode(); err != nil || m.Type != stun.BindingRequest {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resp, err := stun.Build(
+			stun.NewTransactionIDSetter(m.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+			stun.Fingerprint,
+		)
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(resp.Raw, addr)
+	}
+}
+
+// probeHandler does what the probetest service does for proxies measuring
+// their NAT type: it answers the proxy's offer, so that the proxy finds its
+// NAT unrestricted when the data channel opens. Unlike probetest, it keeps
+// local addresses in its answer.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	offer, _, err := messages.DecodePollResponse(body)
+	if err != nil || offer == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sdp, err := util.DeserializeSessionDescription(offer)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		log.Printf("testenv: probe: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	dataChan := make(chan struct{})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { close(dataChan) })
+	})
+	done := webrtc.GatheringCompletePromise(pc)
+	answer, err := func() (string, error) {
+		if err := pc.SetRemoteDescription(*sdp); err != nil {
+			return "", err
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return "", err
+		}
+		if err := pc.SetLocalDescription(answer); err != nil {
+			return "", err
+		}
+		<-done
+		return util.SerializeSessionDescription(pc.LocalDescription())
+	}()
+	if err != nil {
+		log.Printf("testenv: probe: %v", err)
+		pc.Close()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp, err := messages.EncodeAnswerRequest(answer, "stub-sid")
+	if err != nil {
+		pc.Close()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+
+	go func() {
+		select {
+		case <-dataChan:
+		case <-time.After(probeTimeout):
+		}
+		pc.Close()
+	}()
+}
@@ -0,0 +1,38 @@
+package testenv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServeSTUN(t *testing.T) {
+	Convey("The STUN server answers with the address of the request", t, func() {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer server.Close()
+		go serveSTUN(server)
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		_, err = conn.WriteTo(req.Raw, server.LocalAddr())
+		So(err, ShouldBeNil)
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFrom(buf)
+		So(err, ShouldBeNil)
+
+		resp := &stun.Message{Raw: buf[:n]}
+		So(resp.Decode(), ShouldBeNil)
+		So(resp.TransactionID, ShouldEqual, req.TransactionID)
+		var addr stun.XORMappedAddress
+		So(addr.GetFrom(resp), ShouldBeNil)
+		So(addr.String(), ShouldEqual, conn.LocalAddr().String())
+	})
+}
@@ -0,0 +1,250 @@
+/*
+Package testenv runs a complete Snowflake deployment in one process, for
+end-to-end tests: a broker, a proxy, a server and a client, connected over
+loopback and the local network with KeepLocalAddresses set.
+
+The broker is a package main and cannot be imported, so its HTTP handler is
+supplied by the caller, who must direct proxies to the relay URL it is given:
+
+	env, err := testenv.New(testenv.Config{
+		NewBroker: func(relayURL string) (http.Handler, error) {
+			// Build a broker whose bridge list has a bridge with
+			// testenv.BridgeFingerprint at relayURL, allowing relays
+			// matching testenv.RelayPattern.
+		},
+	})
+	if err != nil {
+		// handle error
+	}
+	defer env.Close()
+
+	conn, err := env.Dial()
+
+By default the server echoes back everything it receives on each connection.
+Faults can be injected with StallBroker, DropProxyConnections and
+RestartRelay.
+
+Only one Env may exist in a process at a time, because the proxy package
+keeps its state in package variables.
+*/
+package testenv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	sf "git.torproject.org/pluggable-transports/snowflake.git/v2/client/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/kcpprofile"
+	snowflake_proxy "git.torproject.org/pluggable-transports/snowflake.git/v2/proxy/lib"
+	snowflake_server "git.torproject.org/pluggable-transports/snowflake.git/v2/server/lib"
+)
+
+const (
+	// BridgeFingerprint is the fingerprint of the bridge that clients ask
+	// for. The broker's bridge list must map it to the relay URL.
+	BridgeFingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	// RelayPattern matches the host name of the relay. The broker must
+	// allow it, and the proxy accepts only relays that match it.
+	RelayPattern = "^127.0.0.1$"
+
+	// How long New waits for the proxy to start polling the broker.
+	proxyStartTimeout = 30 * time.Second
+)
+
+// Config configures an Env.
+type Config struct {
+	// NewBroker returns the HTTP handler of the broker, which must direct
+	// proxies to the relay at relayURL.
+	NewBroker func(relayURL string) (http.Handler, error)
+	// Handler is called with each connection accepted by the server. If it
+	// is nil, the server echoes back everything it receives.
+	Handler func(net.Conn)
+	// KCPProfile is the name of the KCP profile of the client and server.
+	KCPProfile string
+	// ProxyCapacity is the maximum number of clients of the proxy, or 0
+	// for no limit.
+	ProxyCapacity uint
+}
+
+// Env is a running Snowflake deployment.
+type Env struct {
+	// BrokerURL is the URL of the broker, for clients and proxies.
+	BrokerURL string
+	// RelayURL is the WebSocket URL that proxies connect to. It leads to
+	// the server through a forwarder that lets tests drop proxy
+	// connections.
+	RelayURL string
+	// Client is the client transport used by Dial.
+	Client *sf.Transport
+	// Proxy is the running proxy.
+	Proxy *snowflake_proxy.SnowflakeProxy
+
+	config    Config
+	cleanup   []func()
+	broker    *brokerGate
+	forwarder *forwarder
+
+	// The address of the server, and synchronization for restarting it.
+	relayAddr *net.TCPAddr
+	relayLock sync.Mutex
+	relay     *snowflake_server.SnowflakeListener
+}
+
+// New starts a broker, a server, a proxy and a client transport. It returns
+// once the proxy is polling the broker.
+func New(config Config) (*Env, error) {
+	if config.NewBroker == nil {
+		return nil, fmt.Errorf("testenv: NewBroker is required")
+	}
+	if config.Handler == nil {
+		config.Handler = echo
+	}
+	env := &Env{config: config}
+	err := env.start()
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *Env) start() error {
+	// The server cannot listen on port 0 and report the port it got, so
+	// find a free port first.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	env.relayAddr = ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	if err := env.startRelay(); err != nil {
+		return err
+	}
+	env.cleanup = append(env.cleanup, func() {
+		env.relayLock.Lock()
+		defer env.relayLock.Unlock()
+		env.relay.Close()
+	})
+
+	env.forwarder, err = newForwarder(env.relayAddr.String())
+	if err != nil {
+		return err
+	}
+	env.cleanup = append(env.cleanup, func() { env.forwarder.Close() })
+	env.RelayURL = "ws://" + env.forwarder.Addr().String() + "/"
+
+	handler, err := env.config.NewBroker(env.RelayURL)
+	if err != nil {
+		return err
+	}
+	env.broker = newBrokerGate(handler)
+	brokerServer := httptest.NewServer(env.broker)
+	env.cleanup = append(env.cleanup, func() {
+		env.broker.Resume()
+		brokerServer.Close()
+	})
+	env.BrokerURL = brokerServer.URL + "/"
+
+	stunConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go serveSTUN(stunConn)
+	env.cleanup = append(env.cleanup, func() { stunConn.Close() })
+
+	probeServer := httptest.NewServer(http.HandlerFunc(probeHandler))
+	env.cleanup = append(env.cleanup, probeServer.Close)
+
+	env.Proxy = &snowflake_proxy.SnowflakeProxy{
+		Capacity:               env.config.ProxyCapacity,
+		STUNURL:                "stun:" + stunConn.LocalAddr().String(),
+		BrokerURL:              env.BrokerURL,
+		KeepLocalAddresses:     true,
+		RelayURL:               env.RelayURL,
+		RelayDomainNamePattern: RelayPattern,
+		AllowNonTLSRelay:       true,
+		NATProbeURL:            probeServer.URL + "/probe",
+	}
+	proxyErr := make(chan error, 1)
+	go func() {
+		proxyErr <- env.Proxy.Start()
+	}()
+	env.cleanup = append(env.cleanup, func() {
+		env.Proxy.Stop()
+		// Cut short the proxy's poll of the broker, so that it notices
+		// it has been stopped.
+		brokerServer.CloseClientConnections()
+	})
+	// Start measures the NAT type of the proxy before it begins polling.
+	// The broker matches clients of unknown NAT type only with proxies
+	// that found theirs to be unrestricted.
+	timeout := time.After(proxyStartTimeout)
+	for env.broker.Requests("/proxy") == 0 {
+		select {
+		case err := <-proxyErr:
+			return fmt.Errorf("testenv: proxy stopped: %v", err)
+		case <-timeout:
+			return fmt.Errorf("testenv: proxy did not poll the broker within %v", proxyStartTimeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	env.Client, err = env.NewClient(sf.ClientConfig{})
+	return err
+}
+
+func (env *Env) startRelay() error {
+	profile, err := kcpprofile.Get(env.config.KCPProfile)
+	if err != nil {
+		return err
+	}
+	relay, err := snowflake_server.NewSnowflakeServer(nil).ListenWithProfile(env.relayAddr, profile)
+	if err != nil {
+		return err
+	}
+	env.relay = relay
+	go func() {
+		for {
+			conn, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			go env.config.Handler(conn)
+		}
+	}()
+	return nil
+}
+
+// NewClient returns a client transport using the Env's broker and bridge.
+// The BrokerURL, BridgeFingerprint, KeepLocalAddresses and KCPProfile of
+// config are overridden.
+func (env *Env) NewClient(config sf.ClientConfig) (*sf.Transport, error) {
+	config.BrokerURL = env.BrokerURL
+	config.BridgeFingerprint = BridgeFingerprint
+	config.KeepLocalAddresses = true
+	config.KCPProfile = env.config.KCPProfile
+	return sf.NewSnowflakeClient(config)
+}
+
+// Dial opens a connection to the server with the Env's client transport.
+func (env *Env) Dial() (net.Conn, error) {
+	return env.Client.Dial()
+}
+
+// Close stops every part of the Env.
+func (env *Env) Close() {
+	for i := len(env.cleanup) - 1; i >= 0; i-- {
+		env.cleanup[i]()
+	}
+	env.cleanup = nil
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
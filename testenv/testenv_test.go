@@ -0,0 +1,231 @@
+package testenv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// How long the stub broker holds proxy polls and client offers that have no
+// match.
+const stubBrokerTimeout = 10 * time.Second
+
+// stubBroker is a minimal broker for the tests of this package, which cannot
+// import the real one. It hands each client offer to a proxy whose poll is
+// waiting, directs the proxy to the relay, and returns the proxy's answer to
+// the client.
+type stubBroker struct {
+	relayURL string
+	offers   chan *stubOffer
+
+	lock sync.Mutex
+	// The offers handed to proxies, by the session id of their poll
+	matched map[string]*stubOffer
+}
+
+// stubOffer is a client offer waiting for the answer of a proxy.
+type stubOffer struct {
+	sdp    string
+	nat    string
+	answer chan string
+}
+
+func newStubBroker(relayURL string) (http.Handler, error) {
+	b := &stubBroker{
+		relayURL: relayURL,
+		offers:   make(chan *stubOffer),
+		matched:  make(map[string]*stubOffer),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", b.proxyPolls)
+	mux.HandleFunc("/client", b.clientOffers)
+	mux.HandleFunc("/answer", b.proxyAnswers)
+	return mux, nil
+}
+
+func (b *stubBroker) proxyPolls(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	poll, err := messages.DecodeProxyPollRequestMessage(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var resp []byte
+	select {
+	case offer := <-b.offers:
+		b.lock.Lock()
+		b.matched[poll.Sid] = offer
+		b.lock.Unlock()
+		resp, err = messages.EncodePollResponseWithRelayURL(offer.sdp, true, offer.nat, b.relayURL, "")
+	case <-time.After(stubBrokerTimeout):
+		resp, err = messages.EncodePollResponse("", false, "")
+	case <-r.Context().Done():
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+func (b *stubBroker) clientOffers(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req, err := messages.DecodeClientPollRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	offer := &stubOffer{sdp: req.Offer, nat: req.NAT, answer: make(chan string, 1)}
+	resp := &messages.ClientPollResponse{}
+	select {
+	case b.offers <- offer:
+		select {
+		case resp.Answer = <-offer.answer:
+		case <-time.After(stubBrokerTimeout):
+			resp.Error = messages.StrTimedOut
+		case <-r.Context().Done():
+			return
+		}
+	case <-time.After(stubBrokerTimeout):
+		resp.Error = messages.StrNoProxies
+	case <-r.Context().Done():
+		return
+	}
+	data, err := resp.EncodePollResponse()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (b *stubBroker) proxyAnswers(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	answer, sid, err := messages.DecodeAnswerRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b.lock.Lock()
+	offer := b.matched[sid]
+	delete(b.matched, sid)
+	b.lock.Unlock()
+	if offer != nil {
+		offer.answer <- answer
+	}
+	resp, err := messages.EncodeAnswerResponse(offer != nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// echoes writes message to conn and checks that it comes back within
+// timeout.
+func echoes(conn net.Conn, message string, timeout time.Duration) error {
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != message {
+		return fmt.Errorf("received %q, expected %q", buf, message)
+	}
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	Convey("New requires a broker", t, func() {
+		env, err := New(Config{})
+		So(env, ShouldBeNil)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	env, err := New(Config{NewBroker: newStubBroker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	Convey("End to end", t, func() {
+		Convey("bytes pass from client to server and back", func() {
+			conn, err := env.Dial()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(echoes(conn, "hello", 30*time.Second), ShouldBeNil)
+
+			Convey("and keep passing after the proxy drops mid-stream", func() {
+				So(env.DropProxyConnections(), ShouldBeGreaterThan, 0)
+				So(echoes(conn, "still there", 60*time.Second), ShouldBeNil)
+			})
+		})
+
+		Convey("clients wait out a stalled broker", func() {
+			env.StallBroker()
+			requests := env.BrokerRequests("/client")
+			conn, err := env.Dial()
+			if err != nil {
+				env.ResumeBroker()
+			}
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			result := make(chan error, 1)
+			go func() { result <- echoes(conn, "patience", 60*time.Second) }()
+			deadline := time.Now().Add(30 * time.Second)
+			for env.BrokerRequests("/client") == requests && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			early := false
+			select {
+			case <-result:
+				early = true
+			case <-time.After(time.Second):
+			}
+			env.ResumeBroker()
+			So(env.BrokerRequests("/client"), ShouldBeGreaterThan, requests)
+			So(early, ShouldBeFalse)
+			So(<-result, ShouldBeNil)
+		})
+
+		Convey("new sessions work after the relay restarts", func() {
+			So(env.RestartRelay(), ShouldBeNil)
+			conn, err := env.Dial()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(echoes(conn, "welcome back", 60*time.Second), ShouldBeNil)
+		})
+	})
+}